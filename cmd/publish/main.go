@@ -0,0 +1,109 @@
+// Command publish starts and stops virtual publishers through the REST API.
+// Files are named relative to the server's MEDIA_DIR:
+//
+//	publish -room demo -member bot -loop camera.ivf mic.ogg
+//	publish -room demo -member replay capture.rtpdump,mime=video/VP8,ssrc=1234
+//	publish -room demo -member bot -stop
+//
+// Options after a file name, separated by commas, are mime, ssrc and source.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"gonference/internal/sfu"
+)
+
+func main() {
+	server := flag.String("server", "http://localhost:8080", "REST API base URL")
+	key := flag.String("key", os.Getenv("API_KEY"), "tenant API key")
+	secret := flag.String("secret", os.Getenv("API_SECRET"), "tenant API secret")
+	room := flag.String("room", "", "conference ID")
+	member := flag.String("member", "", "member ID of the virtual publisher")
+	name := flag.String("name", "", "display name")
+	loop := flag.Bool("loop", false, "restart the files at their end")
+	stop := flag.Bool("stop", false, "stop the publisher instead of starting it")
+	flag.Parse()
+
+	if *room == "" || *member == "" || (!*stop && flag.NArg() == 0) {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	base := strings.TrimRight(*server, "/") + "/conference/" + url.PathEscape(*room) + "/publishers"
+
+	var req *http.Request
+	var err error
+	if *stop {
+		req, err = http.NewRequest(http.MethodDelete, base+"/"+url.PathEscape(*member), nil)
+	} else {
+		body, parseErr := publisherRequest(*member, *name, *loop, flag.Args())
+		if parseErr != nil {
+			fail(parseErr)
+		}
+		req, err = http.NewRequest(http.MethodPost, base, bytes.NewReader(body))
+	}
+	if err != nil {
+		fail(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-API-Key", *key)
+	req.Header.Set("X-API-Secret", *secret)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fail(err)
+	}
+	defer resp.Body.Close()
+
+	out, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode >= 300 {
+		fail(fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(out))))
+	}
+	os.Stdout.Write(out)
+}
+
+func publisherRequest(member, name string, loop bool, files []string) ([]byte, error) {
+	req := sfu.PublisherRequest{MemberID: member, Name: name, Loop: loop}
+
+	for _, arg := range files {
+		parts := strings.Split(arg, ",")
+		track := sfu.PublisherTrack{File: parts[0]}
+
+		for _, opt := range parts[1:] {
+			k, v, _ := strings.Cut(opt, "=")
+			switch k {
+			case "mime":
+				track.MimeType = v
+			case "source":
+				track.Source = sfu.TrackSource(v)
+			case "ssrc":
+				ssrc, err := strconv.ParseUint(v, 10, 32)
+				if err != nil {
+					return nil, fmt.Errorf("%s: bad ssrc %q", parts[0], v)
+				}
+				track.SSRC = uint32(ssrc)
+			default:
+				return nil, fmt.Errorf("%s: unknown option %q", parts[0], k)
+			}
+		}
+
+		req.Tracks = append(req.Tracks, track)
+	}
+
+	return json.Marshal(req)
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "publish:", err)
+	os.Exit(1)
+}
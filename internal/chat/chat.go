@@ -0,0 +1,35 @@
+package chat
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrNotFound = errors.New("chat message not found")
+	// ErrDeleted is returned for edits of a deleted message, so that a
+	// delete cannot be undone.
+	ErrDeleted = errors.New("chat message was deleted")
+)
+
+// Message is a chat message posted in a room. Deleted messages keep their
+// ID and author so history stays consistent, but lose their text.
+type Message struct {
+	ID       string     `json:"id"`
+	Author   string     `json:"author"`
+	Text     string     `json:"text"`
+	SentAt   time.Time  `json:"sentAt"`
+	EditedAt *time.Time `json:"editedAt,omitempty"`
+	Deleted  bool       `json:"deleted,omitempty"`
+}
+
+// Store keeps chat history per room key.
+type Store interface {
+	Append(room string, msg Message) error
+	Get(room, id string) (Message, error)
+	Edit(room, id, text string, at time.Time) (Message, error)
+	Delete(room, id string, at time.Time) (Message, error)
+	// Last returns up to n of the most recent messages, oldest first.
+	Last(room string, n int) ([]Message, error)
+	All(room string) ([]Message, error)
+}
@@ -0,0 +1,183 @@
+package chat
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// FileStore persists history as one append-only JSON lines log per room,
+// replayed into memory the first time a room is accessed.
+type FileStore struct {
+	dir string
+
+	// mux is held across every change to memory and the log write that
+	// records it, so that the log replays to the history served live.
+	mux    sync.Mutex
+	mem    *MemoryStore
+	loaded map[string]bool
+}
+
+type fileEvent struct {
+	Op      string  `json:"op"`
+	Message Message `json:"message"`
+}
+
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	return &FileStore{
+		dir:    dir,
+		mem:    NewMemoryStore(),
+		loaded: make(map[string]bool),
+	}, nil
+}
+
+func (s *FileStore) Append(room string, msg Message) error {
+	if err := s.load(room); err != nil {
+		return err
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if err := s.write(room, fileEvent{Op: "append", Message: msg}); err != nil {
+		return err
+	}
+
+	return s.mem.Append(room, msg)
+}
+
+func (s *FileStore) Get(room, id string) (Message, error) {
+	if err := s.load(room); err != nil {
+		return Message{}, err
+	}
+
+	return s.mem.Get(room, id)
+}
+
+func (s *FileStore) Edit(room, id, text string, at time.Time) (Message, error) {
+	if err := s.load(room); err != nil {
+		return Message{}, err
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	msg, err := s.mem.Edit(room, id, text, at)
+	if err != nil {
+		return Message{}, err
+	}
+
+	return msg, s.write(room, fileEvent{Op: "update", Message: msg})
+}
+
+func (s *FileStore) Delete(room, id string, at time.Time) (Message, error) {
+	if err := s.load(room); err != nil {
+		return Message{}, err
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	msg, err := s.mem.Delete(room, id, at)
+	if err != nil {
+		return Message{}, err
+	}
+
+	return msg, s.write(room, fileEvent{Op: "update", Message: msg})
+}
+
+func (s *FileStore) Last(room string, n int) ([]Message, error) {
+	if err := s.load(room); err != nil {
+		return nil, err
+	}
+
+	return s.mem.Last(room, n)
+}
+
+func (s *FileStore) All(room string) ([]Message, error) {
+	if err := s.load(room); err != nil {
+		return nil, err
+	}
+
+	return s.mem.All(room)
+}
+
+// load replays the room's log into memory once.
+func (s *FileStore) load(room string) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.loaded[room] {
+		return nil
+	}
+
+	f, err := os.Open(s.path(room))
+	if errors.Is(err, fs.ErrNotExist) {
+		s.loaded[room] = true
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var event fileEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return fmt.Errorf("chat log %s: %w", room, err)
+		}
+
+		switch event.Op {
+		case "append":
+			_ = s.mem.Append(room, event.Message)
+		case "update":
+			_, _ = s.mem.update(room, event.Message.ID, func(msg *Message) error {
+				*msg = event.Message
+				return nil
+			})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	s.loaded[room] = true
+
+	return nil
+}
+
+// write appends event to the room's log. The caller holds s.mux.
+func (s *FileStore) write(room string, event fileEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(s.path(room), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(line, '\n'))
+
+	return err
+}
+
+// path maps a room key, which contains slashes, onto a single file name.
+func (s *FileStore) path(room string) string {
+	return filepath.Join(s.dir, url.PathEscape(room)+".jsonl")
+}
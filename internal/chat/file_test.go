@@ -0,0 +1,94 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFileStoreReplaysLiveOrder(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sentAt := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			msg := Message{ID: fmt.Sprint(i), Author: "a", Text: "hi", SentAt: sentAt}
+			if err := s.Append("tenant/room", msg); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if _, err := s.Edit("tenant/room", "7", "edited", sentAt); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Delete("tenant/room", "8", sentAt); err != nil {
+		t.Fatal(err)
+	}
+
+	live, err := s.All("tenant/room")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restarted, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayed, err := restarted.All("tenant/room")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(replayed) != 50 {
+		t.Fatalf("replayed %d messages, want 50", len(replayed))
+	}
+	if !reflect.DeepEqual(live, replayed) {
+		t.Fatal("history after a restart differs from the live history")
+	}
+}
+
+func TestEditAfterDelete(t *testing.T) {
+	file, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, s := range map[string]Store{"memory": NewMemoryStore(), "file": file} {
+		t.Run(name, func(t *testing.T) {
+			at := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+			if err := s.Append("tenant/room", Message{ID: "1", Author: "a", Text: "hi", SentAt: at}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.Delete("tenant/room", "1", at); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := s.Edit("tenant/room", "1", "back", at); !errors.Is(err, ErrDeleted) {
+				t.Fatalf("got %v, want %v", err, ErrDeleted)
+			}
+
+			msg, err := s.Get("tenant/room", "1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !msg.Deleted || msg.Text != "" {
+				t.Fatalf("the deleted message was edited: %+v", msg)
+			}
+		})
+	}
+}
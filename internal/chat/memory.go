@@ -0,0 +1,108 @@
+package chat
+
+import (
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps history in memory for the lifetime of the process.
+type MemoryStore struct {
+	mux   sync.RWMutex
+	rooms map[string][]Message
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		rooms: make(map[string][]Message),
+	}
+}
+
+func (s *MemoryStore) Append(room string, msg Message) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.rooms[room] = append(s.rooms[room], msg)
+
+	return nil
+}
+
+func (s *MemoryStore) Get(room, id string) (Message, error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	i := s.index(room, id)
+	if i < 0 {
+		return Message{}, ErrNotFound
+	}
+
+	return s.rooms[room][i], nil
+}
+
+func (s *MemoryStore) Edit(room, id, text string, at time.Time) (Message, error) {
+	return s.update(room, id, func(msg *Message) error {
+		if msg.Deleted {
+			return ErrDeleted
+		}
+
+		msg.Text = text
+		msg.EditedAt = &at
+		return nil
+	})
+}
+
+func (s *MemoryStore) Delete(room, id string, at time.Time) (Message, error) {
+	return s.update(room, id, func(msg *Message) error {
+		msg.Text = ""
+		msg.Deleted = true
+		msg.EditedAt = &at
+		return nil
+	})
+}
+
+func (s *MemoryStore) Last(room string, n int) ([]Message, error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	msgs := s.rooms[room]
+	if n < len(msgs) {
+		msgs = msgs[len(msgs)-n:]
+	}
+
+	return append([]Message(nil), msgs...), nil
+}
+
+func (s *MemoryStore) All(room string) ([]Message, error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	return append([]Message{}, s.rooms[room]...), nil
+}
+
+// update changes a message in place unless apply fails.
+func (s *MemoryStore) update(room, id string, apply func(*Message) error) (Message, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	i := s.index(room, id)
+	if i < 0 {
+		return Message{}, ErrNotFound
+	}
+
+	if err := apply(&s.rooms[room][i]); err != nil {
+		return Message{}, err
+	}
+
+	return s.rooms[room][i], nil
+}
+
+// index finds a message by ID, newest first. Callers hold s.mux.
+func (s *MemoryStore) index(room, id string) int {
+	msgs := s.rooms[room]
+	for i := len(msgs) - 1; i >= 0; i-- {
+		if msgs[i].ID == id {
+			return i
+		}
+	}
+
+	return -1
+}
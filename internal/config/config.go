@@ -3,6 +3,9 @@ package config
 type Config struct {
 	REST       REST
 	AdminPanel AdminPanel
+	RTSP       RTSP
+	SFU        SFU
+	Tenants    []Tenant
 }
 
 type REST struct {
@@ -12,3 +15,61 @@ type REST struct {
 type AdminPanel struct {
 	Port int
 }
+
+type RTSP struct {
+	Port int
+}
+
+type SFU struct {
+	// ChatStore is "memory" or "file".
+	ChatStore string
+	ChatDir   string
+	// ChatReplay is how many recent chat messages a joining member receives.
+	ChatReplay int
+
+	// FileMaxSize caps the size of a shared file in bytes.
+	FileMaxSize int
+	// FileDir keeps a copy of every shared file when set. Otherwise files
+	// are only relayed and never touch the disk.
+	FileDir string
+
+	Recordings Storage
+	// RecordingFormat is "tracks" for a file per track or "webm" to mux each
+	// member's camera and microphone into one WebM file.
+	RecordingFormat string
+
+	// MediaDir holds the IVF, Ogg and rtpdump files virtual publishers can
+	// play. Requests name files relative to it and cannot leave it.
+	MediaDir string
+
+	// RTPAddress is the local IP plain RTP ingest receives on.
+	RTPAddress string
+	// RTPEgressHosts lists the hosts plain RTP egress may send to. Egress
+	// is disabled when it is empty.
+	RTPEgressHosts []string
+}
+
+// Storage selects where output is kept. Kind is "local", writing under
+// Dir, or "s3".
+type Storage struct {
+	Kind string
+	Dir  string
+	S3   S3
+}
+
+type S3 struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+}
+
+// Tenant is a customer team sharing the cluster. Zero quotas mean unlimited.
+type Tenant struct {
+	ID              string `json:"id"`
+	APIKey          string `json:"apiKey"`
+	APISecret       string `json:"apiSecret"`
+	MaxRooms        int    `json:"maxRooms"`
+	MaxParticipants int    `json:"maxParticipants"`
+}
@@ -1,8 +1,11 @@
 package config
 
 import (
+	"encoding/json"
+	"fmt"
 	"os"
 	"strconv"
+	"strings"
 )
 
 func MustLoad() Config {
@@ -12,9 +15,62 @@ func MustLoad() Config {
 
 	config.AdminPanel.Port = getEnvInt("ADMIN_PANEL_PORT", 6060)
 
+	config.RTSP.Port = getEnvInt("RTSP_PORT", 8554)
+
+	config.SFU.ChatStore = getEnv("CHAT_STORE", "memory")
+	config.SFU.ChatDir = getEnv("CHAT_DIR", "chat")
+	config.SFU.ChatReplay = getEnvInt("CHAT_REPLAY", 50)
+	config.SFU.FileMaxSize = getEnvInt("FILE_MAX_SIZE", 100<<20)
+	config.SFU.FileDir = getEnv("FILE_DIR", "")
+	config.SFU.Recordings = Storage{
+		Kind: getEnv("RECORDING_STORAGE", "local"),
+		Dir:  getEnv("RECORDING_DIR", "recordings"),
+		S3: S3{
+			Endpoint:  getEnv("S3_ENDPOINT", ""),
+			Region:    getEnv("S3_REGION", "us-east-1"),
+			Bucket:    getEnv("S3_BUCKET", ""),
+			AccessKey: getEnv("S3_ACCESS_KEY", ""),
+			SecretKey: getEnv("S3_SECRET_KEY", ""),
+		},
+	}
+	config.SFU.RecordingFormat = getEnv("RECORDING_FORMAT", "tracks")
+	config.SFU.MediaDir = getEnv("MEDIA_DIR", "media")
+	config.SFU.RTPAddress = getEnv("RTP_ADDRESS", "127.0.0.1")
+	config.SFU.RTPEgressHosts = getEnvList("RTP_EGRESS_HOSTS", "127.0.0.1,::1,localhost")
+
+	// Without a tenants file the API stays open and every room lives in the
+	// default namespace.
+	if path := getEnv("TENANTS_FILE", ""); path != "" {
+		config.Tenants = mustLoadTenants(path)
+	}
+
 	return config
 }
 
+func mustLoadTenants(path string) []Tenant {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		panic(fmt.Sprintf("reading tenants file: %v", err))
+	}
+
+	var tenants []Tenant
+	if err := json.Unmarshal(data, &tenants); err != nil {
+		panic(fmt.Sprintf("parsing tenants file: %v", err))
+	}
+
+	for _, t := range tenants {
+		if t.ID == "" || t.APIKey == "" || t.APISecret == "" {
+			panic(fmt.Sprintf("tenant %q: id, apiKey and apiSecret are required", t.ID))
+		}
+		// Rooms are keyed tenant/room; see sfu.roomKey.
+		if strings.Contains(t.ID, "/") {
+			panic(fmt.Sprintf("tenant %q: id must not contain '/'", t.ID))
+		}
+	}
+
+	return tenants
+}
+
 func getEnv(key, fallback string) string {
 	if value, ok := os.LookupEnv(key); ok {
 		return value
@@ -23,6 +79,18 @@ func getEnv(key, fallback string) string {
 	return fallback
 }
 
+// getEnvList splits a comma separated variable, dropping empty entries.
+func getEnvList(key, fallback string) []string {
+	var list []string
+	for _, v := range strings.Split(getEnv(key, fallback), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+
+	return list
+}
+
 func getEnvInt(key string, fallback int) int {
 	v, err := strconv.Atoi(os.Getenv(key))
 	if err == nil {
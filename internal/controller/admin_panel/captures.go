@@ -0,0 +1,110 @@
+package admin_panel
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gonference/internal/sfu"
+)
+
+// adminActor is the audit log actor of actions taken from the admin panel.
+const adminActor = "admin"
+
+type capturesPage struct {
+	Captures []sfu.CaptureInfo
+	Error    string
+}
+
+func (h *AdminPanelHandler) listCaptures(w http.ResponseWriter, r *http.Request) {
+	h.renderCaptures(w, http.StatusOK, "")
+}
+
+// startCapture starts a capture from the captures page form and returns to
+// the page.
+func (h *AdminPanelHandler) startCapture(w http.ResponseWriter, r *http.Request) {
+	room, ok := h.sfu.GetRoom(r.FormValue("tenant"), r.FormValue("room"))
+	if !ok {
+		h.renderCaptures(w, http.StatusNotFound, "conference not found")
+		return
+	}
+
+	seconds, _ := strconv.Atoi(r.FormValue("seconds"))
+	maxMiB, _ := strconv.ParseInt(r.FormValue("maxMiB"), 10, 64)
+
+	capture, err := room.StartCapture(adminActor, sfu.CaptureRequest{
+		MemberID: r.FormValue("member"),
+		Format:   sfu.CaptureFormat(r.FormValue("format")),
+		Duration: time.Duration(seconds) * time.Second,
+		MaxBytes: maxMiB << 20,
+		Payloads: r.FormValue("payloads") != "",
+	})
+	if err != nil {
+		h.renderCaptures(w, captureStatus(err), err.Error())
+		return
+	}
+
+	h.logger.Info(
+		"Capture started",
+		slog.String("capture", capture.ID),
+		slog.String("tenant", capture.Tenant),
+		slog.String("room", capture.Room),
+		slog.String("member", capture.MemberID),
+	)
+
+	http.Redirect(w, r, "/captures", http.StatusSeeOther)
+}
+
+func (h *AdminPanelHandler) stopCapture(w http.ResponseWriter, r *http.Request) {
+	if _, err := h.sfu.StopCapture(r.PathValue("id")); err != nil {
+		h.renderCaptures(w, captureStatus(err), err.Error())
+		return
+	}
+
+	http.Redirect(w, r, "/captures", http.StatusSeeOther)
+}
+
+func (h *AdminPanelHandler) downloadCapture(w http.ResponseWriter, r *http.Request) {
+	file, capture, err := h.sfu.OpenCapture(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, err.Error(), captureStatus(err))
+		return
+	}
+	defer file.Close()
+
+	contentType := "application/vnd.tcpdump.pcap"
+	if capture.Format == sfu.CaptureRTPDump {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+capture.FileName()+`"`)
+
+	http.ServeContent(w, r, capture.FileName(), capture.StartedAt, file)
+}
+
+func (h *AdminPanelHandler) renderCaptures(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+
+	page := capturesPage{Captures: h.sfu.Captures(), Error: message}
+	if err := templates.ExecuteTemplate(w, "captures.html", page); err != nil {
+		h.logger.Error("Failed to render captures", slog.String("error", err.Error()))
+	}
+}
+
+func captureStatus(err error) int {
+	switch {
+	case errors.Is(err, sfu.ErrPeerNotFound),
+		errors.Is(err, sfu.ErrCaptureNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, sfu.ErrInvalidCapture):
+		return http.StatusBadRequest
+	case errors.Is(err, sfu.ErrCaptureActive),
+		errors.Is(err, sfu.ErrCaptureRunning):
+		return http.StatusConflict
+	}
+
+	return http.StatusInternalServerError
+}
@@ -7,8 +7,10 @@ import (
 	"html/template"
 	"log/slog"
 	"net/http"
+	"os"
 
 	"gonference/internal/config"
+	"gonference/internal/sfu"
 )
 
 //go:embed templates
@@ -16,22 +18,39 @@ var templatesFs embed.FS
 
 var templates = template.Must(template.New("").ParseFS(templatesFs, "**/*.html"))
 
+type SFU interface {
+	GetRoom(tenant, id string) (*sfu.Room, bool)
+	Captures() []sfu.CaptureInfo
+	StopCapture(id string) (sfu.CaptureInfo, error)
+	OpenCapture(id string) (*os.File, sfu.CaptureInfo, error)
+}
+
 type AdminPanelHandler struct {
 	logger *slog.Logger
 	srv    *http.Server
+
+	sfu SFU
 }
 
-func NewHandler(cfg config.AdminPanel) *AdminPanelHandler {
+func NewHandler(cfg config.AdminPanel, sfu SFU) *AdminPanelHandler {
 	logger := slog.Default().With(slog.String("component", "admin-panel"))
 
 	mux := http.NewServeMux()
 
 	handler := &AdminPanelHandler{
 		logger: logger,
-		srv:    &http.Server{Addr: fmt.Sprintf(":%d", cfg.Port), Handler: mux}}
+		srv:    &http.Server{Addr: fmt.Sprintf(":%d", cfg.Port), Handler: mux},
+		sfu:    sfu,
+	}
 
 	mux.HandleFunc("/", handler.getIndex)
 	mux.HandleFunc("/conference/{id}", handler.getConference)
+	mux.HandleFunc("GET /conference/{id}/thumbnails", handler.getThumbnails)
+	mux.HandleFunc("GET /conference/{id}/member/{member}/snapshot", handler.getSnapshot)
+	mux.HandleFunc("GET /captures", handler.listCaptures)
+	mux.HandleFunc("POST /captures", handler.startCapture)
+	mux.HandleFunc("GET /captures/{id}", handler.downloadCapture)
+	mux.HandleFunc("POST /captures/{id}/stop", handler.stopCapture)
 
 	return handler
 }
@@ -0,0 +1,85 @@
+package admin_panel
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"gonference/internal/sfu"
+)
+
+// snapshotMaxAge lets browsers reuse a snapshot briefly before they
+// revalidate it against its ETag.
+const snapshotMaxAge = "private, max-age=1"
+
+type thumbnailsPage struct {
+	Tenant  string
+	Room    string
+	Members []sfu.Member
+}
+
+// getSnapshot serves the latest keyframe of a member's video as an image.
+// The tenant query parameter selects the tenant, format is "jpeg" or "png"
+// and width scales the image down.
+func (h *AdminPanelHandler) getSnapshot(w http.ResponseWriter, r *http.Request) {
+	room, ok := h.sfu.GetRoom(r.URL.Query().Get("tenant"), r.PathValue("id"))
+	if !ok {
+		http.Error(w, "conference not found", http.StatusNotFound)
+		return
+	}
+
+	width := 0
+	if v := r.URL.Query().Get("width"); v != "" {
+		var err error
+		if width, err = strconv.Atoi(v); err != nil {
+			http.Error(w, sfu.ErrInvalidSnapshot.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	snapshot, err := room.Snapshot(r.PathValue("member"), sfu.SnapshotFormat(r.URL.Query().Get("format")), width)
+	if err != nil {
+		http.Error(w, err.Error(), snapshotStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", snapshot.ContentType)
+	w.Header().Set("Cache-Control", snapshotMaxAge)
+	w.Header().Set("ETag", snapshot.ETag)
+
+	http.ServeContent(w, r, "", snapshot.CapturedAt, bytes.NewReader(snapshot.Data))
+}
+
+// getThumbnails shows a live thumbnail of every member of a conference.
+func (h *AdminPanelHandler) getThumbnails(w http.ResponseWriter, r *http.Request) {
+	tenant := r.URL.Query().Get("tenant")
+
+	room, ok := h.sfu.GetRoom(tenant, r.PathValue("id"))
+	if !ok {
+		http.Error(w, "conference not found", http.StatusNotFound)
+		return
+	}
+
+	page := thumbnailsPage{Tenant: tenant, Room: room.ID(), Members: room.Roster()}
+	if err := templates.ExecuteTemplate(w, "thumbnails.html", page); err != nil {
+		h.logger.Error("Failed to render thumbnails", slog.String("error", err.Error()))
+	}
+}
+
+func snapshotStatus(err error) int {
+	switch {
+	case errors.Is(err, sfu.ErrPeerNotFound),
+		errors.Is(err, sfu.ErrNoSnapshot):
+		return http.StatusNotFound
+	case errors.Is(err, sfu.ErrInvalidSnapshot):
+		return http.StatusBadRequest
+	case errors.Is(err, sfu.ErrSnapshotRateLimit):
+		return http.StatusTooManyRequests
+	case errors.Is(err, sfu.ErrSnapshotCodec):
+		return http.StatusNotImplemented
+	}
+
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,60 @@
+package middleware
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+
+	"gonference/internal/config"
+)
+
+type tenantKey struct{}
+
+// WithAPIKey authenticates requests against the configured tenants and stores
+// the matching tenant ID in the request context. Credentials are read from the
+// X-API-Key/X-API-Secret headers, basic auth, or the apiKey/apiSecret query
+// parameters (browsers cannot set headers on WebSocket upgrades).
+// With no tenants configured every request is let through unauthenticated.
+func WithAPIKey(handler http.Handler, tenants []config.Tenant) http.Handler {
+	if len(tenants) == 0 {
+		return handler
+	}
+
+	byKey := make(map[string]config.Tenant, len(tenants))
+	for _, t := range tenants {
+		byKey[t.APIKey] = t
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, secret := credentials(r)
+
+		tenant, ok := byKey[key]
+		if !ok || subtle.ConstantTimeCompare([]byte(secret), []byte(tenant.APISecret)) != 1 {
+			http.Error(w, "invalid API credentials", http.StatusUnauthorized)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), tenantKey{}, tenant.ID)
+		handler.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// TenantID returns the tenant the request was authenticated as, or the empty
+// default namespace when authentication is disabled.
+func TenantID(ctx context.Context) string {
+	id, _ := ctx.Value(tenantKey{}).(string)
+	return id
+}
+
+func credentials(r *http.Request) (string, string) {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key, r.Header.Get("X-API-Secret")
+	}
+
+	if key, secret, ok := r.BasicAuth(); ok {
+		return key, secret
+	}
+
+	q := r.URL.Query()
+	return q.Get("apiKey"), q.Get("apiSecret")
+}
@@ -0,0 +1,80 @@
+package rest
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+type CreateBreakoutsRequest struct {
+	Rooms       []string          `json:"rooms"`
+	Assignments map[string]string `json:"assignments"`
+	Duration    int               `json:"durationSeconds"`
+}
+
+type MoveMemberRequest struct {
+	BreakoutID string `json:"breakoutId"`
+}
+
+func (h *Handler) createBreakouts(w http.ResponseWriter, r *http.Request) {
+	room, ok := h.room(w, r)
+	if !ok {
+		return
+	}
+
+	var req CreateBreakoutsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	duration := time.Duration(req.Duration) * time.Second
+	if err := room.CreateBreakouts(apiActor, req.Rooms, req.Assignments, duration); err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	h.writeJSON(w, http.StatusCreated, room.Breakouts())
+}
+
+func (h *Handler) listBreakouts(w http.ResponseWriter, r *http.Request) {
+	room, ok := h.room(w, r)
+	if !ok {
+		return
+	}
+
+	h.writeJSON(w, http.StatusOK, room.Breakouts())
+}
+
+func (h *Handler) closeBreakouts(w http.ResponseWriter, r *http.Request) {
+	room, ok := h.room(w, r)
+	if !ok {
+		return
+	}
+
+	room.CloseBreakouts(apiActor)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// moveMember moves a member into a breakout, or back to the main room when
+// breakoutId is empty.
+func (h *Handler) moveMember(w http.ResponseWriter, r *http.Request) {
+	room, ok := h.room(w, r)
+	if !ok {
+		return
+	}
+
+	var req MoveMemberRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := room.MovePeer(apiActor, r.PathValue("member"), req.BreakoutID); err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,34 @@
+package rest
+
+import (
+	"net/http"
+
+	"gonference/internal/controller/middleware"
+)
+
+// getChat exports a conference's chat history. It works after the
+// conference has ended, so it does not require the room to exist.
+func (h *Handler) getChat(w http.ResponseWriter, r *http.Request) {
+	msgs, err := h.sfu.ChatHistory(middleware.TenantID(r.Context()), r.PathValue("id"))
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	h.writeJSON(w, http.StatusOK, msgs)
+}
+
+func (h *Handler) deleteChatMessage(w http.ResponseWriter, r *http.Request) {
+	room, ok := h.room(w, r)
+	if !ok {
+		return
+	}
+
+	msg, err := room.DeleteChatMessage(apiActor, true, r.PathValue("message"))
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	h.writeJSON(w, http.StatusOK, msg)
+}
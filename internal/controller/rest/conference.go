@@ -1,15 +1,38 @@
 package rest
 
 import (
+	"encoding/json"
+	"errors"
+	"io"
 	"log/slog"
 	"net/http"
 
+	"gonference/internal/controller/middleware"
+	"gonference/internal/sfu"
+
 	"github.com/google/uuid"
 )
 
+type ConferenceInfo struct {
+	ID      string `json:"id"`
+	Members int    `json:"members"`
+}
+
 func (h *Handler) createConference(w http.ResponseWriter, r *http.Request) {
 	roomID := uuid.NewString()
 
+	// The body is optional; an empty one creates a room with defaults.
+	var opts sfu.RoomOptions
+	if err := json.NewDecoder(r.Body).Decode(&opts); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if _, err := h.sfu.CreateRoom(middleware.TenantID(r.Context()), roomID, opts); err != nil {
+		h.writeError(w, err)
+		return
+	}
+
 	w.WriteHeader(http.StatusCreated)
 	if _, err := w.Write([]byte(roomID)); err != nil {
 		h.logger.Error("writing response", slog.String("error", err.Error()))
@@ -17,13 +40,49 @@ func (h *Handler) createConference(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *Handler) joinConference(w http.ResponseWriter, r *http.Request) {
+	if _, ok := h.sfu.GetRoom(middleware.TenantID(r.Context()), r.PathValue("id")); !ok {
+		http.Error(w, "conference not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// leaveConference keeps the route of the original API, on which leaving
+// took no action: members leave by closing their signaling connection, and
+// the API removes them with DELETE /conference/{id}/member/{member}.
+func (h *Handler) leaveConference(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
-// Under question
 func (h *Handler) listConferences(w http.ResponseWriter, r *http.Request) {
+	rooms := h.sfu.Rooms(middleware.TenantID(r.Context()))
+
+	conferences := make([]ConferenceInfo, 0, len(rooms))
+	for _, room := range rooms {
+		conferences = append(conferences, ConferenceInfo{
+			ID:      room.ID(),
+			Members: room.PeerCount(),
+		})
+	}
+
+	h.writeJSON(w, http.StatusOK, conferences)
 }
 
-func (h *Handler) removeMember(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusOK)
+func (h *Handler) listMembers(w http.ResponseWriter, r *http.Request) {
+	room, ok := h.room(w, r)
+	if !ok {
+		return
+	}
+
+	h.writeJSON(w, http.StatusOK, room.Roster())
+}
+
+func (h *Handler) getStats(w http.ResponseWriter, r *http.Request) {
+	room, ok := h.room(w, r)
+	if !ok {
+		return
+	}
+
+	h.writeJSON(w, http.StatusOK, room.Stats())
 }
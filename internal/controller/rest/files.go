@@ -0,0 +1,77 @@
+package rest
+
+import (
+	"mime"
+	"net/http"
+	"os"
+
+	"gonference/internal/controller/middleware"
+	"gonference/internal/sfu"
+)
+
+// fileAction applies a file sharing message received over signaling.
+func (h *Handler) fileAction(self *sfu.Peer, message Message) error {
+	if self == nil {
+		return errNotJoined
+	}
+
+	room := self.Room()
+
+	switch message.Type {
+	case "file-offer":
+		if message.File == nil {
+			return sfu.ErrInvalidFile
+		}
+		_, err := room.OfferFile(self, *message.File)
+		return err
+	case "file-accept":
+		return room.AcceptFile(self, message.TransferID)
+	case "file-decline":
+		return room.DeclineFile(self, message.TransferID)
+	case "file-cancel":
+		return room.CancelFile(self, message.TransferID)
+	case "file-complete":
+		return room.CompleteFile(self, message.TransferID)
+	}
+
+	return nil
+}
+
+func (h *Handler) listFiles(w http.ResponseWriter, r *http.Request) {
+	room, ok := h.room(w, r)
+	if !ok {
+		return
+	}
+
+	h.writeJSON(w, http.StatusOK, room.Transfers())
+}
+
+// downloadFile serves a shared file kept by the SFU. Files are only kept
+// when the SFU is configured with a file directory.
+func (h *Handler) downloadFile(w http.ResponseWriter, r *http.Request) {
+	offer, path, err := h.sfu.StoredFile(middleware.TenantID(r.Context()), r.PathValue("id"), r.PathValue("file"))
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	if offer.MimeType != "" {
+		w.Header().Set("Content-Type", offer.MimeType)
+	}
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": offer.Name}))
+
+	http.ServeContent(w, r, offer.Name, info.ModTime(), f)
+}
@@ -1,18 +1,30 @@
 package rest
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"gonference/internal/sfu"
 	"log/slog"
 	"net/http"
 
+	"gonference/internal/chat"
 	"gonference/internal/config"
 	"gonference/internal/controller/middleware"
 )
 
 type SFU interface {
-	GetOrCreateRoom(id string) *sfu.Room
+	GetRoom(tenant, id string) (*sfu.Room, bool)
+	GetOrCreateRoom(tenant, id string) (*sfu.Room, error)
+	CreateRoom(tenant, id string, opts sfu.RoomOptions) (*sfu.Room, error)
+	Rooms(tenant string) []*sfu.Room
+	ChatHistory(tenant, id string) ([]chat.Message, error)
+	StoredFile(tenant, roomID, id string) (sfu.FileOffer, string, error)
+	Recordings(tenant string) []sfu.RecordingManifest
+	Recording(tenant, id string) (sfu.RecordingManifest, error)
+	HLSPlaylist(ctx context.Context, id string, msn, part int) ([]byte, error)
+	HLSFile(ctx context.Context, id, name string) ([]byte, string, error)
 	Close()
 }
 
@@ -21,13 +33,20 @@ type Handler struct {
 	srv    *http.Server
 
 	sfu SFU
+
+	sessions sessionSet
 }
 
-func NewHandler(cfg config.REST, sfu SFU) *Handler {
+func NewHandler(cfg config.REST, tenants []config.Tenant, sfu SFU) *Handler {
 	logger := slog.Default().With(slog.String("component", "rest"))
 
 	mux := http.NewServeMux()
-	handler := middleware.WithLogging(mux, logger)
+
+	// HLS players cannot authenticate; everything else must.
+	root := http.NewServeMux()
+	root.Handle("/", middleware.WithAPIKey(mux, tenants))
+
+	handler := middleware.WithLogging(root, logger)
 	handler = middleware.WithCORS(handler)
 
 	h := &Handler{
@@ -47,7 +66,54 @@ func NewHandler(cfg config.REST, sfu SFU) *Handler {
 	mux.HandleFunc("POST /conference/create", h.createConference)
 	mux.HandleFunc("GET /conference", h.listConferences)
 	mux.HandleFunc("GET /conference/{id}/join", h.joinConference)
-	mux.HandleFunc("DELETE /conference/{id}/leave", h.removeMember)
+	mux.HandleFunc("DELETE /conference/{id}/leave", h.leaveConference)
+	mux.HandleFunc("GET /conference/{id}/members", h.listMembers)
+	mux.HandleFunc("GET /conference/{id}/stats", h.getStats)
+	mux.HandleFunc("POST /conference/{id}/lock", h.lockConference)
+	mux.HandleFunc("DELETE /conference/{id}/lock", h.lockConference)
+	mux.HandleFunc("GET /conference/{id}/audit", h.getAuditLog)
+	mux.HandleFunc("GET /conference/{id}/chat", h.getChat)
+	mux.HandleFunc("GET /conference/{id}/hands", h.listHands)
+	mux.HandleFunc("DELETE /conference/{id}/hands/{member}", h.lowerHand)
+	mux.HandleFunc("POST /conference/{id}/polls", h.createPoll)
+	mux.HandleFunc("GET /conference/{id}/polls", h.listPolls)
+	mux.HandleFunc("GET /conference/{id}/polls/{poll}", h.getPoll)
+	mux.HandleFunc("POST /conference/{id}/polls/{poll}/close", h.closePoll)
+	mux.HandleFunc("GET /conference/{id}/state", h.getState)
+	mux.HandleFunc("GET /conference/{id}/files", h.listFiles)
+	mux.HandleFunc("GET /conference/{id}/files/{file}", h.downloadFile)
+	mux.HandleFunc("POST /conference/{id}/recordings", h.startRecording)
+	mux.HandleFunc("GET /conference/{id}/recordings", h.listConferenceRecordings)
+	mux.HandleFunc("DELETE /conference/{id}/recordings/{recording}", h.stopRecording)
+	mux.HandleFunc("POST /conference/{id}/publishers", h.startPublisher)
+	mux.HandleFunc("GET /conference/{id}/publishers", h.listPublishers)
+	mux.HandleFunc("DELETE /conference/{id}/publishers/{member}", h.stopPublisher)
+	mux.HandleFunc("POST /conference/{id}/ingest", h.startIngest)
+	mux.HandleFunc("POST /conference/{id}/egress", h.startEgress)
+	mux.HandleFunc("GET /conference/{id}/egress", h.listEgresses)
+	mux.HandleFunc("GET /conference/{id}/egress/{egress}", h.getEgress)
+	mux.HandleFunc("GET /conference/{id}/egress/{egress}/sdp", h.getEgressSDP)
+	mux.HandleFunc("DELETE /conference/{id}/egress/{egress}", h.stopEgress)
+	mux.HandleFunc("POST /conference/{id}/hls", h.startHLS)
+	mux.HandleFunc("GET /conference/{id}/hls", h.getHLS)
+	mux.HandleFunc("DELETE /conference/{id}/hls", h.stopHLS)
+	mux.HandleFunc("GET /recordings", h.listRecordings)
+	mux.HandleFunc("GET /recordings/{recording}", h.getRecording)
+	mux.HandleFunc("POST /conference/{id}/state", h.updateState)
+	mux.HandleFunc("DELETE /conference/{id}/chat/{message}", h.deleteChatMessage)
+	mux.HandleFunc("GET /conference/{id}/lobby", h.getLobby)
+	mux.HandleFunc("POST /conference/{id}/lobby/{member}/admit", h.admitMember)
+	mux.HandleFunc("POST /conference/{id}/lobby/{member}/reject", h.rejectMember)
+	mux.HandleFunc("POST /conference/{id}/breakouts", h.createBreakouts)
+	mux.HandleFunc("GET /conference/{id}/breakouts", h.listBreakouts)
+	mux.HandleFunc("DELETE /conference/{id}/breakouts", h.closeBreakouts)
+	mux.HandleFunc("DELETE /conference/{id}/member/{member}", h.removeMember)
+	mux.HandleFunc("POST /conference/{id}/member/{member}/ban", h.banMember)
+	mux.HandleFunc("DELETE /conference/{id}/member/{member}/ban", h.unbanMember)
+	mux.HandleFunc("POST /conference/{id}/member/{member}/mute", h.muteMember)
+	mux.HandleFunc("POST /conference/{id}/member/{member}/move", h.moveMember)
+
+	root.HandleFunc("GET /hls/{stream}/{file}", h.serveHLS)
 
 	return h
 }
@@ -61,6 +127,7 @@ func (h *Handler) ListenAndServe() {
 }
 
 func (h *Handler) Close() {
+	h.sessions.close()
 	h.sfu.Close()
 	if err := h.srv.Close(); err != nil {
 		h.logger.Error("during closing", slog.String("error", err.Error()))
@@ -68,3 +135,71 @@ func (h *Handler) Close() {
 
 	h.logger.Info("stopped")
 }
+
+func (h *Handler) writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		h.logger.Error("writing response", slog.String("error", err.Error()))
+	}
+}
+
+// writeError writes err with its HTTP status.
+func (h *Handler) writeError(w http.ResponseWriter, err error) {
+	http.Error(w, err.Error(), errorStatus(err))
+}
+
+// errorStatus maps SFU errors onto HTTP statuses.
+func errorStatus(err error) int {
+	status := http.StatusInternalServerError
+
+	switch {
+	case errors.Is(err, sfu.ErrPeerNotFound),
+		errors.Is(err, sfu.ErrNotInLobby),
+		errors.Is(err, sfu.ErrBreakoutNotFound),
+		errors.Is(err, chat.ErrNotFound),
+		errors.Is(err, sfu.ErrPollNotFound),
+		errors.Is(err, sfu.ErrTransferNotFound),
+		errors.Is(err, sfu.ErrRecordingNotFound),
+		errors.Is(err, sfu.ErrPublisherNotFound),
+		errors.Is(err, sfu.ErrEgressNotFound),
+		errors.Is(err, sfu.ErrHLSNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, sfu.ErrBreakoutNested),
+		errors.Is(err, sfu.ErrInvalidBreakouts),
+		errors.Is(err, sfu.ErrInvalidPoll),
+		errors.Is(err, sfu.ErrInvalidVote),
+		errors.Is(err, sfu.ErrInvalidEmoji),
+		errors.Is(err, sfu.ErrInvalidStateOp),
+		errors.Is(err, sfu.ErrInvalidFile),
+		errors.Is(err, sfu.ErrFileTooLarge),
+		errors.Is(err, sfu.ErrInvalidPublisher),
+		errors.Is(err, sfu.ErrUnsupportedMedia),
+		errors.Is(err, sfu.ErrInvalidEgress),
+		errors.Is(err, sfu.ErrInvalidHLS):
+		status = http.StatusBadRequest
+	case errors.Is(err, sfu.ErrPollClosed),
+		errors.Is(err, sfu.ErrStateFull),
+		errors.Is(err, sfu.ErrTransferStarted),
+		errors.Is(err, sfu.ErrRecordingActive),
+		errors.Is(err, sfu.ErrHLSActive),
+		errors.Is(err, sfu.ErrMemberExists),
+		errors.Is(err, chat.ErrDeleted):
+		status = http.StatusConflict
+	case errors.Is(err, sfu.ErrRoomQuotaExceeded),
+		errors.Is(err, sfu.ErrParticipantQuota),
+		errors.Is(err, sfu.ErrIngestLimit),
+		errors.Is(err, sfu.ErrReactionLimit):
+		status = http.StatusTooManyRequests
+	case errors.Is(err, sfu.ErrRoomLocked),
+		errors.Is(err, sfu.ErrBanned),
+		errors.Is(err, sfu.ErrChatForbidden),
+		errors.Is(err, sfu.ErrFileSharingDenied),
+		errors.Is(err, sfu.ErrEgressDenied):
+		status = http.StatusForbidden
+	case errors.Is(err, sfu.ErrHLSNotReady):
+		status = http.StatusServiceUnavailable
+	}
+
+	return status
+}
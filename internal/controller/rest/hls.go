@@ -0,0 +1,119 @@
+package rest
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"gonference/internal/sfu"
+)
+
+// startHLS streams a member of the conference over low-latency HLS. The
+// body is optional; without a source the member's camera is streamed.
+func (h *Handler) startHLS(w http.ResponseWriter, r *http.Request) {
+	room, ok := h.room(w, r)
+	if !ok {
+		return
+	}
+
+	var req sfu.HLSRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	stream, err := room.StartHLS(apiActor, req)
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	h.writeJSON(w, http.StatusCreated, stream)
+}
+
+func (h *Handler) getHLS(w http.ResponseWriter, r *http.Request) {
+	room, ok := h.room(w, r)
+	if !ok {
+		return
+	}
+
+	stream, err := room.HLS()
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	h.writeJSON(w, http.StatusOK, stream)
+}
+
+func (h *Handler) stopHLS(w http.ResponseWriter, r *http.Request) {
+	room, ok := h.room(w, r)
+	if !ok {
+		return
+	}
+
+	if err := room.StopHLS(apiActor); err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveHLS serves the playlist and media of an HLS stream to players,
+// which carry no credentials: the stream ID in the path stands in for
+// them. The playlist supports blocking reloads with the _HLS_msn and
+// _HLS_part query parameters.
+func (h *Handler) serveHLS(w http.ResponseWriter, r *http.Request) {
+	id, name := r.PathValue("stream"), r.PathValue("file")
+
+	if name != "index.m3u8" {
+		data, contentType, err := h.sfu.HLSFile(r.Context(), id, name)
+		if err != nil {
+			h.writeError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", contentType)
+		_, _ = w.Write(data)
+		return
+	}
+
+	msn, err := hlsParam(r, "_HLS_msn")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	part, err := hlsParam(r, "_HLS_part")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	data, err := h.sfu.HLSPlaylist(r.Context(), id, msn, part)
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Header().Set("Cache-Control", "no-cache")
+	_, _ = w.Write(data)
+}
+
+// hlsParam returns a playlist delivery directive, or -1 when it is absent.
+func hlsParam(r *http.Request, name string) (int, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return -1, nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, errors.New("invalid " + name)
+	}
+
+	return n, nil
+}
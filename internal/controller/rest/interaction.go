@@ -0,0 +1,174 @@
+package rest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"gonference/internal/sfu"
+)
+
+var errNotJoined = errors.New("member has not joined")
+
+// interact applies a hand, reaction, poll or shared state action received
+// over signaling.
+// They act on the room the member is in, so breakouts have their own.
+func (h *Handler) interact(self *sfu.Peer, message Message) error {
+	if self == nil {
+		return errNotJoined
+	}
+
+	room := self.Room()
+
+	switch message.Type {
+	case "raise-hand":
+		room.RaiseHand(self)
+	case "lower-hand":
+		target := message.TargetID
+		if target == "" {
+			target = self.ID()
+		}
+		if target != self.ID() && !self.IsModerator() {
+			return errNotModerator
+		}
+		return room.LowerHand(self.ID(), target)
+	case "reaction":
+		return room.React(self, message.Emoji)
+	case "poll-create":
+		if !self.IsModerator() {
+			return errNotModerator
+		}
+		if message.Poll == nil {
+			return fmt.Errorf("%w: poll is required", errInvalidParams)
+		}
+		_, err := room.CreatePoll(self.ID(), *message.Poll)
+		return err
+	case "poll-vote":
+		return room.Vote(self, message.PollID, message.Option)
+	case "poll-close":
+		if !self.IsModerator() {
+			return errNotModerator
+		}
+		_, err := room.ClosePoll(self.ID(), message.PollID)
+		return err
+	case "state-update":
+		_, err := room.UpdateState(self.ID(), message.Ops)
+		return err
+	}
+
+	return nil
+}
+
+func (h *Handler) listHands(w http.ResponseWriter, r *http.Request) {
+	room, ok := h.room(w, r)
+	if !ok {
+		return
+	}
+
+	h.writeJSON(w, http.StatusOK, room.Hands())
+}
+
+func (h *Handler) lowerHand(w http.ResponseWriter, r *http.Request) {
+	room, ok := h.room(w, r)
+	if !ok {
+		return
+	}
+
+	if err := room.LowerHand(apiActor, r.PathValue("member")); err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) createPoll(w http.ResponseWriter, r *http.Request) {
+	room, ok := h.room(w, r)
+	if !ok {
+		return
+	}
+
+	var req sfu.PollRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	poll, err := room.CreatePoll(apiActor, req)
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	h.writeJSON(w, http.StatusCreated, poll)
+}
+
+func (h *Handler) listPolls(w http.ResponseWriter, r *http.Request) {
+	room, ok := h.room(w, r)
+	if !ok {
+		return
+	}
+
+	h.writeJSON(w, http.StatusOK, room.Polls())
+}
+
+func (h *Handler) getPoll(w http.ResponseWriter, r *http.Request) {
+	room, ok := h.room(w, r)
+	if !ok {
+		return
+	}
+
+	poll, err := room.Poll(r.PathValue("poll"))
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	h.writeJSON(w, http.StatusOK, poll)
+}
+
+func (h *Handler) closePoll(w http.ResponseWriter, r *http.Request) {
+	room, ok := h.room(w, r)
+	if !ok {
+		return
+	}
+
+	poll, err := room.ClosePoll(apiActor, r.PathValue("poll"))
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	h.writeJSON(w, http.StatusOK, poll)
+}
+
+func (h *Handler) getState(w http.ResponseWriter, r *http.Request) {
+	room, ok := h.room(w, r)
+	if !ok {
+		return
+	}
+
+	h.writeJSON(w, http.StatusOK, room.State())
+}
+
+func (h *Handler) updateState(w http.ResponseWriter, r *http.Request) {
+	room, ok := h.room(w, r)
+	if !ok {
+		return
+	}
+
+	var ops []sfu.StateOp
+	if err := json.NewDecoder(r.Body).Decode(&ops); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	applied, err := room.UpdateState(apiActor, ops)
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	h.writeJSON(w, http.StatusOK, applied)
+}
@@ -0,0 +1,208 @@
+package rest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"gonference/internal/controller/middleware"
+	"gonference/internal/sfu"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// apiActor is the audit identity for actions taken through the REST API,
+// which are authorized by the tenant's API key.
+const apiActor = "api"
+
+var errNotModerator = errors.New("only moderators may do this")
+
+type MuteRequest struct {
+	Kind  string `json:"kind"`
+	Muted bool   `json:"muted"`
+}
+
+// moderate applies a moderator action received over signaling.
+func (h *Handler) moderate(self *sfu.Peer, message Message) error {
+	if self == nil || !self.IsModerator() {
+		return errNotModerator
+	}
+
+	room := self.Room().Main()
+
+	switch message.Type {
+	case "kick":
+		return room.Kick(self.ID(), message.TargetID)
+	case "ban":
+		return room.Ban(self.ID(), message.TargetID)
+	case "mute", "unmute":
+		kind := webrtc.NewRTPCodecType(message.Kind)
+		if kind == 0 {
+			return fmt.Errorf("%w: kind must be audio or video", errInvalidParams)
+		}
+		return room.SetMuted(self.ID(), message.TargetID, kind, message.Type == "mute")
+	case "lock", "unlock":
+		room.SetLocked(self.ID(), message.Type == "lock")
+	case "admit":
+		_, err := room.Admit(self.ID(), message.TargetID)
+		return err
+	case "reject":
+		return room.Reject(self.ID(), message.TargetID)
+	case "breakout-create":
+		duration := time.Duration(message.Duration) * time.Second
+		return room.CreateBreakouts(self.ID(), message.Breakouts, message.Assignments, duration)
+	case "breakout-move":
+		return room.MovePeer(self.ID(), message.TargetID, message.BreakoutID)
+	case "breakout-close":
+		room.CloseBreakouts(self.ID())
+	case "recording-start":
+		_, err := self.Room().StartRecording(self.ID(), message.TargetID)
+		return err
+	case "recording-stop":
+		_, err := self.Room().StopRecording(self.ID(), message.RecordingID)
+		return err
+	}
+
+	return nil
+}
+
+func (h *Handler) removeMember(w http.ResponseWriter, r *http.Request) {
+	room, ok := h.room(w, r)
+	if !ok {
+		return
+	}
+
+	if err := room.Kick(apiActor, r.PathValue("member")); err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) banMember(w http.ResponseWriter, r *http.Request) {
+	room, ok := h.room(w, r)
+	if !ok {
+		return
+	}
+
+	if err := room.Ban(apiActor, r.PathValue("member")); err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) unbanMember(w http.ResponseWriter, r *http.Request) {
+	room, ok := h.room(w, r)
+	if !ok {
+		return
+	}
+
+	room.Unban(apiActor, r.PathValue("member"))
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) muteMember(w http.ResponseWriter, r *http.Request) {
+	room, ok := h.room(w, r)
+	if !ok {
+		return
+	}
+
+	var req MuteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	kind := webrtc.NewRTPCodecType(req.Kind)
+	if kind == 0 {
+		http.Error(w, "kind must be audio or video", http.StatusBadRequest)
+		return
+	}
+
+	if err := room.SetMuted(apiActor, r.PathValue("member"), kind, req.Muted); err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) lockConference(w http.ResponseWriter, r *http.Request) {
+	room, ok := h.room(w, r)
+	if !ok {
+		return
+	}
+
+	room.SetLocked(apiActor, r.Method == http.MethodPost)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) getLobby(w http.ResponseWriter, r *http.Request) {
+	room, ok := h.room(w, r)
+	if !ok {
+		return
+	}
+
+	h.writeJSON(w, http.StatusOK, room.Lobby())
+}
+
+func (h *Handler) admitMember(w http.ResponseWriter, r *http.Request) {
+	room, ok := h.room(w, r)
+	if !ok {
+		return
+	}
+
+	// A member who is not waiting yet is admitted ahead of time.
+	member := r.PathValue("member")
+	_, err := room.Admit(apiActor, member)
+	if errors.Is(err, sfu.ErrNotInLobby) {
+		room.Invite(apiActor, member)
+		err = nil
+	}
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) rejectMember(w http.ResponseWriter, r *http.Request) {
+	room, ok := h.room(w, r)
+	if !ok {
+		return
+	}
+
+	if err := room.Reject(apiActor, r.PathValue("member")); err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) getAuditLog(w http.ResponseWriter, r *http.Request) {
+	room, ok := h.room(w, r)
+	if !ok {
+		return
+	}
+
+	h.writeJSON(w, http.StatusOK, room.AuditLog())
+}
+
+// room resolves the {id} path value within the caller's tenant.
+func (h *Handler) room(w http.ResponseWriter, r *http.Request) (*sfu.Room, bool) {
+	room, ok := h.sfu.GetRoom(middleware.TenantID(r.Context()), r.PathValue("id"))
+	if !ok {
+		http.Error(w, "conference not found", http.StatusNotFound)
+	}
+
+	return room, ok
+}
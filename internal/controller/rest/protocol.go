@@ -0,0 +1,302 @@
+package rest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"gonference/internal/sfu"
+
+	"github.com/gorilla/websocket"
+)
+
+// Signaling protocol
+//
+// Clients pick the protocol version with the WebSocket subprotocol they ask
+// for when connecting to /ws; the server answers with the one it chose:
+//
+//	gonference.v2  JSON-RPC 2.0 framing, described below
+//	gonference.v1  the original messages; also used when no subprotocol
+//	               is asked for
+//
+// Version 2 frames every message as JSON-RPC 2.0 (https://www.jsonrpc.org/
+// specification). A client calls a method with a request:
+//
+//	{"jsonrpc": "2.0", "id": 7, "method": "offer", "params": {"roomId": "r", "memberId": "m", "sdp": "..."}}
+//
+// and gets exactly one response with the same id, either a result, which
+// is null as methods take effect through the notifications that follow:
+//
+//	{"jsonrpc": "2.0", "id": 7, "result": null}
+//
+// or an error:
+//
+//	{"jsonrpc": "2.0", "id": 7, "error": {"code": -32003, "message": "room is locked"}}
+//
+// A request without an id is a notification and is never answered, even
+// when it fails. The server notifies the client of events the same way, e.g.
+//
+//	{"jsonrpc": "2.0", "method": "answer", "params": {"roomId": "r", "memberId": "m", "sdp": "..."}}
+//
+// Methods and their params are the fields of Message, named by its type:
+// offer, answer, candidate, track-info, subscribe, unsubscribe, pause,
+// resume, raise-hand, lower-hand, reaction, poll-create, poll-vote,
+// poll-close, state-update, the file-* transfer methods, and the moderator
+// methods kick, ban, mute, unmute, lock, unlock, admit, reject,
+// breakout-create, breakout-move, breakout-close, recording-start and
+// recording-stop. Notifications are the events the SFU sends, such as
+// answer, offer, candidate, waiting, admitted, rejected, roster,
+// member-joined, member-left, member-updated, muted, kicked and moved.
+//
+// Version 1 messages are flat objects whose type field names the method or
+// event, with no responses. A message that fails is answered with
+//
+//	{"type": "error", "request": "offer", "code": -32003, "message": "room is locked"}
+//
+// Error codes are those of JSON-RPC 2.0 and the following:
+//
+//	-32001  the member has not joined the room yet
+//	-32003  not allowed, e.g. the room is locked or full, or the member is
+//	        not a moderator
+//	-32004  the member, poll, transfer or other target does not exist
+//	-32009  conflicts with the current state, e.g. a poll already closed
+//	-32029  rate or quota exceeded
+const (
+	protocolV1 = "gonference.v1"
+	protocolV2 = "gonference.v2"
+
+	jsonRPCVersion = "2.0"
+)
+
+// JSON-RPC 2.0 error codes, and the server errors of the protocol.
+const (
+	codeParseError     = -32700
+	codeInvalidRequest = -32600
+	codeMethodNotFound = -32601
+	codeInvalidParams  = -32602
+	codeInternalError  = -32603
+
+	codeNotJoined   = -32001
+	codeForbidden   = -32003
+	codeNotFound    = -32004
+	codeConflict    = -32009
+	codeRateLimited = -32029
+)
+
+var (
+	errParse          = errors.New("parse error")
+	errInvalidRequest = errors.New("invalid request")
+	errUnknownMethod  = errors.New("method not found")
+	errInvalidParams  = errors.New("invalid params")
+)
+
+// call is a client message decoded, and what its reply needs.
+type call struct {
+	// id is the JSON-RPC request id, or nil when no response is due.
+	id      json.RawMessage
+	message Message
+}
+
+// codec reads and writes the messages of one protocol version.
+type codec interface {
+	// decode parses a client message. A message that cannot be handled
+	// comes with the error to reply with.
+	decode(data []byte) (call, error)
+	// reply answers c with err, or with success when err is nil.
+	reply(w sfu.Signaling, c call, err error) error
+	// signaling wraps w so that the events the SFU writes to it are sent
+	// in the version's form.
+	signaling(w sfu.Signaling) sfu.Signaling
+}
+
+// codecFor returns the codec of a negotiated subprotocol.
+func codecFor(subprotocol string) codec {
+	if subprotocol == protocolV2 {
+		return rpcCodec{}
+	}
+
+	return legacyCodec{}
+}
+
+// legacyCodec speaks version 1.
+type legacyCodec struct{}
+
+func (legacyCodec) decode(data []byte) (call, error) {
+	var c call
+	if err := json.Unmarshal(data, &c.message); err != nil {
+		return c, fmt.Errorf("%w: %v", errParse, err)
+	}
+
+	return c, nil
+}
+
+func (legacyCodec) reply(w sfu.Signaling, c call, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	data, err := json.Marshal(map[string]any{
+		"type":    "error",
+		"request": c.message.Type,
+		"code":    errorCode(err),
+		"message": err.Error(),
+	})
+	if err != nil {
+		return err
+	}
+
+	return w.WriteMessage(websocket.TextMessage, data)
+}
+
+func (legacyCodec) signaling(w sfu.Signaling) sfu.Signaling {
+	return w
+}
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+}
+
+type rpcResult struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  any             `json:"result"`
+}
+
+type rpcFailure struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Error   rpcError        `json:"error"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type rpcNotification struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+// rpcCodec speaks version 2. Batches are not supported.
+type rpcCodec struct{}
+
+func (rpcCodec) decode(data []byte) (call, error) {
+	var req rpcRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return call{id: json.RawMessage("null")}, fmt.Errorf("%w: %v", errParse, err)
+	}
+
+	c := call{id: req.ID}
+	if req.JSONRPC != jsonRPCVersion || req.Method == "" {
+		if c.id == nil {
+			c.id = json.RawMessage("null")
+		}
+		return c, errInvalidRequest
+	}
+
+	if len(req.Params) > 0 {
+		if err := json.Unmarshal(req.Params, &c.message); err != nil {
+			return c, fmt.Errorf("%w: %v", errInvalidParams, err)
+		}
+	}
+	c.message.Type = req.Method
+
+	return c, nil
+}
+
+func (rpcCodec) reply(w sfu.Signaling, c call, err error) error {
+	if c.id == nil {
+		return nil
+	}
+
+	var response any = rpcResult{JSONRPC: jsonRPCVersion, ID: c.id}
+	if err != nil {
+		response = rpcFailure{
+			JSONRPC: jsonRPCVersion,
+			ID:      c.id,
+			Error:   rpcError{Code: errorCode(err), Message: err.Error()},
+		}
+	}
+
+	data, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+
+	return w.WriteMessage(websocket.TextMessage, data)
+}
+
+func (rpcCodec) signaling(w sfu.Signaling) sfu.Signaling {
+	return rpcSignaling{w}
+}
+
+// rpcSignaling turns the version 1 events the SFU writes into
+// notifications named by their type.
+type rpcSignaling struct {
+	sfu.Signaling
+}
+
+func (s rpcSignaling) WriteMessage(msgType int, payload []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return err
+	}
+
+	var method string
+	if err := json.Unmarshal(fields["type"], &method); err != nil {
+		return err
+	}
+	delete(fields, "type")
+
+	params, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(rpcNotification{JSONRPC: jsonRPCVersion, Method: method, Params: params})
+	if err != nil {
+		return err
+	}
+
+	return s.Signaling.WriteMessage(msgType, data)
+}
+
+// errorCode maps an error onto the protocol's codes, following the HTTP
+// statuses the REST API gives the same SFU errors.
+func errorCode(err error) int {
+	switch {
+	case errors.Is(err, errParse):
+		return codeParseError
+	case errors.Is(err, errInvalidRequest):
+		return codeInvalidRequest
+	case errors.Is(err, errUnknownMethod):
+		return codeMethodNotFound
+	case errors.Is(err, errInvalidParams):
+		return codeInvalidParams
+	case errors.Is(err, errNotJoined):
+		return codeNotJoined
+	case errors.Is(err, errNotModerator):
+		return codeForbidden
+	}
+
+	switch errorStatus(err) {
+	case http.StatusBadRequest:
+		return codeInvalidParams
+	case http.StatusForbidden:
+		return codeForbidden
+	case http.StatusNotFound:
+		return codeNotFound
+	case http.StatusConflict:
+		return codeConflict
+	case http.StatusTooManyRequests:
+		return codeRateLimited
+	}
+
+	return codeInternalError
+}
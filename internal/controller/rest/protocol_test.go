@@ -0,0 +1,313 @@
+package rest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+
+	"gonference/internal/sfu"
+
+	"github.com/gorilla/websocket"
+)
+
+// recordedSignaling keeps what is written to a member.
+type recordedSignaling struct {
+	messages [][]byte
+}
+
+func (s *recordedSignaling) WriteMessage(msgType int, payload []byte) error {
+	if msgType != websocket.TextMessage {
+		return fmt.Errorf("message type %d, want text", msgType)
+	}
+	s.messages = append(s.messages, payload)
+	return nil
+}
+
+// only returns the one message written, decoded.
+func (s *recordedSignaling) only(t *testing.T) map[string]json.RawMessage {
+	t.Helper()
+
+	if len(s.messages) != 1 {
+		t.Fatalf("%d messages written, want 1: %q", len(s.messages), s.messages)
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(s.messages[0], &fields); err != nil {
+		t.Fatal(err)
+	}
+	return fields
+}
+
+func TestCodecFor(t *testing.T) {
+	if _, ok := codecFor(protocolV2).(rpcCodec); !ok {
+		t.Fatalf("%s does not select JSON-RPC", protocolV2)
+	}
+	for _, subprotocol := range []string{protocolV1, "", "gonference.v3"} {
+		if _, ok := codecFor(subprotocol).(legacyCodec); !ok {
+			t.Fatalf("%q does not select version 1", subprotocol)
+		}
+	}
+}
+
+func TestRPCDecode(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		err     error
+		id      string
+		message Message
+	}{
+		{
+			name:    "request",
+			data:    `{"jsonrpc": "2.0", "id": 7, "method": "offer", "params": {"roomId": "r", "memberId": "m", "sdp": "v=0"}}`,
+			id:      "7",
+			message: Message{Type: "offer", RoomID: "r", MemberID: "m", SDP: "v=0"},
+		},
+		{
+			name:    "string id",
+			data:    `{"jsonrpc": "2.0", "id": "a-1", "method": "lock", "params": {"roomId": "r"}}`,
+			id:      `"a-1"`,
+			message: Message{Type: "lock", RoomID: "r"},
+		},
+		{
+			name:    "notification",
+			data:    `{"jsonrpc": "2.0", "method": "raise-hand", "params": {"roomId": "r", "memberId": "m"}}`,
+			message: Message{Type: "raise-hand", RoomID: "r", MemberID: "m"},
+		},
+		{
+			name:    "no params",
+			data:    `{"jsonrpc": "2.0", "id": 1, "method": "lower-hand"}`,
+			id:      "1",
+			message: Message{Type: "lower-hand"},
+		},
+		{
+			name:    "method wins over a type param",
+			data:    `{"jsonrpc": "2.0", "id": 1, "method": "unlock", "params": {"type": "lock"}}`,
+			id:      "1",
+			message: Message{Type: "unlock"},
+		},
+		{
+			name: "not JSON",
+			data: `{"jsonrpc": "2.0", "id": 1,`,
+			err:  errParse,
+			id:   "null",
+		},
+		{
+			name: "wrong version",
+			data: `{"jsonrpc": "1.0", "id": 3, "method": "offer"}`,
+			err:  errInvalidRequest,
+			id:   "3",
+		},
+		{
+			name: "no method",
+			data: `{"jsonrpc": "2.0"}`,
+			err:  errInvalidRequest,
+			id:   "null",
+		},
+		{
+			name: "params of the wrong shape",
+			data: `{"jsonrpc": "2.0", "id": 4, "method": "offer", "params": {"sdp": 1}}`,
+			err:  errInvalidParams,
+			id:   "4",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := rpcCodec{}.decode([]byte(tt.data))
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+			if string(c.id) != tt.id {
+				t.Fatalf("got id %q, want %q", c.id, tt.id)
+			}
+			if tt.err != nil {
+				return
+			}
+
+			if c.message.Type != tt.message.Type || c.message.RoomID != tt.message.RoomID ||
+				c.message.MemberID != tt.message.MemberID || c.message.SDP != tt.message.SDP {
+				t.Fatalf("got %+v, want %+v", c.message, tt.message)
+			}
+		})
+	}
+}
+
+func TestRPCReply(t *testing.T) {
+	t.Run("result", func(t *testing.T) {
+		w := &recordedSignaling{}
+		if err := (rpcCodec{}).reply(w, call{id: json.RawMessage("7")}, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		fields := w.only(t)
+		if string(fields["jsonrpc"]) != `"2.0"` || string(fields["id"]) != "7" || string(fields["result"]) != "null" {
+			t.Fatalf("got %s", w.messages[0])
+		}
+		if _, ok := fields["error"]; ok {
+			t.Fatalf("a result carries an error: %s", w.messages[0])
+		}
+	})
+
+	t.Run("error", func(t *testing.T) {
+		w := &recordedSignaling{}
+		err := (rpcCodec{}).reply(w, call{id: json.RawMessage(`"a"`)}, sfu.ErrRoomLocked)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fields := w.only(t)
+		if string(fields["id"]) != `"a"` {
+			t.Fatalf("got id %s", fields["id"])
+		}
+		if _, ok := fields["result"]; ok {
+			t.Fatalf("an error carries a result: %s", w.messages[0])
+		}
+
+		var e rpcError
+		if err := json.Unmarshal(fields["error"], &e); err != nil {
+			t.Fatal(err)
+		}
+		if e.Code != codeForbidden || e.Message != sfu.ErrRoomLocked.Error() {
+			t.Fatalf("got error %+v", e)
+		}
+	})
+
+	t.Run("parse error", func(t *testing.T) {
+		c, err := rpcCodec{}.decode([]byte("{"))
+		w := &recordedSignaling{}
+		if err := (rpcCodec{}).reply(w, c, err); err != nil {
+			t.Fatal(err)
+		}
+
+		fields := w.only(t)
+		if string(fields["id"]) != "null" {
+			t.Fatalf("got id %s, want null", fields["id"])
+		}
+		var e rpcError
+		if err := json.Unmarshal(fields["error"], &e); err != nil {
+			t.Fatal(err)
+		}
+		if e.Code != codeParseError {
+			t.Fatalf("got code %d, want %d", e.Code, codeParseError)
+		}
+	})
+
+	t.Run("notification", func(t *testing.T) {
+		w := &recordedSignaling{}
+		for _, err := range []error{nil, sfu.ErrRoomLocked} {
+			if err := (rpcCodec{}).reply(w, call{}, err); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if len(w.messages) != 0 {
+			t.Fatalf("notifications were answered: %q", w.messages)
+		}
+	})
+}
+
+func TestRPCSignaling(t *testing.T) {
+	w := &recordedSignaling{}
+	s := rpcCodec{}.signaling(w)
+
+	event := `{"type": "member-joined", "roomId": "r", "memberId": "m"}`
+	if err := s.WriteMessage(websocket.TextMessage, []byte(event)); err != nil {
+		t.Fatal(err)
+	}
+
+	fields := w.only(t)
+	if string(fields["jsonrpc"]) != `"2.0"` || string(fields["method"]) != `"member-joined"` {
+		t.Fatalf("got %s", w.messages[0])
+	}
+	if _, ok := fields["id"]; ok {
+		t.Fatalf("a notification carries an id: %s", w.messages[0])
+	}
+
+	var params map[string]string
+	if err := json.Unmarshal(fields["params"], &params); err != nil {
+		t.Fatal(err)
+	}
+	if len(params) != 2 || params["roomId"] != "r" || params["memberId"] != "m" {
+		t.Fatalf("got params %v", params)
+	}
+
+	if err := s.WriteMessage(websocket.TextMessage, []byte("not json")); err == nil {
+		t.Fatal("an event that is not JSON was sent")
+	}
+}
+
+func TestLegacyCodec(t *testing.T) {
+	c, err := legacyCodec{}.decode([]byte(`{"type": "offer", "roomId": "r", "memberId": "m", "sdp": "v=0"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.id != nil || c.message.Type != "offer" || c.message.SDP != "v=0" {
+		t.Fatalf("got %+v", c)
+	}
+
+	if _, err := (legacyCodec{}).decode([]byte("{")); !errors.Is(err, errParse) {
+		t.Fatalf("got %v, want %v", err, errParse)
+	}
+
+	w := &recordedSignaling{}
+	if err := (legacyCodec{}).reply(w, c, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(w.messages) != 0 {
+		t.Fatalf("success was answered: %q", w.messages)
+	}
+
+	if err := (legacyCodec{}).reply(w, c, sfu.ErrPeerNotFound); err != nil {
+		t.Fatal(err)
+	}
+	var reply struct {
+		Type    string `json:"type"`
+		Request string `json:"request"`
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	}
+	w.only(t)
+	if err := json.Unmarshal(w.messages[0], &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Type != "error" || reply.Request != "offer" || reply.Code != codeNotFound || reply.Message != sfu.ErrPeerNotFound.Error() {
+		t.Fatalf("got %+v", reply)
+	}
+
+	// Events pass through unchanged.
+	if s := (legacyCodec{}).signaling(w); s != sfu.Signaling(w) {
+		t.Fatal("version 1 events are wrapped")
+	}
+}
+
+func TestErrorCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		code int
+	}{
+		{fmt.Errorf("%w: unexpected end", errParse), codeParseError},
+		{errInvalidRequest, codeInvalidRequest},
+		{errUnknownMethod, codeMethodNotFound},
+		{errInvalidParams, codeInvalidParams},
+		{errNotJoined, codeNotJoined},
+		{errNotModerator, codeForbidden},
+		{sfu.ErrRoomLocked, codeForbidden},
+		{sfu.ErrBanned, codeForbidden},
+		{sfu.ErrPeerNotFound, codeNotFound},
+		{sfu.ErrPollNotFound, codeNotFound},
+		{sfu.ErrInvalidPoll, codeInvalidParams},
+		{sfu.ErrPollClosed, codeConflict},
+		{sfu.ErrMemberExists, codeConflict},
+		{sfu.ErrParticipantQuota, codeRateLimited},
+		{sfu.ErrReactionLimit, codeRateLimited},
+		{fmt.Errorf("join: %w", sfu.ErrRoomQuotaExceeded), codeRateLimited},
+		{errors.New("boom"), codeInternalError},
+	}
+
+	for _, tt := range tests {
+		if code := errorCode(tt.err); code != tt.code {
+			t.Errorf("%v: got %d, want %d", tt.err, code, tt.code)
+		}
+	}
+}
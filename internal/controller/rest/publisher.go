@@ -0,0 +1,54 @@
+package rest
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"gonference/internal/sfu"
+)
+
+// startPublisher adds a virtual publisher playing files from the SFU's media
+// directory to the conference.
+func (h *Handler) startPublisher(w http.ResponseWriter, r *http.Request) {
+	room, ok := h.room(w, r)
+	if !ok {
+		return
+	}
+
+	var req sfu.PublisherRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	publisher, err := room.StartPublisher(apiActor, req)
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	h.writeJSON(w, http.StatusCreated, publisher)
+}
+
+func (h *Handler) listPublishers(w http.ResponseWriter, r *http.Request) {
+	room, ok := h.room(w, r)
+	if !ok {
+		return
+	}
+
+	h.writeJSON(w, http.StatusOK, room.Publishers())
+}
+
+func (h *Handler) stopPublisher(w http.ResponseWriter, r *http.Request) {
+	room, ok := h.room(w, r)
+	if !ok {
+		return
+	}
+
+	if err := room.StopPublisher(apiActor, r.PathValue("member")); err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
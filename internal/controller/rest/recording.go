@@ -0,0 +1,77 @@
+package rest
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"gonference/internal/controller/middleware"
+)
+
+// StartRecordingRequest records a single member when MemberID is set and
+// the whole conference otherwise.
+type StartRecordingRequest struct {
+	MemberID string `json:"memberId"`
+}
+
+func (h *Handler) startRecording(w http.ResponseWriter, r *http.Request) {
+	room, ok := h.room(w, r)
+	if !ok {
+		return
+	}
+
+	// The body is optional; an empty one records the whole conference.
+	var req StartRecordingRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	recording, err := room.StartRecording(apiActor, req.MemberID)
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	h.writeJSON(w, http.StatusCreated, recording)
+}
+
+func (h *Handler) listConferenceRecordings(w http.ResponseWriter, r *http.Request) {
+	room, ok := h.room(w, r)
+	if !ok {
+		return
+	}
+
+	h.writeJSON(w, http.StatusOK, room.Recordings())
+}
+
+func (h *Handler) stopRecording(w http.ResponseWriter, r *http.Request) {
+	room, ok := h.room(w, r)
+	if !ok {
+		return
+	}
+
+	recording, err := room.StopRecording(apiActor, r.PathValue("recording"))
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	h.writeJSON(w, http.StatusAccepted, recording)
+}
+
+func (h *Handler) listRecordings(w http.ResponseWriter, r *http.Request) {
+	h.writeJSON(w, http.StatusOK, h.sfu.Recordings(middleware.TenantID(r.Context())))
+}
+
+// getRecording returns a recording's status. It outlives the conference.
+func (h *Handler) getRecording(w http.ResponseWriter, r *http.Request) {
+	recording, err := h.sfu.Recording(middleware.TenantID(r.Context()), r.PathValue("recording"))
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	h.writeJSON(w, http.StatusOK, recording)
+}
@@ -0,0 +1,128 @@
+package rest
+
+import (
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+
+	"gonference/internal/sfu"
+)
+
+// maxSDPSize bounds an SDP file posted to start an ingest.
+const maxSDPSize = 64 << 10
+
+// startIngest binds a member to plain RTP input. The body is either a JSON
+// sfu.RTPIngestRequest or, with Content-Type application/sdp, an SDP file,
+// in which case the member is named by the memberId and name query
+// parameters and the sender by the sender one.
+func (h *Handler) startIngest(w http.ResponseWriter, r *http.Request) {
+	room, ok := h.room(w, r)
+	if !ok {
+		return
+	}
+
+	var req sfu.RTPIngestRequest
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/sdp" {
+		data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxSDPSize))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		req.MemberID = r.URL.Query().Get("memberId")
+		req.Name = r.URL.Query().Get("name")
+		req.Sender = r.URL.Query().Get("sender")
+		req.SDP = string(data)
+	} else if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	publisher, err := room.StartRTPIngest(apiActor, req)
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	h.writeJSON(w, http.StatusCreated, publisher)
+}
+
+// startEgress forwards a member's tracks as plain RTP to a UDP host.
+func (h *Handler) startEgress(w http.ResponseWriter, r *http.Request) {
+	room, ok := h.room(w, r)
+	if !ok {
+		return
+	}
+
+	var req sfu.EgressRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	egress, err := room.StartEgress(apiActor, req)
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	h.writeJSON(w, http.StatusCreated, egress)
+}
+
+func (h *Handler) listEgresses(w http.ResponseWriter, r *http.Request) {
+	room, ok := h.room(w, r)
+	if !ok {
+		return
+	}
+
+	h.writeJSON(w, http.StatusOK, room.Egresses())
+}
+
+func (h *Handler) getEgress(w http.ResponseWriter, r *http.Request) {
+	room, ok := h.room(w, r)
+	if !ok {
+		return
+	}
+
+	egress, err := room.Egress(r.PathValue("egress"))
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	h.writeJSON(w, http.StatusOK, egress)
+}
+
+// getEgressSDP serves the SDP of an egress as a file a receiver can open,
+// e.g. curl .../sdp > egress.sdp && ffplay -protocol_whitelist file,udp,rtp
+// egress.sdp.
+func (h *Handler) getEgressSDP(w http.ResponseWriter, r *http.Request) {
+	room, ok := h.room(w, r)
+	if !ok {
+		return
+	}
+
+	egress, err := room.Egress(r.PathValue("egress"))
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/sdp")
+	_, _ = io.WriteString(w, egress.SDP)
+}
+
+func (h *Handler) stopEgress(w http.ResponseWriter, r *http.Request) {
+	room, ok := h.room(w, r)
+	if !ok {
+		return
+	}
+
+	if err := room.StopEgress(apiActor, r.PathValue("egress")); err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
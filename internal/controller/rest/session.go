@@ -0,0 +1,282 @@
+package rest
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// sessionWriteWait bounds a write. A client that takes no data for
+	// that long is disconnected.
+	sessionWriteWait = 10 * time.Second
+
+	// sessionPongWait is how long a session stays up without hearing from
+	// the client. Pings go out often enough for a live client to answer
+	// well within it.
+	sessionPongWait   = 60 * time.Second
+	sessionPingPeriod = sessionPongWait * 9 / 10
+
+	// sessionCloseWait is how long a client has to answer the close frame
+	// of a session the server ends.
+	sessionCloseWait = 2 * time.Second
+
+	// sessionQueueSize bounds the messages waiting to be written. A client
+	// that falls this far behind is disconnected rather than holding up
+	// the SFU goroutines that signal it.
+	sessionQueueSize = 256
+
+	// sessionMaxMessage bounds a message from the client; an offer with
+	// many tracks runs to tens of kilobytes.
+	sessionMaxMessage = 512 << 10
+)
+
+var (
+	errSessionClosed  = errors.New("signaling session closed")
+	errSessionBacklog = errors.New("signaling session send queue is full")
+)
+
+// session is one signaling WebSocket connection. gorilla allows a single
+// writer at a time, while the SFU signals a member from many goroutines:
+// ICE gathering, renegotiations caused by other members' tracks, answers.
+// So WriteMessage only queues, and one goroutine writes the queue out in
+// order along with the keepalive pings.
+//
+// The goroutine serving the connection reads from it and ends the session
+// once reading fails: the client closed the connection, stopped answering
+// pings or dropped.
+type session struct {
+	conn   *websocket.Conn
+	logger *slog.Logger
+
+	queue   chan outbound
+	closing chan struct{}
+	done    chan struct{}
+	written chan struct{}
+
+	closeOnce sync.Once
+	closeCode int
+	closeText string
+}
+
+type outbound struct {
+	msgType int
+	data    []byte
+}
+
+func newSession(conn *websocket.Conn, logger *slog.Logger) *session {
+	s := &session{
+		conn:    conn,
+		logger:  logger.With(slog.String("remote", conn.RemoteAddr().String())),
+		queue:   make(chan outbound, sessionQueueSize),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+		written: make(chan struct{}),
+	}
+
+	conn.SetReadLimit(sessionMaxMessage)
+	_ = conn.SetReadDeadline(time.Now().Add(sessionPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(sessionPongWait))
+	})
+
+	go s.writeLoop()
+
+	return s
+}
+
+// WriteMessage queues a message without blocking. payload must not be
+// modified afterwards.
+func (s *session) WriteMessage(msgType int, payload []byte) error {
+	select {
+	case <-s.closing:
+		return errSessionClosed
+	case <-s.done:
+		return errSessionClosed
+	default:
+	}
+
+	select {
+	case s.queue <- outbound{msgType: msgType, data: payload}:
+		return nil
+	default:
+		s.close(websocket.ClosePolicyViolation, "too slow")
+		return errSessionBacklog
+	}
+}
+
+// read returns the next message from the client.
+func (s *session) read() ([]byte, error) {
+	_, data, err := s.conn.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-s.closing:
+		// The client has until the close deadline to answer.
+	default:
+		_ = s.conn.SetReadDeadline(time.Now().Add(sessionPongWait))
+	}
+
+	return data, nil
+}
+
+// close starts the close handshake: what is queued is written, then the
+// close frame. It does not block.
+func (s *session) close(code int, text string) {
+	s.closeOnce.Do(func() {
+		s.closeCode, s.closeText = code, text
+		close(s.closing)
+	})
+}
+
+// end is called by the reading goroutine once reading failed. It stops the
+// writer and closes the connection.
+func (s *session) end() {
+	close(s.done)
+	<-s.written
+	_ = s.conn.Close()
+}
+
+func (s *session) writeLoop() {
+	defer close(s.written)
+
+	ticker := time.NewTicker(sessionPingPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case m := <-s.queue:
+			if err := s.write(m); err != nil {
+				s.fail(err)
+				return
+			}
+		case <-ticker.C:
+			if err := s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(sessionWriteWait)); err != nil {
+				s.fail(err)
+				return
+			}
+		case <-s.closing:
+			if err := s.writeClose(); err != nil {
+				s.fail(err)
+				return
+			}
+
+			// The reader returns with the client's close frame, or is cut
+			// off.
+			select {
+			case <-s.done:
+			case <-time.After(sessionCloseWait):
+				_ = s.conn.Close()
+			}
+			return
+		case <-s.done:
+			// A session closed and ended at once still says why.
+			select {
+			case <-s.closing:
+				_ = s.writeClose()
+			default:
+			}
+			return
+		}
+	}
+}
+
+// writeClose writes what is still queued, then the close frame.
+func (s *session) writeClose() error {
+	s.flush()
+
+	message := websocket.FormatCloseMessage(s.closeCode, s.closeText)
+	return s.conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(sessionWriteWait))
+}
+
+// flush writes what is still queued.
+func (s *session) flush() {
+	for {
+		select {
+		case m := <-s.queue:
+			if err := s.write(m); err != nil {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (s *session) write(m outbound) error {
+	_ = s.conn.SetWriteDeadline(time.Now().Add(sessionWriteWait))
+	return s.conn.WriteMessage(m.msgType, m.data)
+}
+
+// fail drops a connection that could not be written to; the reader then
+// returns and ends the session.
+func (s *session) fail(err error) {
+	s.logger.Warn("Dropping signaling connection", slog.String("error", err.Error()))
+	_ = s.conn.Close()
+}
+
+// sessionSet holds the open sessions so that the handler can close them
+// when the server stops. http.Server.Close does not reach connections that
+// were upgraded.
+type sessionSet struct {
+	mux    sync.Mutex
+	all    map[*session]struct{}
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// add registers s, unless the set was closed already.
+func (ss *sessionSet) add(s *session) bool {
+	ss.mux.Lock()
+	defer ss.mux.Unlock()
+
+	if ss.closed {
+		return false
+	}
+
+	if ss.all == nil {
+		ss.all = make(map[*session]struct{})
+	}
+	ss.all[s] = struct{}{}
+	ss.wg.Add(1)
+
+	return true
+}
+
+func (ss *sessionSet) remove(s *session) {
+	ss.mux.Lock()
+	defer ss.mux.Unlock()
+
+	if _, ok := ss.all[s]; ok {
+		delete(ss.all, s)
+		ss.wg.Done()
+	}
+}
+
+// close closes every session as the server is going away, and makes add
+// refuse new ones. It waits for the sessions to end, at most for the close
+// handshake.
+func (ss *sessionSet) close() {
+	ss.mux.Lock()
+	ss.closed = true
+	for s := range ss.all {
+		s.close(websocket.CloseGoingAway, "server shutting down")
+	}
+	ss.mux.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		ss.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(sessionWriteWait + sessionCloseWait):
+	}
+}
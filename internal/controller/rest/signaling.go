@@ -1,11 +1,14 @@
 package rest
 
 import (
-	"encoding/json"
+	"fmt"
 	"log"
 	"log/slog"
 	"net/http"
 
+	"gonference/internal/controller/middleware"
+	"gonference/internal/sfu"
+
 	"github.com/gorilla/websocket"
 	"github.com/pion/webrtc/v3"
 )
@@ -16,14 +19,46 @@ var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool {
 		return true // для прикладу
 	},
+	// In order of preference; see protocol.go.
+	Subprotocols: []string{protocolV2, protocolV1},
 }
 
+// Message is a signaling message: the whole of a version 1 message, or the
+// method and params of a version 2 request.
 type Message struct {
 	Type      string                   `json:"type"`
 	RoomID    string                   `json:"roomId"`
 	MemberID  string                   `json:"memberId"`
+	Name      string                   `json:"name,omitempty"`
 	SDP       string                   `json:"sdp,omitempty"`
 	Candidate *webrtc.ICECandidateInit `json:"candidate,omitempty"`
+	TargetID  string                   `json:"targetId,omitempty"`
+	Kind      string                   `json:"kind,omitempty"`
+
+	Tracks []sfu.TrackDeclaration `json:"tracks,omitempty"`
+
+	// Subscription is "manual" to pick tracks with subscribe/unsubscribe
+	// instead of receiving everything; anything else means automatic.
+	Subscription  string             `json:"subscription,omitempty"`
+	Subscriptions []sfu.Subscription `json:"subscriptions,omitempty"`
+	TrackIDs      []string           `json:"trackIds,omitempty"`
+
+	BreakoutID  string            `json:"breakoutId,omitempty"`
+	Breakouts   []string          `json:"breakouts,omitempty"`
+	Assignments map[string]string `json:"assignments,omitempty"`
+	Duration    int               `json:"duration,omitempty"`
+
+	Emoji  string           `json:"emoji,omitempty"`
+	Poll   *sfu.PollRequest `json:"poll,omitempty"`
+	PollID string           `json:"pollId,omitempty"`
+	Option int              `json:"option,omitempty"`
+
+	Ops []sfu.StateOp `json:"ops,omitempty"`
+
+	File       *sfu.FileOffer `json:"file,omitempty"`
+	TransferID string         `json:"transferId,omitempty"`
+
+	RecordingID string `json:"recordingId,omitempty"`
 }
 
 func (h *Handler) wsHandler(w http.ResponseWriter, r *http.Request) {
@@ -32,61 +67,191 @@ func (h *Handler) wsHandler(w http.ResponseWriter, r *http.Request) {
 		log.Println("upgrade error:", err)
 		return
 	}
-	defer conn.Close()
+
+	session := newSession(conn, h.logger)
+	defer h.sessions.remove(session)
+	defer session.end()
+
+	// During shutdown the session only says goodbye; nothing it sends is
+	// handled.
+	if !h.sessions.add(session) {
+		session.close(websocket.CloseGoingAway, "server shutting down")
+		return
+	}
+
+	codec := codecFor(conn.Subprotocol())
+	s := &signalingConn{
+		h:      h,
+		tenant: middleware.TenantID(r.Context()),
+		signal: codec.signaling(session),
+	}
+	defer s.leave()
 
 	for {
-		var message Message
+		data, err := session.read()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				h.logger.Info("Signaling connection lost", slog.String("error", err.Error()))
+			}
+			break
+		}
 
-		_, msg, err := conn.ReadMessage()
+		c, err := codec.decode(data)
+		if err == nil {
+			err = s.handle(c.message)
+		}
 		if err != nil {
-			log.Println("read error:", err)
+			h.logger.Warn("Signaling request failed",
+				slog.String("type", c.message.Type),
+				slog.String("error", err.Error()))
+		}
+
+		if err := codec.reply(session, c, err); err != nil {
+			h.logger.Error("Failed to reply", slog.String("error", err.Error()))
 			break
 		}
+	}
+}
+
+// signalingConn is the state of one signaling connection. joined and
+// memberID identify who it joined as; moderator actions are attributed to
+// them rather than to whatever memberId a message claims. The peer itself
+// may only appear after lobby admission.
+type signalingConn struct {
+	h      *Handler
+	tenant string
+	signal sfu.Signaling
+
+	joined   *sfu.Room
+	memberID string
+}
+
+func (s *signalingConn) self() *sfu.Peer {
+	if s.joined == nil {
+		return nil
+	}
+
+	peer, _ := s.joined.FindPeer(s.memberID)
+	return peer
+}
+
+// leave takes the member out of the lobby or their room when the
+// connection ends, unless they have joined again over another connection
+// since.
+func (s *signalingConn) leave() {
+	if s.joined == nil {
+		return
+	}
+
+	s.joined.LeaveLobby(s.memberID)
+	if peer := s.self(); peer != nil && peer.Signaling() == s.signal {
+		peer.Room().RemovePeer(peer.ID())
+	}
+}
+
+// handle applies a message from the client.
+func (s *signalingConn) handle(message Message) error {
+	h := s.h
+
+	switch message.Type {
+	case "offer":
+		offer := webrtc.SessionDescription{
+			Type: webrtc.SDPTypeOffer,
+			SDP:  message.SDP,
+		}
 
-		if err := json.Unmarshal(msg, &message); err != nil {
-			log.Println("unmarshal error:", err)
+		// An offer from a member who already joined renegotiates their
+		// existing connection, e.g. to start sharing their screen.
+		if peer := s.self(); peer != nil {
+			peer.Room().DeclareTracks(peer, message.Tracks)
+			return peer.SendAnswer(offer)
 		}
 
-		switch message.Type {
-		case "offer":
-			room := h.sfu.GetOrCreateRoom(message.RoomID)
+		if message.RoomID == "" || message.MemberID == "" {
+			return fmt.Errorf("%w: roomId and memberId are required", errInvalidParams)
+		}
 
-			offer := webrtc.SessionDescription{
-				Type: webrtc.SDPTypeOffer,
-				SDP:  message.SDP,
-			}
+		room, err := h.sfu.GetOrCreateRoom(s.tenant, message.RoomID)
+		if err != nil {
+			return err
+		}
 
-			_, err := room.AddPeer(conn, offer, message.MemberID)
-			if err != nil {
-				h.logger.Error("Failed to add peer", slog.String("error", err.Error()))
-				return
-			}
-		case "answer":
-			peer, ok := h.sfu.GetOrCreateRoom(message.RoomID).GetPeer(message.MemberID)
-			if !ok {
-				h.logger.Error("Peer not found", slog.String("memberId", message.MemberID))
-				return
-			}
+		req := sfu.JoinRequest{
+			MemberID: message.MemberID,
+			Name:     message.Name,
+			Offer:    offer,
+			Tracks:   message.Tracks,
 
-			err := peer.ValidateAnswer(webrtc.SessionDescription{
-				Type: webrtc.SDPTypeAnswer,
-				SDP:  message.SDP,
-			})
-			if err != nil {
-				h.logger.Error("SetRemote(answer) failed", slog.String("error", err.Error()))
-			}
-		case "candidate":
-			peer, ok := h.sfu.GetOrCreateRoom(message.RoomID).GetPeer(message.MemberID)
-			if !ok {
-				h.logger.Error("Peer not found", slog.String("memberId", message.MemberID))
-				return
-			}
+			ManualSubscription: message.Subscription == "manual",
+		}
 
-			if err := peer.AddICECandidate(*message.Candidate); err != nil {
-				h.logger.Error("AddICECandidate failed", slog.String("error", err.Error()))
-			}
-		default:
-			h.logger.Info("unknown message type:", message.Type)
+		if _, err := room.Join(s.signal, req); err != nil {
+			return err
+		}
+		s.joined, s.memberID = room, message.MemberID
+	case "answer":
+		peer := s.self()
+		if peer == nil {
+			return errNotJoined
 		}
+
+		err := peer.ValidateAnswer(webrtc.SessionDescription{
+			Type: webrtc.SDPTypeAnswer,
+			SDP:  message.SDP,
+		})
+		if err != nil {
+			return fmt.Errorf("%w: %v", errInvalidParams, err)
+		}
+	case "candidate":
+		peer := s.self()
+		if peer == nil {
+			return errNotJoined
+		}
+		if message.Candidate == nil {
+			return fmt.Errorf("%w: candidate is required", errInvalidParams)
+		}
+
+		if err := peer.AddICECandidate(*message.Candidate); err != nil {
+			return fmt.Errorf("%w: %v", errInvalidParams, err)
+		}
+	case "track-info":
+		peer := s.self()
+		if peer == nil {
+			return errNotJoined
+		}
+
+		peer.Room().DeclareTracks(peer, message.Tracks)
+	case "subscribe", "unsubscribe":
+		peer := s.self()
+		if peer == nil {
+			return errNotJoined
+		}
+
+		update := peer.Room().Subscribe
+		if message.Type == "unsubscribe" {
+			update = peer.Room().Unsubscribe
+		}
+
+		return update(peer, message.Subscriptions)
+	case "pause", "resume":
+		peer := s.self()
+		if peer == nil {
+			return errNotJoined
+		}
+
+		return peer.Room().SetPaused(peer, message.TrackIDs, message.Type == "pause")
+	case "raise-hand", "lower-hand", "reaction", "poll-create", "poll-vote", "poll-close",
+		"state-update":
+		return h.interact(s.self(), message)
+	case "file-offer", "file-accept", "file-decline", "file-cancel", "file-complete":
+		return h.fileAction(s.self(), message)
+	case "kick", "ban", "mute", "unmute", "lock", "unlock", "admit", "reject",
+		"breakout-create", "breakout-move", "breakout-close",
+		"recording-start", "recording-stop":
+		return h.moderate(s.self(), message)
+	default:
+		return fmt.Errorf("%w: %q", errUnknownMethod, message.Type)
 	}
+
+	return nil
 }
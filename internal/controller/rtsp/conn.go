@@ -0,0 +1,407 @@
+package rtsp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gonference/internal/sfu"
+
+	"github.com/pion/sdp/v3"
+)
+
+const (
+	// sessionTimeout is announced to clients, which keep their session
+	// alive with a request or an RTCP report at least this often. A
+	// connection silent for longer is closed.
+	sessionTimeout = 60 * time.Second
+
+	// writeTimeout bounds an interleaved write. A client too slow to take
+	// its media within it is disconnected.
+	writeTimeout = 5 * time.Second
+
+	maxBodySize = 64 << 10
+)
+
+// Statuses RTSP adds to HTTP's (RFC 2326, section 7.1.1).
+const (
+	statusSessionNotFound       = 454
+	statusMethodNotValidInState = 455
+	statusUnsupportedTransport  = 461
+)
+
+var errBadRequest = errors.New("malformed RTSP request")
+
+type request struct {
+	method string
+	url    *url.URL
+	header textproto.MIMEHeader
+}
+
+// conn is one RTSP connection. It holds at most one session, which ends
+// with the connection.
+type conn struct {
+	h      *Handler
+	nc     net.Conn
+	reader *bufio.Reader
+	logger *slog.Logger
+
+	// wmux serializes responses and interleaved packets.
+	wmux sync.Mutex
+
+	session *session
+}
+
+func newConn(h *Handler, nc net.Conn) *conn {
+	return &conn{
+		h:      h,
+		nc:     nc,
+		reader: bufio.NewReader(nc),
+		logger: h.logger.With(slog.String("remote", nc.RemoteAddr().String())),
+	}
+}
+
+func (c *conn) serve() {
+	defer func() {
+		if c.session != nil {
+			c.session.close()
+		}
+		_ = c.nc.Close()
+		c.h.forget(c)
+	}()
+
+	for {
+		req, err := c.readRequest()
+		if err != nil {
+			if errors.Is(err, errBadRequest) {
+				c.logger.Warn("Closing RTSP connection", slog.String("error", err.Error()))
+			}
+			return
+		}
+
+		c.handle(req)
+	}
+}
+
+// readRequest reads the next request, skipping the RTCP reports a client
+// interleaves on the connection.
+func (c *conn) readRequest() (*request, error) {
+	for {
+		_ = c.nc.SetReadDeadline(time.Now().Add(sessionTimeout))
+
+		b, err := c.reader.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		if b[0] != '$' {
+			break
+		}
+
+		var frame [4]byte
+		if _, err := io.ReadFull(c.reader, frame[:]); err != nil {
+			return nil, err
+		}
+		if _, err := c.reader.Discard(int(binary.BigEndian.Uint16(frame[2:]))); err != nil {
+			return nil, err
+		}
+	}
+
+	tp := textproto.NewReader(c.reader)
+	line, err := tp.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+
+	method, rest, ok1 := strings.Cut(line, " ")
+	rawURL, proto, ok2 := strings.Cut(rest, " ")
+	if !ok1 || !ok2 || proto != "RTSP/1.0" {
+		return nil, fmt.Errorf("%w: %q", errBadRequest, line)
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errBadRequest, err)
+	}
+
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errBadRequest, err)
+	}
+
+	if length := header.Get("Content-Length"); length != "" {
+		n, err := strconv.Atoi(length)
+		if err != nil || n < 0 || n > maxBodySize {
+			return nil, fmt.Errorf("%w: content length %q", errBadRequest, length)
+		}
+		if _, err := c.reader.Discard(n); err != nil {
+			return nil, err
+		}
+	}
+
+	return &request{method: method, url: u, header: header}, nil
+}
+
+func (c *conn) handle(req *request) {
+	switch req.method {
+	case "OPTIONS":
+		c.respond(req, http.StatusOK, []string{"Public", "OPTIONS, DESCRIBE, SETUP, PLAY, PAUSE, TEARDOWN, GET_PARAMETER, SET_PARAMETER"}, nil)
+		return
+	case "GET_PARAMETER", "SET_PARAMETER":
+		// Keep-alives; the read deadline has already been extended.
+		c.respond(req, http.StatusOK, c.sessionHeader(), nil)
+		return
+	case "DESCRIBE", "SETUP", "PLAY", "PAUSE", "TEARDOWN":
+	default:
+		c.respond(req, http.StatusNotImplemented, nil, nil)
+		return
+	}
+
+	tenant, ok := c.h.tenant(req.header.Get("Authorization"))
+	if !ok {
+		c.respond(req, http.StatusUnauthorized, []string{"WWW-Authenticate", `Basic realm="gonference"`}, nil)
+		return
+	}
+
+	if req.method != "DESCRIBE" && req.method != "SETUP" {
+		c.control(req)
+		return
+	}
+
+	p, ok := parsePath(req.url.Path)
+	if !ok {
+		c.respond(req, http.StatusNotFound, nil, nil)
+		return
+	}
+
+	room, ok := c.h.sfu.GetRoom(tenant, p.roomID)
+	if !ok {
+		c.respond(req, http.StatusNotFound, nil, nil)
+		return
+	}
+
+	if req.method == "DESCRIBE" {
+		c.describe(req, room, p)
+	} else {
+		c.setup(req, room, p)
+	}
+}
+
+// control handles the requests made on an existing session.
+func (c *conn) control(req *request) {
+	id, _, _ := strings.Cut(req.header.Get("Session"), ";")
+	if c.session == nil || strings.TrimSpace(id) != c.session.id {
+		c.respond(req, statusSessionNotFound, nil, nil)
+		return
+	}
+
+	switch req.method {
+	case "PLAY":
+		if len(c.session.tracks) == 0 {
+			c.respond(req, statusMethodNotValidInState, nil, nil)
+			return
+		}
+
+		// The response goes out before the first packet does.
+		c.respond(req, http.StatusOK, append(c.sessionHeader(), "Range", "npt=0.000-"), nil)
+		if err := c.session.play(); err != nil {
+			c.logger.Warn("Failed to play RTSP session", slog.String("error", err.Error()))
+			_ = c.nc.Close()
+		}
+	case "PAUSE":
+		c.session.pause()
+		c.respond(req, http.StatusOK, c.sessionHeader(), nil)
+	case "TEARDOWN":
+		c.session.close()
+		c.session = nil
+		c.respond(req, http.StatusOK, nil, nil)
+	}
+}
+
+func (c *conn) describe(req *request, room *sfu.Room, p streamPath) {
+	tracks := room.Tracks(p.memberID)
+	if len(tracks) == 0 {
+		c.respond(req, http.StatusNotFound, nil, nil)
+		return
+	}
+
+	host, _, _ := net.SplitHostPort(c.nc.LocalAddr().String())
+	addressType := "IP4"
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		addressType = "IP6"
+	}
+
+	desc := &sdp.SessionDescription{
+		Origin: sdp.Origin{
+			Username:       "-",
+			SessionID:      uint64(time.Now().Unix()),
+			SessionVersion: uint64(time.Now().Unix()),
+			NetworkType:    "IN",
+			AddressType:    addressType,
+			UnicastAddress: host,
+		},
+		SessionName:      sdp.SessionName("gonference " + p.String()),
+		TimeDescriptions: []sdp.TimeDescription{{}},
+	}
+	desc.WithValueAttribute("control", "*")
+
+	for _, track := range tracks {
+		_, name, _ := strings.Cut(track.Codec.MimeType, "/")
+
+		media := &sdp.MediaDescription{
+			MediaName: sdp.MediaName{
+				Media:  track.Kind.String(),
+				Port:   sdp.RangedPort{Value: 0},
+				Protos: []string{"RTP", "AVP"},
+			},
+		}
+		media.WithCodec(uint8(track.Codec.PayloadType), name, track.Codec.ClockRate, track.Codec.Channels, track.Codec.SDPFmtpLine)
+		media.WithValueAttribute("control", "trackID="+track.TrackID)
+		desc.WithMedia(media)
+	}
+
+	body, err := desc.Marshal()
+	if err != nil {
+		c.respond(req, http.StatusInternalServerError, nil, nil)
+		return
+	}
+
+	base := *req.url
+	base.Path = strings.TrimSuffix(base.Path, "/") + "/"
+	c.respond(req, http.StatusOK, []string{
+		"Content-Base", base.String(),
+		"Content-Type", "application/sdp",
+	}, body)
+}
+
+func (c *conn) setup(req *request, room *sfu.Room, p streamPath) {
+	if p.trackID == "" {
+		c.respond(req, http.StatusNotFound, nil, nil)
+		return
+	}
+
+	if id, _, _ := strings.Cut(req.header.Get("Session"), ";"); id != "" && (c.session == nil || strings.TrimSpace(id) != c.session.id) {
+		c.respond(req, statusSessionNotFound, nil, nil)
+		return
+	}
+	if c.session != nil && (c.session.playing || c.session.room != room) {
+		c.respond(req, statusMethodNotValidInState, nil, nil)
+		return
+	}
+
+	var track *sfu.MediaTrack
+	for _, t := range room.Tracks(p.memberID) {
+		if t.TrackID == p.trackID {
+			track = &t
+			break
+		}
+	}
+	if track == nil {
+		c.respond(req, http.StatusNotFound, nil, nil)
+		return
+	}
+
+	if c.session == nil {
+		c.session = newSession(c, room)
+	}
+
+	transport, err := c.session.setup(*track, req.header.Get("Transport"))
+	if err != nil {
+		c.respond(req, statusUnsupportedTransport, nil, nil)
+		return
+	}
+
+	c.respond(req, http.StatusOK, append(c.sessionHeader(), "Transport", transport), nil)
+}
+
+func (c *conn) sessionHeader() []string {
+	if c.session == nil {
+		return nil
+	}
+
+	return []string{"Session", fmt.Sprintf("%s;timeout=%d", c.session.id, int(sessionTimeout.Seconds()))}
+}
+
+// respond writes a response. header holds name and value pairs, in order.
+func (c *conn) respond(req *request, status int, header []string, body []byte) {
+	text := http.StatusText(status)
+	switch status {
+	case statusSessionNotFound:
+		text = "Session Not Found"
+	case statusMethodNotValidInState:
+		text = "Method Not Valid in This State"
+	case statusUnsupportedTransport:
+		text = "Unsupported Transport"
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "RTSP/1.0 %d %s\r\n", status, text)
+	fmt.Fprintf(&b, "CSeq: %s\r\n", req.header.Get("CSeq"))
+	b.WriteString("Server: gonference\r\n")
+	for i := 0; i+1 < len(header); i += 2 {
+		fmt.Fprintf(&b, "%s: %s\r\n", header[i], header[i+1])
+	}
+	fmt.Fprintf(&b, "Content-Length: %d\r\n\r\n", len(body))
+	b.Write(body)
+
+	if err := c.write([]byte(b.String())); err != nil {
+		c.logger.Warn("Failed to write RTSP response", slog.String("error", err.Error()))
+		_ = c.nc.Close()
+	}
+}
+
+// write sends b whole or not at all within writeTimeout.
+func (c *conn) write(b []byte) error {
+	c.wmux.Lock()
+	defer c.wmux.Unlock()
+
+	_ = c.nc.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err := c.nc.Write(b)
+
+	return err
+}
+
+// streamPath is a parsed /room/{id}[/{member}][/trackID={track}] path.
+type streamPath struct {
+	roomID   string
+	memberID string
+	trackID  string
+}
+
+func parsePath(p string) (streamPath, bool) {
+	segments := strings.Split(strings.Trim(p, "/"), "/")
+
+	var parsed streamPath
+	if last := segments[len(segments)-1]; strings.HasPrefix(last, "trackID=") {
+		parsed.trackID = strings.TrimPrefix(last, "trackID=")
+		segments = segments[:len(segments)-1]
+	}
+
+	if len(segments) < 2 || len(segments) > 3 || segments[0] != "room" || segments[1] == "" {
+		return streamPath{}, false
+	}
+	parsed.roomID = segments[1]
+	if len(segments) == 3 {
+		parsed.memberID = segments[2]
+	}
+
+	return parsed, true
+}
+
+func (p streamPath) String() string {
+	if p.memberID == "" {
+		return p.roomID
+	}
+
+	return p.roomID + "/" + p.memberID
+}
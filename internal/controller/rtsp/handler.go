@@ -0,0 +1,154 @@
+package rtsp
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+
+	"gonference/internal/config"
+	"gonference/internal/sfu"
+)
+
+type SFU interface {
+	GetRoom(tenant, id string) (*sfu.Room, bool)
+}
+
+// Handler serves the tracks of every room over RTSP, read-only:
+//
+//	rtsp://host:port/room/{id}           every track of the conference
+//	rtsp://host:port/room/{id}/{member}  one member's tracks
+//
+// Media is the forwarded RTP as is, interleaved on the RTSP connection or
+// sent over UDP. When tenants are configured, clients authenticate with
+// their tenant's API key and secret as basic auth credentials.
+type Handler struct {
+	logger  *slog.Logger
+	addr    string
+	tenants map[string]config.Tenant
+
+	sfu SFU
+
+	mux      sync.Mutex
+	listener net.Listener
+	conns    map[*conn]struct{}
+	closed   bool
+}
+
+func NewHandler(cfg config.RTSP, tenants []config.Tenant, sfu SFU) *Handler {
+	byKey := make(map[string]config.Tenant, len(tenants))
+	for _, t := range tenants {
+		byKey[t.APIKey] = t
+	}
+
+	return &Handler{
+		logger:  slog.Default().With(slog.String("component", "rtsp")),
+		addr:    fmt.Sprintf(":%d", cfg.Port),
+		tenants: byKey,
+		sfu:     sfu,
+		conns:   make(map[*conn]struct{}),
+	}
+}
+
+func (h *Handler) ListenAndServe() {
+	listener, err := net.Listen("tcp", h.addr)
+	if err != nil {
+		h.logger.Error("during serving", slog.String("error", err.Error()))
+		return
+	}
+
+	h.mux.Lock()
+	if h.closed {
+		h.mux.Unlock()
+		_ = listener.Close()
+		return
+	}
+	h.listener = listener
+	h.mux.Unlock()
+
+	h.logger.Info("started", slog.String("addr", h.addr))
+
+	for {
+		nc, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			h.logger.Error("during serving", slog.String("error", err.Error()))
+			continue
+		}
+
+		c := newConn(h, nc)
+
+		h.mux.Lock()
+		if h.closed {
+			h.mux.Unlock()
+			_ = nc.Close()
+			return
+		}
+		h.conns[c] = struct{}{}
+		h.mux.Unlock()
+
+		go c.serve()
+	}
+}
+
+// Close stops accepting connections and ends every session.
+func (h *Handler) Close() {
+	h.mux.Lock()
+	h.closed = true
+	listener := h.listener
+	conns := make([]*conn, 0, len(h.conns))
+	for c := range h.conns {
+		conns = append(conns, c)
+	}
+	h.mux.Unlock()
+
+	if listener != nil {
+		if err := listener.Close(); err != nil {
+			h.logger.Error("during closing", slog.String("error", err.Error()))
+		}
+	}
+
+	for _, c := range conns {
+		_ = c.nc.Close()
+	}
+
+	h.logger.Info("stopped")
+}
+
+func (h *Handler) forget(c *conn) {
+	h.mux.Lock()
+	delete(h.conns, c)
+	h.mux.Unlock()
+}
+
+// tenant authenticates a request by its Authorization header. Without
+// tenants every request is let through in the default namespace.
+func (h *Handler) tenant(authorization string) (string, bool) {
+	if len(h.tenants) == 0 {
+		return "", true
+	}
+
+	encoded, ok := strings.CutPrefix(authorization, "Basic ")
+	if !ok {
+		return "", false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return "", false
+	}
+
+	key, secret, _ := strings.Cut(string(decoded), ":")
+	tenant, ok := h.tenants[key]
+	if !ok || subtle.ConstantTimeCompare([]byte(secret), []byte(tenant.APISecret)) != 1 {
+		return "", false
+	}
+
+	return tenant.ID, true
+}
@@ -0,0 +1,296 @@
+package rtsp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gonference/internal/sfu"
+
+	"github.com/google/uuid"
+)
+
+// maxPacketSize is the largest RTP packet the SFU forwards.
+const maxPacketSize = 1500
+
+var (
+	errUnsupportedTransport = errors.New("no supported transport offered")
+	errNothingToPlay        = errors.New("no track of the session is published anymore")
+)
+
+// session is the set of tracks a client has set up on its connection and
+// plays together. The tracks are fed by their forwarders while playing; a
+// track published after DESCRIBE is not part of it, so clients pick it up
+// by connecting again. Once every track has ended the connection is closed.
+type session struct {
+	id   string
+	c    *conn
+	room *sfu.Room
+
+	// Touched only by the connection's goroutine.
+	tracks  []*sessionTrack
+	playing bool
+
+	// mux guards live, the sinks still fed by their track, and the sinks'
+	// removed flags.
+	mux  sync.Mutex
+	live int
+}
+
+// sessionTrack is a set-up track and where its packets go: an interleaved
+// channel on the connection, or a UDP socket to the client's port.
+type sessionTrack struct {
+	track   sfu.MediaTrack
+	channel byte
+	udp     *net.UDPConn
+
+	sink   *sink
+	remove func()
+}
+
+func newSession(c *conn, room *sfu.Room) *session {
+	return &session{
+		id:   strings.ReplaceAll(uuid.NewString(), "-", ""),
+		c:    c,
+		room: room,
+	}
+}
+
+// setup adds track with the first transport of the Transport header that
+// is supported, and returns the transport chosen.
+func (s *session) setup(track sfu.MediaTrack, header string) (string, error) {
+	for _, spec := range strings.Split(header, ",") {
+		params := strings.Split(strings.TrimSpace(spec), ";")
+
+		var multicast bool
+		var interleaved, clientPorts []int
+		for _, param := range params[1:] {
+			key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			switch strings.ToLower(key) {
+			case "multicast":
+				multicast = true
+			case "interleaved":
+				interleaved = parseRange(value)
+			case "client_port":
+				clientPorts = parseRange(value)
+			}
+		}
+		if multicast {
+			continue
+		}
+
+		st := &sessionTrack{track: track}
+		var transport string
+		switch strings.ToUpper(params[0]) {
+		case "RTP/AVP/TCP":
+			channel := 2 * len(s.tracks)
+			if len(interleaved) > 0 {
+				channel = interleaved[0]
+			}
+			if channel < 0 || channel > 254 {
+				continue
+			}
+
+			st.channel = byte(channel)
+			transport = fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d", channel, channel+1)
+		case "RTP/AVP", "RTP/AVP/UDP":
+			if len(clientPorts) == 0 || clientPorts[0] <= 0 || clientPorts[0] > 65535 {
+				continue
+			}
+
+			remote, ok := s.c.nc.RemoteAddr().(*net.TCPAddr)
+			if !ok {
+				continue
+			}
+
+			udp, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: remote.IP, Port: clientPorts[0]})
+			if err != nil {
+				return "", err
+			}
+
+			st.udp = udp
+			transport = fmt.Sprintf("RTP/AVP;unicast;client_port=%s;server_port=%d",
+				formatRange(clientPorts), udp.LocalAddr().(*net.UDPAddr).Port)
+		default:
+			continue
+		}
+
+		s.replace(st)
+
+		return transport, nil
+	}
+
+	return "", errUnsupportedTransport
+}
+
+// replace adds st, or swaps it in for the same track set up again.
+func (s *session) replace(st *sessionTrack) {
+	for i, old := range s.tracks {
+		if old.track.TrackID == st.track.TrackID {
+			if old.udp != nil {
+				_ = old.udp.Close()
+			}
+			s.tracks[i] = st
+			return
+		}
+	}
+
+	s.tracks = append(s.tracks, st)
+}
+
+// play starts feeding every set-up track that is still published.
+func (s *session) play() error {
+	if s.playing {
+		return nil
+	}
+	s.playing = true
+
+	for _, st := range s.tracks {
+		k := &sink{session: s, track: st, payloadType: uint8(st.track.Codec.PayloadType)}
+
+		s.mux.Lock()
+		s.live++
+		st.sink = k
+		s.mux.Unlock()
+
+		remove, err := s.room.AddTrackSink(st.track.TrackID, "rtsp:"+s.id, k)
+		if err != nil {
+			s.mux.Lock()
+			s.live--
+			k.removed = true
+			s.mux.Unlock()
+			continue
+		}
+		st.remove = remove
+	}
+
+	s.mux.Lock()
+	live := s.live
+	s.mux.Unlock()
+
+	if live == 0 {
+		return errNothingToPlay
+	}
+
+	return nil
+}
+
+// pause stops feeding the tracks, keeping them set up.
+func (s *session) pause() {
+	s.playing = false
+
+	s.mux.Lock()
+	var removes []func()
+	for _, st := range s.tracks {
+		if st.sink != nil {
+			st.sink.removed = true
+		}
+		if st.remove != nil {
+			removes = append(removes, st.remove)
+		}
+		st.sink, st.remove = nil, nil
+	}
+	s.live = 0
+	s.mux.Unlock()
+
+	for _, remove := range removes {
+		remove()
+	}
+}
+
+func (s *session) close() {
+	s.pause()
+
+	for _, st := range s.tracks {
+		if st.udp != nil {
+			_ = st.udp.Close()
+		}
+	}
+	s.tracks = nil
+}
+
+// ended is called when the track of k has ended. The client is disconnected
+// once nothing is left to play.
+func (s *session) ended(k *sink) {
+	s.mux.Lock()
+	if k.removed {
+		s.mux.Unlock()
+		return
+	}
+	k.removed = true
+	s.live--
+	done := s.live == 0
+	s.mux.Unlock()
+
+	if done {
+		_ = s.c.nc.Close()
+	}
+}
+
+// sink sends the packets of one forwarded track to the client, with the
+// payload type the session's SDP gives its codec.
+type sink struct {
+	session     *session
+	track       *sessionTrack
+	payloadType uint8
+
+	// removed is guarded by the session's mux.
+	removed bool
+
+	buf [4 + maxPacketSize]byte
+}
+
+func (k *sink) Write(b []byte) (int, error) {
+	if len(b) < 2 || len(b) > maxPacketSize {
+		return 0, errors.New("invalid RTP packet size")
+	}
+
+	n := copy(k.buf[4:], b)
+	k.buf[5] = k.buf[5]&0x80 | k.payloadType
+
+	if k.track.udp != nil {
+		return k.track.udp.Write(k.buf[4 : 4+n])
+	}
+
+	k.buf[0], k.buf[1] = '$', k.track.channel
+	binary.BigEndian.PutUint16(k.buf[2:4], uint16(n))
+	if err := k.session.c.write(k.buf[:4+n]); err != nil {
+		// A timed out write may have left half a frame behind.
+		_ = k.session.c.nc.Close()
+		return 0, err
+	}
+
+	return n, nil
+}
+
+func (k *sink) Close() error {
+	k.session.ended(k)
+	return nil
+}
+
+// parseRange parses a port or channel range such as "5000-5001".
+func parseRange(value string) []int {
+	var values []int
+	for _, part := range strings.SplitN(value, "-", 2) {
+		n, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return nil
+		}
+		values = append(values, n)
+	}
+
+	return values
+}
+
+func formatRange(values []int) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = strconv.Itoa(v)
+	}
+
+	return strings.Join(parts, "-")
+}
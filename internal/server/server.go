@@ -10,22 +10,31 @@ import (
 	"gonference/internal/config"
 	"gonference/internal/controller/admin_panel"
 	"gonference/internal/controller/rest"
+	"gonference/internal/controller/rtsp"
 )
 
 func Run() {
 	cfg := config.MustLoad()
 
-	sfu, err := sfu.New()
+	sfu, err := sfu.New(cfg.SFU)
 	if err != nil {
 		slog.Error("Failed to create SFU", slog.String("error", err.Error()))
+		return
 	}
 
-	rest := rest.NewHandler(cfg.REST, sfu)
+	for _, tenant := range cfg.Tenants {
+		sfu.SetQuota(tenant.ID, sfuQuota(tenant))
+	}
+
+	rest := rest.NewHandler(cfg.REST, cfg.Tenants, sfu)
 	go rest.ListenAndServe()
 
-	ap := admin_panel.NewHandler(cfg.AdminPanel)
+	ap := admin_panel.NewHandler(cfg.AdminPanel, sfu)
 	go ap.ListenAndServe()
 
+	rtsp := rtsp.NewHandler(cfg.RTSP, cfg.Tenants, sfu)
+	go rtsp.ListenAndServe()
+
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGINT)
 
@@ -33,6 +42,14 @@ func Run() {
 
 	slog.Info("Execution interrupted", slog.String("signal", sig.String()))
 
+	rtsp.Close()
 	rest.Close()
 	ap.Close()
 }
+
+func sfuQuota(tenant config.Tenant) sfu.Quota {
+	return sfu.Quota{
+		MaxRooms:        tenant.MaxRooms,
+		MaxParticipants: tenant.MaxParticipants,
+	}
+}
@@ -0,0 +1,307 @@
+package sfu
+
+import (
+	"errors"
+	"log/slog"
+	"time"
+)
+
+var (
+	ErrBreakoutNotFound = errors.New("breakout room not found")
+	ErrBreakoutNested   = errors.New("breakout rooms cannot have breakouts")
+	// ErrInvalidBreakouts is returned for an empty breakout ID, which names
+	// the main room, or one given twice.
+	ErrInvalidBreakouts = errors.New("breakout rooms need distinct, non-empty IDs")
+)
+
+// BreakoutInfo describes a breakout room and who is in it.
+type BreakoutInfo struct {
+	ID      string    `json:"id"`
+	Members []string  `json:"members"`
+	EndsAt  time.Time `json:"endsAt,omitzero"`
+}
+
+// CreateBreakouts opens child rooms under r, moves members according to
+// assignments (member ID -> breakout ID) and, when duration is positive,
+// brings everyone back to the main room once it elapses.
+func (r *Room) CreateBreakouts(actor string, ids []string, assignments map[string]string, duration time.Duration) error {
+	if r.parent != nil {
+		return ErrBreakoutNested
+	}
+
+	seen := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		if id == "" || seen[id] {
+			return ErrInvalidBreakouts
+		}
+		seen[id] = true
+	}
+
+	r.mux.Lock()
+	for _, id := range ids {
+		if _, exists := r.breakouts[id]; exists {
+			continue
+		}
+
+		breakout := NewRoom(r.svc, r.tenant, id, RoomOptions{})
+		breakout.parent = r
+		r.breakouts[id] = breakout
+	}
+
+	if r.breakoutTimer != nil {
+		r.breakoutTimer.Stop()
+		r.breakoutTimer = nil
+		r.breakoutsEnd = time.Time{}
+	}
+	if duration > 0 {
+		r.breakoutsEnd = time.Now().Add(duration)
+		r.breakoutTimer = time.AfterFunc(duration, func() {
+			r.CloseBreakouts("timer")
+		})
+	}
+	r.mux.Unlock()
+
+	r.audit(actor, "breakouts-open", "", duration.String())
+	r.broadcast(nil, "breakouts-opened", map[string]any{"breakouts": r.Breakouts()})
+
+	for memberID, breakoutID := range assignments {
+		if err := r.MovePeer(actor, memberID, breakoutID); err != nil {
+			slog.Error("Failed to assign member to breakout",
+				slog.String("member", memberID),
+				slog.String("breakout", breakoutID),
+				slog.String("error", err.Error()))
+		}
+	}
+
+	return nil
+}
+
+// MovePeer moves a member of the main room or any of its breakouts into the
+// breakout with breakoutID, or back into the main room when it is empty. The
+// member keeps their signaling connection and PeerConnection; only the tracks
+// they send and receive are renegotiated.
+func (r *Room) MovePeer(actor, id, breakoutID string) error {
+	peer, ok := r.FindPeer(id)
+	if !ok {
+		return ErrPeerNotFound
+	}
+
+	to := r
+	if breakoutID != "" {
+		r.mux.RLock()
+		to, ok = r.breakouts[breakoutID]
+		r.mux.RUnlock()
+		if !ok {
+			return ErrBreakoutNotFound
+		}
+	}
+
+	from := peer.Room()
+	if from == to {
+		return nil
+	}
+
+	owned := from.detachPeer(peer)
+	to.attachPeer(peer, owned)
+
+	r.audit(actor, "move", id, to.ID())
+
+	err := peer.send("moved", map[string]any{
+		"from":       from.ID(),
+		"breakoutId": breakoutID,
+	})
+	if err != nil {
+		peer.logger.Error("Failed to notify move", slog.String("error", err.Error()))
+	}
+
+	return nil
+}
+
+// CloseBreakouts brings every member back to the main room and closes the
+// breakout rooms.
+func (r *Room) CloseBreakouts(actor string) {
+	r.mux.Lock()
+	breakouts := r.breakouts
+	r.breakouts = make(map[string]*Room)
+	if r.breakoutTimer != nil {
+		r.breakoutTimer.Stop()
+		r.breakoutTimer = nil
+	}
+	r.breakoutsEnd = time.Time{}
+	r.mux.Unlock()
+
+	for _, breakout := range breakouts {
+		breakout.mux.RLock()
+		peers := breakout.peerList(nil)
+		breakout.mux.RUnlock()
+
+		for _, peer := range peers {
+			owned := breakout.detachPeer(peer)
+			r.attachPeer(peer, owned)
+
+			if err := peer.send("moved", map[string]any{"from": breakout.ID()}); err != nil {
+				peer.logger.Error("Failed to notify move", slog.String("error", err.Error()))
+			}
+		}
+
+		breakout.Close()
+	}
+
+	r.audit(actor, "breakouts-close", "", "")
+	r.broadcast(nil, "breakouts-closed", nil)
+	r.closeIfIdle()
+}
+
+// Breakouts lists the open breakout rooms.
+func (r *Room) Breakouts() []BreakoutInfo {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	infos := make([]BreakoutInfo, 0, len(r.breakouts))
+	for id, breakout := range r.breakouts {
+		breakout.mux.RLock()
+		members := make([]string, 0, len(breakout.peers))
+		for memberID := range breakout.peers {
+			members = append(members, memberID)
+		}
+		breakout.mux.RUnlock()
+
+		infos = append(infos, BreakoutInfo{ID: id, Members: members, EndsAt: r.breakoutsEnd})
+	}
+
+	return infos
+}
+
+// Main returns the room a breakout belongs to, or r itself.
+func (r *Room) Main() *Room {
+	if r.parent != nil {
+		return r.parent
+	}
+
+	return r
+}
+
+// FindPeer looks a member up in the room and its breakouts.
+func (r *Room) FindPeer(id string) (*Peer, bool) {
+	if peer, ok := r.GetPeer(id); ok {
+		return peer, true
+	}
+
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	for _, breakout := range r.breakouts {
+		if peer, ok := breakout.GetPeer(id); ok {
+			return peer, true
+		}
+	}
+
+	return nil, false
+}
+
+// detachPeer removes peer from the room without closing it. The peer stops
+// receiving the room's tracks, the room stops receiving the peer's tracks,
+// and the forwarders the peer publishes are handed back to the caller.
+func (r *Room) detachPeer(peer *Peer) []*TrackForwarder {
+	r.mux.Lock()
+	delete(r.peers, peer.ID())
+
+	var owned []*TrackForwarder
+	var ownedIDs, subscribed []string
+	for trackID, forwarder := range r.forwarders {
+		if forwarder.peer == peer {
+			delete(r.forwarders, trackID)
+			owned = append(owned, forwarder)
+			ownedIDs = append(ownedIDs, trackID)
+			continue
+		}
+
+		forwarder.RemovePeer(peer.ID())
+		subscribed = append(subscribed, trackID)
+	}
+
+	peers := r.peerList(nil)
+	recs := r.recordingList()
+	egresses := r.egressList()
+	hls := r.hls
+	r.mux.Unlock()
+
+	for _, rec := range recs {
+		for _, forwarder := range owned {
+			rec.detach(forwarder)
+		}
+	}
+	for _, e := range egresses {
+		for _, forwarder := range owned {
+			e.detach(forwarder)
+		}
+	}
+	if hls != nil {
+		for _, forwarder := range owned {
+			hls.detach(forwarder)
+		}
+	}
+
+	peer.removeTracks(subscribed...)
+
+	r.announceLeave(peer.ID())
+
+	for _, p := range peers {
+		for _, forwarder := range owned {
+			forwarder.RemovePeer(p.ID())
+		}
+
+		if err := p.RemoveTracksAndRenegotiate(ownedIDs...); err != nil {
+			p.logger.Error("Failed to renegotiate", slog.String("error", err.Error()))
+		}
+	}
+
+	r.backfill()
+
+	return owned
+}
+
+// attachPeer adds an already connected peer and the forwarders it publishes
+// to the room and renegotiates everyone affected.
+func (r *Room) attachPeer(peer *Peer, owned []*TrackForwarder) {
+	r.mux.Lock()
+	peer.setRoom(r)
+	r.peers[peer.ID()] = peer
+	forwarders := r.forwarderList(peer)
+	for _, forwarder := range owned {
+		r.forwarders[forwarder.ID()] = forwarder
+	}
+	peers := r.peerList(peer)
+	recs := r.recordingList()
+	egresses := r.egressList()
+	hls := r.hls
+	r.mux.Unlock()
+
+	for _, rec := range recs {
+		for _, forwarder := range owned {
+			rec.attach(forwarder)
+		}
+	}
+	for _, e := range egresses {
+		for _, forwarder := range owned {
+			e.attach(forwarder)
+		}
+	}
+	if hls != nil {
+		for _, forwarder := range owned {
+			hls.attach(forwarder)
+		}
+	}
+
+	r.subscribe(peer, forwarders)
+
+	if err := peer.Renegotiate(); err != nil {
+		peer.logger.Error("Failed to renegotiate", slog.String("error", err.Error()))
+	}
+
+	r.announceJoin(peer)
+
+	for _, forwarder := range owned {
+		r.publish(forwarder, peers)
+	}
+}
@@ -0,0 +1,31 @@
+package sfu
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCreateBreakoutsRejectsInvalidIDs(t *testing.T) {
+	s := newTestSFU(t)
+
+	room, err := s.CreateRoom("", "a", RoomOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ids := range [][]string{{""}, {"b", ""}, {"b", "c", "b"}} {
+		if err := room.CreateBreakouts(systemActor, ids, nil, 0); !errors.Is(err, ErrInvalidBreakouts) {
+			t.Fatalf("%q: got %v, want %v", ids, err, ErrInvalidBreakouts)
+		}
+	}
+	if breakouts := room.Breakouts(); len(breakouts) != 0 {
+		t.Fatalf("rejected requests opened %v", breakouts)
+	}
+
+	if err := room.CreateBreakouts(systemActor, []string{"b", "c"}, nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	if breakouts := room.Breakouts(); len(breakouts) != 2 {
+		t.Fatalf("got %v, want two breakouts", breakouts)
+	}
+}
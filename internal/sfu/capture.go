@@ -0,0 +1,686 @@
+package sfu
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3/pkg/media/rtpdump"
+)
+
+// CaptureFormat is the file format of a packet capture.
+type CaptureFormat string
+
+const (
+	// CapturePcap writes raw IPv4/UDP frames with synthetic addresses:
+	// the member is captureMemberAddr and the SFU captureSFUAddr. Tell
+	// Wireshark to decode the port as RTP, or enable its RTP heuristics.
+	CapturePcap CaptureFormat = "pcap"
+	// CaptureRTPDump writes the rtpdump format read by rtpplay and
+	// Wireshark. It has no notion of direction; use the stream list of the
+	// capture to tell inbound from outbound SSRCs.
+	CaptureRTPDump CaptureFormat = "rtpdump"
+)
+
+// CaptureStatus is where a capture is in its lifecycle.
+type CaptureStatus string
+
+const (
+	CaptureRunning CaptureStatus = "capturing"
+	CaptureDone    CaptureStatus = "done"
+	CaptureFailed  CaptureStatus = "failed"
+)
+
+// Directions of captured streams, as seen from the SFU.
+const (
+	CaptureInbound  = "inbound"
+	CaptureOutbound = "outbound"
+)
+
+const (
+	defaultCaptureDuration = 30 * time.Second
+	maxCaptureDuration     = 10 * time.Minute
+	defaultCaptureBytes    = 16 << 20
+	maxCaptureBytes        = 256 << 20
+
+	// captureHistory is how many finished captures the SFU keeps on disk.
+	captureHistory = 20
+
+	// capturePort is the UDP port of both sides in pcap files; RTP and
+	// RTCP are multiplexed on it like on the real transport.
+	capturePort = 5004
+)
+
+var (
+	captureSFUAddr    = net.IPv4(10, 0, 0, 1).To4()
+	captureMemberAddr = net.IPv4(10, 0, 0, 2).To4()
+)
+
+var (
+	ErrCaptureActive   = errors.New("member is already being captured")
+	ErrCaptureRunning  = errors.New("capture is still running")
+	ErrCaptureNotFound = errors.New("capture not found")
+	ErrInvalidCapture  = errors.New("invalid capture request")
+)
+
+// CaptureRequest asks for a packet capture of one member's media. The
+// capture ends after Duration or once the file reaches MaxBytes, whichever
+// comes first; zero values pick the defaults. Without Payloads only RTP
+// headers are kept, which is usually enough to debug frozen video and keeps
+// the media itself out of the file. RTCP is always captured whole.
+type CaptureRequest struct {
+	MemberID string        `json:"memberId"`
+	Format   CaptureFormat `json:"format"`
+	Duration time.Duration `json:"duration"`
+	MaxBytes int64         `json:"maxBytes"`
+	Payloads bool          `json:"payloads"`
+}
+
+// CaptureStream is an RTP stream of the captured member's connection.
+type CaptureStream struct {
+	SSRC        uint32 `json:"ssrc"`
+	Direction   string `json:"direction"`
+	TrackID     string `json:"trackId,omitempty"`
+	MimeType    string `json:"mimeType"`
+	PayloadType uint8  `json:"payloadType"`
+}
+
+// CaptureInfo describes a capture and, once it has ended, its file.
+type CaptureInfo struct {
+	ID        string          `json:"id"`
+	Tenant    string          `json:"tenant"`
+	Room      string          `json:"room"`
+	MemberID  string          `json:"memberId"`
+	Format    CaptureFormat   `json:"format"`
+	Payloads  bool            `json:"payloads"`
+	Status    CaptureStatus   `json:"status"`
+	Error     string          `json:"error,omitempty"`
+	StartedAt time.Time       `json:"startedAt"`
+	EndedAt   *time.Time      `json:"endedAt,omitempty"`
+	MaxBytes  int64           `json:"maxBytes"`
+	Packets   uint64          `json:"packets"`
+	Bytes     int64           `json:"bytes"`
+	Streams   []CaptureStream `json:"streams"`
+}
+
+// FileName is the name a capture is offered for download under.
+func (c CaptureInfo) FileName() string {
+	ext := ".pcap"
+	if c.Format == CaptureRTPDump {
+		ext = ".rtpdump"
+	}
+
+	return c.MemberID + "-" + c.ID + ext
+}
+
+// StartCapture starts capturing the RTP and RTCP of a member's connection,
+// in both directions, as it goes over the wire.
+func (r *Room) StartCapture(actor string, req CaptureRequest) (CaptureInfo, error) {
+	if req.Format == "" {
+		req.Format = CapturePcap
+	}
+	if req.Duration == 0 {
+		req.Duration = defaultCaptureDuration
+	}
+	if req.MaxBytes == 0 {
+		req.MaxBytes = defaultCaptureBytes
+	}
+
+	switch {
+	case req.Format != CapturePcap && req.Format != CaptureRTPDump,
+		req.Duration < 0 || req.Duration > maxCaptureDuration,
+		req.MaxBytes < 0 || req.MaxBytes > maxCaptureBytes:
+		return CaptureInfo{}, ErrInvalidCapture
+	}
+
+	peer, ok := r.GetPeer(req.MemberID)
+	if !ok {
+		return CaptureInfo{}, ErrPeerNotFound
+	}
+
+	c, err := newCapture(r, req, peer.tap)
+	if err != nil {
+		return CaptureInfo{}, err
+	}
+
+	if !peer.tap.active.CompareAndSwap(nil, c) {
+		c.discard()
+		return CaptureInfo{}, ErrCaptureActive
+	}
+
+	c.mux.Lock()
+	c.timer = time.AfterFunc(req.Duration, func() {
+		c.finish(nil)
+	})
+	c.mux.Unlock()
+
+	r.svc.captures.add(c)
+	r.audit(actor, "capture-start", req.MemberID, string(req.Format))
+
+	return c.snapshot(), nil
+}
+
+// Captures lists the captures the SFU still has, newest last.
+func (s *SFU) Captures() []CaptureInfo {
+	return s.svc.captures.list()
+}
+
+// Capture returns a capture by ID.
+func (s *SFU) Capture(id string) (CaptureInfo, error) {
+	c, err := s.svc.captures.get(id)
+	if err != nil {
+		return CaptureInfo{}, err
+	}
+
+	return c.snapshot(), nil
+}
+
+// StopCapture ends a capture early. Stopping an ended capture is a no-op.
+func (s *SFU) StopCapture(id string) (CaptureInfo, error) {
+	c, err := s.svc.captures.get(id)
+	if err != nil {
+		return CaptureInfo{}, err
+	}
+
+	c.finish(nil)
+
+	return c.snapshot(), nil
+}
+
+// OpenCapture opens the file of an ended capture. The caller closes it.
+func (s *SFU) OpenCapture(id string) (*os.File, CaptureInfo, error) {
+	c, err := s.svc.captures.get(id)
+	if err != nil {
+		return nil, CaptureInfo{}, err
+	}
+
+	info := c.snapshot()
+	if info.Status == CaptureRunning {
+		return nil, info, ErrCaptureRunning
+	}
+
+	f, err := os.Open(c.path)
+	if err != nil {
+		return nil, info, err
+	}
+
+	return f, info, nil
+}
+
+// captureRegistry keeps the captures of an SFU, deleting the files of the
+// oldest finished ones beyond captureHistory.
+type captureRegistry struct {
+	mux   sync.RWMutex
+	byID  map[string]*capture
+	order []string
+}
+
+func newCaptureRegistry() *captureRegistry {
+	return &captureRegistry{byID: make(map[string]*capture)}
+}
+
+func (reg *captureRegistry) add(c *capture) {
+	reg.mux.Lock()
+	defer reg.mux.Unlock()
+
+	reg.byID[c.id] = c
+	reg.order = append(reg.order, c.id)
+
+	for i := 0; len(reg.order) > captureHistory && i < len(reg.order); {
+		old := reg.byID[reg.order[i]]
+		if old.snapshot().Status == CaptureRunning {
+			i++
+			continue
+		}
+
+		if err := os.Remove(old.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("Failed to remove capture", slog.String("capture", old.id), slog.String("error", err.Error()))
+		}
+		delete(reg.byID, old.id)
+		reg.order = append(reg.order[:i], reg.order[i+1:]...)
+	}
+}
+
+func (reg *captureRegistry) list() []CaptureInfo {
+	reg.mux.RLock()
+	defer reg.mux.RUnlock()
+
+	infos := make([]CaptureInfo, 0, len(reg.order))
+	for _, id := range reg.order {
+		infos = append(infos, reg.byID[id].snapshot())
+	}
+
+	return infos
+}
+
+func (reg *captureRegistry) get(id string) (*capture, error) {
+	reg.mux.RLock()
+	defer reg.mux.RUnlock()
+
+	c, ok := reg.byID[id]
+	if !ok {
+		return nil, ErrCaptureNotFound
+	}
+
+	return c, nil
+}
+
+// closeAll ends every running capture, e.g. on shutdown.
+func (reg *captureRegistry) closeAll() {
+	reg.mux.RLock()
+	captures := make([]*capture, 0, len(reg.byID))
+	for _, c := range reg.byID {
+		captures = append(captures, c)
+	}
+	reg.mux.RUnlock()
+
+	for _, c := range captures {
+		c.finish(nil)
+	}
+}
+
+// capture writes the packets a captureTap sees to a temporary file until
+// its deadline or size limit.
+type capture struct {
+	id   string
+	path string
+	tap  *captureTap
+
+	mux     sync.Mutex
+	info    CaptureInfo
+	file    *os.File
+	buf     *bufio.Writer
+	counter *countingWriter
+	out     packetWriter
+	timer   *time.Timer
+}
+
+// packetWriter writes one captured packet. data may be shorter than the
+// packet on the wire, which was size bytes long.
+type packetWriter interface {
+	writePacket(at time.Time, inbound, isRTCP bool, data []byte, size int) error
+}
+
+func newCapture(r *Room, req CaptureRequest, tap *captureTap) (*capture, error) {
+	id := uuid.NewString()
+
+	file, err := os.CreateTemp("", "gonference-capture-*")
+	if err != nil {
+		return nil, err
+	}
+
+	c := &capture{
+		id:   id,
+		path: file.Name(),
+		tap:  tap,
+		info: CaptureInfo{
+			ID:        id,
+			Tenant:    r.tenant,
+			Room:      r.id,
+			MemberID:  req.MemberID,
+			Format:    req.Format,
+			Payloads:  req.Payloads,
+			Status:    CaptureRunning,
+			StartedAt: time.Now(),
+			MaxBytes:  req.MaxBytes,
+			Streams:   []CaptureStream{},
+		},
+		file: file,
+	}
+	c.buf = bufio.NewWriter(file)
+	c.counter = &countingWriter{w: c.buf}
+
+	if req.Format == CaptureRTPDump {
+		c.out, err = newRTPDumpWriter(c.counter, c.info.StartedAt)
+	} else {
+		c.out, err = newPcapWriter(c.counter)
+	}
+	if err != nil {
+		c.discard()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// recordRTP captures an RTP packet from its header and payload.
+func (c *capture) recordRTP(inbound bool, header *rtp.Header, payload []byte) {
+	headerSize := header.MarshalSize()
+	size := headerSize + len(payload)
+	if !c.info.Payloads {
+		payload = nil
+	}
+
+	data := make([]byte, headerSize+len(payload))
+	if _, err := header.MarshalTo(data); err != nil {
+		return
+	}
+	copy(data[headerSize:], payload)
+
+	c.record(inbound, false, data, size)
+}
+
+// recordRawRTP captures a marshalled RTP packet.
+func (c *capture) recordRawRTP(inbound bool, raw []byte) {
+	var header rtp.Header
+	n, err := header.Unmarshal(raw)
+	if err != nil || c.info.Payloads {
+		n = len(raw)
+	}
+
+	c.record(inbound, false, raw[:n], len(raw))
+}
+
+func (c *capture) record(inbound, isRTCP bool, data []byte, size int) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.info.Status != CaptureRunning {
+		return
+	}
+
+	if c.counter.n+int64(len(data))+pcapRecordOverhead > c.info.MaxBytes {
+		c.finishLocked(nil)
+		return
+	}
+
+	if err := c.out.writePacket(time.Now(), inbound, isRTCP, data, size); err != nil {
+		c.finishLocked(err)
+		return
+	}
+	c.info.Packets++
+}
+
+// finish ends the capture, failing it when err is set.
+func (c *capture) finish(err error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	c.finishLocked(err)
+}
+
+func (c *capture) finishLocked(err error) {
+	if c.info.Status != CaptureRunning {
+		return
+	}
+
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	c.tap.active.CompareAndSwap(c, nil)
+
+	if flushErr := c.buf.Flush(); err == nil {
+		err = flushErr
+	}
+	if closeErr := c.file.Close(); err == nil {
+		err = closeErr
+	}
+
+	now := time.Now()
+	c.info.EndedAt = &now
+	c.info.Bytes = c.counter.n
+	c.info.Streams = c.tap.streamList()
+	c.info.Status = CaptureDone
+	if err != nil {
+		c.info.Status = CaptureFailed
+		c.info.Error = err.Error()
+	}
+
+	slog.Info(
+		"Capture finished",
+		slog.String("capture", c.id),
+		slog.String("member", c.info.MemberID),
+		slog.String("status", string(c.info.Status)),
+		slog.Uint64("packets", c.info.Packets),
+	)
+}
+
+// discard removes the file of a capture that never started.
+func (c *capture) discard() {
+	_ = c.file.Close()
+	_ = os.Remove(c.path)
+}
+
+func (c *capture) snapshot() CaptureInfo {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	info := c.info
+	if info.Status == CaptureRunning {
+		info.Bytes = c.counter.n
+		info.Streams = c.tap.streamList()
+	}
+
+	return info
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.n += int64(n)
+	return n, err
+}
+
+// captureTap sits first in a peer's interceptor chain, next to the
+// transport, so it sees packets exactly as they go over the wire. It costs
+// one atomic load per packet unless a capture is running.
+type captureTap struct {
+	active atomic.Pointer[capture]
+
+	mux     sync.Mutex
+	streams map[uint32]CaptureStream
+}
+
+func newCaptureTap() *captureTap {
+	return &captureTap{streams: make(map[uint32]CaptureStream)}
+}
+
+// stop ends the running capture, if any.
+func (t *captureTap) stop() {
+	if c := t.active.Load(); c != nil {
+		c.finish(nil)
+	}
+}
+
+func (t *captureTap) addStream(info *interceptor.StreamInfo, direction string) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	t.streams[info.SSRC] = CaptureStream{
+		SSRC:        info.SSRC,
+		Direction:   direction,
+		TrackID:     info.ID,
+		MimeType:    info.MimeType,
+		PayloadType: info.PayloadType,
+	}
+}
+
+func (t *captureTap) streamList() []CaptureStream {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	streams := make([]CaptureStream, 0, len(t.streams))
+	for _, stream := range t.streams {
+		streams = append(streams, stream)
+	}
+	sort.Slice(streams, func(i, j int) bool {
+		return streams[i].SSRC < streams[j].SSRC
+	})
+
+	return streams
+}
+
+// captureFactory adds a peer's captureTap to its interceptor chain.
+type captureFactory struct {
+	tap *captureTap
+}
+
+func (f captureFactory) NewInterceptor(string) (interceptor.Interceptor, error) {
+	return &captureInterceptor{tap: f.tap}, nil
+}
+
+type captureInterceptor struct {
+	interceptor.NoOp
+	tap *captureTap
+}
+
+func (i *captureInterceptor) BindRTCPReader(reader interceptor.RTCPReader) interceptor.RTCPReader {
+	return interceptor.RTCPReaderFunc(func(b []byte, a interceptor.Attributes) (int, interceptor.Attributes, error) {
+		n, a, err := reader.Read(b, a)
+		if c := i.tap.active.Load(); c != nil && err == nil {
+			c.record(true, true, b[:n], n)
+		}
+
+		return n, a, err
+	})
+}
+
+func (i *captureInterceptor) BindRTCPWriter(writer interceptor.RTCPWriter) interceptor.RTCPWriter {
+	return interceptor.RTCPWriterFunc(func(pkts []rtcp.Packet, a interceptor.Attributes) (int, error) {
+		if c := i.tap.active.Load(); c != nil {
+			if raw, err := rtcp.Marshal(pkts); err == nil {
+				c.record(false, true, raw, len(raw))
+			}
+		}
+
+		return writer.Write(pkts, a)
+	})
+}
+
+func (i *captureInterceptor) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	i.tap.addStream(info, CaptureOutbound)
+
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, a interceptor.Attributes) (int, error) {
+		if c := i.tap.active.Load(); c != nil {
+			c.recordRTP(false, header, payload)
+		}
+
+		return writer.Write(header, payload, a)
+	})
+}
+
+func (i *captureInterceptor) BindRemoteStream(info *interceptor.StreamInfo, reader interceptor.RTPReader) interceptor.RTPReader {
+	i.tap.addStream(info, CaptureInbound)
+
+	return interceptor.RTPReaderFunc(func(b []byte, a interceptor.Attributes) (int, interceptor.Attributes, error) {
+		n, a, err := reader.Read(b, a)
+		if c := i.tap.active.Load(); c != nil && err == nil {
+			c.recordRawRTP(true, b[:n])
+		}
+
+		return n, a, err
+	})
+}
+
+const (
+	pcapLinkTypeRaw = 101
+	pcapSnapLen     = 65535
+	// pcapRecordOverhead is the record header plus the synthetic IPv4 and
+	// UDP headers in front of every packet.
+	pcapRecordOverhead = 16 + 20 + 8
+)
+
+type pcapWriter struct {
+	w io.Writer
+}
+
+func newPcapWriter(w io.Writer) (*pcapWriter, error) {
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(header[20:], pcapLinkTypeRaw)
+
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+
+	return &pcapWriter{w: w}, nil
+}
+
+func (p *pcapWriter) writePacket(at time.Time, inbound, _ bool, data []byte, size int) error {
+	src, dst := captureSFUAddr, captureMemberAddr
+	if inbound {
+		src, dst = dst, src
+	}
+
+	record := make([]byte, pcapRecordOverhead+len(data))
+	binary.LittleEndian.PutUint32(record[0:], uint32(at.Unix()))
+	binary.LittleEndian.PutUint32(record[4:], uint32(at.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(record[8:], uint32(28+len(data)))
+	binary.LittleEndian.PutUint32(record[12:], uint32(28+size))
+
+	ip := record[16:36]
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(28+size))
+	ip[8] = 64
+	ip[9] = 17
+	copy(ip[12:], src)
+	copy(ip[16:], dst)
+	binary.BigEndian.PutUint16(ip[10:], ipChecksum(ip))
+
+	udp := record[36:44]
+	binary.BigEndian.PutUint16(udp[0:], capturePort)
+	binary.BigEndian.PutUint16(udp[2:], capturePort)
+	binary.BigEndian.PutUint16(udp[4:], uint16(8+size))
+
+	copy(record[44:], data)
+
+	_, err := p.w.Write(record)
+	return err
+}
+
+func ipChecksum(header []byte) uint16 {
+	var sum uint32
+	for i := 0; i < len(header); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(header[i:]))
+	}
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+
+	return ^uint16(sum)
+}
+
+type rtpDumpWriter struct {
+	w     *rtpdump.Writer
+	start time.Time
+}
+
+func newRTPDumpWriter(w io.Writer, start time.Time) (*rtpDumpWriter, error) {
+	dump, err := rtpdump.NewWriter(w, rtpdump.Header{
+		Start:  start,
+		Source: captureMemberAddr,
+		Port:   capturePort,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &rtpDumpWriter{w: dump, start: start}, nil
+}
+
+func (d *rtpDumpWriter) writePacket(at time.Time, _, isRTCP bool, data []byte, _ int) error {
+	return d.w.WritePacket(rtpdump.Packet{
+		Offset:  at.Sub(d.start),
+		IsRTCP:  isRTCP,
+		Payload: data,
+	})
+}
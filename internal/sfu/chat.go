@@ -0,0 +1,174 @@
+package sfu
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"gonference/internal/chat"
+	"gonference/internal/config"
+
+	"github.com/google/uuid"
+)
+
+// Data message types handled by the room's chat instead of being relayed
+// verbatim.
+const (
+	chatMsgType       = "chat"
+	chatEditMsgType   = "chat-edit"
+	chatDeleteMsgType = "chat-delete"
+)
+
+var ErrChatForbidden = errors.New("only the author or a moderator may change a message")
+
+type chatPayload struct {
+	ID   string `json:"id,omitempty"`
+	Text string `json:"text"`
+}
+
+func newChatStore(cfg config.SFU) (chat.Store, error) {
+	switch cfg.ChatStore {
+	case "", "memory":
+		return chat.NewMemoryStore(), nil
+	case "file":
+		return chat.NewFileStore(cfg.ChatDir)
+	default:
+		return nil, fmt.Errorf("unknown chat store %q", cfg.ChatStore)
+	}
+}
+
+// ChatHistory returns a room's full chat history. It stays available after
+// the meeting ends and the room is closed.
+func (s *SFU) ChatHistory(tenant, id string) ([]chat.Message, error) {
+	return s.svc.chat.All(roomKey(tenant, id))
+}
+
+// DeleteChatMessage removes a message's text on behalf of actor, who must be
+// its author or a moderator unless it is the API.
+func (r *Room) DeleteChatMessage(actor string, moderator bool, id string) (chat.Message, error) {
+	msg, err := r.svc.chat.Get(r.storageKey(), id)
+	if err != nil {
+		return chat.Message{}, err
+	}
+
+	if msg.Author != actor && !moderator {
+		return chat.Message{}, ErrChatForbidden
+	}
+
+	msg, err = r.svc.chat.Delete(r.storageKey(), id, time.Now())
+	if err != nil {
+		return chat.Message{}, err
+	}
+
+	r.broadcastChat(chatDeleteMsgType, msg)
+
+	return msg, nil
+}
+
+// isChat reports whether a data message belongs to the room chat. Messages
+// addressed to a member or role are private and relayed without storing.
+func isChat(msg DataMessage) bool {
+	if msg.To != "" || msg.Role != "" {
+		return false
+	}
+
+	switch msg.Type {
+	case chatMsgType, chatEditMsgType, chatDeleteMsgType:
+		return true
+	}
+
+	return false
+}
+
+// handleChat stores a chat message, edit or delete and broadcasts the
+// resulting message to everyone in the room, the author included, so they
+// learn its ID.
+func (r *Room) handleChat(from *Peer, msg DataMessage) error {
+	var payload chatPayload
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+		return errDataMalformed
+	}
+
+	switch msg.Type {
+	case chatMsgType:
+		stored := chat.Message{
+			ID:     uuid.NewString(),
+			Author: from.ID(),
+			Text:   payload.Text,
+			SentAt: time.Now(),
+		}
+		if err := r.svc.chat.Append(r.storageKey(), stored); err != nil {
+			return err
+		}
+
+		r.broadcastChat(chatMsgType, stored)
+	case chatEditMsgType:
+		current, err := r.svc.chat.Get(r.storageKey(), payload.ID)
+		if err != nil {
+			return err
+		}
+
+		if current.Author != from.ID() && !from.IsModerator() {
+			return ErrChatForbidden
+		}
+		if current.Deleted {
+			return chat.ErrDeleted
+		}
+
+		edited, err := r.svc.chat.Edit(r.storageKey(), payload.ID, payload.Text, time.Now())
+		if err != nil {
+			return err
+		}
+
+		r.broadcastChat(chatEditMsgType, edited)
+	case chatDeleteMsgType:
+		if _, err := r.DeleteChatMessage(from.ID(), from.IsModerator(), payload.ID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *Room) broadcastChat(msgType string, msg chat.Message) {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		slog.Error("Failed to marshal chat message", slog.String("error", err.Error()))
+		return
+	}
+
+	r.mux.RLock()
+	peers := r.peerList(nil)
+	r.mux.RUnlock()
+
+	for _, peer := range peers {
+		err := peer.SendData(ReliableChannel, DataMessage{
+			From:    msg.Author,
+			Type:    msgType,
+			Payload: payload,
+		})
+		if err != nil {
+			peer.logger.Error("Failed to send chat message", slog.String("error", err.Error()))
+		}
+	}
+}
+
+// replayChat sends a joining member the most recent chat messages. It goes
+// over signaling because the data channels are not open yet.
+func (r *Room) replayChat(peer *Peer) {
+	if r.svc.chatReplay <= 0 {
+		return
+	}
+
+	msgs, err := r.svc.chat.Last(r.storageKey(), r.svc.chatReplay)
+	if err != nil {
+		peer.logger.Error("Failed to load chat history", slog.String("error", err.Error()))
+		return
+	}
+
+	if err := peer.send("chat-history", map[string]any{"messages": msgs}); err != nil {
+		peer.logger.Error("Failed to send chat history", slog.String("error", err.Error()))
+	}
+}
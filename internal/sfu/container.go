@@ -0,0 +1,401 @@
+package sfu
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"sync"
+	"time"
+)
+
+// frameWriter stores depacketized frames. pts is the frame's time since the
+// start of its track.
+type frameWriter interface {
+	writeFrame(frame []byte, pts time.Duration, keyframe bool) error
+	Close() error
+}
+
+// ivfFile writes VP8 or VP9 frames to an IVF file with a millisecond
+// timebase, so frame times survive the way RTP timestamps carried them.
+type ivfFile struct {
+	w      io.WriteCloser
+	frames uint32
+}
+
+func newIVFFile(w io.WriteCloser, fourcc string, width, height uint16) (*ivfFile, error) {
+	header := make([]byte, 32)
+	copy(header[0:], "DKIF")
+	binary.LittleEndian.PutUint16(header[6:], 32)
+	copy(header[8:], fourcc)
+	binary.LittleEndian.PutUint16(header[12:], width)
+	binary.LittleEndian.PutUint16(header[14:], height)
+	binary.LittleEndian.PutUint32(header[16:], 1000)
+	binary.LittleEndian.PutUint32(header[20:], 1)
+
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+
+	return &ivfFile{w: w}, nil
+}
+
+func (f *ivfFile) writeFrame(frame []byte, pts time.Duration, _ bool) error {
+	header := make([]byte, 12)
+	binary.LittleEndian.PutUint32(header[0:], uint32(len(frame)))
+	binary.LittleEndian.PutUint64(header[4:], uint64(pts.Milliseconds()))
+
+	if _, err := f.w.Write(header); err != nil {
+		return err
+	}
+	if _, err := f.w.Write(frame); err != nil {
+		return err
+	}
+	f.frames++
+
+	return nil
+}
+
+// Close patches the frame count when the output can seek.
+func (f *ivfFile) Close() error {
+	if ws, ok := f.w.(io.WriteSeeker); ok {
+		if _, err := ws.Seek(24, io.SeekStart); err == nil {
+			_ = binary.Write(ws, binary.LittleEndian, f.frames)
+		}
+	}
+
+	return f.w.Close()
+}
+
+// WebM element IDs used by webmFile.
+const (
+	ebmlHeaderID        = 0x1A45DFA3
+	ebmlVersionID       = 0x4286
+	ebmlReadVersionID   = 0x42F7
+	ebmlMaxIDLengthID   = 0x42F2
+	ebmlMaxSizeLengthID = 0x42F3
+	ebmlDocTypeID       = 0x4282
+	ebmlDocTypeVerID    = 0x4287
+	ebmlDocTypeReadID   = 0x4285
+	segmentID           = 0x18538067
+	infoID              = 0x1549A966
+	timecodeScaleID     = 0x2AD7B1
+	muxingAppID         = 0x4D80
+	writingAppID        = 0x5741
+	tracksID            = 0x1654AE6B
+	trackEntryID        = 0xAE
+	trackNumberID       = 0xD7
+	trackUIDID          = 0x73C5
+	trackTypeID         = 0x83
+	codecIDID           = 0x86
+	codecPrivateID      = 0x63A2
+	videoID             = 0xE0
+	pixelWidthID        = 0xB0
+	pixelHeightID       = 0xBA
+	audioID             = 0xE1
+	samplingFreqID      = 0xB5
+	channelsID          = 0x9F
+	clusterID           = 0x1F43B675
+	clusterTimecodeID   = 0xE7
+	simpleBlockID       = 0xA3
+)
+
+const (
+	webmVideoTrack = 1
+	webmAudioTrack = 2
+
+	// webmClusterSpan keeps block timecodes, which are relative to their
+	// cluster, well inside int16 milliseconds.
+	webmClusterSpan = 10 * time.Second
+
+	// webmVideoWait is how long audio is held back for the video track to
+	// attach and fix the video codec of the header. A member without a
+	// camera gets a VP8 track that stays empty.
+	webmVideoWait = 3 * time.Second
+)
+
+// webmFile muxes one member's camera and microphone into a single WebM
+// stream. The segment and clusters have unknown sizes so the file can be
+// written front to back. Both tracks are declared up front; one that never
+// receives frames is simply empty.
+type webmFile struct {
+	mux         sync.Mutex
+	w           io.WriteCloser
+	videoCodec  string
+	wroteHeader bool
+	cluster     time.Duration
+	hasCluster  bool
+	err         error
+
+	// pending holds audio frames written before the video codec is known.
+	pending []webmFrame
+}
+
+type webmFrame struct {
+	data []byte
+	at   time.Duration
+}
+
+func newWebMFile(w io.WriteCloser) *webmFile {
+	return &webmFile{w: w}
+}
+
+// claimVideo sets the video codec, "VP80" or "VP90", unless the file has one
+// already. It reports whether a video track of that codec fits the file.
+func (f *webmFile) claimVideo(fourcc string) bool {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	if f.videoCodec == "" && !f.wroteHeader {
+		f.videoCodec = fourcc
+	}
+
+	return f.videoCodec == fourcc
+}
+
+// track returns a frameWriter for one of the file's tracks. offset is when
+// the track started relative to the file's first frame.
+func (f *webmFile) track(number uint64, offset time.Duration) frameWriter {
+	return &webmTrack{file: f, number: number, offset: offset}
+}
+
+func (f *webmFile) write(number uint64, frame []byte, at time.Duration, keyframe bool) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	if f.err != nil {
+		return f.err
+	}
+
+	if !f.wroteHeader {
+		if number == webmAudioTrack && f.videoCodec == "" && at < webmVideoWait {
+			f.pending = append(f.pending, webmFrame{data: frame, at: at})
+			return nil
+		}
+
+		width, height := uint64(640), uint64(480)
+		if number == webmVideoTrack {
+			if w, h, ok := vp8Dimensions(frame); ok {
+				width, height = uint64(w), uint64(h)
+			}
+		}
+
+		if err := f.start(width, height); err != nil {
+			return err
+		}
+	}
+
+	return f.writeBlock(number, frame, at, keyframe)
+}
+
+// start writes the header and the audio held back for it. Callers hold
+// f.mux.
+func (f *webmFile) start(width, height uint64) error {
+	if f.videoCodec == "" {
+		f.videoCodec = "VP80"
+	}
+	if f.err = f.writeHeader(width, height); f.err != nil {
+		return f.err
+	}
+	f.wroteHeader = true
+
+	pending := f.pending
+	f.pending = nil
+	for _, p := range pending {
+		if err := f.writeBlock(webmAudioTrack, p.data, p.at, false); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeBlock writes a frame once the header is out. Callers hold f.mux.
+func (f *webmFile) writeBlock(number uint64, frame []byte, at time.Duration, keyframe bool) error {
+
+	// Start clusters on video keyframes so players can seek to them.
+	newCluster := !f.hasCluster ||
+		at-f.cluster > webmClusterSpan ||
+		at < f.cluster-webmClusterSpan ||
+		(keyframe && number == webmVideoTrack && at > f.cluster)
+	if newCluster {
+		f.cluster = max(at, 0)
+		f.hasCluster = true
+
+		var cluster []byte
+		cluster = ebmlID(cluster, clusterID)
+		cluster = append(cluster, 0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF)
+		cluster = ebmlUint(cluster, clusterTimecodeID, uint64(f.cluster.Milliseconds()))
+		if _, f.err = f.w.Write(cluster); f.err != nil {
+			return f.err
+		}
+	}
+
+	flags := byte(0)
+	if keyframe || number == webmAudioTrack {
+		flags = 0x80
+	}
+
+	block := make([]byte, 0, len(frame)+4)
+	block = append(block, 0x80|byte(number))
+	block = binary.BigEndian.AppendUint16(block, uint16(int16((at - f.cluster).Milliseconds())))
+	block = append(block, flags)
+	block = append(block, frame...)
+
+	_, f.err = f.w.Write(ebmlElement(nil, simpleBlockID, block))
+
+	return f.err
+}
+
+func (f *webmFile) writeHeader(width, height uint64) error {
+	var header []byte
+	header = ebmlElement(header, ebmlHeaderID, concat(
+		ebmlUint(nil, ebmlVersionID, 1),
+		ebmlUint(nil, ebmlReadVersionID, 1),
+		ebmlUint(nil, ebmlMaxIDLengthID, 4),
+		ebmlUint(nil, ebmlMaxSizeLengthID, 8),
+		ebmlElement(nil, ebmlDocTypeID, []byte("webm")),
+		ebmlUint(nil, ebmlDocTypeVerID, 4),
+		ebmlUint(nil, ebmlDocTypeReadID, 2),
+	))
+
+	header = ebmlID(header, segmentID)
+	header = append(header, 0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF)
+
+	header = ebmlElement(header, infoID, concat(
+		ebmlUint(nil, timecodeScaleID, uint64(time.Millisecond)),
+		ebmlElement(nil, muxingAppID, []byte("gonference")),
+		ebmlElement(nil, writingAppID, []byte("gonference")),
+	))
+
+	codec := "V_VP8"
+	if f.videoCodec == "VP90" {
+		codec = "V_VP9"
+	}
+
+	header = ebmlElement(header, tracksID, concat(
+		ebmlElement(nil, trackEntryID, concat(
+			ebmlUint(nil, trackNumberID, webmVideoTrack),
+			ebmlUint(nil, trackUIDID, webmVideoTrack),
+			ebmlUint(nil, trackTypeID, 1),
+			ebmlElement(nil, codecIDID, []byte(codec)),
+			ebmlElement(nil, videoID, concat(
+				ebmlUint(nil, pixelWidthID, width),
+				ebmlUint(nil, pixelHeightID, height),
+			)),
+		)),
+		ebmlElement(nil, trackEntryID, concat(
+			ebmlUint(nil, trackNumberID, webmAudioTrack),
+			ebmlUint(nil, trackUIDID, webmAudioTrack),
+			ebmlUint(nil, trackTypeID, 2),
+			ebmlElement(nil, codecIDID, []byte("A_OPUS")),
+			ebmlElement(nil, codecPrivateID, opusHead(2, 48000)),
+			ebmlElement(nil, audioID, concat(
+				ebmlFloat(nil, samplingFreqID, 48000),
+				ebmlUint(nil, channelsID, 2),
+			)),
+		)),
+	))
+
+	_, err := f.w.Write(header)
+	return err
+}
+
+func (f *webmFile) Close() error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	// A short recording may not have got past holding its audio back.
+	var err error
+	if f.err == nil && !f.wroteHeader && len(f.pending) > 0 {
+		err = f.start(640, 480)
+	}
+
+	return errors.Join(err, f.w.Close())
+}
+
+type webmTrack struct {
+	file   *webmFile
+	number uint64
+	offset time.Duration
+}
+
+func (t *webmTrack) writeFrame(frame []byte, pts time.Duration, keyframe bool) error {
+	return t.file.write(t.number, frame, t.offset+pts, keyframe)
+}
+
+// Close is a no-op; the file is closed once every track has finished.
+func (t *webmTrack) Close() error {
+	return nil
+}
+
+// vp8Dimensions reads the frame size from a VP8 keyframe header.
+func vp8Dimensions(frame []byte) (uint16, uint16, bool) {
+	if len(frame) < 10 || frame[0]&0x01 != 0 || frame[3] != 0x9D || frame[4] != 0x01 || frame[5] != 0x2A {
+		return 0, 0, false
+	}
+
+	width := binary.LittleEndian.Uint16(frame[6:]) & 0x3FFF
+	height := binary.LittleEndian.Uint16(frame[8:]) & 0x3FFF
+
+	return width, height, true
+}
+
+// opusHead is the Opus identification header used as codec private data.
+func opusHead(channels uint8, sampleRate uint32) []byte {
+	head := make([]byte, 19)
+	copy(head, "OpusHead")
+	head[8] = 1
+	head[9] = channels
+	binary.LittleEndian.PutUint16(head[10:], 312)
+	binary.LittleEndian.PutUint32(head[12:], sampleRate)
+
+	return head
+}
+
+func ebmlID(b []byte, id uint32) []byte {
+	switch {
+	case id >= 1<<24:
+		return append(b, byte(id>>24), byte(id>>16), byte(id>>8), byte(id))
+	case id >= 1<<16:
+		return append(b, byte(id>>16), byte(id>>8), byte(id))
+	case id >= 1<<8:
+		return append(b, byte(id>>8), byte(id))
+	default:
+		return append(b, byte(id))
+	}
+}
+
+// ebmlSize encodes n as an 8-byte EBML variable size integer.
+func ebmlSize(b []byte, n uint64) []byte {
+	return binary.BigEndian.AppendUint64(b, n|1<<56)
+}
+
+func ebmlElement(b []byte, id uint32, data []byte) []byte {
+	b = ebmlID(b, id)
+	b = ebmlSize(b, uint64(len(data)))
+
+	return append(b, data...)
+}
+
+func ebmlUint(b []byte, id uint32, v uint64) []byte {
+	data := binary.BigEndian.AppendUint64(nil, v)
+	for len(data) > 1 && data[0] == 0 {
+		data = data[1:]
+	}
+
+	return ebmlElement(b, id, data)
+}
+
+func ebmlFloat(b []byte, id uint32, v float64) []byte {
+	return ebmlElement(b, id, binary.BigEndian.AppendUint64(nil, math.Float64bits(v)))
+}
+
+func concat(parts ...[]byte) []byte {
+	var out []byte
+	for _, part := range parts {
+		out = append(out, part...)
+	}
+
+	return out
+}
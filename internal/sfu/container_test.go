@@ -0,0 +1,88 @@
+package sfu
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+type bufferCloser struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (b *bufferCloser) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestWebMVideoCodecFromVideoTrack(t *testing.T) {
+	var out bufferCloser
+	f := newWebMFile(&out)
+
+	// The microphone attaches and sends first, the VP9 camera after.
+	audio := f.track(webmAudioTrack, 0)
+	if err := audio.writeFrame([]byte{0xf8}, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	if out.Len() != 0 {
+		t.Fatal("header written before the video codec was known")
+	}
+
+	if !f.claimVideo("VP90") {
+		t.Fatal("first video track was refused")
+	}
+	if f.claimVideo("VP80") {
+		t.Fatal("a second video codec was accepted")
+	}
+
+	video := f.track(webmVideoTrack, 20*time.Millisecond)
+	if err := video.writeFrame([]byte{0x00, 0x01}, 0, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data := out.Bytes()
+	if !bytes.Contains(data, []byte("V_VP9")) || bytes.Contains(data, []byte("V_VP8")) {
+		t.Fatal("header does not declare VP9")
+	}
+	if n := bytes.Count(data, []byte{simpleBlockID}); n < 2 {
+		t.Fatalf("found %d blocks, want the held back audio and the video", n)
+	}
+}
+
+func TestWebMAudioOnly(t *testing.T) {
+	var out bufferCloser
+	f := newWebMFile(&out)
+
+	audio := f.track(webmAudioTrack, 0)
+	if err := audio.writeFrame([]byte{0xf8}, 0, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Past the wait the header goes out without a camera.
+	if err := audio.writeFrame([]byte{0xf8}, webmVideoWait, false); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(out.Bytes(), []byte("A_OPUS")) {
+		t.Fatal("no header after the wait")
+	}
+	if f.claimVideo("VP90") {
+		t.Fatal("a camera of another codec fit a file already started")
+	}
+
+	// A recording shorter than the wait is written on close.
+	var short bufferCloser
+	f = newWebMFile(&short)
+	if err := f.track(webmAudioTrack, 0).writeFrame([]byte{0xf8}, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !short.closed || !bytes.Contains(short.Bytes(), []byte("A_OPUS")) {
+		t.Fatal("short recording was not written")
+	}
+}
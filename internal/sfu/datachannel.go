@@ -0,0 +1,207 @@
+package sfu
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// Labels of the SFU-terminated data channels every peer gets. FileChannel
+// carries shared file chunks; see files.go.
+const (
+	ReliableChannel   = "room-reliable"
+	UnreliableChannel = "room-unreliable"
+	FileChannel       = "room-files"
+)
+
+const (
+	maxDataMessageSize = 16 * 1024
+
+	reliableRate     = 20
+	reliableBurst    = 40
+	unreliableRate   = 60
+	unreliableBurst  = 120
+	dataErrorMsgType = "error"
+)
+
+var (
+	errDataTooLarge    = errors.New("message too large")
+	errDataRateLimit   = errors.New("rate limit exceeded")
+	errDataMalformed   = errors.New("malformed message")
+	errDataNoRecipient = errors.New("recipient not found")
+)
+
+// DataMessage is the envelope relayed between members over the room data
+// channels. To addresses a single member and Role every member holding that
+// role; with neither set the message is broadcast. From is always set by the
+// SFU to the sender.
+type DataMessage struct {
+	From    string          `json:"from"`
+	To      string          `json:"to,omitempty"`
+	Role    Role            `json:"role,omitempty"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// dataChannel is one SFU-terminated channel of a peer with its send-side
+// rate limit.
+type dataChannel struct {
+	dc      *webrtc.DataChannel
+	limiter *rateLimiter
+	// drained is signalled when the send buffer falls below
+	// fileLowWatermark.
+	drained chan struct{}
+}
+
+// openDataChannels creates the reliable, unreliable and file channels. They
+// are negotiated with the offer the SFU sends after answering the join.
+func (p *Peer) openDataChannels() error {
+	ordered := false
+	maxRetransmits := uint16(0)
+
+	specs := []struct {
+		label string
+		init  *webrtc.DataChannelInit
+		rate  float64
+		burst float64
+	}{
+		{ReliableChannel, nil, reliableRate, reliableBurst},
+		{UnreliableChannel, &webrtc.DataChannelInit{Ordered: &ordered, MaxRetransmits: &maxRetransmits}, unreliableRate, unreliableBurst},
+		{FileChannel, nil, fileChunkRate, fileChunkBurst},
+	}
+
+	for _, spec := range specs {
+		dc, err := p.conn.CreateDataChannel(spec.label, spec.init)
+		if err != nil {
+			return err
+		}
+
+		channel := &dataChannel{
+			dc:      dc,
+			limiter: newRateLimiter(spec.rate, spec.burst),
+			drained: make(chan struct{}, 1),
+		}
+		dc.SetBufferedAmountLowThreshold(fileLowWatermark)
+		dc.OnBufferedAmountLow(func() {
+			select {
+			case channel.drained <- struct{}{}:
+			default:
+			}
+		})
+		label := spec.label
+		dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+			p.onDataMessage(label, channel, msg)
+		})
+
+		p.channels[label] = channel
+	}
+
+	return nil
+}
+
+func (p *Peer) onDataMessage(label string, channel *dataChannel, msg webrtc.DataChannelMessage) {
+	relay := p.Room().relayData
+	if label == FileChannel {
+		relay = p.Room().relayFileChunk
+	}
+
+	if err := relay(p, label, channel, msg); err != nil {
+		p.logger.Warn("Data message dropped", slog.String("channel", label), slog.String("error", err.Error()))
+		p.sendDataError(label, err)
+	}
+}
+
+// SendData writes a message to the peer on the channel with label. Messages
+// for a channel that is not open yet are dropped.
+func (p *Peer) SendData(label string, msg DataMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	return p.sendRawData(label, data)
+}
+
+func (p *Peer) sendRawData(label string, data []byte) error {
+	channel, ok := p.channels[label]
+	if !ok || channel.dc.ReadyState() != webrtc.DataChannelStateOpen {
+		return nil
+	}
+
+	return channel.dc.SendText(string(data))
+}
+
+func (p *Peer) sendDataError(label string, reason error) {
+	payload, _ := json.Marshal(map[string]string{"reason": reason.Error()})
+
+	err := p.SendData(label, DataMessage{Type: dataErrorMsgType, Payload: payload})
+	if err != nil {
+		p.logger.Error("Failed to send data error", slog.String("error", err.Error()))
+	}
+}
+
+// relayData validates a message received from a member and routes it to its
+// recipients on the same kind of channel it arrived on.
+func (r *Room) relayData(from *Peer, label string, channel *dataChannel, raw webrtc.DataChannelMessage) error {
+	if len(raw.Data) > maxDataMessageSize {
+		return errDataTooLarge
+	}
+
+	if !channel.limiter.Allow() {
+		return errDataRateLimit
+	}
+
+	var msg DataMessage
+	if err := json.Unmarshal(raw.Data, &msg); err != nil || msg.Type == "" {
+		return errDataMalformed
+	}
+	msg.From = from.ID()
+
+	if label == ReliableChannel && isChat(msg) {
+		return r.handleChat(from, msg)
+	}
+
+	if label == ReliableChannel && msg.Type == stateMsgType && msg.To == "" && msg.Role == "" {
+		return r.handleStateMessage(from, msg)
+	}
+
+	return r.routeData(from, label, msg)
+}
+
+// routeData delivers msg to its recipients in the room.
+func (r *Room) routeData(from *Peer, label string, msg DataMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	r.mux.RLock()
+	var recipients []*Peer
+	switch {
+	case msg.To != "":
+		if peer, ok := r.peers[msg.To]; ok && peer != from {
+			recipients = append(recipients, peer)
+		}
+	default:
+		for _, peer := range r.peerList(from) {
+			if msg.Role == "" || peer.Role() == msg.Role {
+				recipients = append(recipients, peer)
+			}
+		}
+	}
+	r.mux.RUnlock()
+
+	if msg.To != "" && len(recipients) == 0 {
+		return errDataNoRecipient
+	}
+
+	for _, peer := range recipients {
+		if err := peer.sendRawData(label, data); err != nil {
+			peer.logger.Error("Failed to relay data message", slog.String("error", err.Error()))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,415 @@
+package sfu
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+var (
+	ErrEgressNotFound = errors.New("egress not found")
+	ErrInvalidEgress  = errors.New("invalid egress")
+	ErrEgressDenied   = errors.New("egress host is not allowed")
+)
+
+// EgressRequest forwards a member's microphone and camera as plain RTP over
+// UDP, audio to AudioPort and video to VideoPort of Host. A zero port leaves
+// that kind out. Host must be one of the SFU's egress hosts.
+type EgressRequest struct {
+	MemberID  string `json:"memberId"`
+	Host      string `json:"host"`
+	AudioPort int    `json:"audioPort,omitempty"`
+	VideoPort int    `json:"videoPort,omitempty"`
+}
+
+// EgressInfo describes a running egress. SDP describes its streams for the
+// receiver, e.g. ffmpeg -protocol_whitelist file,udp,rtp -i egress.sdp.
+type EgressInfo struct {
+	ID        string             `json:"id"`
+	MemberID  string             `json:"memberId"`
+	Host      string             `json:"host"`
+	AudioPort int                `json:"audioPort,omitempty"`
+	VideoPort int                `json:"videoPort,omitempty"`
+	StartedAt time.Time          `json:"startedAt"`
+	Tracks    []EgressTrackStats `json:"tracks"`
+	SDP       string             `json:"sdp"`
+}
+
+// EgressTrackStats reports a track an egress is sending.
+type EgressTrackStats struct {
+	TrackID  string `json:"trackId"`
+	Kind     string `json:"kind"`
+	MimeType string `json:"mimeType"`
+	Packets  uint64 `json:"packets"`
+}
+
+// StartEgress forwards a member's current and future tracks until
+// StopEgress, the member leaving, or Close. Only the first track of each
+// kind is sent; screen shares never are.
+func (r *Room) StartEgress(actor string, req EgressRequest) (EgressInfo, error) {
+	if req.MemberID == "" || req.Host == "" || (req.AudioPort == 0 && req.VideoPort == 0) || req.AudioPort == req.VideoPort ||
+		req.AudioPort < 0 || req.AudioPort > 65535 || req.VideoPort < 0 || req.VideoPort > 65535 {
+		return EgressInfo{}, ErrInvalidEgress
+	}
+
+	if !slices.ContainsFunc(r.svc.egressHosts, func(host string) bool { return strings.EqualFold(host, req.Host) }) {
+		return EgressInfo{}, ErrEgressDenied
+	}
+
+	addr, err := net.ResolveIPAddr("ip", req.Host)
+	if err != nil {
+		return EgressInfo{}, ErrInvalidEgress
+	}
+
+	r.mux.Lock()
+	_, isPeer := r.peers[req.MemberID]
+	_, isPublisher := r.publishers[req.MemberID]
+	if !isPeer && !isPublisher {
+		r.mux.Unlock()
+		return EgressInfo{}, ErrPeerNotFound
+	}
+
+	e := newEgress(req, addr.IP)
+	r.egresses[e.id] = e
+	forwarders := r.forwarderList(nil)
+	r.mux.Unlock()
+
+	for _, forwarder := range forwarders {
+		e.attach(forwarder)
+	}
+
+	r.audit(actor, "egress-start", req.MemberID, addr.String())
+
+	return e.info(), nil
+}
+
+// StopEgress stops sending a member's tracks.
+func (r *Room) StopEgress(actor, id string) error {
+	r.mux.Lock()
+	e, ok := r.egresses[id]
+	delete(r.egresses, id)
+	r.mux.Unlock()
+
+	if !ok {
+		return ErrEgressNotFound
+	}
+
+	e.stop()
+	if actor != systemActor {
+		r.audit(actor, "egress-stop", e.memberID, e.id)
+	}
+
+	return nil
+}
+
+// Egresses lists the room's running egresses.
+func (r *Room) Egresses() []EgressInfo {
+	r.mux.RLock()
+	egresses := r.egressList()
+	r.mux.RUnlock()
+
+	infos := make([]EgressInfo, 0, len(egresses))
+	for _, e := range egresses {
+		infos = append(infos, e.info())
+	}
+
+	return infos
+}
+
+// Egress returns one of the room's running egresses.
+func (r *Room) Egress(id string) (EgressInfo, error) {
+	r.mux.RLock()
+	e, ok := r.egresses[id]
+	r.mux.RUnlock()
+
+	if !ok {
+		return EgressInfo{}, ErrEgressNotFound
+	}
+
+	return e.info(), nil
+}
+
+// egressList returns the room's egresses. Callers hold r.mux.
+func (r *Room) egressList() []*egress {
+	egresses := make([]*egress, 0, len(r.egresses))
+	for _, e := range r.egresses {
+		egresses = append(egresses, e)
+	}
+
+	return egresses
+}
+
+// stopMemberEgresses stops the egresses of a member who left the room.
+func (r *Room) stopMemberEgresses(memberID string) {
+	r.mux.RLock()
+	var ids []string
+	for id, e := range r.egresses {
+		if e.memberID == memberID {
+			ids = append(ids, id)
+		}
+	}
+	r.mux.RUnlock()
+
+	for _, id := range ids {
+		if err := r.StopEgress(systemActor, id); err != nil && !errors.Is(err, ErrEgressNotFound) {
+			slog.Error("Failed to stop egress", slog.String("egress", id), slog.String("error", err.Error()))
+		}
+	}
+}
+
+// egress sends one member's tracks to a UDP host. Each kind has one slot,
+// taken by the first track of that kind and freed when its sink closes.
+type egress struct {
+	id        string
+	memberID  string
+	host      string
+	ip        net.IP
+	audioPort int
+	videoPort int
+	startedAt time.Time
+
+	mux      sync.Mutex
+	stopped  bool
+	slots    map[webrtc.RTPCodecType]*udpSink
+	attached map[string]*TrackForwarder
+}
+
+func newEgress(req EgressRequest, ip net.IP) *egress {
+	return &egress{
+		id:        uuid.NewString(),
+		memberID:  req.MemberID,
+		host:      req.Host,
+		ip:        ip,
+		audioPort: req.AudioPort,
+		videoPort: req.VideoPort,
+		startedAt: time.Now(),
+		slots:     make(map[webrtc.RTPCodecType]*udpSink),
+		attached:  make(map[string]*TrackForwarder),
+	}
+}
+
+func (e *egress) sinkID() string {
+	return "egress:" + e.id
+}
+
+func (e *egress) port(kind webrtc.RTPCodecType) int {
+	if kind == webrtc.RTPCodecTypeAudio {
+		return e.audioPort
+	}
+
+	return e.videoPort
+}
+
+// attach sends forwarder when it is the member's and its kind's slot is
+// free.
+func (e *egress) attach(forwarder *TrackForwarder) {
+	kind := forwarder.Kind()
+	if forwarder.peer.ID() != e.memberID || forwarder.Source() == SourceScreen || e.port(kind) == 0 {
+		return
+	}
+
+	codec, ok := registeredCodec(forwarder.remote.Codec().MimeType)
+	if !ok {
+		return
+	}
+
+	e.mux.Lock()
+	defer e.mux.Unlock()
+
+	if e.stopped || e.slots[kind] != nil {
+		return
+	}
+
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: e.ip, Port: e.port(kind)})
+	if err != nil {
+		slog.Error("Failed to open egress", slog.String("egress", e.id), slog.String("error", err.Error()))
+		return
+	}
+
+	sink := &udpSink{
+		egress:      e,
+		kind:        kind,
+		trackID:     forwarder.ID(),
+		mimeType:    codec.MimeType,
+		payloadType: uint8(codec.PayloadType),
+		conn:        conn,
+	}
+	if err := forwarder.AddSink(e.sinkID(), sink); err != nil {
+		_ = conn.Close()
+		return
+	}
+
+	e.slots[kind] = sink
+	e.attached[forwarder.ID()] = forwarder
+}
+
+// detach stops sending forwarder, e.g. when its member moves to a breakout
+// room.
+func (e *egress) detach(forwarder *TrackForwarder) {
+	e.mux.Lock()
+	_, ok := e.attached[forwarder.ID()]
+	delete(e.attached, forwarder.ID())
+	e.mux.Unlock()
+
+	if ok {
+		forwarder.RemoveSink(e.sinkID())
+	}
+}
+
+func (e *egress) stop() {
+	e.mux.Lock()
+	if e.stopped {
+		e.mux.Unlock()
+		return
+	}
+	e.stopped = true
+	attached := make([]*TrackForwarder, 0, len(e.attached))
+	for _, forwarder := range e.attached {
+		attached = append(attached, forwarder)
+	}
+	clear(e.attached)
+	e.mux.Unlock()
+
+	for _, forwarder := range attached {
+		forwarder.RemoveSink(e.sinkID())
+	}
+}
+
+func (e *egress) info() EgressInfo {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+
+	info := EgressInfo{
+		ID:        e.id,
+		MemberID:  e.memberID,
+		Host:      e.host,
+		AudioPort: e.audioPort,
+		VideoPort: e.videoPort,
+		StartedAt: e.startedAt,
+		Tracks:    make([]EgressTrackStats, 0, len(e.slots)),
+		SDP:       e.sdp(),
+	}
+	for _, sink := range e.slots {
+		info.Tracks = append(info.Tracks, EgressTrackStats{
+			TrackID:  sink.trackID,
+			Kind:     sink.kind.String(),
+			MimeType: sink.mimeType,
+			Packets:  sink.packets.Load(),
+		})
+	}
+
+	return info
+}
+
+// sdp describes the egress's streams with every codec the SFU supports for
+// their kind, so it stays valid whichever codec the member publishes.
+func (e *egress) sdp() string {
+	addressType := "IP4"
+	if e.ip.To4() == nil {
+		addressType = "IP6"
+	}
+
+	desc := &sdp.SessionDescription{
+		Origin: sdp.Origin{
+			Username:       "-",
+			SessionID:      uint64(e.startedAt.Unix()),
+			SessionVersion: uint64(e.startedAt.Unix()),
+			NetworkType:    "IN",
+			AddressType:    addressType,
+			UnicastAddress: e.ip.String(),
+		},
+		SessionName: sdp.SessionName("gonference " + e.memberID),
+		ConnectionInformation: &sdp.ConnectionInformation{
+			NetworkType: "IN",
+			AddressType: addressType,
+			Address:     &sdp.Address{Address: e.ip.String()},
+		},
+		TimeDescriptions: []sdp.TimeDescription{{}},
+	}
+
+	for _, m := range []struct {
+		media  string
+		port   int
+		codecs []webrtc.RTPCodecParameters
+	}{
+		{"audio", e.audioPort, audioCodecs},
+		{"video", e.videoPort, videoCodecs},
+	} {
+		if m.port == 0 {
+			continue
+		}
+
+		media := &sdp.MediaDescription{
+			MediaName: sdp.MediaName{
+				Media:  m.media,
+				Port:   sdp.RangedPort{Value: m.port},
+				Protos: []string{"RTP", "AVP"},
+			},
+		}
+		for _, codec := range m.codecs {
+			_, name, _ := strings.Cut(codec.MimeType, "/")
+			media.WithCodec(uint8(codec.PayloadType), name, codec.ClockRate, codec.Channels, codec.SDPFmtpLine)
+		}
+		desc.WithMedia(media.WithPropertyAttribute(sdp.AttrKeyRecvOnly))
+	}
+
+	data, err := desc.Marshal()
+	if err != nil {
+		return ""
+	}
+
+	return string(data)
+}
+
+// udpSink sends a forwarder's packets to the egress host, with the payload
+// type the egress SDP gives its codec.
+type udpSink struct {
+	egress      *egress
+	kind        webrtc.RTPCodecType
+	trackID     string
+	mimeType    string
+	payloadType uint8
+	conn        *net.UDPConn
+
+	buf     [maxPacketSize]byte
+	packets atomic.Uint64
+}
+
+// Write sends b. Until the receiver listens, writes fail with the port
+// unreachable errors the host reports and the packets are dropped.
+func (s *udpSink) Write(b []byte) (int, error) {
+	if len(b) < 2 {
+		return 0, errors.New("short RTP packet")
+	}
+
+	n := copy(s.buf[:], b)
+	s.buf[1] = s.buf[1]&0x80 | s.payloadType
+
+	if _, err := s.conn.Write(s.buf[:n]); err != nil {
+		return 0, err
+	}
+	s.packets.Add(1)
+
+	return n, nil
+}
+
+// Close frees the sink's slot so that the member's next track of its kind
+// takes it.
+func (s *udpSink) Close() error {
+	s.egress.mux.Lock()
+	if s.egress.slots[s.kind] == s {
+		delete(s.egress.slots, s.kind)
+	}
+	s.egress.mux.Unlock()
+
+	return s.conn.Close()
+}
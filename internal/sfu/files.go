@@ -0,0 +1,549 @@
+package sfu
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pion/webrtc/v3"
+)
+
+// Shared files are relayed, never pushed: a member offers a file over
+// signaling, the others accept or decline, and the sender then writes binary
+// frames on FileChannel. Each frame is the 36-byte transfer ID followed by up
+// to maxFileChunk bytes of the file. The SFU forwards every frame to the
+// members who accepted and acknowledges it to the sender with a "file-ack"
+// text message once all of them took it; senders keep at most fileWindow
+// frames unacknowledged. A sender that overruns the window, or a recipient
+// whose channel stays full for fileStallTimeout, is cut off.
+
+// FileSharingPolicy restricts who may offer files to a room.
+type FileSharingPolicy string
+
+const (
+	FileSharingEveryone   FileSharingPolicy = ""
+	FileSharingModerators FileSharingPolicy = "moderators"
+	FileSharingNone       FileSharingPolicy = "none"
+)
+
+const (
+	fileIDLen    = 36
+	maxFileChunk = maxDataMessageSize - fileIDLen
+	fileWindow   = 32
+
+	fileChunkRate  = 1000
+	fileChunkBurst = 2 * fileWindow
+
+	fileHighWatermark = 1 << 20
+	fileLowWatermark  = 256 << 10
+
+	fileStallTimeout = 15 * time.Second
+	fileIdleTimeout  = 2 * time.Minute
+)
+
+var (
+	ErrFileSharingDenied = errors.New("file sharing is not allowed")
+	ErrFileTooLarge      = errors.New("file exceeds the size limit")
+	ErrInvalidFile       = errors.New("file needs a name and a size")
+	ErrTransferNotFound  = errors.New("file transfer not found")
+	ErrTransferStarted   = errors.New("file transfer already started")
+
+	errFileWindow     = errors.New("file flow control window exceeded")
+	errFileStalled    = errors.New("recipient stopped reading")
+	errFileIncomplete = errors.New("file ended before its declared size")
+	errFileNoChannel  = errors.New("file channel is not open")
+)
+
+// FileOffer describes a file a member offers to the room.
+type FileOffer struct {
+	ID       string `json:"id"`
+	From     string `json:"from"`
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType,omitempty"`
+}
+
+type fileTransfer struct {
+	offer  FileOffer
+	room   *Room
+	sender *Peer
+
+	// frames is the sender's window; a nil frame marks the end of the file.
+	frames chan []byte
+	ctx    context.Context
+	cancel context.CancelFunc
+	once   sync.Once
+
+	mux        sync.Mutex
+	recipients map[string]*Peer
+	started    bool
+	received   int64
+}
+
+// OfferFile announces a file from peer to the rest of the room and returns
+// the offer with its transfer ID.
+func (r *Room) OfferFile(peer *Peer, offer FileOffer) (FileOffer, error) {
+	if !r.canShareFile(peer) {
+		return FileOffer{}, ErrFileSharingDenied
+	}
+
+	offer.Name = filepath.Base(strings.TrimSpace(offer.Name))
+	if offer.Size <= 0 || offer.Name == "." || offer.Name == string(filepath.Separator) {
+		return FileOffer{}, ErrInvalidFile
+	}
+	if offer.Size > r.svc.fileMaxSize {
+		return FileOffer{}, ErrFileTooLarge
+	}
+
+	offer.ID = uuid.NewString()
+	offer.From = peer.ID()
+
+	t := &fileTransfer{
+		offer:      offer,
+		room:       r,
+		sender:     peer,
+		frames:     make(chan []byte, fileWindow),
+		recipients: make(map[string]*Peer),
+	}
+	t.ctx, t.cancel = context.WithCancel(context.Background())
+
+	r.mux.Lock()
+	r.transfers[offer.ID] = t
+	r.mux.Unlock()
+
+	goroutines.Go("file-transfer", t.run)
+
+	r.broadcast(nil, "file-offered", map[string]any{"file": offer})
+
+	return offer, nil
+}
+
+// AcceptFile adds peer to the recipients of a transfer that has not started.
+func (r *Room) AcceptFile(peer *Peer, id string) error {
+	t, err := r.transfer(id)
+	if err != nil {
+		return err
+	}
+
+	t.mux.Lock()
+	if t.started {
+		t.mux.Unlock()
+		return ErrTransferStarted
+	}
+	if peer != t.sender {
+		t.recipients[peer.ID()] = peer
+	}
+	t.mux.Unlock()
+
+	t.notifySender("file-accepted", peer.ID())
+
+	return nil
+}
+
+// DeclineFile removes peer from a transfer's recipients, before or during
+// the transfer.
+func (r *Room) DeclineFile(peer *Peer, id string) error {
+	t, err := r.transfer(id)
+	if err != nil {
+		return err
+	}
+
+	t.dropRecipient(peer.ID())
+
+	return nil
+}
+
+// CancelFile stops a transfer for everyone when peer is its sender or a
+// moderator; anyone else just stops receiving it.
+func (r *Room) CancelFile(peer *Peer, id string) error {
+	t, err := r.transfer(id)
+	if err != nil {
+		return err
+	}
+
+	if peer != t.sender && !peer.IsModerator() {
+		t.dropRecipient(peer.ID())
+		return nil
+	}
+
+	t.close("cancelled by " + peer.ID())
+
+	return nil
+}
+
+// CompleteFile marks the end of the sender's frames. The transfer finishes
+// once they have all been delivered.
+func (r *Room) CompleteFile(peer *Peer, id string) error {
+	t, err := r.transfer(id)
+	if err != nil {
+		return err
+	}
+
+	if peer != t.sender {
+		return ErrFileSharingDenied
+	}
+
+	return t.push(nil)
+}
+
+// Transfers returns the files currently offered in the room.
+func (r *Room) Transfers() []FileOffer {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	offers := make([]FileOffer, 0, len(r.transfers))
+	for _, t := range r.transfers {
+		offers = append(offers, t.offer)
+	}
+
+	return offers
+}
+
+// StoredFile returns a completed file kept in the SFU's file directory.
+func (s *SFU) StoredFile(tenant, roomID, id string) (FileOffer, string, error) {
+	if s.svc.fileDir == "" || !isUUID(id) {
+		return FileOffer{}, "", ErrTransferNotFound
+	}
+
+	path := filepath.Join(s.svc.fileDir, url.PathEscape(roomKey(tenant, roomID)), id)
+
+	data, err := os.ReadFile(path + ".json")
+	if errors.Is(err, os.ErrNotExist) {
+		return FileOffer{}, "", ErrTransferNotFound
+	}
+	if err != nil {
+		return FileOffer{}, "", err
+	}
+
+	var offer FileOffer
+	if err := json.Unmarshal(data, &offer); err != nil {
+		return FileOffer{}, "", err
+	}
+
+	return offer, path, nil
+}
+
+// relayFileChunk takes a frame from the sender of a transfer.
+func (r *Room) relayFileChunk(from *Peer, _ string, channel *dataChannel, raw webrtc.DataChannelMessage) error {
+	if len(raw.Data) > maxDataMessageSize {
+		return errDataTooLarge
+	}
+
+	if raw.IsString || len(raw.Data) <= fileIDLen {
+		return errDataMalformed
+	}
+
+	if !channel.limiter.Allow() {
+		return errDataRateLimit
+	}
+
+	t, err := r.transfer(string(raw.Data[:fileIDLen]))
+	if err != nil {
+		return err
+	}
+
+	if from != t.sender {
+		return ErrFileSharingDenied
+	}
+
+	return t.push(append([]byte(nil), raw.Data...))
+}
+
+func (r *Room) transfer(id string) (*fileTransfer, error) {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	t, ok := r.transfers[id]
+	if !ok {
+		return nil, ErrTransferNotFound
+	}
+
+	return t, nil
+}
+
+func (r *Room) canShareFile(peer *Peer) bool {
+	switch r.options.FileSharing {
+	case FileSharingNone:
+		return false
+	case FileSharingModerators:
+		return peer.IsModerator()
+	default:
+		return true
+	}
+}
+
+// dropTransfers cancels the transfers a departing member was sending and
+// stops sending them the ones they accepted.
+func (r *Room) dropTransfers(id string) {
+	r.mux.RLock()
+	transfers := make([]*fileTransfer, 0, len(r.transfers))
+	for _, t := range r.transfers {
+		transfers = append(transfers, t)
+	}
+	r.mux.RUnlock()
+
+	for _, t := range transfers {
+		if t.sender.ID() == id {
+			t.close("sender left")
+			continue
+		}
+
+		t.mux.Lock()
+		delete(t.recipients, id)
+		t.mux.Unlock()
+	}
+}
+
+// push queues a frame, or the end of the file when frame is nil, for
+// delivery. A sender that overruns its window loses the transfer.
+func (t *fileTransfer) push(frame []byte) error {
+	if frame != nil {
+		t.mux.Lock()
+		t.started = true
+		t.received += int64(len(frame) - fileIDLen)
+		tooLarge := t.received > t.offer.Size
+		t.mux.Unlock()
+
+		if tooLarge {
+			t.close(ErrFileTooLarge.Error())
+			return ErrFileTooLarge
+		}
+	}
+
+	select {
+	case t.frames <- frame:
+		return nil
+	default:
+		t.close(errFileWindow.Error())
+		return errFileWindow
+	}
+}
+
+func (t *fileTransfer) run() {
+	store := t.createStore()
+	completed := false
+	defer func() {
+		if store != nil {
+			t.closeStore(store, completed)
+		}
+	}()
+
+	idle := time.NewTimer(fileIdleTimeout)
+	defer idle.Stop()
+
+	var delivered int64
+	var frames int
+	for {
+		select {
+		case <-t.ctx.Done():
+			return
+		case <-idle.C:
+			t.close("timed out")
+			return
+		case frame := <-t.frames:
+			idle.Reset(fileIdleTimeout)
+
+			if frame == nil {
+				if delivered != t.offer.Size {
+					t.close(errFileIncomplete.Error())
+					return
+				}
+
+				completed = true
+				t.finish()
+				return
+			}
+
+			for _, peer := range t.recipientList() {
+				if err := t.deliver(peer, frame); err != nil {
+					if t.ctx.Err() != nil {
+						return
+					}
+					t.dropRecipient(peer.ID())
+					t.notify(peer, "file-cancelled", map[string]any{"reason": err.Error()})
+				}
+			}
+
+			if store != nil {
+				if _, err := store.Write(frame[fileIDLen:]); err != nil {
+					t.sender.logger.Error("Failed to store file", slog.String("error", err.Error()))
+					t.closeStore(store, false)
+					store = nil
+				}
+			}
+
+			delivered += int64(len(frame) - fileIDLen)
+			frames++
+			t.ack(delivered, frames)
+		}
+	}
+}
+
+// deliver sends a frame to a recipient, waiting while their channel has more
+// than fileHighWatermark buffered.
+func (t *fileTransfer) deliver(peer *Peer, frame []byte) error {
+	channel, ok := peer.channels[FileChannel]
+	if !ok || channel.dc.ReadyState() != webrtc.DataChannelStateOpen {
+		return errFileNoChannel
+	}
+
+	stalled := time.NewTimer(fileStallTimeout)
+	defer stalled.Stop()
+
+	for channel.dc.BufferedAmount() > fileHighWatermark {
+		select {
+		case <-channel.drained:
+		case <-time.After(100 * time.Millisecond):
+			// Several transfers may wait on one channel, but only one of
+			// them gets the drained signal.
+		case <-stalled.C:
+			return errFileStalled
+		case <-t.ctx.Done():
+			return t.ctx.Err()
+		}
+	}
+
+	return channel.dc.Send(frame)
+}
+
+func (t *fileTransfer) ack(offset int64, frames int) {
+	data, err := json.Marshal(map[string]any{
+		"type":       "file-ack",
+		"transferId": t.offer.ID,
+		"offset":     offset,
+		"frames":     frames,
+	})
+	if err != nil {
+		return
+	}
+
+	if err := t.sender.sendRawData(FileChannel, data); err != nil {
+		t.sender.logger.Error("Failed to acknowledge file chunk", slog.String("error", err.Error()))
+	}
+}
+
+func (t *fileTransfer) finish() {
+	t.once.Do(func() {
+		t.cancel()
+		t.unregister()
+
+		t.notify(t.sender, "file-complete", nil)
+		for _, peer := range t.recipientList() {
+			t.notify(peer, "file-complete", nil)
+		}
+	})
+}
+
+// close ends the transfer and tells the sender and every recipient why.
+func (t *fileTransfer) close(reason string) {
+	t.once.Do(func() {
+		t.cancel()
+		t.unregister()
+
+		fields := map[string]any{"reason": reason}
+		t.notify(t.sender, "file-cancelled", fields)
+		for _, peer := range t.recipientList() {
+			t.notify(peer, "file-cancelled", fields)
+		}
+	})
+}
+
+func (t *fileTransfer) unregister() {
+	t.room.mux.Lock()
+	delete(t.room.transfers, t.offer.ID)
+	t.room.mux.Unlock()
+}
+
+func (t *fileTransfer) dropRecipient(id string) {
+	t.mux.Lock()
+	_, ok := t.recipients[id]
+	delete(t.recipients, id)
+	t.mux.Unlock()
+
+	if ok {
+		t.notifySender("file-declined", id)
+	}
+}
+
+func (t *fileTransfer) recipientList() []*Peer {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	peers := make([]*Peer, 0, len(t.recipients))
+	for _, peer := range t.recipients {
+		peers = append(peers, peer)
+	}
+
+	return peers
+}
+
+func (t *fileTransfer) notifySender(msgType, memberID string) {
+	t.notify(t.sender, msgType, map[string]any{"memberId": memberID})
+}
+
+func (t *fileTransfer) notify(peer *Peer, msgType string, fields map[string]any) {
+	payload := map[string]any{"transferId": t.offer.ID}
+	for k, v := range fields {
+		payload[k] = v
+	}
+
+	if err := peer.send(msgType, payload); err != nil {
+		peer.logger.Error("Failed to send "+msgType, slog.String("error", err.Error()))
+	}
+}
+
+// createStore opens the file that keeps a copy of the transfer when the SFU
+// is configured with a file directory.
+func (t *fileTransfer) createStore() *os.File {
+	if t.room.svc.fileDir == "" {
+		return nil
+	}
+
+	main := t.room.Main()
+	dir := filepath.Join(t.room.svc.fileDir, url.PathEscape(roomKey(main.tenant, main.id)))
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		t.sender.logger.Error("Failed to create file directory", slog.String("error", err.Error()))
+		return nil
+	}
+
+	f, err := os.Create(filepath.Join(dir, t.offer.ID))
+	if err != nil {
+		t.sender.logger.Error("Failed to create file", slog.String("error", err.Error()))
+		return nil
+	}
+
+	return f
+}
+
+// closeStore keeps a completed file next to its offer and removes anything
+// partial.
+func (t *fileTransfer) closeStore(f *os.File, completed bool) {
+	err := f.Close()
+	if completed && err == nil {
+		var data []byte
+		data, err = json.Marshal(t.offer)
+		if err == nil {
+			err = os.WriteFile(f.Name()+".json", data, 0o640)
+		}
+	}
+
+	if !completed || err != nil {
+		_ = os.Remove(f.Name())
+	}
+	if err != nil {
+		t.sender.logger.Error("Failed to store file", slog.String("error", err.Error()))
+	}
+}
+
+func isUUID(id string) bool {
+	_, err := uuid.Parse(id)
+	return err == nil && len(id) == fileIDLen
+}
@@ -0,0 +1,506 @@
+package sfu
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Timescales of the fMP4 tracks: the RTP clock rates, so that RTP
+// timestamps carry over unscaled.
+const (
+	fmp4VideoTimescale = 90000
+	fmp4AudioTimescale = 48000
+
+	fmp4VideoTrackID = 1
+	fmp4AudioTrackID = 2
+)
+
+// Sample flags of a trun entry (ISO/IEC 14496-12, section 8.8.3.1): a sync
+// sample depends on no other; any other video sample does.
+const (
+	fmp4SyncSample    = 0x02000000
+	fmp4NonSyncSample = 0x01010000
+)
+
+// fmp4Sample is one access unit of a fragment. Video data is in AVCC form,
+// each NAL unit prefixed by its 4 byte length.
+type fmp4Sample struct {
+	dts      int64
+	duration uint32
+	sync     bool
+	data     []byte
+}
+
+// h264Config is what the avc1 sample entry needs of a stream.
+type h264Config struct {
+	sps    []byte
+	pps    []byte
+	width  uint16
+	height uint16
+}
+
+// mp4Box builds ISO BMFF boxes into one buffer.
+type mp4Box struct {
+	buf []byte
+}
+
+func (b *mp4Box) u8(v uint8) {
+	b.buf = append(b.buf, v)
+}
+
+func (b *mp4Box) u16(v uint16) {
+	b.buf = binary.BigEndian.AppendUint16(b.buf, v)
+}
+
+func (b *mp4Box) u32(v uint32) {
+	b.buf = binary.BigEndian.AppendUint32(b.buf, v)
+}
+
+func (b *mp4Box) u64(v uint64) {
+	b.buf = binary.BigEndian.AppendUint64(b.buf, v)
+}
+
+func (b *mp4Box) bytes(v []byte) {
+	b.buf = append(b.buf, v...)
+}
+
+func (b *mp4Box) zeros(n int) {
+	b.buf = append(b.buf, make([]byte, n)...)
+}
+
+// box writes a box of type typ whose content body writes.
+func (b *mp4Box) box(typ string, body func()) {
+	start := len(b.buf)
+	b.u32(0)
+	b.buf = append(b.buf, typ...)
+	body()
+	binary.BigEndian.PutUint32(b.buf[start:], uint32(len(b.buf)-start))
+}
+
+// fullBox writes a box with a version and flags.
+func (b *mp4Box) fullBox(typ string, version uint8, flags uint32, body func()) {
+	b.box(typ, func() {
+		b.u32(uint32(version)<<24 | flags&0xffffff)
+		body()
+	})
+}
+
+// matrix writes the identity transformation matrix.
+func (b *mp4Box) matrix() {
+	for _, v := range []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000} {
+		b.u32(v)
+	}
+}
+
+// fmp4Init builds the initialization segment of a stream with an H.264
+// track when video is set and an Opus track when channels is not zero.
+func fmp4Init(video *h264Config, channels uint16) []byte {
+	b := &mp4Box{}
+
+	b.box("ftyp", func() {
+		b.bytes([]byte("iso6"))
+		b.u32(0)
+		b.bytes([]byte("iso6iso5mp41cmfc"))
+	})
+
+	b.box("moov", func() {
+		b.fullBox("mvhd", 0, 0, func() {
+			b.u32(0) // creation time
+			b.u32(0) // modification time
+			b.u32(1000)
+			b.u32(0) // duration
+			b.u32(0x00010000)
+			b.u16(0x0100)
+			b.zeros(10)
+			b.matrix()
+			b.zeros(24)
+			b.u32(fmp4AudioTrackID + 1)
+		})
+
+		if video != nil {
+			b.trak(fmp4VideoTrackID, fmp4VideoTimescale, "vide", func() { b.avc1(video) }, video.width, video.height)
+		}
+		if channels > 0 {
+			b.trak(fmp4AudioTrackID, fmp4AudioTimescale, "soun", func() { b.opus(channels) }, 0, 0)
+		}
+
+		b.box("mvex", func() {
+			for _, id := range []uint32{fmp4VideoTrackID, fmp4AudioTrackID} {
+				if (id == fmp4VideoTrackID && video == nil) || (id == fmp4AudioTrackID && channels == 0) {
+					continue
+				}
+
+				b.fullBox("trex", 0, 0, func() {
+					b.u32(id)
+					b.u32(1) // sample description index
+					b.u32(0)
+					b.u32(0)
+					b.u32(0)
+				})
+			}
+		})
+	})
+
+	return b.buf
+}
+
+func (b *mp4Box) trak(id, timescale uint32, handler string, sampleEntry func(), width, height uint16) {
+	b.box("trak", func() {
+		b.fullBox("tkhd", 0, 3, func() {
+			b.u32(0)
+			b.u32(0)
+			b.u32(id)
+			b.u32(0)
+			b.u32(0) // duration
+			b.zeros(8)
+			b.u16(0) // layer
+			b.u16(0) // alternate group
+			if handler == "soun" {
+				b.u16(0x0100)
+			} else {
+				b.u16(0)
+			}
+			b.u16(0)
+			b.matrix()
+			b.u32(uint32(width) << 16)
+			b.u32(uint32(height) << 16)
+		})
+
+		b.box("mdia", func() {
+			b.fullBox("mdhd", 0, 0, func() {
+				b.u32(0)
+				b.u32(0)
+				b.u32(timescale)
+				b.u32(0)
+				b.u16(0x55c4) // "und"
+				b.u16(0)
+			})
+
+			b.fullBox("hdlr", 0, 0, func() {
+				b.u32(0)
+				b.bytes([]byte(handler))
+				b.zeros(12)
+				b.bytes([]byte("gonference\x00"))
+			})
+
+			b.box("minf", func() {
+				if handler == "vide" {
+					b.fullBox("vmhd", 0, 1, func() { b.zeros(8) })
+				} else {
+					b.fullBox("smhd", 0, 0, func() { b.zeros(4) })
+				}
+
+				b.box("dinf", func() {
+					b.fullBox("dref", 0, 0, func() {
+						b.u32(1)
+						b.fullBox("url ", 0, 1, func() {})
+					})
+				})
+
+				b.box("stbl", func() {
+					b.fullBox("stsd", 0, 0, func() {
+						b.u32(1)
+						sampleEntry()
+					})
+					b.fullBox("stts", 0, 0, func() { b.u32(0) })
+					b.fullBox("stsc", 0, 0, func() { b.u32(0) })
+					b.fullBox("stsz", 0, 0, func() {
+						b.u32(0) // sample size
+						b.u32(0)
+					})
+					b.fullBox("stco", 0, 0, func() { b.u32(0) })
+				})
+			})
+		})
+	})
+}
+
+func (b *mp4Box) avc1(cfg *h264Config) {
+	b.box("avc1", func() {
+		b.zeros(6)
+		b.u16(1) // data reference index
+		b.zeros(16)
+		b.u16(cfg.width)
+		b.u16(cfg.height)
+		b.u32(0x00480000)
+		b.u32(0x00480000)
+		b.u32(0)
+		b.u16(1) // frame count
+		b.zeros(32)
+		b.u16(0x0018)
+		b.u16(0xffff)
+
+		b.box("avcC", func() {
+			b.u8(1)
+			b.u8(cfg.sps[1]) // profile
+			b.u8(cfg.sps[2]) // constraint flags
+			b.u8(cfg.sps[3]) // level
+			b.u8(0xff)       // 4 byte NAL unit lengths
+			b.u8(0xe1)       // one SPS
+			b.u16(uint16(len(cfg.sps)))
+			b.bytes(cfg.sps)
+			b.u8(1)
+			b.u16(uint16(len(cfg.pps)))
+			b.bytes(cfg.pps)
+		})
+	})
+}
+
+func (b *mp4Box) opus(channels uint16) {
+	b.box("Opus", func() {
+		b.zeros(6)
+		b.u16(1) // data reference index
+		b.zeros(8)
+		b.u16(channels)
+		b.u16(16)
+		b.zeros(4)
+		b.u32(fmp4AudioTimescale << 16)
+
+		// Opus in ISOBMFF, section 4.3.2.
+		b.box("dOps", func() {
+			b.u8(0)
+			b.u8(uint8(channels))
+			b.u16(0) // pre-skip
+			b.u32(fmp4AudioTimescale)
+			b.u16(0) // output gain
+			b.u8(0)  // channel mapping family
+		})
+	})
+}
+
+// fmp4Fragment builds one moof and mdat pair holding video and audio
+// samples; either may be empty.
+func fmp4Fragment(sequence uint32, video, audio []fmp4Sample) []byte {
+	b := &mp4Box{}
+
+	type run struct {
+		trackID uint32
+		samples []fmp4Sample
+		offset  int // of the trun data offset field
+	}
+	var runs []*run
+	if len(video) > 0 {
+		runs = append(runs, &run{trackID: fmp4VideoTrackID, samples: video})
+	}
+	if len(audio) > 0 {
+		runs = append(runs, &run{trackID: fmp4AudioTrackID, samples: audio})
+	}
+
+	b.box("moof", func() {
+		b.fullBox("mfhd", 0, 0, func() { b.u32(sequence) })
+
+		for _, r := range runs {
+			b.box("traf", func() {
+				// default-base-is-moof
+				b.fullBox("tfhd", 0, 0x020000, func() { b.u32(r.trackID) })
+				b.fullBox("tfdt", 1, 0, func() { b.u64(uint64(r.samples[0].dts)) })
+
+				// data offset, sample duration, size and flags present
+				b.fullBox("trun", 0, 0x000701, func() {
+					b.u32(uint32(len(r.samples)))
+					r.offset = len(b.buf)
+					b.u32(0)
+					for _, s := range r.samples {
+						b.u32(s.duration)
+						b.u32(uint32(len(s.data)))
+						if s.sync {
+							b.u32(fmp4SyncSample)
+						} else {
+							b.u32(fmp4NonSyncSample)
+						}
+					}
+				})
+			})
+		}
+	})
+
+	b.box("mdat", func() {
+		for _, r := range runs {
+			// The moof starts the buffer, so offsets into it are
+			// relative to the moof.
+			binary.BigEndian.PutUint32(b.buf[r.offset:], uint32(len(b.buf)))
+			for _, s := range r.samples {
+				b.bytes(s.data)
+			}
+		}
+	})
+
+	return b.buf
+}
+
+// annexBNALUs splits an Annex B byte stream into its NAL units.
+func annexBNALUs(data []byte) [][]byte {
+	var nalus [][]byte
+	start := -1
+	for i := 0; i+2 < len(data); i++ {
+		if data[i] != 0 || data[i+1] != 0 || data[i+2] != 1 {
+			continue
+		}
+
+		if start >= 0 {
+			end := i
+			// A four byte start code leaves a zero behind.
+			if end > start && data[end-1] == 0 {
+				end--
+			}
+			nalus = append(nalus, data[start:end])
+		}
+		start = i + 3
+		i += 2
+	}
+	if start >= 0 && start < len(data) {
+		nalus = append(nalus, data[start:])
+	}
+
+	return nalus
+}
+
+var errInvalidSPS = errors.New("invalid H.264 SPS")
+
+// h264Dimensions reads the picture size from an SPS NAL unit (ITU-T H.264,
+// section 7.3.2.1.1).
+func h264Dimensions(sps []byte) (uint16, uint16, error) {
+	if len(sps) < 4 {
+		return 0, 0, errInvalidSPS
+	}
+
+	// Drop the emulation prevention bytes.
+	rbsp := make([]byte, 0, len(sps))
+	for i := 1; i < len(sps); i++ {
+		if i >= 3 && sps[i] == 3 && sps[i-1] == 0 && sps[i-2] == 0 {
+			continue
+		}
+		rbsp = append(rbsp, sps[i])
+	}
+
+	r := &bitReader{data: rbsp}
+	profile := r.bits(8)
+	r.bits(16) // constraint flags and level
+	r.ue()     // seq_parameter_set_id
+
+	chromaFormat := uint32(1)
+	switch profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chromaFormat = r.ue()
+		if chromaFormat == 3 {
+			r.bits(1) // separate_colour_plane_flag
+		}
+		r.ue()    // bit_depth_luma_minus8
+		r.ue()    // bit_depth_chroma_minus8
+		r.bits(1) // qpprime_y_zero_transform_bypass_flag
+		if r.bits(1) == 1 {
+			lists := 8
+			if chromaFormat == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				if r.bits(1) == 0 {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				last, next := int32(8), int32(8)
+				for j := 0; j < size; j++ {
+					if next != 0 {
+						next = (last + r.se() + 256) % 256
+					}
+					if next != 0 {
+						last = next
+					}
+				}
+			}
+		}
+	}
+
+	r.ue() // log2_max_frame_num_minus4
+	switch r.ue() {
+	case 0:
+		r.ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		r.bits(1)
+		r.se()
+		r.se()
+		for n := r.ue(); n > 0 && r.err == nil; n-- {
+			r.se()
+		}
+	}
+	r.ue()    // max_num_ref_frames
+	r.bits(1) // gaps_in_frame_num_value_allowed_flag
+
+	widthMBs := r.ue() + 1
+	heightMapUnits := r.ue() + 1
+	frameMBsOnly := r.bits(1)
+	if frameMBsOnly == 0 {
+		r.bits(1) // mb_adaptive_frame_field_flag
+	}
+	r.bits(1) // direct_8x8_inference_flag
+
+	width := widthMBs * 16
+	height := (2 - frameMBsOnly) * heightMapUnits * 16
+
+	if r.bits(1) == 1 {
+		left, right, top, bottom := r.ue(), r.ue(), r.ue(), r.ue()
+
+		cropX, cropY := uint32(1), 2-frameMBsOnly
+		if chromaFormat == 1 || chromaFormat == 2 {
+			cropX = 2
+		}
+		if chromaFormat == 1 {
+			cropY *= 2
+		}
+		width -= (left + right) * cropX
+		height -= (top + bottom) * cropY
+	}
+
+	if r.err != nil || width == 0 || height == 0 || width > 0xffff || height > 0xffff {
+		return 0, 0, errInvalidSPS
+	}
+
+	return uint16(width), uint16(height), nil
+}
+
+// bitReader reads the Exp-Golomb coded fields of an RBSP. Reading past the
+// end sets err and yields zeros.
+type bitReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *bitReader) bits(n int) uint32 {
+	var v uint32
+	for i := 0; i < n; i++ {
+		if r.pos >= len(r.data)*8 {
+			r.err = errInvalidSPS
+			return 0
+		}
+		v = v<<1 | uint32(r.data[r.pos/8]>>(7-r.pos%8)&1)
+		r.pos++
+	}
+
+	return v
+}
+
+func (r *bitReader) ue() uint32 {
+	zeros := 0
+	for r.bits(1) == 0 {
+		if r.err != nil || zeros == 31 {
+			r.err = errInvalidSPS
+			return 0
+		}
+		zeros++
+	}
+
+	return 1<<zeros - 1 + r.bits(zeros)
+}
+
+func (r *bitReader) se() int32 {
+	v := r.ue()
+	if v%2 == 1 {
+		return int32(v/2 + 1)
+	}
+
+	return -int32(v / 2)
+}
@@ -0,0 +1,370 @@
+package sfu
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// mp4Child is a box read back from a buffer.
+type mp4Child struct {
+	typ  string
+	body []byte
+}
+
+// readBoxes splits data into the boxes it holds, failing the test when a
+// size does not add up.
+func readBoxes(t *testing.T, data []byte) []mp4Child {
+	t.Helper()
+
+	var boxes []mp4Child
+	for at := 0; at < len(data); {
+		if len(data)-at < 8 {
+			t.Fatalf("%d trailing bytes", len(data)-at)
+		}
+		size := int(binary.BigEndian.Uint32(data[at:]))
+		if size < 8 || at+size > len(data) {
+			t.Fatalf("box %q at %d has size %d of %d", data[at+4:at+8], at, size, len(data)-at)
+		}
+		boxes = append(boxes, mp4Child{typ: string(data[at+4 : at+8]), body: data[at+8 : at+size]})
+		at += size
+	}
+
+	return boxes
+}
+
+func boxTypes(boxes []mp4Child) []string {
+	types := make([]string, len(boxes))
+	for i, b := range boxes {
+		types[i] = b.typ
+	}
+	return types
+}
+
+func findBox(t *testing.T, boxes []mp4Child, typ string) mp4Child {
+	t.Helper()
+
+	for _, b := range boxes {
+		if b.typ == typ {
+			return b
+		}
+	}
+	t.Fatalf("no %s box in %v", typ, boxTypes(boxes))
+	return mp4Child{}
+}
+
+func TestFMP4Init(t *testing.T) {
+	video := &h264Config{sps: []byte{0x67, 0x42, 0xc0, 0x1f}, pps: []byte{0x68, 0xce}, width: 1280, height: 720}
+
+	tests := []struct {
+		name     string
+		video    *h264Config
+		channels uint16
+		traks    int
+		trexIDs  []uint32
+	}{
+		{"video and audio", video, 2, 2, []uint32{fmp4VideoTrackID, fmp4AudioTrackID}},
+		{"video only", video, 0, 1, []uint32{fmp4VideoTrackID}},
+		{"audio only", nil, 1, 1, []uint32{fmp4AudioTrackID}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			top := readBoxes(t, fmp4Init(tt.video, tt.channels))
+			if got := boxTypes(top); len(got) != 2 || got[0] != "ftyp" || got[1] != "moov" {
+				t.Fatalf("top level boxes %v, want [ftyp moov]", got)
+			}
+
+			moov := readBoxes(t, top[1].body)
+			findBox(t, moov, "mvhd")
+
+			traks := 0
+			for _, b := range moov {
+				if b.typ == "trak" {
+					traks++
+				}
+			}
+			if traks != tt.traks {
+				t.Fatalf("%d traks, want %d", traks, tt.traks)
+			}
+
+			var ids []uint32
+			for _, trex := range readBoxes(t, findBox(t, moov, "mvex").body) {
+				// version and flags, then the track ID
+				ids = append(ids, binary.BigEndian.Uint32(trex.body[4:]))
+			}
+			if len(ids) != len(tt.trexIDs) {
+				t.Fatalf("trex for tracks %v, want %v", ids, tt.trexIDs)
+			}
+			for i := range ids {
+				if ids[i] != tt.trexIDs[i] {
+					t.Fatalf("trex for tracks %v, want %v", ids, tt.trexIDs)
+				}
+			}
+		})
+	}
+}
+
+func TestFMP4InitCarriesParameterSets(t *testing.T) {
+	video := &h264Config{sps: []byte{0x67, 0x64, 0x00, 0x28, 0xac}, pps: []byte{0x68, 0xee, 0x3c, 0x80}, width: 1920, height: 1080}
+	init := fmp4Init(video, 0)
+
+	for _, want := range [][]byte{[]byte("avc1"), []byte("avcC"), video.sps, video.pps} {
+		if !bytes.Contains(init, want) {
+			t.Fatalf("init segment lacks % x", want)
+		}
+	}
+}
+
+func TestFMP4Fragment(t *testing.T) {
+	video := []fmp4Sample{
+		{dts: 90000, duration: 3000, sync: true, data: []byte("keyframe")},
+		{dts: 93000, duration: 3000, data: []byte("delta")},
+	}
+	audio := []fmp4Sample{
+		{dts: 48000, duration: 960, sync: true, data: []byte("opus-1")},
+		{dts: 48960, duration: 960, sync: true, data: []byte("opus-2")},
+		{dts: 49920, duration: 960, sync: true, data: []byte("opus-3")},
+	}
+
+	data := fmp4Fragment(7, video, audio)
+	top := readBoxes(t, data)
+	if got := boxTypes(top); len(got) != 2 || got[0] != "moof" || got[1] != "mdat" {
+		t.Fatalf("boxes %v, want [moof mdat]", got)
+	}
+
+	moof := readBoxes(t, top[0].body)
+	if seq := binary.BigEndian.Uint32(findBox(t, moof, "mfhd").body[4:]); seq != 7 {
+		t.Fatalf("sequence %d, want 7", seq)
+	}
+
+	var trafs []mp4Child
+	for _, b := range moof {
+		if b.typ == "traf" {
+			trafs = append(trafs, b)
+		}
+	}
+	if len(trafs) != 2 {
+		t.Fatalf("%d trafs, want 2", len(trafs))
+	}
+
+	for i, want := range []struct {
+		trackID uint32
+		samples []fmp4Sample
+	}{{fmp4VideoTrackID, video}, {fmp4AudioTrackID, audio}} {
+		traf := readBoxes(t, trafs[i].body)
+
+		if id := binary.BigEndian.Uint32(findBox(t, traf, "tfhd").body[4:]); id != want.trackID {
+			t.Fatalf("traf %d is for track %d, want %d", i, id, want.trackID)
+		}
+		if dts := binary.BigEndian.Uint64(findBox(t, traf, "tfdt").body[4:]); dts != uint64(want.samples[0].dts) {
+			t.Fatalf("track %d decode time %d, want %d", want.trackID, dts, want.samples[0].dts)
+		}
+
+		trun := findBox(t, traf, "trun").body
+		if n := binary.BigEndian.Uint32(trun[4:]); n != uint32(len(want.samples)) {
+			t.Fatalf("track %d has %d samples, want %d", want.trackID, n, len(want.samples))
+		}
+
+		// The data offset is relative to the start of the moof, which
+		// starts the fragment.
+		offset := int(binary.BigEndian.Uint32(trun[8:]))
+		for j, s := range want.samples {
+			entry := trun[12+12*j:]
+			duration := binary.BigEndian.Uint32(entry)
+			size := int(binary.BigEndian.Uint32(entry[4:]))
+			flags := binary.BigEndian.Uint32(entry[8:])
+
+			wantFlags := uint32(fmp4NonSyncSample)
+			if s.sync {
+				wantFlags = fmp4SyncSample
+			}
+			if duration != s.duration || size != len(s.data) || flags != wantFlags {
+				t.Fatalf("track %d sample %d: duration %d size %d flags %#x", want.trackID, j, duration, size, flags)
+			}
+
+			if got := data[offset : offset+size]; !bytes.Equal(got, s.data) {
+				t.Fatalf("track %d sample %d reads %q, want %q", want.trackID, j, got, s.data)
+			}
+			offset += size
+		}
+	}
+}
+
+func TestFMP4FragmentAudioOnly(t *testing.T) {
+	audio := []fmp4Sample{{dts: 0, duration: 960, sync: true, data: []byte("opus")}}
+
+	top := readBoxes(t, fmp4Fragment(1, nil, audio))
+	moof := readBoxes(t, top[0].body)
+	traf := readBoxes(t, findBox(t, moof, "traf").body)
+	if id := binary.BigEndian.Uint32(findBox(t, traf, "tfhd").body[4:]); id != fmp4AudioTrackID {
+		t.Fatalf("traf for track %d, want %d", id, fmp4AudioTrackID)
+	}
+	if !bytes.Equal(top[1].body, []byte("opus")) {
+		t.Fatalf("mdat holds %q", top[1].body)
+	}
+}
+
+func TestAnnexBNALUs(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want [][]byte
+	}{
+		{
+			name: "four byte start codes",
+			data: []byte{0, 0, 0, 1, 0x67, 0x42, 0, 0, 0, 1, 0x68, 0xce, 0, 0, 0, 1, 0x65, 0x88},
+			want: [][]byte{{0x67, 0x42}, {0x68, 0xce}, {0x65, 0x88}},
+		},
+		{
+			name: "three byte start codes",
+			data: []byte{0, 0, 1, 0x41, 0x9a, 0, 0, 1, 0x41, 0x9b},
+			want: [][]byte{{0x41, 0x9a}, {0x41, 0x9b}},
+		},
+		{
+			name: "emulation prevention is kept",
+			data: []byte{0, 0, 0, 1, 0x65, 0, 0, 3, 1},
+			want: [][]byte{{0x65, 0, 0, 3, 1}},
+		},
+		{
+			name: "no start code",
+			data: []byte{0x65, 0x88},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := annexBNALUs(tt.data)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d NAL units % x, want %d", len(got), got, len(tt.want))
+			}
+			for i := range got {
+				if !bytes.Equal(got[i], tt.want[i]) {
+					t.Fatalf("NAL unit %d is % x, want % x", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+// spsWriter encodes the fields of an SPS for h264Dimensions to read back.
+type spsWriter struct {
+	bits []byte
+}
+
+func (w *spsWriter) u(n int, v uint32) {
+	for i := n - 1; i >= 0; i-- {
+		w.bits = append(w.bits, byte(v>>i)&1)
+	}
+}
+
+func (w *spsWriter) ue(v uint32) {
+	v++
+	n := 0
+	for x := v; x > 1; x >>= 1 {
+		n++
+	}
+	w.u(n, 0)
+	w.u(n+1, v)
+}
+
+// nalu packs the bits with a stop bit and inserts emulation prevention
+// bytes where the payload calls for them.
+func (w *spsWriter) nalu() []byte {
+	bits := append(w.bits, 1)
+	for len(bits)%8 != 0 {
+		bits = append(bits, 0)
+	}
+
+	out := []byte{0x67}
+	zeros := 0
+	for i := 0; i < len(bits); i += 8 {
+		var b byte
+		for _, bit := range bits[i : i+8] {
+			b = b<<1 | bit
+		}
+		if zeros >= 2 && b <= 3 {
+			out = append(out, 3)
+			zeros = 0
+		}
+		out = append(out, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+
+	return out
+}
+
+// testSPS builds an SPS with 4:2:0 chroma, frame MBs only and the given
+// size in macroblocks and bottom crop in rows of chroma samples.
+func testSPS(profile uint32, widthMBs, heightMBs, cropBottom uint32) []byte {
+	w := &spsWriter{}
+	w.u(8, profile)
+	w.u(8, 0)  // constraint flags
+	w.u(8, 40) // level
+	w.ue(0)    // seq_parameter_set_id
+	if profile == 100 {
+		w.ue(1)   // chroma_format_idc
+		w.ue(0)   // bit_depth_luma_minus8
+		w.ue(0)   // bit_depth_chroma_minus8
+		w.u(1, 0) // qpprime_y_zero_transform_bypass_flag
+		w.u(1, 0) // seq_scaling_matrix_present_flag
+	}
+	w.ue(0)   // log2_max_frame_num_minus4
+	w.ue(0)   // pic_order_cnt_type
+	w.ue(0)   // log2_max_pic_order_cnt_lsb_minus4
+	w.ue(1)   // max_num_ref_frames
+	w.u(1, 0) // gaps_in_frame_num_value_allowed_flag
+	w.ue(widthMBs - 1)
+	w.ue(heightMBs - 1)
+	w.u(1, 1) // frame_mbs_only_flag
+	w.u(1, 1) // direct_8x8_inference_flag
+	if cropBottom > 0 {
+		w.u(1, 1)
+		w.ue(0)
+		w.ue(0)
+		w.ue(0)
+		w.ue(cropBottom)
+	} else {
+		w.u(1, 0)
+	}
+	w.u(1, 0) // vui_parameters_present_flag
+
+	return w.nalu()
+}
+
+func TestH264Dimensions(t *testing.T) {
+	tests := []struct {
+		name          string
+		sps           []byte
+		width, height uint16
+	}{
+		{"baseline 640x480", testSPS(66, 40, 30, 0), 640, 480},
+		{"high 1920x1080 cropped", testSPS(100, 120, 68, 4), 1920, 1080},
+		{"one macroblock", testSPS(66, 1, 1, 0), 16, 16},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			width, height, err := h264Dimensions(tt.sps)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if width != tt.width || height != tt.height {
+				t.Fatalf("got %dx%d, want %dx%d", width, height, tt.width, tt.height)
+			}
+		})
+	}
+}
+
+func TestH264DimensionsInvalid(t *testing.T) {
+	for _, sps := range [][]byte{nil, {0x67, 0x42}, {0x67, 0x42, 0xc0, 0x1f}} {
+		if _, _, err := h264Dimensions(sps); !errors.Is(err, errInvalidSPS) {
+			t.Fatalf("SPS % x: got %v, want %v", sps, err, errInvalidSPS)
+		}
+	}
+}
@@ -0,0 +1,1040 @@
+package sfu
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media/samplebuilder"
+)
+
+var (
+	ErrHLSNotFound = errors.New("HLS stream not found")
+	ErrHLSActive   = errors.New("room is already streamed over HLS")
+	ErrInvalidHLS  = errors.New("invalid HLS request")
+	ErrHLSNotReady = errors.New("HLS stream has no media yet")
+)
+
+const (
+	// hlsPartTarget bounds a partial segment.
+	hlsPartTarget = 500 * time.Millisecond
+	// hlsSegmentTarget is how long a segment runs before it is cut at the
+	// next keyframe; one is requested shortly before.
+	hlsSegmentTarget = 2 * time.Second
+	// hlsTargetDuration bounds a segment: one that found no keyframe in
+	// time is cut anyway, and the next starts on a dependent frame.
+	hlsTargetDuration = 6 * time.Second
+
+	// hlsSegments is how many complete segments a playlist lists, and
+	// hlsPartSegments how many of the last ones still list their parts.
+	hlsSegments     = 10
+	hlsPartSegments = 2
+
+	// hlsBlockTimeout bounds a blocking playlist or part request.
+	hlsBlockTimeout = 3 * hlsTargetDuration
+	// hlsLinger is how long a stopped stream stays playable, so that
+	// players reach the end of its playlist.
+	hlsLinger = 30 * time.Second
+
+	hlsOpusChannels = 2
+)
+
+// HLSRequest streams a member's H.264 video of Source, the camera unless
+// set, together with their Opus microphone.
+type HLSRequest struct {
+	MemberID string      `json:"memberId"`
+	Source   TrackSource `json:"source,omitempty"`
+}
+
+// HLSInfo describes a room's HLS stream. Playlist is the path of its media
+// playlist on the REST server, which serves it without credentials: the
+// stream ID is not guessable.
+type HLSInfo struct {
+	ID           string      `json:"id"`
+	MemberID     string      `json:"memberId"`
+	Source       TrackSource `json:"source"`
+	StartedAt    time.Time   `json:"startedAt"`
+	Playlist     string      `json:"playlist"`
+	VideoTrackID string      `json:"videoTrackId,omitempty"`
+	AudioTrackID string      `json:"audioTrackId,omitempty"`
+	Segments     int         `json:"segments"`
+}
+
+// StartHLS packages a member's tracks as low-latency HLS, in fMP4 segments
+// and partial segments cut straight from the forwarded RTP, until StopHLS
+// or Close. A room has one stream. It outlives the member, whose tracks are
+// picked up again when they publish anew.
+func (r *Room) StartHLS(actor string, req HLSRequest) (HLSInfo, error) {
+	if req.Source == "" {
+		req.Source = SourceCamera
+	}
+	if req.MemberID == "" || (req.Source != SourceCamera && req.Source != SourceScreen) {
+		return HLSInfo{}, ErrInvalidHLS
+	}
+
+	r.mux.Lock()
+	if r.hls != nil {
+		r.mux.Unlock()
+		return HLSInfo{}, ErrHLSActive
+	}
+
+	_, isPeer := r.peers[req.MemberID]
+	_, isPublisher := r.publishers[req.MemberID]
+	if !isPeer && !isPublisher {
+		r.mux.Unlock()
+		return HLSInfo{}, ErrPeerNotFound
+	}
+
+	s := newHLSStream(req)
+	r.hls = s
+	forwarders := r.forwarderList(nil)
+	r.mux.Unlock()
+
+	r.svc.hls.add(s)
+	for _, forwarder := range forwarders {
+		s.attach(forwarder)
+	}
+
+	r.audit(actor, "hls-start", req.MemberID, s.id)
+
+	return s.info(), nil
+}
+
+// StopHLS ends the room's stream. Its playlist stays playable for a while
+// with the segments it had.
+func (r *Room) StopHLS(actor string) error {
+	r.mux.Lock()
+	s := r.hls
+	r.hls = nil
+	r.mux.Unlock()
+
+	if s == nil {
+		return ErrHLSNotFound
+	}
+
+	s.stop()
+	r.svc.hls.retire(s)
+	if actor != systemActor {
+		r.audit(actor, "hls-stop", s.memberID, s.id)
+	}
+
+	return nil
+}
+
+// HLS returns the room's stream.
+func (r *Room) HLS() (HLSInfo, error) {
+	r.mux.RLock()
+	s := r.hls
+	r.mux.RUnlock()
+
+	if s == nil {
+		return HLSInfo{}, ErrHLSNotFound
+	}
+
+	return s.info(), nil
+}
+
+// HLSPlaylist returns the media playlist of a stream. When msn is not
+// negative the request is a blocking reload, held until the playlist has
+// segment msn, or part part of it when part is not negative either.
+func (s *SFU) HLSPlaylist(ctx context.Context, id string, msn, part int) ([]byte, error) {
+	stream, err := s.svc.hls.get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return stream.playlist(ctx, msn, part)
+}
+
+// HLSFile returns an initialization section, segment or partial segment of
+// a stream, and its content type. The part the playlist hints at next is
+// waited for.
+func (s *SFU) HLSFile(ctx context.Context, id, name string) ([]byte, string, error) {
+	stream, err := s.svc.hls.get(id)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return stream.file(ctx, name)
+}
+
+// hlsRegistry keeps the streams of an SFU by ID, so that players reach
+// them without knowing the room.
+type hlsRegistry struct {
+	mux  sync.RWMutex
+	byID map[string]*hlsStream
+}
+
+func newHLSRegistry() *hlsRegistry {
+	return &hlsRegistry{byID: make(map[string]*hlsStream)}
+}
+
+func (reg *hlsRegistry) add(s *hlsStream) {
+	reg.mux.Lock()
+	defer reg.mux.Unlock()
+
+	reg.byID[s.id] = s
+}
+
+// retire forgets a stopped stream after hlsLinger.
+func (reg *hlsRegistry) retire(s *hlsStream) {
+	time.AfterFunc(hlsLinger, func() {
+		reg.mux.Lock()
+		defer reg.mux.Unlock()
+
+		delete(reg.byID, s.id)
+	})
+}
+
+func (reg *hlsRegistry) get(id string) (*hlsStream, error) {
+	reg.mux.RLock()
+	defer reg.mux.RUnlock()
+
+	s, ok := reg.byID[id]
+	if !ok {
+		return nil, ErrHLSNotFound
+	}
+
+	return s, nil
+}
+
+// hlsStream segments one member's video and audio. Both are put on one
+// timeline, the time since the stream started, by the wall clock at each
+// track's first packet.
+//
+// The stream is cut into periods, each with its own initialization section
+// and introduced by a discontinuity. A period starts at a keyframe carrying
+// its parameter sets, or at once without video, and ends when the tracks
+// change: a track is attached or leaves, the parameter sets change, or the
+// video stalls for longer than a segment may last.
+//
+// Cuts follow the video while there is some: each frame is held until the
+// next gives its duration, and the audio received up to a cut goes into the
+// part it ends.
+type hlsStream struct {
+	id        string
+	memberID  string
+	source    TrackSource
+	startedAt time.Time
+
+	mux      sync.Mutex
+	stopped  bool
+	attached map[string]*TrackForwarder
+	video    *hlsSink
+	audio    *hlsSink
+	videoAt  time.Time
+	restart  bool
+
+	period    *hlsPeriod
+	nextMap   int
+	inits     map[int][]byte
+	segments  []*hlsSegment
+	open      *hlsSegment
+	nextMSN   int
+	discSeq   int
+	fragments uint32
+	asked     bool
+
+	part       hlsPartBuilder
+	partEnd    time.Duration
+	pending    *fmp4Sample
+	audioQueue []fmp4Sample
+	audioEnd   time.Duration
+
+	// changed is closed and replaced whenever a part is added or the
+	// stream stops.
+	changed chan struct{}
+}
+
+type hlsPeriod struct {
+	mapID         int
+	video         *h264Config
+	audio         bool
+	discontinuity bool
+}
+
+type hlsSegment struct {
+	msn           int
+	mapID         int
+	discontinuity bool
+	start         time.Duration
+	parts         []*hlsPart
+	duration      time.Duration
+}
+
+type hlsPart struct {
+	data        []byte
+	duration    time.Duration
+	independent bool
+}
+
+// hlsPartBuilder holds the samples of the part being cut.
+type hlsPartBuilder struct {
+	start       time.Duration
+	independent bool
+	video       []fmp4Sample
+	audio       []fmp4Sample
+}
+
+func (b *hlsPartBuilder) empty() bool {
+	return len(b.video) == 0 && len(b.audio) == 0
+}
+
+func newHLSStream(req HLSRequest) *hlsStream {
+	return &hlsStream{
+		id:        uuid.NewString(),
+		memberID:  req.MemberID,
+		source:    req.Source,
+		startedAt: time.Now(),
+		attached:  make(map[string]*TrackForwarder),
+		inits:     make(map[int][]byte),
+		changed:   make(chan struct{}),
+	}
+}
+
+func (s *hlsStream) sinkID() string {
+	return "hls:" + s.id
+}
+
+// attach packages forwarder when it is the member's H.264 video of the
+// stream's source or their Opus microphone, and that slot is free.
+func (s *hlsStream) attach(forwarder *TrackForwarder) {
+	if forwarder.peer.ID() != s.memberID {
+		return
+	}
+
+	mimeType := forwarder.remote.Codec().MimeType
+	video := forwarder.Kind() == webrtc.RTPCodecTypeVideo && forwarder.Source() == s.source &&
+		strings.EqualFold(mimeType, webrtc.MimeTypeH264)
+	audio := forwarder.Kind() == webrtc.RTPCodecTypeAudio && forwarder.Source() == SourceMicrophone &&
+		strings.EqualFold(mimeType, webrtc.MimeTypeOpus)
+	if !video && !audio {
+		return
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.stopped || (video && s.video != nil) || (audio && s.audio != nil) {
+		return
+	}
+
+	sink := newHLSSink(s, forwarder, video)
+	if err := forwarder.AddSink(s.sinkID(), sink); err != nil {
+		return
+	}
+
+	if video {
+		s.video = sink
+		s.videoAt = time.Now()
+	} else {
+		s.audio = sink
+		if s.video != nil {
+			s.video.forwarder.RequestKeyframe()
+		}
+	}
+	s.attached[forwarder.ID()] = forwarder
+	s.restart = true
+}
+
+// detach stops packaging forwarder, e.g. when its member moves to a
+// breakout room.
+func (s *hlsStream) detach(forwarder *TrackForwarder) {
+	s.mux.Lock()
+	_, ok := s.attached[forwarder.ID()]
+	delete(s.attached, forwarder.ID())
+	s.mux.Unlock()
+
+	if ok {
+		forwarder.RemoveSink(s.sinkID())
+	}
+}
+
+// released frees the slot of a sink whose track ended or was detached.
+func (s *hlsStream) released(k *hlsSink) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	switch {
+	case s.video == k:
+		s.video = nil
+		if s.period != nil && s.period.video != nil {
+			s.endPeriod(s.partEnd)
+		}
+	case s.audio == k:
+		s.audio = nil
+		if s.period != nil && s.period.video == nil {
+			s.endPeriod(s.partEnd)
+		} else {
+			s.restart = true
+		}
+	}
+}
+
+func (s *hlsStream) stop() {
+	s.mux.Lock()
+	if s.stopped {
+		s.mux.Unlock()
+		return
+	}
+	s.stopped = true
+	s.endPeriod(s.partEnd)
+	attached := make([]*TrackForwarder, 0, len(s.attached))
+	for _, forwarder := range s.attached {
+		attached = append(attached, forwarder)
+	}
+	clear(s.attached)
+	s.notify()
+	s.mux.Unlock()
+
+	for _, forwarder := range attached {
+		forwarder.RemoveSink(s.sinkID())
+	}
+}
+
+func (s *hlsStream) info() HLSInfo {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	info := HLSInfo{
+		ID:        s.id,
+		MemberID:  s.memberID,
+		Source:    s.source,
+		StartedAt: s.startedAt,
+		Playlist:  "/hls/" + s.id + "/index.m3u8",
+		Segments:  s.nextMSN,
+	}
+	if s.video != nil {
+		info.VideoTrackID = s.video.forwarder.ID()
+	}
+	if s.audio != nil {
+		info.AudioTrackID = s.audio.forwarder.ID()
+	}
+	if s.open != nil {
+		info.Segments--
+	}
+
+	return info
+}
+
+// writeVideo adds a video frame, starting a period when it is a keyframe
+// that one is waited for at.
+func (s *hlsStream) writeVideo(f fmp4Sample, cfg *h264Config) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.stopped {
+		return
+	}
+	s.videoAt = time.Now()
+
+	p := s.period
+	if f.sync && cfg != nil && (p == nil || p.video == nil || s.restart || !cfg.equal(p.video)) {
+		s.startPeriod(cfg, mediaTime(f.dts, fmp4VideoTimescale))
+		p = s.period
+	}
+	if p == nil || p.video == nil {
+		if s.video != nil {
+			s.video.forwarder.RequestKeyframe()
+		}
+		return
+	}
+
+	if s.pending != nil {
+		if f.dts <= s.pending.dts {
+			return
+		}
+
+		frame := *s.pending
+		frame.duration = uint32(f.dts - frame.dts)
+		s.placeVideo(frame)
+	}
+	s.pending = &f
+}
+
+// writeAudio adds an audio sample. Without video to follow it starts an
+// audio only period.
+func (s *hlsStream) writeAudio(a fmp4Sample) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.stopped {
+		return
+	}
+
+	t := mediaTime(a.dts, fmp4AudioTimescale)
+	stalled := s.video == nil || time.Since(s.videoAt) > hlsTargetDuration
+
+	p := s.period
+	switch {
+	case p == nil && stalled,
+		p != nil && p.video != nil && stalled,
+		p != nil && p.video == nil && s.restart && s.video == nil:
+		s.startPeriod(nil, t)
+	case p == nil || !p.audio:
+		return
+	}
+
+	if s.period.video != nil {
+		if t >= s.audioEnd {
+			s.audioQueue = append(s.audioQueue, a)
+		}
+		return
+	}
+
+	s.placeAudio(a)
+}
+
+// startPeriod ends the current period at and starts one packaging video
+// when it is set, and the audio when there is some.
+func (s *hlsStream) startPeriod(video *h264Config, at time.Duration) {
+	s.endPeriod(at)
+
+	audio := s.audio != nil
+	channels := uint16(0)
+	if audio {
+		channels = hlsOpusChannels
+	}
+
+	s.period = &hlsPeriod{
+		mapID:         s.nextMap,
+		video:         video,
+		audio:         audio,
+		discontinuity: s.nextMap > 0,
+	}
+	s.inits[s.nextMap] = fmp4Init(video, channels)
+	s.nextMap++
+	s.restart = false
+}
+
+// endPeriod closes the current period, giving the frame still held the
+// time up to end when that is known.
+func (s *hlsStream) endPeriod(end time.Duration) {
+	if s.period == nil {
+		return
+	}
+
+	if s.pending != nil {
+		frame := *s.pending
+		s.pending = nil
+
+		d := end - mediaTime(frame.dts, fmp4VideoTimescale)
+		if d <= 0 || d > time.Second {
+			d = time.Second / 30
+		}
+		frame.duration = uint32(d * fmp4VideoTimescale / time.Second)
+		s.placeVideo(frame)
+	}
+
+	if s.open != nil {
+		s.closeSegment(s.partEnd)
+	}
+
+	s.audioQueue = nil
+	s.audioEnd = 0
+	s.period = nil
+}
+
+// placeVideo adds a frame whose duration is known to the current part,
+// cutting it or the segment before the frame first when it is due.
+func (s *hlsStream) placeVideo(f fmp4Sample) {
+	t := mediaTime(f.dts, fmp4VideoTimescale)
+	d := mediaTime(int64(f.duration), fmp4VideoTimescale)
+
+	switch {
+	case s.open == nil:
+		s.openSegment(t)
+	case f.sync && t-s.open.start >= hlsSegmentTarget,
+		t-s.open.start+d > hlsTargetDuration:
+		s.closeSegment(t)
+		s.openSegment(t)
+	case !s.part.empty() && t-s.part.start+d > hlsPartTarget:
+		s.closePart(t)
+	}
+
+	if !s.asked && t-s.open.start >= hlsSegmentTarget-hlsPartTarget && s.video != nil {
+		s.video.forwarder.RequestKeyframe()
+		s.asked = true
+	}
+
+	if s.part.empty() {
+		s.part.start = t
+		s.part.independent = f.sync
+	}
+	s.part.video = append(s.part.video, f)
+	s.partEnd = t + d
+}
+
+// placeAudio adds a sample to an audio only period, where every sample is
+// a place to cut at.
+func (s *hlsStream) placeAudio(a fmp4Sample) {
+	t := mediaTime(a.dts, fmp4AudioTimescale)
+	d := mediaTime(int64(a.duration), fmp4AudioTimescale)
+
+	switch {
+	case s.open == nil:
+		s.openSegment(t)
+	case t-s.open.start+d > hlsSegmentTarget:
+		s.closeSegment(t)
+		s.openSegment(t)
+	case !s.part.empty() && t-s.part.start+d > hlsPartTarget:
+		s.closePart(t)
+	}
+
+	if s.part.empty() {
+		s.part.start = t
+		s.part.independent = true
+	}
+	s.part.audio = append(s.part.audio, a)
+	s.partEnd = t + d
+}
+
+func (s *hlsStream) openSegment(start time.Duration) {
+	s.open = &hlsSegment{
+		msn:           s.nextMSN,
+		mapID:         s.period.mapID,
+		discontinuity: s.period.discontinuity,
+		start:         start,
+	}
+	s.period.discontinuity = false
+	s.nextMSN++
+	s.asked = false
+}
+
+// closeSegment closes the open segment at end. A segment left without
+// parts is dropped and its sequence number reused.
+func (s *hlsStream) closeSegment(end time.Duration) {
+	if !s.part.empty() {
+		s.closePart(end)
+	}
+
+	seg := s.open
+	s.open = nil
+	if len(seg.parts) == 0 {
+		s.nextMSN = seg.msn
+		if seg.discontinuity && s.period != nil {
+			s.period.discontinuity = true
+		}
+		return
+	}
+
+	for _, part := range seg.parts {
+		seg.duration += part.duration
+	}
+	s.segments = append(s.segments, seg)
+
+	for len(s.segments) > hlsSegments {
+		if s.segments[0].discontinuity {
+			s.discSeq++
+		}
+		s.segments = s.segments[1:]
+	}
+
+	for mapID := range s.inits {
+		if !s.usesMap(mapID) {
+			delete(s.inits, mapID)
+		}
+	}
+
+	s.notify()
+}
+
+// closePart turns the samples gathered into a fragment ending at end,
+// along with the audio queued before it.
+func (s *hlsStream) closePart(end time.Duration) {
+	n := 0
+	for n < len(s.audioQueue) && mediaTime(s.audioQueue[n].dts, fmp4AudioTimescale) < end {
+		a := s.audioQueue[n]
+		if n+1 < len(s.audioQueue) && s.audioQueue[n+1].dts > a.dts {
+			a.duration = uint32(s.audioQueue[n+1].dts - a.dts)
+		}
+		s.part.audio = append(s.part.audio, a)
+		s.audioEnd = mediaTime(a.dts+int64(a.duration), fmp4AudioTimescale)
+		n++
+	}
+	s.audioQueue = append(s.audioQueue[:0], s.audioQueue[n:]...)
+
+	s.open.parts = append(s.open.parts, &hlsPart{
+		data:        fmp4Fragment(s.fragments, s.part.video, s.part.audio),
+		duration:    end - s.part.start,
+		independent: s.part.independent,
+	})
+	s.fragments++
+	s.part = hlsPartBuilder{}
+
+	s.notify()
+}
+
+func (s *hlsStream) usesMap(mapID int) bool {
+	if (s.period != nil && s.period.mapID == mapID) || (s.open != nil && s.open.mapID == mapID) {
+		return true
+	}
+	for _, seg := range s.segments {
+		if seg.mapID == mapID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// notify wakes the requests waiting for the stream to change. Callers hold
+// s.mux.
+func (s *hlsStream) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// wait calls ready with s.mux held until it reports done, and returns
+// still holding s.mux then. Otherwise it gives up once the stream stops or
+// hlsBlockTimeout passes.
+func (s *hlsStream) wait(ctx context.Context, ready func() bool) error {
+	timer := time.NewTimer(hlsBlockTimeout)
+	defer timer.Stop()
+
+	for {
+		s.mux.Lock()
+		if ready() {
+			return nil
+		}
+		stopped := s.stopped
+		changed := s.changed
+		s.mux.Unlock()
+
+		if stopped {
+			return ErrHLSNotReady
+		}
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			return ErrHLSNotReady
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (s *hlsStream) playlist(ctx context.Context, msn, part int) ([]byte, error) {
+	s.mux.Lock()
+	tooFar := msn > s.nextMSN+1
+	s.mux.Unlock()
+
+	if tooFar || (part >= 0 && msn < 0) {
+		return nil, ErrInvalidHLS
+	}
+
+	err := s.wait(ctx, func() bool {
+		if len(s.segments) == 0 && (s.open == nil || len(s.open.parts) == 0) {
+			return false
+		}
+		if msn < 0 || s.stopped {
+			return true
+		}
+
+		if n := len(s.segments); n > 0 && s.segments[n-1].msn >= msn {
+			return true
+		}
+
+		return part >= 0 && s.open != nil && (s.open.msn > msn || (s.open.msn == msn && len(s.open.parts) > part))
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer s.mux.Unlock()
+
+	return s.render(), nil
+}
+
+// render writes the media playlist. Callers hold s.mux.
+func (s *hlsStream) render() []byte {
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	b.WriteString("#EXT-X-VERSION:9\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", int(hlsTargetDuration.Seconds()))
+	fmt.Fprintf(&b, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%.3f\n", (3 * hlsPartTarget).Seconds())
+	fmt.Fprintf(&b, "#EXT-X-PART-INF:PART-TARGET=%.3f\n", hlsPartTarget.Seconds())
+
+	segments := s.segments
+	if s.open != nil {
+		segments = append(segments[:len(segments):len(segments)], s.open)
+	}
+
+	first := s.nextMSN
+	if len(segments) > 0 {
+		first = segments[0].msn
+	}
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", first)
+	fmt.Fprintf(&b, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", s.discSeq)
+
+	mapID := -1
+	for i, seg := range segments {
+		if seg.discontinuity {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		if seg.mapID != mapID {
+			mapID = seg.mapID
+			fmt.Fprintf(&b, "#EXT-X-MAP:URI=\"init%d.mp4\"\n", mapID)
+		}
+		fmt.Fprintf(&b, "#EXT-X-PROGRAM-DATE-TIME:%s\n", s.startedAt.Add(seg.start).UTC().Format("2006-01-02T15:04:05.000Z"))
+
+		if seg == s.open || i >= len(s.segments)-hlsPartSegments {
+			for j, part := range seg.parts {
+				fmt.Fprintf(&b, "#EXT-X-PART:DURATION=%.5f,URI=\"seg%d.%d.m4s\"", part.duration.Seconds(), seg.msn, j)
+				if part.independent {
+					b.WriteString(",INDEPENDENT=YES")
+				}
+				b.WriteString("\n")
+			}
+		}
+
+		if seg != s.open {
+			fmt.Fprintf(&b, "#EXTINF:%.5f,\nseg%d.m4s\n", seg.duration.Seconds(), seg.msn)
+		}
+	}
+
+	if s.stopped {
+		b.WriteString("#EXT-X-ENDLIST\n")
+	} else if s.open != nil {
+		fmt.Fprintf(&b, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"seg%d.%d.m4s\"\n", s.open.msn, len(s.open.parts))
+	}
+
+	return []byte(b.String())
+}
+
+// file serves init{map}.mp4, seg{msn}.m4s and seg{msn}.{part}.m4s.
+func (s *hlsStream) file(ctx context.Context, name string) ([]byte, string, error) {
+	if mapID, ok := parseHLSName(name, "init", ".mp4", 1); ok {
+		s.mux.Lock()
+		defer s.mux.Unlock()
+
+		data, ok := s.inits[mapID[0]]
+		if !ok {
+			return nil, "", ErrHLSNotFound
+		}
+
+		return data, "video/mp4", nil
+	}
+
+	if msn, ok := parseHLSName(name, "seg", ".m4s", 1); ok {
+		s.mux.Lock()
+		defer s.mux.Unlock()
+
+		for _, seg := range s.segments {
+			if seg.msn == msn[0] {
+				var data []byte
+				for _, part := range seg.parts {
+					data = append(data, part.data...)
+				}
+
+				return data, "video/iso.segment", nil
+			}
+		}
+
+		return nil, "", ErrHLSNotFound
+	}
+
+	ids, ok := parseHLSName(name, "seg", ".m4s", 2)
+	if !ok {
+		return nil, "", ErrHLSNotFound
+	}
+	msn, index := ids[0], ids[1]
+
+	var data []byte
+	err := s.wait(ctx, func() bool {
+		segments := s.segments
+		if s.open != nil {
+			segments = append(segments[:len(segments):len(segments)], s.open)
+		}
+		for _, seg := range segments {
+			if seg.msn == msn && index < len(seg.parts) {
+				data = seg.parts[index].data
+				return true
+			}
+		}
+
+		// Only the part hinted at is waited for.
+		hinted := (s.open != nil && s.open.msn == msn && index == len(s.open.parts)) ||
+			(msn == s.nextMSN && index == 0)
+		return !hinted
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	s.mux.Unlock()
+
+	if data == nil {
+		return nil, "", ErrHLSNotFound
+	}
+
+	return data, "video/iso.segment", nil
+}
+
+// parseHLSName parses prefix{n}[.{n}...]suffix with count numbers.
+func parseHLSName(name, prefix, suffix string, count int) ([]int, bool) {
+	rest, ok := strings.CutPrefix(name, prefix)
+	if !ok {
+		return nil, false
+	}
+	rest, ok = strings.CutSuffix(rest, suffix)
+	if !ok {
+		return nil, false
+	}
+
+	fields := strings.Split(rest, ".")
+	if len(fields) != count {
+		return nil, false
+	}
+
+	ids := make([]int, count)
+	for i, field := range fields {
+		n, err := strconv.Atoi(field)
+		if err != nil || n < 0 {
+			return nil, false
+		}
+		ids[i] = n
+	}
+
+	return ids, true
+}
+
+// mediaTime converts ticks of timescale into a duration.
+func mediaTime(ticks int64, timescale int64) time.Duration {
+	return time.Duration(ticks/timescale)*time.Second + time.Duration(ticks%timescale)*time.Second/time.Duration(timescale)
+}
+
+func (c *h264Config) equal(other *h264Config) bool {
+	return string(c.sps) == string(other.sps) && string(c.pps) == string(other.pps)
+}
+
+// hlsSink turns a forwarder's packets into samples for the stream: access
+// units of the video in AVCC form, or Opus packets.
+type hlsSink struct {
+	stream    *hlsStream
+	forwarder *TrackForwarder
+	video     bool
+	clockRate int64
+
+	reorder reorderBuffer
+	builder *samplebuilder.SampleBuilder
+
+	started bool
+	base    int64
+	lastTS  uint32
+	elapsed int64
+}
+
+func newHLSSink(s *hlsStream, forwarder *TrackForwarder, video bool) *hlsSink {
+	k := &hlsSink{stream: s, forwarder: forwarder, video: video, clockRate: fmp4AudioTimescale}
+	if video {
+		k.clockRate = fmp4VideoTimescale
+		k.builder = samplebuilder.New(sampleMaxLate, &codecs.H264Packet{}, fmp4VideoTimescale)
+	}
+
+	return k
+}
+
+func (k *hlsSink) Write(b []byte) (int, error) {
+	pkt := &rtp.Packet{}
+	if err := pkt.Unmarshal(append([]byte(nil), b...)); err != nil {
+		return 0, err
+	}
+
+	ordered, skipped := k.reorder.push(pkt)
+	if skipped && k.video {
+		k.forwarder.RequestKeyframe()
+	}
+
+	for _, p := range ordered {
+		if !k.video {
+			if len(p.Payload) > 0 {
+				k.stream.writeAudio(fmp4Sample{
+					dts:      k.dts(p.Timestamp),
+					duration: uint32(opusSamples(p.Payload)),
+					sync:     true,
+					data:     p.Payload,
+				})
+			}
+			continue
+		}
+
+		k.builder.Push(p)
+		for sample, ts := k.builder.PopWithTimestamp(); sample != nil; sample, ts = k.builder.PopWithTimestamp() {
+			k.writeFrame(sample.Data, k.dts(ts))
+		}
+	}
+
+	return len(b), nil
+}
+
+// writeFrame converts an Annex B access unit to AVCC, taking the parameter
+// sets out of it for the initialization section.
+func (k *hlsSink) writeFrame(data []byte, dts int64) {
+	var cfg h264Config
+	frame := fmp4Sample{dts: dts}
+	for _, nalu := range annexBNALUs(data) {
+		if len(nalu) == 0 {
+			continue
+		}
+
+		switch nalu[0] & 0x1f {
+		case h264NALUSPS:
+			cfg.sps = nalu
+			continue
+		case h264NALUPPS:
+			cfg.pps = nalu
+			continue
+		case h264NALUAUD:
+			continue
+		case h264NALUIDR:
+			frame.sync = true
+		}
+
+		frame.data = append(frame.data, byte(len(nalu)>>24), byte(len(nalu)>>16), byte(len(nalu)>>8), byte(len(nalu)))
+		frame.data = append(frame.data, nalu...)
+	}
+	if len(frame.data) == 0 {
+		return
+	}
+
+	var params *h264Config
+	if cfg.sps != nil && cfg.pps != nil {
+		width, height, err := h264Dimensions(cfg.sps)
+		if err != nil {
+			slog.Warn("Dropping H.264 parameter sets", slog.String("hls", k.stream.id), slog.String("error", err.Error()))
+		} else {
+			cfg.width, cfg.height = width, height
+			params = &cfg
+		}
+	}
+
+	k.stream.writeVideo(frame, params)
+}
+
+// dts places an RTP timestamp on the stream's timeline.
+func (k *hlsSink) dts(ts uint32) int64 {
+	if !k.started {
+		k.started = true
+		k.base = int64(time.Since(k.stream.startedAt)/time.Millisecond) * k.clockRate / 1000
+		k.lastTS = ts
+	}
+
+	k.elapsed += int64(int32(ts - k.lastTS))
+	k.lastTS = ts
+
+	return k.base + k.elapsed
+}
+
+func (k *hlsSink) Close() error {
+	k.stream.released(k)
+	return nil
+}
@@ -0,0 +1,315 @@
+package sfu
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+)
+
+const (
+	// rtpReadBuffer is the socket buffer of an ingest port, large enough
+	// to ride out the burst of a keyframe.
+	rtpReadBuffer = 1 << 20
+
+	// maxRoomIngests bounds the RTP ingests of a room, and so the ports it
+	// binds.
+	maxRoomIngests = 4
+)
+
+var ErrIngestLimit = errors.New("room has too many RTP ingests")
+
+// RTPIngestTrack is one plain RTP stream a member sends to the SFU over UDP,
+// without ICE or DTLS. Port is the local port to receive on; zero picks a
+// free one, reported in the publisher's track address. PayloadType and SSRC
+// pick one stream when several arrive on the port, and without an SSRC the
+// first stream received is kept.
+type RTPIngestTrack struct {
+	Port        int               `json:"port,omitempty"`
+	MimeType    string            `json:"mimeType"`
+	PayloadType uint8             `json:"payloadType,omitempty"`
+	SSRC        uint32            `json:"ssrc,omitempty"`
+	Source      TrackSource       `json:"source,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+}
+
+// RTPIngestRequest binds a member to plain RTP input, e.g. from ffmpeg,
+// GStreamer or a hardware encoder. The streams are described either by SDP,
+// the text of an SDP file such as ffmpeg writes with -sdp_file, or by
+// Tracks. The connection address of the SDP is ignored: the SFU always
+// receives on its RTP address.
+//
+// Sender is the IP address the streams come from; packets from anywhere
+// else are dropped. Without it, each port keeps to the address and port of
+// the first packet it receives.
+type RTPIngestRequest struct {
+	MemberID string           `json:"memberId"`
+	Name     string           `json:"name,omitempty"`
+	SDP      string           `json:"sdp,omitempty"`
+	Tracks   []RTPIngestTrack `json:"tracks,omitempty"`
+	Sender   string           `json:"sender,omitempty"`
+}
+
+// StartRTPIngest adds a member whose tracks are received as plain RTP. The
+// member is a virtual publisher: it is listed and stopped like one, and
+// stays until StopPublisher or the room closes.
+func (r *Room) StartRTPIngest(actor string, req RTPIngestRequest) (PublisherInfo, error) {
+	tracks := req.Tracks
+	if req.SDP != "" {
+		if len(tracks) > 0 {
+			return PublisherInfo{}, ErrInvalidPublisher
+		}
+
+		parsed, err := parseIngestSDP(req.SDP)
+		if err != nil {
+			return PublisherInfo{}, err
+		}
+		tracks = parsed
+	}
+
+	if req.MemberID == "" || len(tracks) == 0 || len(tracks) > maxPublisherTracks {
+		return PublisherInfo{}, ErrInvalidPublisher
+	}
+
+	var sender netip.Addr
+	if req.Sender != "" {
+		addr, err := netip.ParseAddr(req.Sender)
+		if err != nil {
+			return PublisherInfo{}, fmt.Errorf("%w: %v", ErrInvalidPublisher, err)
+		}
+		sender = addr.Unmap()
+	}
+
+	// addPublisher checks the limit again, as ingests may start meanwhile;
+	// this only spares binding ports that are closed right away.
+	r.mux.RLock()
+	ingests := r.ingestCount()
+	r.mux.RUnlock()
+	if ingests >= maxRoomIngests {
+		return PublisherInfo{}, ErrIngestLimit
+	}
+
+	vp := newVirtualPublisher(r, req.MemberID, req.Name, false)
+
+	var decls []TrackDeclaration
+	addresses := make([]string, 0, len(tracks))
+	for _, spec := range tracks {
+		track, err := r.svc.openRTPTrack(spec, req.MemberID, sender)
+		if err != nil {
+			vp.close()
+			return PublisherInfo{}, err
+		}
+		vp.tracks = append(vp.tracks, track)
+
+		decls = append(decls, TrackDeclaration{TrackID: track.ID(), Source: spec.Source, Metadata: spec.Metadata})
+		addresses = append(addresses, track.address)
+	}
+
+	return r.addPublisher(actor, "ingest-start", strings.Join(addresses, ","), vp, decls)
+}
+
+// ingestCount counts the room's virtual publishers that receive RTP.
+// Callers hold r.mux.
+func (r *Room) ingestCount() int {
+	n := 0
+	for _, vp := range r.publishers {
+		if vp.ingest() {
+			n++
+		}
+	}
+
+	return n
+}
+
+// parseIngestSDP turns every media section of an SDP into a track. Each
+// section takes its first payload type whose codec the SFU supports.
+func parseIngestSDP(text string) ([]RTPIngestTrack, error) {
+	var desc sdp.SessionDescription
+	if err := desc.UnmarshalString(text); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPublisher, err)
+	}
+
+	var tracks []RTPIngestTrack
+	for _, media := range desc.MediaDescriptions {
+		// A zero port disables the section.
+		if media.MediaName.Port.Value == 0 {
+			continue
+		}
+
+		track := RTPIngestTrack{Port: media.MediaName.Port.Value}
+		for _, attr := range media.Attributes {
+			switch attr.Key {
+			case "rtpmap":
+				if track.MimeType != "" {
+					continue
+				}
+
+				pt, encoding, ok := parseRTPMap(attr.Value)
+				if !ok {
+					continue
+				}
+				name, clockRate, _ := strings.Cut(encoding, "/")
+				clockRate, _, _ = strings.Cut(clockRate, "/")
+
+				codec, ok := registeredCodec(media.MediaName.Media + "/" + name)
+				if !ok || strconv.FormatUint(uint64(codec.ClockRate), 10) != clockRate {
+					continue
+				}
+				track.MimeType, track.PayloadType = codec.MimeType, pt
+			case "ssrc":
+				if track.SSRC != 0 {
+					continue
+				}
+
+				id, _, _ := strings.Cut(attr.Value, " ")
+				if ssrc, err := strconv.ParseUint(id, 10, 32); err == nil {
+					track.SSRC = uint32(ssrc)
+				}
+			}
+		}
+
+		if track.MimeType == "" {
+			return nil, ErrUnsupportedMedia
+		}
+		tracks = append(tracks, track)
+	}
+
+	return tracks, nil
+}
+
+// parseRTPMap splits an rtpmap value such as "96 VP8/90000".
+func parseRTPMap(value string) (uint8, string, bool) {
+	pt, encoding, ok := strings.Cut(value, " ")
+	if !ok {
+		return 0, "", false
+	}
+
+	n, err := strconv.ParseUint(pt, 10, 7)
+	if err != nil {
+		return 0, "", false
+	}
+
+	return uint8(n), strings.TrimSpace(encoding), true
+}
+
+// openRTPTrack binds spec's port on the SFU's RTP address. Packets are
+// taken only from sender when it is valid.
+func (svc *services) openRTPTrack(spec RTPIngestTrack, streamID string, sender netip.Addr) (*virtualTrack, error) {
+	codec, ok := registeredCodec(spec.MimeType)
+	if !ok {
+		return nil, ErrUnsupportedMedia
+	}
+
+	ip := net.ParseIP(svc.rtpAddress)
+	if ip == nil || spec.Port < 0 || spec.Port > 65535 {
+		return nil, ErrInvalidPublisher
+	}
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip, Port: spec.Port})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPublisher, err)
+	}
+	_ = conn.SetReadBuffer(rtpReadBuffer)
+
+	media := &udpMedia{
+		conn:        conn,
+		sender:      sender,
+		payloadType: spec.PayloadType,
+		ssrc:        spec.SSRC,
+		buf:         make([]byte, maxPacketSize),
+	}
+
+	track := newVirtualTrack("", streamID, codec, media, false)
+	track.address = conn.LocalAddr().String()
+
+	return track, nil
+}
+
+// udpMedia receives one RTP stream on a UDP socket. Packets are due as soon
+// as they arrive, and keyframe requests cannot reach the sender, so video
+// senders should be set up with a short keyframe interval.
+//
+// Nothing authenticates plain RTP, so the stream is kept to one source:
+// the sender address when one is given, or else the first address and port
+// heard from.
+type udpMedia struct {
+	conn        *net.UDPConn
+	sender      netip.Addr
+	source      netip.AddrPort
+	payloadType uint8
+	ssrc        uint32
+	buf         []byte
+}
+
+// accepts reports whether a packet from addr belongs to the stream.
+func (m *udpMedia) accepts(addr netip.AddrPort) bool {
+	addr = netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+
+	if m.sender.IsValid() {
+		return addr.Addr() == m.sender
+	}
+	if !m.source.IsValid() {
+		m.source = addr
+	}
+
+	return addr == m.source
+}
+
+func (m *udpMedia) next() (*rtp.Packet, time.Duration, error) {
+	for {
+		n, addr, err := m.conn.ReadFromUDPAddrPort(m.buf)
+		if errors.Is(err, net.ErrClosed) || errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil, 0, io.EOF
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		if !m.accepts(addr) {
+			continue
+		}
+
+		pkt := &rtp.Packet{}
+		if err := pkt.Unmarshal(m.buf[:n]); err != nil {
+			continue
+		}
+
+		// RTCP multiplexed onto the port shows up with payload types 64
+		// to 95 (RFC 5761, section 4).
+		if pkt.PayloadType >= 64 && pkt.PayloadType <= 95 {
+			continue
+		}
+		if m.payloadType != 0 && pkt.PayloadType != m.payloadType {
+			continue
+		}
+
+		if m.ssrc == 0 {
+			m.ssrc = pkt.SSRC
+		}
+		if pkt.SSRC != m.ssrc {
+			continue
+		}
+
+		return pkt, 0, nil
+	}
+}
+
+// rewind is never called: live media does not loop.
+func (m *udpMedia) rewind() error {
+	return ErrUnsupportedMedia
+}
+
+func (m *udpMedia) SetReadDeadline(deadline time.Time) error {
+	return m.conn.SetReadDeadline(deadline)
+}
+
+func (m *udpMedia) Close() error {
+	return m.conn.Close()
+}
@@ -0,0 +1,138 @@
+package sfu
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"gonference/internal/config"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+func TestRTPIngestLimit(t *testing.T) {
+	s, err := New(config.SFU{RTPAddress: "127.0.0.1", Recordings: config.Storage{Dir: t.TempDir()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	s.SetQuota("acme", Quota{MaxParticipants: maxRoomIngests + 1})
+
+	room, err := s.CreateRoom("acme", "a", RoomOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ingest := func(id string) error {
+		_, err := room.StartRTPIngest(systemActor, RTPIngestRequest{
+			MemberID: id,
+			Tracks:   []RTPIngestTrack{{MimeType: webrtc.MimeTypeVP8}},
+		})
+		return err
+	}
+
+	for i := 0; i < maxRoomIngests; i++ {
+		if err := ingest(string(rune('a' + i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ingest("over"); !errors.Is(err, ErrIngestLimit) {
+		t.Fatalf("got %v, want %v", err, ErrIngestLimit)
+	}
+
+	// Ingests take participant slots: one is left, then one more once an
+	// ingest stops.
+	if _, err := room.AddPeer(&testSignaling{}, joinRequest(t, "m1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := room.StopPublisher(systemActor, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := room.AddPeer(&testSignaling{}, joinRequest(t, "m2")); err != nil {
+		t.Fatalf("after an ingest stopped: %v", err)
+	}
+	if _, err := room.AddPeer(&testSignaling{}, joinRequest(t, "m3")); !errors.Is(err, ErrParticipantQuota) {
+		t.Fatalf("got %v, want %v", err, ErrParticipantQuota)
+	}
+}
+
+// udpSender sends RTP packets of one SSRC from a local address.
+func udpSender(t *testing.T, ip string, to net.Addr) *net.UDPConn {
+	t.Helper()
+
+	conn, err := net.DialUDP("udp", &net.UDPAddr{IP: net.ParseIP(ip)}, to.(*net.UDPAddr))
+	if err != nil {
+		t.Skipf("cannot send from %s: %v", ip, err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	return conn
+}
+
+func sendRTP(t *testing.T, conn *net.UDPConn, seq uint16) {
+	t.Helper()
+
+	pkt := rtp.Packet{Header: rtp.Header{Version: 2, PayloadType: 96, SequenceNumber: seq, SSRC: 1}, Payload: []byte{0}}
+	data, err := pkt.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUDPMediaKeepsToOneSource(t *testing.T) {
+	tests := []struct {
+		name   string
+		sender netip.Addr
+		// want lists the sequence numbers received, of packets 1 and 3
+		// from 127.0.0.1 and 2 from 127.0.0.2.
+		want []uint16
+	}{
+		{"first source", netip.Addr{}, []uint16{1, 3}},
+		{"given sender", netip.MustParseAddr("127.0.0.2"), []uint16{2}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			m := &udpMedia{conn: conn, sender: tt.sender, buf: make([]byte, maxPacketSize)}
+			t.Cleanup(func() { _ = m.Close() })
+
+			first := udpSender(t, "127.0.0.1", conn.LocalAddr())
+			other := udpSender(t, "127.0.0.2", conn.LocalAddr())
+			sendRTP(t, first, 1)
+			sendRTP(t, other, 2)
+			sendRTP(t, first, 3)
+
+			if err := m.SetReadDeadline(time.Now().Add(200 * time.Millisecond)); err != nil {
+				t.Fatal(err)
+			}
+
+			var got []uint16
+			for {
+				pkt, _, err := m.next()
+				if err != nil {
+					break
+				}
+				got = append(got, pkt.SequenceNumber)
+			}
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("received %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("received %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,307 @@
+package sfu
+
+import (
+	"errors"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrPollNotFound  = errors.New("poll not found")
+	ErrPollClosed    = errors.New("poll is closed")
+	ErrInvalidPoll   = errors.New("a poll needs a question and at least two options")
+	ErrInvalidVote   = errors.New("no such poll option")
+	ErrInvalidEmoji  = errors.New("reaction must be a short emoji")
+	ErrReactionLimit = errors.New("reaction rate limit exceeded")
+)
+
+const (
+	maxReactionBytes = 32
+	maxPollOptions   = 10
+
+	// Reactions are ephemeral, so a member sending them faster than this is
+	// just flooding the room.
+	reactionRate  = 3
+	reactionBurst = 10
+)
+
+// HandRaise is a member waiting to speak. The queue is ordered by RaisedAt.
+type HandRaise struct {
+	MemberID string    `json:"memberId"`
+	Name     string    `json:"name"`
+	RaisedAt time.Time `json:"raisedAt"`
+}
+
+// PollRequest describes a poll to open.
+type PollRequest struct {
+	Question  string   `json:"question"`
+	Options   []string `json:"options"`
+	Anonymous bool     `json:"anonymous"`
+}
+
+// Poll is a poll as members see it. Results are only filled in once the poll
+// is closed, and Voters only for named polls.
+type Poll struct {
+	ID        string     `json:"id"`
+	Question  string     `json:"question"`
+	Options   []string   `json:"options"`
+	Anonymous bool       `json:"anonymous"`
+	CreatedBy string     `json:"createdBy"`
+	CreatedAt time.Time  `json:"createdAt"`
+	ClosedAt  *time.Time `json:"closedAt,omitempty"`
+	Votes     int        `json:"votes"`
+	Results   []int      `json:"results,omitempty"`
+	Voters    [][]string `json:"voters,omitempty"`
+}
+
+type poll struct {
+	Poll
+	// ballots maps a member to the option they voted for; members may
+	// change their vote until the poll closes.
+	ballots map[string]int
+}
+
+// view returns the poll as members see it. Callers hold r.mux.
+func (p *poll) view() Poll {
+	view := p.Poll
+	view.Options = slices.Clone(p.Options)
+	view.Votes = len(p.ballots)
+
+	if p.ClosedAt == nil {
+		return view
+	}
+
+	view.Results = make([]int, len(p.Options))
+	if !p.Anonymous {
+		view.Voters = make([][]string, len(p.Options))
+	}
+	for member, option := range p.ballots {
+		view.Results[option]++
+		if !p.Anonymous {
+			view.Voters[option] = append(view.Voters[option], member)
+		}
+	}
+	for _, voters := range view.Voters {
+		slices.Sort(voters)
+	}
+
+	return view
+}
+
+// RaiseHand puts the member at the back of the hand queue. Raising an
+// already raised hand keeps its place.
+func (r *Room) RaiseHand(peer *Peer) {
+	r.mux.Lock()
+	if slices.ContainsFunc(r.hands, func(h HandRaise) bool { return h.MemberID == peer.ID() }) {
+		r.mux.Unlock()
+		return
+	}
+
+	hand := HandRaise{MemberID: peer.ID(), Name: peer.Name(), RaisedAt: time.Now()}
+	r.hands = append(r.hands, hand)
+	r.mux.Unlock()
+
+	r.broadcast(nil, "hand-raised", map[string]any{"hand": hand})
+	r.notifyModerators("hands", map[string]any{"hands": r.Hands()})
+}
+
+// LowerHand takes a member out of the hand queue. Members lower their own
+// hand; moderators may lower anyone's.
+func (r *Room) LowerHand(actor, id string) error {
+	if !r.dropHand(id) {
+		return ErrPeerNotFound
+	}
+
+	if actor != id {
+		r.audit(actor, "lower-hand", id, "")
+	}
+
+	return nil
+}
+
+// Hands returns the hand queue, longest waiting first.
+func (r *Room) Hands() []HandRaise {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	return slices.Clone(r.hands)
+}
+
+// dropHand removes id from the hand queue and tells the room, reporting
+// whether their hand was raised.
+func (r *Room) dropHand(id string) bool {
+	r.mux.Lock()
+	i := slices.IndexFunc(r.hands, func(h HandRaise) bool { return h.MemberID == id })
+	if i < 0 {
+		r.mux.Unlock()
+		return false
+	}
+	r.hands = slices.Delete(r.hands, i, i+1)
+	r.mux.Unlock()
+
+	r.broadcast(nil, "hand-lowered", map[string]any{"memberId": id})
+	r.notifyModerators("hands", map[string]any{"hands": r.Hands()})
+
+	return true
+}
+
+// React broadcasts an ephemeral emoji reaction. Reactions are not kept, so
+// late joiners never see them.
+func (r *Room) React(peer *Peer, emoji string) error {
+	emoji = strings.TrimSpace(emoji)
+	if emoji == "" || len(emoji) > maxReactionBytes || !utf8.ValidString(emoji) {
+		return ErrInvalidEmoji
+	}
+
+	if !peer.reactions.Allow() {
+		return ErrReactionLimit
+	}
+
+	r.broadcast(nil, "reaction", map[string]any{
+		"memberId": peer.ID(),
+		"emoji":    emoji,
+	})
+
+	return nil
+}
+
+// CreatePoll opens a poll in the room and announces it to every member.
+func (r *Room) CreatePoll(actor string, req PollRequest) (Poll, error) {
+	req.Question = strings.TrimSpace(req.Question)
+	if req.Question == "" || len(req.Options) < 2 || len(req.Options) > maxPollOptions {
+		return Poll{}, ErrInvalidPoll
+	}
+
+	p := &poll{
+		Poll: Poll{
+			ID:        uuid.NewString(),
+			Question:  req.Question,
+			Options:   slices.Clone(req.Options),
+			Anonymous: req.Anonymous,
+			CreatedBy: actor,
+			CreatedAt: time.Now(),
+		},
+		ballots: make(map[string]int),
+	}
+
+	r.mux.Lock()
+	r.polls[p.ID] = p
+	view := p.view()
+	r.mux.Unlock()
+
+	r.audit(actor, "poll-create", p.ID, p.Question)
+	r.broadcast(nil, "poll-opened", map[string]any{"poll": view})
+
+	return view, nil
+}
+
+// Vote records or changes a member's vote in an open poll. Only the vote
+// count is announced until the poll closes.
+func (r *Room) Vote(peer *Peer, pollID string, option int) error {
+	r.mux.Lock()
+	p, ok := r.polls[pollID]
+	switch {
+	case !ok:
+		r.mux.Unlock()
+		return ErrPollNotFound
+	case p.ClosedAt != nil:
+		r.mux.Unlock()
+		return ErrPollClosed
+	case option < 0 || option >= len(p.Options):
+		r.mux.Unlock()
+		return ErrInvalidVote
+	}
+
+	p.ballots[peer.ID()] = option
+	votes := len(p.ballots)
+	r.mux.Unlock()
+
+	r.broadcast(nil, "poll-voted", map[string]any{"pollId": pollID, "votes": votes})
+
+	return nil
+}
+
+// ClosePoll stops voting and broadcasts the results.
+func (r *Room) ClosePoll(actor, pollID string) (Poll, error) {
+	r.mux.Lock()
+	p, ok := r.polls[pollID]
+	if !ok {
+		r.mux.Unlock()
+		return Poll{}, ErrPollNotFound
+	}
+	if p.ClosedAt != nil {
+		r.mux.Unlock()
+		return Poll{}, ErrPollClosed
+	}
+
+	now := time.Now()
+	p.ClosedAt = &now
+	view := p.view()
+	r.mux.Unlock()
+
+	r.audit(actor, "poll-close", pollID, "")
+	r.broadcast(nil, "poll-closed", map[string]any{"poll": view})
+
+	return view, nil
+}
+
+// Polls returns every poll in the room, oldest first.
+func (r *Room) Polls() []Poll {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	return r.pollList(false)
+}
+
+func (r *Room) Poll(id string) (Poll, error) {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	p, ok := r.polls[id]
+	if !ok {
+		return Poll{}, ErrPollNotFound
+	}
+
+	return p.view(), nil
+}
+
+// pollList returns the room's polls, oldest first. Callers hold r.mux.
+func (r *Room) pollList(openOnly bool) []Poll {
+	polls := make([]Poll, 0, len(r.polls))
+	for _, p := range r.polls {
+		if openOnly && p.ClosedAt != nil {
+			continue
+		}
+		polls = append(polls, p.view())
+	}
+
+	slices.SortFunc(polls, func(a, b Poll) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+
+	return polls
+}
+
+// sendRoomState brings a joining member up to date with the raised hands,
+// open polls and shared state, and tells them about recordings in progress.
+func (r *Room) sendRoomState(peer *Peer) {
+	r.mux.RLock()
+	hands := slices.Clone(r.hands)
+	polls := r.pollList(true)
+	r.mux.RUnlock()
+
+	err := peer.send("room-state", map[string]any{
+		"hands":      hands,
+		"polls":      polls,
+		"state":      r.State(),
+		"recordings": r.Recordings(),
+	})
+	if err != nil {
+		peer.logger.Error("Failed to send room state", slog.String("error", err.Error()))
+	}
+}
@@ -0,0 +1,75 @@
+package sfu
+
+import (
+	"context"
+	"sync"
+)
+
+// goroutines tracks the SFU's long-running goroutines by name so shutdown
+// can wait for them and report any that leak.
+var goroutines = &tracker{live: make(map[string]int)}
+
+type tracker struct {
+	wg sync.WaitGroup
+
+	mux  sync.Mutex
+	live map[string]int
+}
+
+// Go runs f on a new goroutine accounted under name.
+func (t *tracker) Go(name string, f func()) {
+	t.wg.Add(1)
+	t.mux.Lock()
+	t.live[name]++
+	t.mux.Unlock()
+
+	go func() {
+		defer func() {
+			t.mux.Lock()
+			t.live[name]--
+			if t.live[name] == 0 {
+				delete(t.live, name)
+			}
+			t.mux.Unlock()
+
+			t.wg.Done()
+		}()
+
+		f()
+	}()
+}
+
+// Wait blocks until every tracked goroutine has returned or ctx is done.
+func (t *tracker) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Live returns how many tracked goroutines are running, by name.
+func (t *tracker) Live() map[string]int {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	live := make(map[string]int, len(t.live))
+	for name, n := range t.live {
+		live[name] = n
+	}
+
+	return live
+}
+
+// LiveGoroutines reports the SFU goroutines still running, by name. It is
+// empty once every room, peer and forwarder has been released.
+func LiveGoroutines() map[string]int {
+	return goroutines.Live()
+}
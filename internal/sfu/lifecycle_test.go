@@ -0,0 +1,82 @@
+package sfu
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// assertDrained waits for the SFU's goroutines and fails the test with
+// those still running.
+func assertDrained(t *testing.T) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := goroutines.Wait(ctx); err != nil {
+		t.Fatalf("goroutines still running: %v", LiveGoroutines())
+	}
+	if live := LiveGoroutines(); len(live) != 0 {
+		t.Fatalf("goroutines still running: %v", live)
+	}
+}
+
+func TestRoomCloseReleasesGoroutines(t *testing.T) {
+	s := newTestSFU(t)
+
+	room, err := s.CreateRoom("", "a", RoomOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice := newTestClient(t, room, "alice", true)
+	bob := newTestClient(t, room, "bob", false)
+
+	waitFor(t, "alice's track to reach bob", func() bool {
+		live := LiveGoroutines()
+		return live["forwarder"] == 1 && live["subscriber"] == 1
+	})
+
+	// Leaving releases what the member used, closing the rest.
+	room.RemovePeer(bob.id)
+	waitFor(t, "bob's subscription to end", func() bool {
+		return LiveGoroutines()["subscriber"] == 0
+	})
+
+	room.Close()
+	alice.close()
+	bob.close()
+
+	if _, ok := s.GetRoom("", "a"); ok {
+		t.Fatal("closed room is still registered")
+	}
+	assertDrained(t)
+}
+
+func TestIdleRoomReleasesGoroutines(t *testing.T) {
+	timeout := idleRoomTimeout
+	idleRoomTimeout = 100 * time.Millisecond
+	t.Cleanup(func() { idleRoomTimeout = timeout })
+
+	s := newTestSFU(t)
+
+	room, err := s.CreateRoom("", "a", RoomOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice := newTestClient(t, room, "alice", true)
+	waitFor(t, "alice's track", func() bool {
+		return LiveGoroutines()["forwarder"] == 1
+	})
+
+	room.RemovePeer(alice.id)
+	alice.close()
+
+	waitFor(t, "the idle room to close", func() bool {
+		_, ok := s.GetRoom("", "a")
+		return !ok
+	})
+	assertDrained(t)
+}
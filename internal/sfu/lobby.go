@@ -0,0 +1,195 @@
+package sfu
+
+import (
+	"log/slog"
+	"time"
+)
+
+// lobbyEntry is a member that is signaling-connected but has no
+// PeerConnection yet. Their offer is kept until a moderator decides.
+type lobbyEntry struct {
+	signal   Signaling
+	req      JoinRequest
+	joinedAt time.Time
+}
+
+// LobbyMember describes a member waiting for admission.
+type LobbyMember struct {
+	ID       string    `json:"id"`
+	Name     string    `json:"name,omitempty"`
+	JoinedAt time.Time `json:"joinedAt"`
+}
+
+// Join adds the member to the room, or parks them in the lobby when the room
+// requires admission. A nil peer with a nil error means the member is waiting.
+func (r *Room) Join(signal Signaling, req JoinRequest) (*Peer, error) {
+	id := req.MemberID
+
+	r.mux.Lock()
+	if err := r.joinable(id); err != nil {
+		r.mux.Unlock()
+		return nil, err
+	}
+	if _, waiting := r.lobby[id]; waiting {
+		r.mux.Unlock()
+		return nil, ErrMemberExists
+	}
+
+	if !r.options.Lobby || id == r.options.Host {
+		r.mux.Unlock()
+		return r.AddPeer(signal, req)
+	}
+
+	if _, ok := r.invited[id]; ok {
+		delete(r.invited, id)
+		r.mux.Unlock()
+
+		peer, err := r.AddPeer(signal, req)
+		if err != nil {
+			r.mux.Lock()
+			r.invited[id] = struct{}{}
+			r.mux.Unlock()
+		}
+		return peer, err
+	}
+
+	r.lobby[id] = &lobbyEntry{
+		signal:   signal,
+		req:      req,
+		joinedAt: time.Now(),
+	}
+	r.mux.Unlock()
+
+	if err := writeSignal(signal, r.id, id, "lobby", map[string]any{"status": "waiting"}); err != nil {
+		slog.Error("Failed to notify lobby member", slog.String("member", id), slog.String("error", err.Error()))
+	}
+
+	r.notifyModerators("lobby-join", map[string]any{"targetId": id, "name": req.Name})
+
+	return nil, nil
+}
+
+// Admit moves a waiting member into the room and negotiates their media. A
+// member who cannot join after all, e.g. as the room was locked meanwhile,
+// is turned away with the reason.
+func (r *Room) Admit(actor, id string) (*Peer, error) {
+	entry, err := r.takeFromLobby(id)
+	if err != nil {
+		return nil, err
+	}
+
+	peer, err := r.AddPeer(entry.signal, entry.req)
+	if err != nil {
+		fields := map[string]any{"by": actor, "reason": err.Error()}
+		if err := writeSignal(entry.signal, r.id, id, "rejected", fields); err != nil {
+			slog.Error("Failed to notify rejected member", slog.String("member", id), slog.String("error", err.Error()))
+		}
+
+		r.notifyModerators("lobby-rejected", map[string]any{"targetId": id, "by": actor, "reason": err.Error()})
+		r.closeIfIdle()
+
+		return nil, err
+	}
+
+	r.audit(actor, "admit", id, "")
+
+	if err := writeSignal(entry.signal, r.id, id, "admitted", map[string]any{"by": actor}); err != nil {
+		slog.Error("Failed to notify admitted member", slog.String("member", id), slog.String("error", err.Error()))
+	}
+
+	r.notifyModerators("lobby-admitted", map[string]any{"targetId": id, "by": actor})
+
+	return peer, nil
+}
+
+// Invite admits a member ahead of time: they skip the lobby the next time
+// they join.
+func (r *Room) Invite(actor, id string) {
+	r.mux.Lock()
+	r.invited[id] = struct{}{}
+	r.mux.Unlock()
+
+	r.audit(actor, "invite", id, "")
+}
+
+// Reject turns a waiting member away.
+func (r *Room) Reject(actor, id string) error {
+	entry, err := r.takeFromLobby(id)
+	if err != nil {
+		return err
+	}
+
+	r.audit(actor, "reject", id, "")
+
+	if err := writeSignal(entry.signal, r.id, id, "rejected", map[string]any{"by": actor}); err != nil {
+		slog.Error("Failed to notify rejected member", slog.String("member", id), slog.String("error", err.Error()))
+	}
+
+	r.notifyModerators("lobby-rejected", map[string]any{"targetId": id, "by": actor})
+	r.closeIfIdle()
+
+	return nil
+}
+
+// LeaveLobby drops a waiting member whose signaling connection went away.
+func (r *Room) LeaveLobby(id string) {
+	if _, err := r.takeFromLobby(id); err != nil {
+		return
+	}
+
+	r.notifyModerators("lobby-left", map[string]any{"targetId": id})
+	r.closeIfIdle()
+}
+
+// Lobby lists the members waiting for admission.
+func (r *Room) Lobby() []LobbyMember {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	members := make([]LobbyMember, 0, len(r.lobby))
+	for _, entry := range r.lobby {
+		members = append(members, LobbyMember{ID: entry.req.MemberID, Name: entry.req.Name, JoinedAt: entry.joinedAt})
+	}
+
+	return members
+}
+
+// sendLobby tells a moderator who just joined about the members already
+// waiting, as there may have been nobody to admit them.
+func (r *Room) sendLobby(moderator *Peer) {
+	for _, member := range r.Lobby() {
+		if err := moderator.send("lobby-join", map[string]any{"targetId": member.ID, "name": member.Name}); err != nil {
+			moderator.logger.Error("Failed to notify moderator", slog.String("error", err.Error()))
+		}
+	}
+}
+
+func (r *Room) takeFromLobby(id string) (*lobbyEntry, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	entry, ok := r.lobby[id]
+	if !ok {
+		return nil, ErrNotInLobby
+	}
+	delete(r.lobby, id)
+
+	return entry, nil
+}
+
+func (r *Room) notifyModerators(msgType string, fields map[string]any) {
+	r.mux.RLock()
+	moderators := make([]*Peer, 0)
+	for _, peer := range r.peers {
+		if peer.IsModerator() {
+			moderators = append(moderators, peer)
+		}
+	}
+	r.mux.RUnlock()
+
+	for _, peer := range moderators {
+		if err := peer.send(msgType, fields); err != nil {
+			peer.logger.Error("Failed to notify moderator", slog.String("error", err.Error()))
+		}
+	}
+}
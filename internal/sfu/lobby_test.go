@@ -0,0 +1,106 @@
+package sfu
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestLobbyEmptyRoomDoesNotBypass(t *testing.T) {
+	s := newTestSFU(t)
+
+	room, err := s.CreateRoom("", "a", RoomOptions{Lobby: true, Host: "host"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nobody is in the room, yet a joiner waits rather than becoming
+	// moderator.
+	guest := &testSignaling{}
+	peer, err := room.Join(guest, joinRequest(t, "guest"))
+	if err != nil || peer != nil {
+		t.Fatalf("got %v, %v; want to wait in the lobby", peer, err)
+	}
+	if _, err := room.Join(&testSignaling{}, joinRequest(t, "guest")); !errors.Is(err, ErrMemberExists) {
+		t.Fatalf("second join while waiting: got %v, want %v", err, ErrMemberExists)
+	}
+
+	host := &testSignaling{}
+	peer, err = room.Join(host, joinRequest(t, "host"))
+	if err != nil || peer == nil {
+		t.Fatalf("host: got %v, %v; want to join", peer, err)
+	}
+	if !peer.IsModerator() {
+		t.Fatal("host is not moderator")
+	}
+	if !host.received("lobby-join") {
+		t.Fatal("host was not told about the waiting member")
+	}
+
+	if _, err := room.Admit("host", "guest"); err != nil {
+		t.Fatal(err)
+	}
+	if peer, _ := room.GetPeer("guest"); peer == nil || peer.IsModerator() {
+		t.Fatal("admitted guest should be a participant")
+	}
+}
+
+func TestLobbyWithoutHost(t *testing.T) {
+	s := newTestSFU(t)
+
+	room, err := s.CreateRoom("", "a", RoomOptions{Lobby: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if peer, err := room.Join(&testSignaling{}, joinRequest(t, "first")); err != nil || peer != nil {
+		t.Fatalf("got %v, %v; want to wait in the lobby", peer, err)
+	}
+
+	// The API admits ahead of time; that member joins directly, once.
+	room.Invite(systemActor, "invited")
+	peer, err := room.Join(&testSignaling{}, joinRequest(t, "invited"))
+	if err != nil || peer == nil {
+		t.Fatalf("invited: got %v, %v; want to join", peer, err)
+	}
+	if peer.IsModerator() {
+		t.Fatal("invited member became moderator")
+	}
+
+	room.RemovePeer("invited")
+	if peer, err := room.Join(&testSignaling{}, joinRequest(t, "invited")); err != nil || peer != nil {
+		t.Fatalf("rejoin: got %v, %v; want to wait in the lobby", peer, err)
+	}
+}
+
+func TestAdmitIntoLockedRoom(t *testing.T) {
+	s := newTestSFU(t)
+
+	room, err := s.CreateRoom("", "a", RoomOptions{Lobby: true, Host: "host"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := &testSignaling{}
+	if _, err := room.Join(host, joinRequest(t, "host")); err != nil {
+		t.Fatal(err)
+	}
+
+	guest := &testSignaling{}
+	if _, err := room.Join(guest, joinRequest(t, "guest")); err != nil {
+		t.Fatal(err)
+	}
+
+	room.SetLocked("host", true)
+	if _, err := room.Admit("host", "guest"); !errors.Is(err, ErrRoomLocked) {
+		t.Fatalf("got %v, want %v", err, ErrRoomLocked)
+	}
+
+	if guest.received("admitted") || !guest.received("rejected") {
+		t.Fatal("the guest was not told they cannot join")
+	}
+	if host.received("lobby-admitted") || !host.received("lobby-rejected") {
+		t.Fatal("the host was not told the guest cannot join")
+	}
+	if _, ok := room.GetPeer("guest"); ok {
+		t.Fatal("the guest joined a locked room")
+	}
+}
@@ -1,6 +1,11 @@
 package sfu
 
-import "github.com/pion/webrtc/v3"
+import (
+	"strings"
+
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+)
 
 const (
 	VP8 uint8 = 120
@@ -8,6 +13,35 @@ const (
 	OPUS uint8 = 109
 )
 
+// H.264 NAL unit types (RFC 6184, section 5.2).
+const (
+	h264NALUIDR   = 5
+	h264NALUSPS   = 7
+	h264NALUPPS   = 8
+	h264NALUAUD   = 9
+	h264NALUSTAPA = 24
+	h264NALUFUA   = 28
+)
+
+var audioCodecs = []webrtc.RTPCodecParameters{
+	{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType:    webrtc.MimeTypeOpus,
+			ClockRate:   48000,
+			Channels:    2,
+			SDPFmtpLine: "minptime=10;useinbandfec=1",
+		},
+		PayloadType: 109,
+	},
+}
+
+var videoRTCPFeedback = []webrtc.RTCPFeedback{
+	{Type: webrtc.TypeRTCPFBGoogREMB},
+	{Type: webrtc.TypeRTCPFBCCM, Parameter: "fir"},
+	{Type: webrtc.TypeRTCPFBNACK},
+	{Type: webrtc.TypeRTCPFBNACK, Parameter: "pli"},
+}
+
 var videoCodecs = []webrtc.RTPCodecParameters{
 	//{
 	//	RTPCodecCapability: webrtc.RTPCodecCapability{
@@ -34,25 +68,115 @@ var videoCodecs = []webrtc.RTPCodecParameters{
 	//},
 	{
 		RTPCodecCapability: webrtc.RTPCodecCapability{
-			MimeType:  webrtc.MimeTypeVP8,
-			ClockRate: 90000,
+			MimeType:     webrtc.MimeTypeVP8,
+			ClockRate:    90000,
+			RTCPFeedback: videoRTCPFeedback,
 		},
 		PayloadType: 120,
 	},
-	//{
-	//	RTPCodecCapability: webrtc.RTPCodecCapability{
-	//		MimeType:    webrtc.MimeTypeH264,
-	//		ClockRate:   90000,
-	//		SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42001f",
-	//	},
-	//	PayloadType: 97,
-	//},
-	//{
-	//	RTPCodecCapability: webrtc.RTPCodecCapability{
-	//		MimeType:    webrtc.MimeTypeH264,
-	//		ClockRate:   90000,
-	//		SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f",
-	//	},
-	//	PayloadType: 101,
-	//},
+	{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType:     webrtc.MimeTypeH264,
+			ClockRate:    90000,
+			SDPFmtpLine:  "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42001f",
+			RTCPFeedback: videoRTCPFeedback,
+		},
+		PayloadType: 97,
+	},
+	{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType:     webrtc.MimeTypeH264,
+			ClockRate:    90000,
+			SDPFmtpLine:  "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f",
+			RTCPFeedback: videoRTCPFeedback,
+		},
+		PayloadType: 101,
+	},
+}
+
+// isKeyframe reports whether an RTP payload starts a keyframe. Codecs it
+// cannot inspect are never treated as keyframes.
+func isKeyframe(mimeType string, payload []byte) bool {
+	switch {
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP8):
+		var vp8 codecs.VP8Packet
+		frame, err := vp8.Unmarshal(payload)
+		if err != nil || len(frame) == 0 {
+			return false
+		}
+
+		return vp8.S == 1 && vp8.PID == 0 && frame[0]&0x01 == 0
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP9):
+		var vp9 codecs.VP9Packet
+		if _, err := vp9.Unmarshal(payload); err != nil {
+			return false
+		}
+
+		return vp9.B && !vp9.P
+	case strings.EqualFold(mimeType, webrtc.MimeTypeH264):
+		return h264Keyframe(payload)
+	}
+
+	return false
+}
+
+// h264Keyframe reports whether an H.264 payload (RFC 6184) starts an IDR
+// picture or carries the SPS sent ahead of one.
+func h264Keyframe(payload []byte) bool {
+	if len(payload) == 0 {
+		return false
+	}
+
+	switch nalType := payload[0] & 0x1f; nalType {
+	case h264NALUIDR, h264NALUSPS:
+		return true
+	case h264NALUSTAPA:
+		for rest := payload[1:]; len(rest) > 2; {
+			size := int(rest[0])<<8 | int(rest[1])
+			if size == 0 || len(rest) < 2+size {
+				return false
+			}
+			if t := rest[2] & 0x1f; t == h264NALUIDR || t == h264NALUSPS {
+				return true
+			}
+			rest = rest[2+size:]
+		}
+	case h264NALUFUA:
+		// The start bit marks the fragment holding the NAL header.
+		return len(payload) > 1 && payload[1]&0x80 != 0 && payload[1]&0x1f == h264NALUIDR
+	}
+
+	return false
+}
+
+// h264SPS returns the SPS carried in an H.264 payload on its own or in a
+// STAP-A, or nil if there is none.
+func h264SPS(payload []byte) []byte {
+	if len(payload) == 0 {
+		return nil
+	}
+
+	switch payload[0] & 0x1f {
+	case h264NALUSPS:
+		return payload
+	case h264NALUSTAPA:
+		for rest := payload[1:]; len(rest) > 2; {
+			size := int(rest[0])<<8 | int(rest[1])
+			if size == 0 || len(rest) < 2+size {
+				return nil
+			}
+			if rest[2]&0x1f == h264NALUSPS {
+				return rest[2 : 2+size]
+			}
+			rest = rest[2+size:]
+		}
+	}
+
+	return nil
+}
+
+// detectsKeyframes reports whether isKeyframe understands mimeType.
+func detectsKeyframes(mimeType string) bool {
+	return strings.EqualFold(mimeType, webrtc.MimeTypeVP8) || strings.EqualFold(mimeType, webrtc.MimeTypeVP9) ||
+		strings.EqualFold(mimeType, webrtc.MimeTypeH264)
 }
@@ -0,0 +1,346 @@
+package sfu
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media/ivfreader"
+	"github.com/pion/webrtc/v3/pkg/media/rtpdump"
+)
+
+// virtualMTU bounds the packets a virtual publisher cuts frames into.
+const virtualMTU = 1200
+
+// registeredCodec returns the SFU's codec for mimeType, so that tracks of a
+// virtual publisher negotiate like a browser's would.
+func registeredCodec(mimeType string) (webrtc.RTPCodecParameters, bool) {
+	for _, codec := range append(append([]webrtc.RTPCodecParameters{}, audioCodecs...), videoCodecs...) {
+		if strings.EqualFold(codec.MimeType, mimeType) {
+			return codec, true
+		}
+	}
+
+	return webrtc.RTPCodecParameters{}, false
+}
+
+// ivfMedia packetizes the frames of an IVF file. Frames are due at their
+// IVF timestamp and every packet of a frame shares its RTP timestamp.
+type ivfMedia struct {
+	file   *os.File
+	reader *ivfreader.IVFReader
+	header *ivfreader.IVFFileHeader
+
+	packetizer rtp.Packetizer
+	pending    []*rtp.Packet
+	due        time.Duration
+}
+
+func newIVFMedia(file *os.File) (*ivfMedia, string, error) {
+	reader, header, err := ivfreader.NewWith(file)
+	if err != nil {
+		return nil, "", ErrUnsupportedMedia
+	}
+	if header.TimebaseDenominator == 0 || header.TimebaseNumerator == 0 {
+		return nil, "", ErrUnsupportedMedia
+	}
+
+	// VP8 is the only IVF codec that is negotiated; see videoCodecs.
+	if header.FourCC != "VP80" {
+		return nil, "", ErrUnsupportedMedia
+	}
+
+	payloader := &codecs.VP8Payloader{EnablePictureID: true}
+	return &ivfMedia{
+		file:       file,
+		reader:     reader,
+		header:     header,
+		packetizer: rtp.NewPacketizer(virtualMTU, 0, 0, payloader, rtp.NewRandomSequencer(), 90000),
+	}, webrtc.MimeTypeVP8, nil
+}
+
+func (m *ivfMedia) next() (*rtp.Packet, time.Duration, error) {
+	for len(m.pending) == 0 {
+		frame, header, err := m.reader.ParseNextFrame()
+		if err != nil {
+			return nil, 0, eofOr(err)
+		}
+
+		seconds := float64(header.Timestamp) * float64(m.header.TimebaseNumerator) / float64(m.header.TimebaseDenominator)
+		m.due = time.Duration(seconds * float64(time.Second))
+		m.pending = m.packetizer.Packetize(frame, 0)
+		for _, pkt := range m.pending {
+			pkt.Timestamp = uint32(seconds * 90000)
+		}
+	}
+
+	pkt := m.pending[0]
+	m.pending = m.pending[1:]
+
+	return pkt, m.due, nil
+}
+
+func (m *ivfMedia) rewind() error {
+	if _, err := m.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	reader, _, err := ivfreader.NewWith(m.file)
+	if err != nil {
+		return err
+	}
+	m.reader = reader
+	m.pending = nil
+
+	return nil
+}
+
+func (m *ivfMedia) Close() error {
+	return m.file.Close()
+}
+
+// oggMedia reads the Opus packets of an Ogg file, one RTP packet each. A
+// packet is due once the samples of the packets before it have played.
+type oggMedia struct {
+	file   *os.File
+	reader *bufio.Reader
+
+	// segments is the lacing of the current page and body its data.
+	segments []byte
+	body     []byte
+
+	seq     uint16
+	samples uint64
+}
+
+func newOggMedia(file *os.File) (*oggMedia, string, error) {
+	m := &oggMedia{file: file, reader: bufio.NewReader(file)}
+	if err := m.skipHeaders(); err != nil {
+		return nil, "", err
+	}
+
+	return m, webrtc.MimeTypeOpus, nil
+}
+
+// skipHeaders checks for and skips the OpusHead and OpusTags packets.
+func (m *oggMedia) skipHeaders() error {
+	head, err := m.packet()
+	if err != nil || !bytes.HasPrefix(head, []byte("OpusHead")) {
+		return ErrUnsupportedMedia
+	}
+
+	if _, err := m.packet(); err != nil {
+		return ErrUnsupportedMedia
+	}
+
+	return nil
+}
+
+func (m *oggMedia) next() (*rtp.Packet, time.Duration, error) {
+	payload, err := m.packet()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	pkt := &rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			SequenceNumber: m.seq,
+			Timestamp:      uint32(m.samples),
+		},
+		Payload: payload,
+	}
+	due := time.Duration(m.samples) * time.Second / 48000
+
+	m.seq++
+	m.samples += uint64(opusSamples(payload))
+
+	return pkt, due, nil
+}
+
+// packet returns the next packet, which may span pages.
+func (m *oggMedia) packet() ([]byte, error) {
+	var packet []byte
+	for {
+		for len(m.segments) == 0 {
+			if err := m.page(); err != nil {
+				return nil, err
+			}
+		}
+
+		size := int(m.segments[0])
+		if size > len(m.body) {
+			return nil, ErrUnsupportedMedia
+		}
+		packet = append(packet, m.body[:size]...)
+		m.segments, m.body = m.segments[1:], m.body[size:]
+
+		// A lacing value below 255 ends the packet.
+		if size < 255 {
+			return packet, nil
+		}
+	}
+}
+
+// page reads the next Ogg page.
+func (m *oggMedia) page() error {
+	header := make([]byte, 27)
+	if _, err := io.ReadFull(m.reader, header); err != nil {
+		return eofOr(err)
+	}
+	if string(header[:4]) != "OggS" {
+		return ErrUnsupportedMedia
+	}
+
+	segments := make([]byte, header[26])
+	if _, err := io.ReadFull(m.reader, segments); err != nil {
+		return eofOr(err)
+	}
+
+	size := 0
+	for _, s := range segments {
+		size += int(s)
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(m.reader, body); err != nil {
+		return eofOr(err)
+	}
+
+	m.segments, m.body = segments, body
+
+	return nil
+}
+
+func (m *oggMedia) rewind() error {
+	if _, err := m.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	m.reader.Reset(m.file)
+	m.segments, m.body = nil, nil
+	m.samples = 0
+
+	return m.skipHeaders()
+}
+
+func (m *oggMedia) Close() error {
+	return m.file.Close()
+}
+
+// opusSamples returns the duration of an Opus packet in 48 kHz samples, from
+// its TOC byte (RFC 6716, section 3.1).
+func opusSamples(packet []byte) int {
+	if len(packet) == 0 {
+		return 0
+	}
+
+	config := packet[0] >> 3
+	var frame int
+	switch {
+	case config < 12:
+		frame = [...]int{480, 960, 1920, 2880}[config%4]
+	case config < 16:
+		frame = [...]int{480, 960}[config%2]
+	default:
+		frame = [...]int{120, 240, 480, 960}[config%4]
+	}
+
+	switch packet[0] & 3 {
+	case 0:
+		return frame
+	case 1, 2:
+		return 2 * frame
+	default:
+		if len(packet) < 2 {
+			return 0
+		}
+		return int(packet[1]&0x3f) * frame
+	}
+}
+
+// rtpDumpMedia replays the RTP packets of one stream of an rtpdump as they
+// were recorded, at their recorded offsets. RTCP is skipped. Captures taken
+// without payloads replay, but subscribers cannot decode them.
+type rtpDumpMedia struct {
+	file   *os.File
+	reader *rtpdump.Reader
+	ssrc   uint32
+
+	first    time.Duration
+	hasFirst bool
+}
+
+func newRTPDumpMedia(file *os.File, ssrc uint32) (*rtpDumpMedia, error) {
+	reader, _, err := rtpdump.NewReader(file)
+	if err != nil {
+		return nil, ErrUnsupportedMedia
+	}
+
+	return &rtpDumpMedia{file: file, reader: reader, ssrc: ssrc}, nil
+}
+
+func (m *rtpDumpMedia) next() (*rtp.Packet, time.Duration, error) {
+	for {
+		dumped, err := m.reader.Next()
+		if err != nil {
+			return nil, 0, eofOr(err)
+		}
+		if dumped.IsRTCP {
+			continue
+		}
+
+		pkt := &rtp.Packet{}
+		if err := pkt.Unmarshal(dumped.Payload); err != nil {
+			continue
+		}
+
+		// Without an SSRC the first stream in the dump is replayed.
+		if m.ssrc == 0 {
+			m.ssrc = pkt.SSRC
+		}
+		if pkt.SSRC != m.ssrc {
+			continue
+		}
+
+		if !m.hasFirst {
+			m.first, m.hasFirst = dumped.Offset, true
+		}
+
+		return pkt, dumped.Offset - m.first, nil
+	}
+}
+
+func (m *rtpDumpMedia) rewind() error {
+	if _, err := m.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	reader, _, err := rtpdump.NewReader(m.file)
+	if err != nil {
+		return err
+	}
+	m.reader = reader
+	m.hasFirst = false
+
+	return nil
+}
+
+func (m *rtpDumpMedia) Close() error {
+	return m.file.Close()
+}
+
+// eofOr maps the ways a file can end, including in the middle of a record,
+// to io.EOF.
+func eofOr(err error) error {
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return io.EOF
+	}
+
+	return err
+}
@@ -0,0 +1,212 @@
+package sfu
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func tempMedia(t *testing.T, name string, data []byte) *os.File {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = f.Close() })
+
+	return f
+}
+
+// oggPage builds an Ogg page holding data laced as given. The reader does
+// not check CRCs, so none is computed.
+func oggPage(lacing []byte, data []byte) []byte {
+	header := make([]byte, 27)
+	copy(header, "OggS")
+	header[26] = byte(len(lacing))
+
+	return append(append(header, lacing...), data...)
+}
+
+// lace returns the lacing values of a packet that ends on this page.
+func lace(size int) []byte {
+	var lacing []byte
+	for ; size >= 255; size -= 255 {
+		lacing = append(lacing, 255)
+	}
+
+	return append(lacing, byte(size))
+}
+
+func TestOggMedia(t *testing.T) {
+	// TOC 0x08: SILK 20 ms, one frame.
+	first := []byte{0x08, 1, 2}
+	long := append([]byte{0x08}, bytes.Repeat([]byte{7}, 299)...)
+	split := append([]byte{0x08}, bytes.Repeat([]byte{9}, 254)...)
+	splitEnd := []byte{9, 9}
+
+	var file []byte
+	file = append(file, oggPage(lace(19), append([]byte("OpusHead"), make([]byte, 11)...))...)
+	file = append(file, oggPage(lace(8), []byte("OpusTags"))...)
+	page := append(append(lace(len(first)), lace(len(long))...), 255)
+	file = append(file, oggPage(page, concat(first, long, split))...)
+	// The last packet continues on the next page.
+	file = append(file, oggPage(lace(len(splitEnd)), splitEnd)...)
+
+	m, mimeType, err := newOggMedia(tempMedia(t, "a.ogg", file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mimeType != "audio/opus" {
+		t.Fatalf("mime type %s", mimeType)
+	}
+
+	want := [][]byte{first, long, append(split, splitEnd...)}
+	for i, payload := range want {
+		pkt, due, err := m.next()
+		if err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+		if !bytes.Equal(pkt.Payload, payload) {
+			t.Fatalf("packet %d: %d bytes, want %d", i, len(pkt.Payload), len(payload))
+		}
+		if due != time.Duration(i)*20*time.Millisecond || pkt.Timestamp != uint32(i*960) || pkt.SequenceNumber != uint16(i) {
+			t.Fatalf("packet %d: due %v, timestamp %d, sequence %d", i, due, pkt.Timestamp, pkt.SequenceNumber)
+		}
+	}
+	if _, _, err := m.next(); !errors.Is(err, io.EOF) {
+		t.Fatalf("after the last packet: got %v, want EOF", err)
+	}
+
+	if err := m.rewind(); err != nil {
+		t.Fatal(err)
+	}
+	if pkt, due, err := m.next(); err != nil || due != 0 || !bytes.Equal(pkt.Payload, first) {
+		t.Fatalf("after rewind: got %v, %v, %v", pkt, due, err)
+	}
+}
+
+func TestOggMediaRejectsOtherFiles(t *testing.T) {
+	if _, _, err := newOggMedia(tempMedia(t, "a.ogg", []byte("RIFF not an ogg file at all"))); !errors.Is(err, ErrUnsupportedMedia) {
+		t.Fatalf("got %v, want %v", err, ErrUnsupportedMedia)
+	}
+
+	vorbis := oggPage(lace(7), []byte("\x01vorbis"))
+	if _, _, err := newOggMedia(tempMedia(t, "b.ogg", vorbis)); !errors.Is(err, ErrUnsupportedMedia) {
+		t.Fatalf("vorbis: got %v, want %v", err, ErrUnsupportedMedia)
+	}
+}
+
+func TestOpusSamples(t *testing.T) {
+	tests := []struct {
+		packet []byte
+		want   int
+	}{
+		{nil, 0},
+		{[]byte{0x08}, 960},           // SILK 20 ms
+		{[]byte{0x18}, 2880},          // SILK 60 ms
+		{[]byte{0x78}, 960},           // hybrid 20 ms
+		{[]byte{0xf8}, 960},           // CELT 20 ms
+		{[]byte{0xe0}, 120},           // CELT 2.5 ms
+		{[]byte{0xf9}, 1920},          // two frames
+		{[]byte{0xfb, 0x03}, 2880},    // code 3, three frames
+		{[]byte{0xfb}, 0},             // code 3 without a frame count
+		{[]byte{0x0a, 0, 0}, 2 * 960}, // two frames of different sizes
+	}
+
+	for _, tt := range tests {
+		if got := opusSamples(tt.packet); got != tt.want {
+			t.Errorf("opusSamples(%x) = %d, want %d", tt.packet, got, tt.want)
+		}
+	}
+}
+
+func testIVF(fourcc string, timestamps ...uint64) []byte {
+	header := make([]byte, 32)
+	copy(header, "DKIF")
+	binary.LittleEndian.PutUint16(header[6:], 32)
+	copy(header[8:], fourcc)
+	binary.LittleEndian.PutUint16(header[12:], 320)
+	binary.LittleEndian.PutUint16(header[14:], 240)
+	binary.LittleEndian.PutUint32(header[16:], 30)
+	binary.LittleEndian.PutUint32(header[20:], 1)
+	binary.LittleEndian.PutUint32(header[24:], uint32(len(timestamps)))
+
+	file := header
+	for _, ts := range timestamps {
+		frame := bytes.Repeat([]byte{0x10}, 2000)
+		frameHeader := make([]byte, 12)
+		binary.LittleEndian.PutUint32(frameHeader, uint32(len(frame)))
+		binary.LittleEndian.PutUint64(frameHeader[4:], ts)
+		file = append(append(file, frameHeader...), frame...)
+	}
+
+	return file
+}
+
+func TestIVFMedia(t *testing.T) {
+	m, mimeType, err := newIVFMedia(tempMedia(t, "a.ivf", testIVF("VP80", 0, 3)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mimeType != "video/VP8" {
+		t.Fatalf("mime type %s", mimeType)
+	}
+
+	// A 2000 byte frame takes two packets, sharing the frame's timestamp.
+	type packet struct {
+		timestamp uint32
+		due       time.Duration
+		marker    bool
+	}
+	want := []packet{
+		{0, 0, false},
+		{0, 0, true},
+		{9000, 100 * time.Millisecond, false},
+		{9000, 100 * time.Millisecond, true},
+	}
+	for i, w := range want {
+		pkt, due, err := m.next()
+		if err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+		if pkt.MarshalSize() > virtualMTU+12 {
+			t.Fatalf("packet %d is over the MTU", i)
+		}
+		got := packet{pkt.Timestamp, due.Round(time.Millisecond), pkt.Marker}
+		if got != w {
+			t.Fatalf("packet %d: got %+v, want %+v", i, got, w)
+		}
+	}
+	if _, _, err := m.next(); !errors.Is(err, io.EOF) {
+		t.Fatalf("after the last frame: got %v, want EOF", err)
+	}
+
+	if err := m.rewind(); err != nil {
+		t.Fatal(err)
+	}
+	if pkt, due, err := m.next(); err != nil || due != 0 || pkt.Timestamp != 0 {
+		t.Fatalf("after rewind: got %v, %v, %v", pkt, due, err)
+	}
+}
+
+func TestIVFMediaRejectsUnknownCodec(t *testing.T) {
+	// VP9 and AV1 are not negotiated, so they cannot be played either.
+	for _, fourcc := range []string{"H264", "VP90", "AV01"} {
+		if _, _, err := newIVFMedia(tempMedia(t, fourcc+".ivf", testIVF(fourcc, 0))); !errors.Is(err, ErrUnsupportedMedia) {
+			t.Fatalf("%s: got %v, want %v", fourcc, err, ErrUnsupportedMedia)
+		}
+	}
+	if _, _, err := newIVFMedia(tempMedia(t, "b.ivf", []byte("not an ivf file"))); !errors.Is(err, ErrUnsupportedMedia) {
+		t.Fatalf("got %v, want %v", err, ErrUnsupportedMedia)
+	}
+}
@@ -0,0 +1,156 @@
+package sfu
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+var auditLogger = slog.Default().With(slog.String("component", "audit"))
+
+// systemActor attributes actions the SFU takes on its own, such as recording
+// a room created with RoomOptions.Record.
+const systemActor = "system"
+
+// AuditEntry records a moderator action taken in a room.
+type AuditEntry struct {
+	Time   time.Time `json:"time"`
+	Actor  string    `json:"actor"`
+	Action string    `json:"action"`
+	Target string    `json:"target,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// Kick disconnects a member. They may rejoin unless banned.
+func (r *Room) Kick(actor, id string) error {
+	peer, ok := r.FindPeer(id)
+	if !ok {
+		return ErrPeerNotFound
+	}
+
+	r.audit(actor, "kick", id, "")
+
+	if err := peer.send("kicked", map[string]any{"by": actor}); err != nil {
+		peer.logger.Error("Failed to notify kick", slog.String("error", err.Error()))
+	}
+
+	peer.Room().RemovePeer(id)
+
+	return nil
+}
+
+// Ban keeps the member identity from rejoining and removes them if present.
+func (r *Room) Ban(actor, id string) error {
+	r.mux.Lock()
+	r.banned[id] = struct{}{}
+	r.mux.Unlock()
+
+	r.audit(actor, "ban", id, "")
+
+	if err := r.Kick(actor, id); err != nil && err != ErrPeerNotFound {
+		return err
+	}
+
+	return nil
+}
+
+// Unban lets a previously banned member identity join again.
+func (r *Room) Unban(actor, id string) {
+	r.mux.Lock()
+	delete(r.banned, id)
+	r.mux.Unlock()
+
+	r.audit(actor, "unban", id, "")
+}
+
+// SetMuted stops or resumes forwarding every track of kind published by the
+// member, including tracks they publish later, and notifies them.
+func (r *Room) SetMuted(actor, id string, kind webrtc.RTPCodecType, muted bool) error {
+	peer, ok := r.FindPeer(id)
+	if !ok {
+		return ErrPeerNotFound
+	}
+
+	peer.setMuted(kind, muted)
+
+	room := peer.Room()
+	room.mux.RLock()
+	for _, forwarder := range room.forwarders {
+		if forwarder.peer == peer && forwarder.Kind() == kind {
+			forwarder.SetMuted(muted)
+		}
+	}
+	room.mux.RUnlock()
+
+	room.announceUpdate(peer)
+
+	action := "unmute"
+	if muted {
+		action = "mute"
+	}
+	r.audit(actor, action, id, kind.String())
+
+	err := peer.send("muted", map[string]any{
+		"kind":  kind.String(),
+		"muted": muted,
+		"by":    actor,
+	})
+	if err != nil {
+		peer.logger.Error("Failed to notify mute", slog.String("error", err.Error()))
+	}
+
+	return nil
+}
+
+// SetLocked stops or allows new members joining the room.
+func (r *Room) SetLocked(actor string, locked bool) {
+	r.mux.Lock()
+	r.locked = locked
+	r.mux.Unlock()
+
+	action := "unlock"
+	if locked {
+		action = "lock"
+	}
+	r.audit(actor, action, "", "")
+}
+
+func (r *Room) Locked() bool {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	return r.locked
+}
+
+// AuditLog returns a copy of the moderator actions taken in the room.
+func (r *Room) AuditLog() []AuditEntry {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	return append([]AuditEntry(nil), r.auditLog...)
+}
+
+func (r *Room) audit(actor, action, target, detail string) {
+	entry := AuditEntry{
+		Time:   time.Now(),
+		Actor:  actor,
+		Action: action,
+		Target: target,
+		Detail: detail,
+	}
+
+	r.mux.Lock()
+	r.auditLog = append(r.auditLog, entry)
+	r.mux.Unlock()
+
+	auditLogger.Info(
+		"Moderator action",
+		slog.String("tenant", r.tenant),
+		slog.String("room", r.id),
+		slog.String("actor", actor),
+		slog.String("action", action),
+		slog.String("target", target),
+		slog.String("detail", detail),
+	)
+}
@@ -0,0 +1,118 @@
+package sfu
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+)
+
+// Rough per-leg budgets used to decide which video legs fit a subscriber's
+// receive bandwidth estimate.
+const (
+	audioLegBitrate  = 40_000
+	cameraLegBitrate = 300_000
+	screenLegBitrate = 600_000
+
+	// pliInterval throttles keyframe requests forwarded to a publisher.
+	pliInterval = 500 * time.Millisecond
+)
+
+// SetPaused pauses or resumes sending the given tracks to peer without
+// renegotiating, e.g. when the client scrolls a tile off-screen.
+func (r *Room) SetPaused(peer *Peer, trackIDs []string, paused bool) error {
+	for _, trackID := range trackIDs {
+		forwarder, ok := r.forwarder(trackID)
+		if !ok || !forwarder.hasPeer(peer.ID()) {
+			return ErrTrackNotFound
+		}
+
+		forwarder.SetPaused(peer.ID(), PauseBySubscriber, paused)
+	}
+
+	return nil
+}
+
+// applyEstimate fits peer's video legs into its receive bandwidth estimate,
+// keeping the highest priority tracks and pausing the rest. Audio is never
+// paused but its share is reserved first.
+func (r *Room) applyEstimate(peer *Peer, bitrate uint64) {
+	r.mux.RLock()
+	var video []*TrackForwarder
+	budget := int64(bitrate)
+	for _, forwarder := range r.forwarders {
+		if !forwarder.hasPeer(peer.ID()) {
+			continue
+		}
+
+		if forwarder.Kind() == webrtc.RTPCodecTypeAudio {
+			budget -= audioLegBitrate
+			continue
+		}
+		video = append(video, forwarder)
+	}
+	r.mux.RUnlock()
+
+	byPriority(video)
+
+	for _, forwarder := range video {
+		cost := int64(cameraLegBitrate)
+		if forwarder.Source() == SourceScreen {
+			cost = screenLegBitrate
+		}
+
+		paused := budget < cost
+		if !paused {
+			budget -= cost
+		}
+
+		if !forwarder.SetPaused(peer.ID(), PauseByBandwidth, paused) {
+			continue
+		}
+
+		msgType := "resumed"
+		if paused {
+			msgType = "paused"
+		}
+
+		err := peer.send(msgType, map[string]any{
+			"trackId": forwarder.ID(),
+			"reason":  "bandwidth",
+		})
+		if err != nil {
+			peer.logger.Error("Failed to notify "+msgType, slog.String("error", err.Error()))
+		}
+	}
+}
+
+func (r *Room) forwarder(trackID string) (*TrackForwarder, bool) {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	forwarder, ok := r.forwarders[trackID]
+	return forwarder, ok
+}
+
+// readSenderRTCP drains RTCP the subscriber sends about trackID. Keyframe
+// requests are passed on to the publisher and bandwidth estimates drive
+// pausing of video legs. It returns once the sender is stopped.
+func (p *Peer) readSenderRTCP(trackID string, sender *webrtc.RTPSender) {
+	for {
+		packets, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+
+		for _, packet := range packets {
+			switch packet := packet.(type) {
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				if forwarder, ok := p.Room().forwarder(trackID); ok {
+					forwarder.RequestKeyframe()
+				}
+			case *rtcp.ReceiverEstimatedMaximumBitrate:
+				p.Room().applyEstimate(p, uint64(packet.Bitrate))
+			}
+		}
+	}
+}
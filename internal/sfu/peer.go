@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"log/slog"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/pion/rtcp"
@@ -14,21 +15,58 @@ type Signaling interface {
 	WriteMessage(msgType int, payload []byte) error
 }
 
+type Role string
+
+const (
+	RoleModerator   Role = "moderator"
+	RoleParticipant Role = "participant"
+)
+
 type Peer struct {
-	id string
+	id                 string
+	name               string
+	role               Role
+	joinedAt           time.Time
+	manualSubscription bool
 
 	logger *slog.Logger
 	conn   *webrtc.PeerConnection
 	room   *Room
 	signal Signaling
 
-	mux            sync.RWMutex
-	inTracks       map[string]*webrtc.TrackRemote
-	outTracks      map[string]*webrtc.TrackLocalStaticRTP
+	mux        sync.RWMutex
+	inTracks   map[string]*webrtc.TrackRemote
+	outTracks  map[string]*webrtc.TrackLocalStaticRTP
+	senders    map[string]*webrtc.RTPSender
+	mutedKinds map[webrtc.RTPCodecType]bool
+	declared   map[string]TrackDeclaration
+	qualities  map[string]Quality
+	channels   map[string]*dataChannel
+
 	candidateQueue []webrtc.ICECandidateInit
+	reactions      *rateLimiter
+	tap            *captureTap
+
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+// JoinRequest carries what a member sends when joining a room.
+type JoinRequest struct {
+	MemberID string
+	Name     string
+	Offer    webrtc.SessionDescription
+	// Tracks declares the source of the tracks in Offer and of tracks
+	// added by later renegotiations.
+	Tracks []TrackDeclaration
+	// ManualSubscription opts the member out of receiving every track in
+	// the room; they subscribe to the tracks they want instead.
+	ManualSubscription bool
 }
 
-func NewPeer(api *webrtc.API, signal Signaling, room *Room, offer webrtc.SessionDescription, id string) (*Peer, error) {
+func NewPeer(api *webrtc.API, tap *captureTap, signal Signaling, room *Room, req JoinRequest) (*Peer, error) {
+	id := req.MemberID
+
 	pc, err := api.NewPeerConnection(webrtc.Configuration{
 		ICEServers: []webrtc.ICEServer{
 			{
@@ -36,39 +74,49 @@ func NewPeer(api *webrtc.API, signal Signaling, room *Room, offer webrtc.Session
 			},
 		},
 	})
+	if err != nil {
+		return nil, err
+	}
 
 	peer := &Peer{
-		id:        id,
-		logger:    slog.Default().With("peer", id),
-		conn:      pc,
-		room:      room,
-		signal:    signal,
-		inTracks:  make(map[string]*webrtc.TrackRemote),
-		outTracks: make(map[string]*webrtc.TrackLocalStaticRTP),
+		id:       id,
+		name:     req.Name,
+		role:     RoleParticipant,
+		joinedAt: time.Now(),
+
+		manualSubscription: req.ManualSubscription,
+		logger:             slog.Default().With("peer", id),
+		conn:               pc,
+		room:               room,
+		signal:             signal,
+		inTracks:           make(map[string]*webrtc.TrackRemote),
+		outTracks:          make(map[string]*webrtc.TrackLocalStaticRTP),
+		senders:            make(map[string]*webrtc.RTPSender),
+		mutedKinds:         make(map[webrtc.RTPCodecType]bool),
+		declared:           make(map[string]TrackDeclaration),
+		qualities:          make(map[string]Quality),
+		channels:           make(map[string]*dataChannel),
+		reactions:          newRateLimiter(reactionRate, reactionBurst),
+		tap:                tap,
 	}
+	peer.declareTracks(req.Tracks)
 
 	pc.OnICECandidate(func(c *webrtc.ICECandidate) {
 		if c == nil {
 			return
 		}
 
-		msg, err := json.Marshal(map[string]any{
-			"type":      "candidate",
-			"roomId":    room.ID(),
-			"memberId":  id,
+		err := peer.send("candidate", map[string]any{
 			"candidate": c.ToJSON(),
 		})
 		if err != nil {
-			peer.logger.Error("Failed to marshal ICE candidate", slog.String("error", err.Error()))
-			return
+			peer.logger.Error("Failed to send ICE candidate", slog.String("error", err.Error()))
 		}
-
-		peer.signal.WriteMessage(websocket.TextMessage, msg)
 	})
 
 	var cleanupOnce sync.Once
 	cleanup := func() {
-		peer.room.RemovePeer(peer.id)
+		peer.Room().RemovePeer(peer.id)
 	}
 
 	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
@@ -84,35 +132,89 @@ func NewPeer(api *webrtc.API, signal Signaling, room *Room, offer webrtc.Session
 
 	pc.OnTrack(func(remote *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
 		peer.addInboundTrack(remote)
-		peer.room.addIncomingTrack(peer, remote)
+		peer.Room().addIncomingTrack(peer, remote)
 	})
 
 	_, err = pc.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{
 		Direction: webrtc.RTPTransceiverDirectionRecvonly,
 	})
 	if err != nil {
+		_ = peer.Close()
+		return nil, err
+	}
+
+	if err := peer.openDataChannels(); err != nil {
+		_ = peer.Close()
 		return nil, err
 	}
 
-	if err := peer.SendAnswer(offer); err != nil {
+	if err := peer.SendAnswer(req.Offer); err != nil {
+		_ = peer.Close()
 		return nil, err
 	}
 
-	return peer, err
+	return peer, nil
 }
 
 func (p *Peer) ID() string {
 	return p.id
 }
 
+// Signaling returns the connection the peer joined over.
+func (p *Peer) Signaling() Signaling {
+	return p.signal
+}
+
+func (p *Peer) Name() string {
+	return p.name
+}
+
+// Room returns the room the peer is currently in, which changes when a
+// moderator moves them into or out of a breakout room.
+func (p *Peer) Room() *Room {
+	p.mux.RLock()
+	defer p.mux.RUnlock()
+
+	return p.room
+}
+
+func (p *Peer) Role() Role {
+	p.mux.RLock()
+	defer p.mux.RUnlock()
+
+	return p.role
+}
+
+func (p *Peer) IsModerator() bool {
+	return p.Role() == RoleModerator
+}
+
+// Close tears down the PeerConnection and waits for the goroutines reading
+// its senders to return. It is safe to call more than once.
 func (p *Peer) Close() error {
-	clear(p.inTracks)
-	clear(p.outTracks)
+	var err error
+
+	p.closeOnce.Do(func() {
+		err = p.conn.Close()
+		p.wg.Wait()
+		p.tap.stop()
 
-	return p.conn.Close()
+		p.mux.Lock()
+		clear(p.inTracks)
+		clear(p.outTracks)
+		clear(p.senders)
+		p.mux.Unlock()
+	})
+
+	return err
 }
 
 func (p *Peer) SendPLI(ssrc uint32) {
+	// A virtual publisher has no connection to send it on.
+	if p.isVirtual() {
+		return
+	}
+
 	p.logger.Info(
 		"Send PLI",
 		slog.String("peer", p.id),
@@ -174,13 +276,49 @@ func (p *Peer) AddTrackAndRenegotiate(track *webrtc.TrackLocalStaticRTP) error {
 	p.outTracks[track.ID()] = track
 	p.mux.Unlock()
 
-	if _, err := p.conn.AddTrack(track); err != nil {
+	if err := p.addSender(track); err != nil {
 		return err
 	}
 
 	return p.Renegotiate()
 }
 
+// RemoveTracksAndRenegotiate stops sending the given tracks and renegotiates
+// once if any of them was actually being sent.
+func (p *Peer) RemoveTracksAndRenegotiate(trackIDs ...string) error {
+	if !p.removeTracks(trackIDs...) {
+		return nil
+	}
+
+	return p.Renegotiate()
+}
+
+// removeTracks stops sending the given tracks and reports whether any sender
+// was removed. The caller renegotiates.
+func (p *Peer) removeTracks(trackIDs ...string) bool {
+	removed := false
+
+	for _, trackID := range trackIDs {
+		p.mux.Lock()
+		sender, ok := p.senders[trackID]
+		delete(p.senders, trackID)
+		delete(p.outTracks, trackID)
+		p.mux.Unlock()
+
+		if !ok {
+			continue
+		}
+
+		if err := p.conn.RemoveTrack(sender); err != nil {
+			p.logger.Error("Failed to remove track", slog.String("track", trackID), slog.String("error", err.Error()))
+			continue
+		}
+		removed = true
+	}
+
+	return removed
+}
+
 func (p *Peer) Renegotiate() error {
 	offer, err := p.conn.CreateOffer(nil)
 	if err != nil {
@@ -193,17 +331,9 @@ func (p *Peer) Renegotiate() error {
 
 	<-webrtc.GatheringCompletePromise(p.conn)
 
-	msg, err := json.Marshal(map[string]any{
-		"type":     "offer",
-		"roomId":   p.room.ID(),
-		"memberId": p.id,
-		"sdp":      p.conn.LocalDescription().SDP,
+	return p.send("offer", map[string]any{
+		"sdp": p.conn.LocalDescription().SDP,
 	})
-	if err != nil {
-		return err
-	}
-
-	return p.signal.WriteMessage(websocket.TextMessage, msg)
 }
 
 func (p *Peer) SendAnswer(offer webrtc.SessionDescription) error {
@@ -224,17 +354,32 @@ func (p *Peer) SendAnswer(offer webrtc.SessionDescription) error {
 
 	<-webrtc.GatheringCompletePromise(p.conn)
 
-	msg, err := json.Marshal(map[string]any{
-		"type":     "answer",
-		"roomId":   p.room.ID(),
-		"memberId": p.id,
-		"sdp":      p.conn.LocalDescription().SDP,
+	return p.send("answer", map[string]any{
+		"sdp": p.conn.LocalDescription().SDP,
 	})
+}
+
+// send writes a signaling message of msgType addressed to this peer.
+func (p *Peer) send(msgType string, fields map[string]any) error {
+	return writeSignal(p.signal, p.Room().ID(), p.id, msgType, fields)
+}
+
+func writeSignal(signal Signaling, roomID, memberID, msgType string, fields map[string]any) error {
+	payload := map[string]any{
+		"type":     msgType,
+		"roomId":   roomID,
+		"memberId": memberID,
+	}
+	for k, v := range fields {
+		payload[k] = v
+	}
+
+	msg, err := json.Marshal(payload)
 	if err != nil {
 		return err
 	}
 
-	return p.signal.WriteMessage(websocket.TextMessage, msg)
+	return signal.WriteMessage(websocket.TextMessage, msg)
 }
 
 func (p *Peer) flushCandidateQueue() {
@@ -259,3 +404,50 @@ func (p *Peer) addOutboundTrack(track *webrtc.TrackLocalStaticRTP) {
 
 	p.outTracks[track.ID()] = track
 }
+
+func (p *Peer) addSender(track *webrtc.TrackLocalStaticRTP) error {
+	sender, err := p.conn.AddTrack(track)
+	if err != nil {
+		return err
+	}
+
+	p.mux.Lock()
+	p.senders[track.ID()] = sender
+	p.mux.Unlock()
+
+	p.wg.Add(1)
+	goroutines.Go("sender-rtcp", func() {
+		defer p.wg.Done()
+		p.readSenderRTCP(track.ID(), sender)
+	})
+
+	return nil
+}
+
+func (p *Peer) setRoom(room *Room) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	p.room = room
+}
+
+func (p *Peer) setRole(role Role) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	p.role = role
+}
+
+func (p *Peer) isMuted(kind webrtc.RTPCodecType) bool {
+	p.mux.RLock()
+	defer p.mux.RUnlock()
+
+	return p.mutedKinds[kind]
+}
+
+func (p *Peer) setMuted(kind webrtc.RTPCodecType, muted bool) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	p.mutedKinds[kind] = muted
+}
@@ -0,0 +1,549 @@
+package sfu
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+const maxPublisherTracks = 4
+
+var (
+	ErrPublisherNotFound = errors.New("virtual publisher not found")
+	ErrInvalidPublisher  = errors.New("invalid virtual publisher")
+	ErrUnsupportedMedia  = errors.New("unsupported media file")
+)
+
+// PublisherTrack is a file a virtual publisher plays as one track. VP8 IVF
+// and Ogg Opus files carry their codec; an rtpdump does not, so MimeType is
+// required for it, and SSRC picks one stream out of a dump holding several.
+// File is relative to the SFU's media directory.
+type PublisherTrack struct {
+	File     string            `json:"file"`
+	Source   TrackSource       `json:"source,omitempty"`
+	MimeType string            `json:"mimeType,omitempty"`
+	SSRC     uint32            `json:"ssrc,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// PublisherRequest starts a virtual publisher: a member without a browser
+// whose tracks are read from files, paced by their timestamps.
+type PublisherRequest struct {
+	MemberID string           `json:"memberId"`
+	Name     string           `json:"name,omitempty"`
+	Tracks   []PublisherTrack `json:"tracks"`
+	// Loop restarts every track from the beginning at its end. Otherwise
+	// the publisher leaves once all of its tracks have ended.
+	Loop bool `json:"loop"`
+}
+
+// PublisherInfo describes a running virtual publisher.
+type PublisherInfo struct {
+	MemberID  string                `json:"memberId"`
+	Name      string                `json:"name,omitempty"`
+	Loop      bool                  `json:"loop"`
+	StartedAt time.Time             `json:"startedAt"`
+	Tracks    []PublisherTrackStats `json:"tracks"`
+}
+
+// PublisherTrackStats reports the playback of one virtual track. File is
+// set for a track played from a file, Address for one received over UDP.
+type PublisherTrackStats struct {
+	TrackID  string `json:"trackId"`
+	File     string `json:"file,omitempty"`
+	Address  string `json:"address,omitempty"`
+	MimeType string `json:"mimeType"`
+	Packets  uint64 `json:"packets"`
+	Loops    uint64 `json:"loops"`
+	Ended    bool   `json:"ended"`
+}
+
+// virtualPublisher is a member that only publishes. It is not one of the
+// room's peers: it has no connection, subscribes to nothing and cannot be
+// moved to a breakout, but its forwarders are ordinary ones.
+type virtualPublisher struct {
+	peer      *Peer
+	loop      bool
+	startedAt time.Time
+	tracks    []*virtualTrack
+}
+
+func (vp *virtualPublisher) info() PublisherInfo {
+	info := PublisherInfo{
+		MemberID:  vp.peer.ID(),
+		Name:      vp.peer.Name(),
+		Loop:      vp.loop,
+		StartedAt: vp.startedAt,
+		Tracks:    make([]PublisherTrackStats, 0, len(vp.tracks)),
+	}
+	for _, t := range vp.tracks {
+		info.Tracks = append(info.Tracks, t.stats())
+	}
+
+	return info
+}
+
+// StartPublisher adds a virtual publisher to the room and publishes its
+// tracks to the members like any other.
+func (r *Room) StartPublisher(actor string, req PublisherRequest) (PublisherInfo, error) {
+	if req.MemberID == "" || len(req.Tracks) == 0 || len(req.Tracks) > maxPublisherTracks {
+		return PublisherInfo{}, ErrInvalidPublisher
+	}
+
+	vp := newVirtualPublisher(r, req.MemberID, req.Name, req.Loop)
+
+	var decls []TrackDeclaration
+	files := make([]string, 0, len(req.Tracks))
+	for _, spec := range req.Tracks {
+		track, err := r.svc.openVirtualTrack(spec, req.MemberID, req.Loop)
+		if err != nil {
+			vp.close()
+			return PublisherInfo{}, err
+		}
+		vp.tracks = append(vp.tracks, track)
+
+		decls = append(decls, TrackDeclaration{TrackID: track.ID(), Source: spec.Source, Metadata: spec.Metadata})
+		files = append(files, spec.File)
+	}
+
+	return r.addPublisher(actor, "publisher-start", strings.Join(files, ","), vp, decls)
+}
+
+func newVirtualPublisher(r *Room, memberID, name string, loop bool) *virtualPublisher {
+	return &virtualPublisher{
+		peer:      newVirtualPeer(r, memberID, name),
+		loop:      loop,
+		startedAt: time.Now(),
+	}
+}
+
+// addPublisher adds vp, whose tracks are open, to the room and starts
+// forwarding them. The publisher is stopped once all of its tracks have
+// ended.
+func (r *Room) addPublisher(actor, action, detail string, vp *virtualPublisher, decls []TrackDeclaration) (PublisherInfo, error) {
+	memberID := vp.peer.ID()
+	vp.peer.declareTracks(decls)
+
+	// A virtual publisher takes a participant slot like any member.
+	if err := r.svc.participants.acquire(r.tenant); err != nil {
+		vp.close()
+		return PublisherInfo{}, err
+	}
+
+	r.mux.Lock()
+	_, isPeer := r.peers[memberID]
+	_, isPublisher := r.publishers[memberID]
+	var err error
+	switch {
+	case isPeer || isPublisher:
+		err = ErrMemberExists
+	case vp.ingest() && r.ingestCount() >= maxRoomIngests:
+		err = ErrIngestLimit
+	}
+	if err != nil {
+		r.mux.Unlock()
+		r.svc.participants.release(r.tenant, 1)
+		vp.close()
+		return PublisherInfo{}, err
+	}
+	r.publishers[memberID] = vp
+	member := r.member(vp.peer)
+	r.mux.Unlock()
+
+	r.broadcast(nil, "member-joined", map[string]any{"member": member})
+
+	var ended sync.WaitGroup
+	for _, track := range vp.tracks {
+		ended.Add(1)
+		track.onEnd = ended.Done
+
+		if r.addIncomingTrack(vp.peer, track) == nil {
+			track.end()
+		}
+	}
+
+	r.audit(actor, action, memberID, detail)
+
+	goroutines.Go("publisher", func() {
+		ended.Wait()
+		if err := r.StopPublisher(systemActor, memberID); err != nil && !errors.Is(err, ErrPublisherNotFound) {
+			vp.peer.logger.Error("Failed to stop virtual publisher", slog.String("error", err.Error()))
+		}
+	})
+
+	return vp.info(), nil
+}
+
+// StopPublisher removes a virtual publisher and withdraws its tracks.
+func (r *Room) StopPublisher(actor, memberID string) error {
+	r.mux.Lock()
+	vp, ok := r.publishers[memberID]
+	if !ok {
+		r.mux.Unlock()
+		return ErrPublisherNotFound
+	}
+	delete(r.publishers, memberID)
+	r.svc.participants.release(r.tenant, 1)
+
+	var owned []string
+	var closing []*TrackForwarder
+	for trackID, forwarder := range r.forwarders {
+		if forwarder.peer == vp.peer {
+			delete(r.forwarders, trackID)
+			owned = append(owned, trackID)
+			closing = append(closing, forwarder)
+		}
+	}
+	peers := r.peerList(nil)
+	r.mux.Unlock()
+
+	for _, forwarder := range closing {
+		forwarder.Close()
+	}
+	vp.close()
+
+	if actor != systemActor {
+		r.audit(actor, "publisher-stop", memberID, "")
+	}
+	r.announceLeave(memberID)
+	r.stopMemberRecordings(memberID)
+	r.stopMemberEgresses(memberID)
+
+	for _, p := range peers {
+		if err := p.RemoveTracksAndRenegotiate(owned...); err != nil {
+			p.logger.Error("Failed to renegotiate", slog.String("error", err.Error()))
+		}
+	}
+	r.backfill()
+
+	return nil
+}
+
+// Publishers lists the room's virtual publishers.
+func (r *Room) Publishers() []PublisherInfo {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	infos := make([]PublisherInfo, 0, len(r.publishers))
+	for _, vp := range r.publishers {
+		infos = append(infos, vp.info())
+	}
+
+	return infos
+}
+
+// ingest reports whether vp receives RTP rather than playing files.
+func (vp *virtualPublisher) ingest() bool {
+	for _, t := range vp.tracks {
+		if _, ok := t.media.(*udpMedia); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (vp *virtualPublisher) close() {
+	for _, t := range vp.tracks {
+		t.close()
+	}
+}
+
+// newVirtualPeer creates the Peer a virtual publisher's forwarders belong
+// to. It has no connection and drops every signaling message.
+func newVirtualPeer(room *Room, id, name string) *Peer {
+	return &Peer{
+		id:         id,
+		name:       name,
+		role:       RoleParticipant,
+		joinedAt:   time.Now(),
+		logger:     slog.Default().With("peer", id, "virtual", true),
+		room:       room,
+		signal:     discardSignaling{},
+		inTracks:   make(map[string]*webrtc.TrackRemote),
+		outTracks:  make(map[string]*webrtc.TrackLocalStaticRTP),
+		senders:    make(map[string]*webrtc.RTPSender),
+		mutedKinds: make(map[webrtc.RTPCodecType]bool),
+		declared:   make(map[string]TrackDeclaration),
+		qualities:  make(map[string]Quality),
+		channels:   make(map[string]*dataChannel),
+		reactions:  newRateLimiter(reactionRate, reactionBurst),
+		tap:        newCaptureTap(),
+	}
+}
+
+// isVirtual reports whether p is a virtual publisher.
+func (p *Peer) isVirtual() bool {
+	return p.conn == nil
+}
+
+type discardSignaling struct{}
+
+func (discardSignaling) WriteMessage(int, []byte) error {
+	return nil
+}
+
+// mediaReader yields the RTP packets of a file in order, each with the time
+// it is due relative to the start of the file. Live media is due on arrival.
+type mediaReader interface {
+	next() (*rtp.Packet, time.Duration, error)
+	// rewind starts over from the beginning of the file.
+	rewind() error
+	Close() error
+}
+
+// openVirtualTrack opens spec's file below the media directory. os.Root
+// keeps names such as "../x" from escaping it.
+func (svc *services) openVirtualTrack(spec PublisherTrack, streamID string, loop bool) (*virtualTrack, error) {
+	if svc.mediaDir == "" || spec.File == "" {
+		return nil, ErrInvalidPublisher
+	}
+
+	root, err := os.OpenRoot(svc.mediaDir)
+	if err != nil {
+		return nil, err
+	}
+	defer root.Close()
+
+	f, err := root.Open(spec.File)
+	if err != nil {
+		return nil, ErrInvalidPublisher
+	}
+
+	var media mediaReader
+	var mimeType string
+	switch strings.ToLower(filepath.Ext(spec.File)) {
+	case ".ivf":
+		media, mimeType, err = newIVFMedia(f)
+	case ".ogg", ".opus":
+		media, mimeType, err = newOggMedia(f)
+	case ".rtpdump", ".rtp":
+		mimeType = spec.MimeType
+		media, err = newRTPDumpMedia(f, spec.SSRC)
+	default:
+		err = ErrUnsupportedMedia
+	}
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	codec, ok := registeredCodec(mimeType)
+	if !ok {
+		_ = media.Close()
+		return nil, ErrUnsupportedMedia
+	}
+
+	return newVirtualTrack(spec.File, streamID, codec, media, loop), nil
+}
+
+// loopGap separates the last packet of a file from the first one of its next
+// loop, in time and in RTP timestamp.
+const loopGap = 20 * time.Millisecond
+
+// virtualTrack is a track read from a file or a plain RTP socket instead of
+// a peer connection. The forwarder's read loop drives it: Read sleeps until
+// the next packet is due. Sequence numbers and timestamps are offset on
+// every loop so that they keep increasing the way a real publisher's would.
+type virtualTrack struct {
+	id       string
+	streamID string
+	file     string
+	address  string
+	codec    webrtc.RTPCodecParameters
+	media    mediaReader
+	loop     bool
+
+	start   time.Time
+	base    time.Duration // start of the current loop relative to start
+	lastDue time.Duration
+	looped  bool
+
+	seqOffset uint16
+	tsOffset  uint32
+	lastSeq   uint16
+	lastTS    uint32
+	sent      bool
+
+	packets atomic.Uint64
+	loops   atomic.Uint64
+	ended   atomic.Bool
+
+	done      chan struct{}
+	doneOnce  sync.Once
+	endOnce   sync.Once
+	closeOnce sync.Once
+	onEnd     func()
+}
+
+func newVirtualTrack(file, streamID string, codec webrtc.RTPCodecParameters, media mediaReader, loop bool) *virtualTrack {
+	return &virtualTrack{
+		id:       uuid.NewString(),
+		streamID: streamID,
+		file:     file,
+		codec:    codec,
+		media:    media,
+		loop:     loop,
+		done:     make(chan struct{}),
+	}
+}
+
+func (t *virtualTrack) ID() string {
+	return t.id
+}
+
+func (t *virtualTrack) StreamID() string {
+	return t.streamID
+}
+
+func (t *virtualTrack) Kind() webrtc.RTPCodecType {
+	if strings.HasPrefix(strings.ToLower(t.codec.MimeType), "audio/") {
+		return webrtc.RTPCodecTypeAudio
+	}
+
+	return webrtc.RTPCodecTypeVideo
+}
+
+func (t *virtualTrack) Codec() webrtc.RTPCodecParameters {
+	return t.codec
+}
+
+// SSRC is never used to address a virtual track: keyframe requests to it
+// are dropped since a file cannot produce one on demand.
+func (t *virtualTrack) SSRC() webrtc.SSRC {
+	return 0
+}
+
+// SetReadDeadline interrupts a pending Read. Only the deadline of the
+// forwarder closing the track is supported, so any deadline ends the track.
+// Media waiting on a socket gets the deadline too.
+func (t *virtualTrack) SetReadDeadline(deadline time.Time) error {
+	t.doneOnce.Do(func() {
+		close(t.done)
+	})
+
+	if media, ok := t.media.(interface{ SetReadDeadline(time.Time) error }); ok {
+		return media.SetReadDeadline(deadline)
+	}
+
+	return nil
+}
+
+func (t *virtualTrack) Read(b []byte) (int, interceptor.Attributes, error) {
+	n, err := t.read(b)
+	if err != nil {
+		t.end()
+	}
+
+	return n, nil, err
+}
+
+func (t *virtualTrack) read(b []byte) (int, error) {
+	if t.start.IsZero() {
+		t.start = time.Now()
+	}
+
+	for {
+		pkt, due, err := t.media.next()
+		if errors.Is(err, io.EOF) && t.loop && t.sent {
+			if err := t.rewind(); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		if t.looped {
+			// The first packet of a loop fixes the offsets that carry on
+			// from the last packet of the previous one.
+			t.seqOffset = t.lastSeq + 1 - pkt.SequenceNumber
+			t.tsOffset = t.lastTS + uint32(loopGap.Seconds()*float64(t.codec.ClockRate)) - pkt.Timestamp
+			t.looped = false
+		}
+		pkt.SequenceNumber += t.seqOffset
+		pkt.Timestamp += t.tsOffset
+
+		t.lastDue = due
+		wait := time.Until(t.start.Add(t.base + due))
+		if wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-t.done:
+				timer.Stop()
+				return 0, io.EOF
+			case <-timer.C:
+			}
+		}
+
+		select {
+		case <-t.done:
+			return 0, io.EOF
+		default:
+		}
+
+		n, err := pkt.MarshalTo(b)
+		if err != nil {
+			return 0, err
+		}
+
+		t.lastSeq, t.lastTS, t.sent = pkt.SequenceNumber, pkt.Timestamp, true
+		t.packets.Add(1)
+
+		return n, nil
+	}
+}
+
+func (t *virtualTrack) rewind() error {
+	if err := t.media.rewind(); err != nil {
+		return err
+	}
+
+	t.base += t.lastDue + loopGap
+	t.looped = true
+	t.loops.Add(1)
+
+	return nil
+}
+
+// end marks the track as finished and tells its publisher, once.
+func (t *virtualTrack) end() {
+	t.endOnce.Do(func() {
+		t.ended.Store(true)
+		if t.onEnd != nil {
+			t.onEnd()
+		}
+	})
+}
+
+// close releases the file. The forwarder must no longer be reading.
+func (t *virtualTrack) close() {
+	t.closeOnce.Do(func() {
+		_ = t.SetReadDeadline(time.Now())
+		_ = t.media.Close()
+	})
+}
+
+func (t *virtualTrack) stats() PublisherTrackStats {
+	return PublisherTrackStats{
+		TrackID:  t.id,
+		File:     t.file,
+		Address:  t.address,
+		MimeType: t.codec.MimeType,
+		Packets:  t.packets.Load(),
+		Loops:    t.loops.Load(),
+		Ended:    t.ended.Load(),
+	}
+}
@@ -0,0 +1,205 @@
+package sfu
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	maxPacketSize = 1500
+
+	videoQueueSize = 512
+	audioQueueSize = 64
+)
+
+// packet is a pooled RTP packet shared by every subscriber queue it is
+// pushed to. The last holder to release it returns it to the pool.
+type packet struct {
+	buf      [maxPacketSize]byte
+	n        int
+	keyframe bool
+	refs     atomic.Int32
+}
+
+var packetPool = sync.Pool{
+	New: func() any { return new(packet) },
+}
+
+func getPacket() *packet {
+	p := packetPool.Get().(*packet)
+	p.n = 0
+	p.keyframe = false
+	p.refs.Store(1)
+
+	return p
+}
+
+func (p *packet) retain() {
+	p.refs.Add(1)
+}
+
+func (p *packet) release() {
+	if p.refs.Add(-1) == 0 {
+		packetPool.Put(p)
+	}
+}
+
+func (p *packet) payload() []byte {
+	return p.buf[:p.n]
+}
+
+// packetQueue is a bounded ring of packets. When full it drops the oldest
+// packet that is not part of a keyframe, falling back to the oldest packet.
+type packetQueue struct {
+	mux   sync.Mutex
+	items []*packet
+	head  int
+	size  int
+
+	ready chan struct{}
+}
+
+func newPacketQueue(capacity int) *packetQueue {
+	return &packetQueue{
+		items: make([]*packet, capacity),
+		ready: make(chan struct{}, 1),
+	}
+}
+
+// push enqueues p and reports whether another packet had to be dropped.
+func (q *packetQueue) push(p *packet) bool {
+	q.mux.Lock()
+	dropped := false
+	if q.size == len(q.items) {
+		q.dropOne()
+		dropped = true
+	}
+
+	q.items[(q.head+q.size)%len(q.items)] = p
+	q.size++
+	q.mux.Unlock()
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+
+	return dropped
+}
+
+func (q *packetQueue) pop() *packet {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	if q.size == 0 {
+		return nil
+	}
+
+	p := q.items[q.head]
+	q.items[q.head] = nil
+	q.head = (q.head + 1) % len(q.items)
+	q.size--
+
+	return p
+}
+
+func (q *packetQueue) len() int {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	return q.size
+}
+
+func (q *packetQueue) capacity() int {
+	return len(q.items)
+}
+
+// dropOne removes the oldest non-keyframe packet, or the oldest packet when
+// the queue only holds keyframe packets. Callers hold q.mux.
+func (q *packetQueue) dropOne() {
+	victim := 0
+	for i := 0; i < q.size; i++ {
+		if !q.items[(q.head+i)%len(q.items)].keyframe {
+			victim = i
+			break
+		}
+	}
+
+	// Shift the packets in front of the victim one slot back so order holds.
+	idx := (q.head + victim) % len(q.items)
+	q.items[idx].release()
+	for i := victim; i > 0; i-- {
+		cur := (q.head + i) % len(q.items)
+		prev := (q.head + i - 1) % len(q.items)
+		q.items[cur] = q.items[prev]
+	}
+	q.items[q.head] = nil
+	q.head = (q.head + 1) % len(q.items)
+	q.size--
+}
+
+// clear releases every queued packet.
+func (q *packetQueue) clear() {
+	for p := q.pop(); p != nil; p = q.pop() {
+		p.release()
+	}
+}
+
+// rtpWriter consumes raw RTP packets. The buffer is only valid during the
+// call.
+type rtpWriter interface {
+	Write(b []byte) (int, error)
+}
+
+// subscriber is one forwarder to subscriber leg, or to a sink such as a
+// recorder. Packets are queued by the forwarder's read loop and written by
+// the leg's own goroutine, so a slow subscriber only ever delays itself.
+type subscriber struct {
+	id     string
+	track  rtpWriter
+	paused atomic.Uint32
+	queue  *packetQueue
+
+	sent    atomic.Uint64
+	dropped atomic.Uint64
+
+	done chan struct{}
+	once sync.Once
+}
+
+func newSubscriber(id string, track rtpWriter, queueSize int) *subscriber {
+	return &subscriber{
+		id:    id,
+		track: track,
+		queue: newPacketQueue(queueSize),
+		done:  make(chan struct{}),
+	}
+}
+
+// run writes queued packets until the subscriber is stopped or ctx is done.
+func (s *subscriber) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			s.queue.clear()
+			return
+		case <-s.done:
+			s.queue.clear()
+			return
+		case <-s.queue.ready:
+			for p := s.queue.pop(); p != nil; p = s.queue.pop() {
+				if _, err := s.track.Write(p.payload()); err == nil {
+					s.sent.Add(1)
+				}
+				p.release()
+			}
+		}
+	}
+}
+
+func (s *subscriber) stop() {
+	s.once.Do(func() {
+		close(s.done)
+	})
+}
@@ -0,0 +1,84 @@
+package sfu
+
+import (
+	"testing"
+)
+
+func testPacket(seq byte, keyframe bool) *packet {
+	p := getPacket()
+	p.buf[0] = seq
+	p.n = 1
+	p.keyframe = keyframe
+
+	return p
+}
+
+func drain(q *packetQueue) []byte {
+	var seqs []byte
+	for p := q.pop(); p != nil; p = q.pop() {
+		seqs = append(seqs, p.payload()[0])
+		p.release()
+	}
+
+	return seqs
+}
+
+func TestPacketQueueDropsOldestNonKeyframe(t *testing.T) {
+	q := newPacketQueue(4)
+
+	q.push(testPacket(1, true))
+	q.push(testPacket(2, true))
+	dropped := testPacket(3, false)
+	dropped.retain()
+	q.push(dropped)
+	q.push(testPacket(4, false))
+
+	if !q.push(testPacket(5, false)) {
+		t.Fatal("push to a full queue did not report a drop")
+	}
+	if n := dropped.refs.Load(); n != 1 {
+		t.Fatalf("dropped packet holds %d references, want only the test's", n)
+	}
+	dropped.release()
+
+	if got := drain(q); string(got) != string([]byte{1, 2, 4, 5}) {
+		t.Fatalf("got %v, want keyframe packets kept and order preserved", got)
+	}
+}
+
+func TestPacketQueueDropsOldestWhenAllKeyframes(t *testing.T) {
+	q := newPacketQueue(3)
+
+	for seq := byte(1); seq <= 3; seq++ {
+		q.push(testPacket(seq, true))
+	}
+	if !q.push(testPacket(4, true)) {
+		t.Fatal("push to a full queue did not report a drop")
+	}
+
+	if got := drain(q); string(got) != string([]byte{2, 3, 4}) {
+		t.Fatalf("got %v, want the oldest dropped", got)
+	}
+}
+
+func TestPacketQueueWraps(t *testing.T) {
+	q := newPacketQueue(3)
+
+	for seq := byte(1); seq <= 10; seq++ {
+		q.push(testPacket(seq, seq%4 == 0))
+		if seq%2 == 0 {
+			p := q.pop()
+			p.release()
+		}
+	}
+
+	if n := q.len(); n > q.capacity() {
+		t.Fatalf("queue holds %d packets, over its capacity", n)
+	}
+	got := drain(q)
+	for i := 1; i < len(got); i++ {
+		if got[i] <= got[i-1] {
+			t.Fatalf("order lost: %v", got)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package sfu
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket refilled at rate tokens per second up to
+// burst tokens.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mux    sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate, burst float64) *rateLimiter {
+	return &rateLimiter{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// Allow takes a token if one is available.
+func (l *rateLimiter) Allow() bool {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	now := time.Now()
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+
+	return true
+}
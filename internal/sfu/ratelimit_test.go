@@ -0,0 +1,46 @@
+package sfu
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(1, 3)
+
+	for i := 0; i < 3; i++ {
+		if !l.Allow() {
+			t.Fatalf("call %d within the burst was refused", i)
+		}
+	}
+	if l.Allow() {
+		t.Fatal("call past the burst was allowed")
+	}
+
+	// Two seconds refill two tokens.
+	l.mux.Lock()
+	l.last = l.last.Add(-2 * time.Second)
+	l.mux.Unlock()
+
+	for i := 0; i < 2; i++ {
+		if !l.Allow() {
+			t.Fatalf("refilled call %d was refused", i)
+		}
+	}
+	if l.Allow() {
+		t.Fatal("refill went past the elapsed time")
+	}
+
+	// Refill is capped at the burst.
+	l.mux.Lock()
+	l.last = l.last.Add(-time.Hour)
+	l.mux.Unlock()
+
+	allowed := 0
+	for l.Allow() {
+		allowed++
+	}
+	if allowed != 3 {
+		t.Fatalf("allowed %d after a long idle, want the burst of 3", allowed)
+	}
+}
@@ -0,0 +1,867 @@
+package sfu
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"gonference/internal/storage"
+
+	"github.com/google/uuid"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+	"github.com/pion/webrtc/v3/pkg/media/ivfwriter"
+	"github.com/pion/webrtc/v3/pkg/media/oggwriter"
+	"github.com/pion/webrtc/v3/pkg/media/samplebuilder"
+)
+
+// RecordingFormat selects how a room recording is laid out on disk.
+type RecordingFormat string
+
+const (
+	// RecordTracks writes every track to its own file: IVF for VP8, VP9,
+	// AV1 and H.264, Ogg for Opus.
+	RecordTracks RecordingFormat = "tracks"
+	// RecordWebM muxes each member's camera and microphone into one WebM
+	// file. Their other tracks, such as screen share, fall back to a file
+	// per track.
+	RecordWebM RecordingFormat = "webm"
+)
+
+var (
+	ErrRecordingActive   = errors.New("already being recorded")
+	ErrRecordingNotFound = errors.New("recording not found")
+)
+
+// RecordingStatus is where a recording is in its life.
+type RecordingStatus string
+
+const (
+	// RecordingPending has started but not received any media yet.
+	RecordingPending RecordingStatus = "pending"
+	// RecordingActive is writing media.
+	RecordingActive RecordingStatus = "recording"
+	// RecordingFinalizing has stopped and is flushing its files to storage.
+	RecordingFinalizing RecordingStatus = "finalizing"
+	RecordingDone       RecordingStatus = "done"
+	RecordingFailed     RecordingStatus = "failed"
+)
+
+const (
+	// reorderWindow is how many packets a recorder holds back waiting for
+	// a missing one before skipping it.
+	reorderWindow = 64
+	// sampleMaxLate is how many packets the frame assembler waits for the
+	// rest of a frame.
+	sampleMaxLate = 128
+
+	// recordingHistory is how many finished recordings the SFU remembers
+	// for status queries.
+	recordingHistory = 1000
+
+	manifestFile = "manifest.json"
+)
+
+// RecordingManifest describes a recording and doubles as its status
+// resource. It is stored next to the media files once the recording is
+// finalized. MemberID is set when only one member is
+// recorded.
+type RecordingManifest struct {
+	ID        string           `json:"id"`
+	Tenant    string           `json:"tenant"`
+	Room      string           `json:"room"`
+	MemberID  string           `json:"memberId,omitempty"`
+	Status    RecordingStatus  `json:"status"`
+	Error     string           `json:"error,omitempty"`
+	Format    RecordingFormat  `json:"format"`
+	Path      string           `json:"path"`
+	StartedAt time.Time        `json:"startedAt"`
+	EndedAt   *time.Time       `json:"endedAt,omitempty"`
+	Tracks    []TrackRecording `json:"tracks"`
+}
+
+// TrackRecording locates one track of a recording. The track's first
+// recorded frame arrived OffsetMs after the recording started and carries
+// FirstRTPTimestamp, so tracks are synchronized by placing each at its
+// offset. Video starts on a keyframe. StartedAt is nil when nothing was
+// recorded.
+type TrackRecording struct {
+	TrackID           string      `json:"trackId"`
+	MemberID          string      `json:"memberId"`
+	Kind              string      `json:"kind"`
+	Source            TrackSource `json:"source"`
+	MimeType          string      `json:"mimeType"`
+	ClockRate         uint32      `json:"clockRate"`
+	File              string      `json:"file"`
+	StartedAt         *time.Time  `json:"startedAt,omitempty"`
+	OffsetMs          int64       `json:"offsetMs"`
+	FirstRTPTimestamp uint32      `json:"firstRtpTimestamp"`
+	EndedAt           *time.Time  `json:"endedAt,omitempty"`
+	Packets           uint64      `json:"packets"`
+	Error             string      `json:"error,omitempty"`
+}
+
+// StartRecording records every current and future track of the room, or
+// only those of memberID when it is set, until StopRecording or Close.
+// Everyone in the room is told that recording is on.
+func (r *Room) StartRecording(actor, memberID string) (RecordingManifest, error) {
+	r.mux.Lock()
+	if memberID != "" {
+		if _, ok := r.peers[memberID]; !ok {
+			r.mux.Unlock()
+			return RecordingManifest{}, ErrPeerNotFound
+		}
+	}
+
+	for _, rec := range r.recordings {
+		if rec.memberID == "" || rec.memberID == memberID {
+			r.mux.Unlock()
+			return RecordingManifest{}, ErrRecordingActive
+		}
+	}
+
+	rec := newRecording(r, memberID)
+	r.recordings[rec.id] = rec
+	forwarders := r.forwarderList(nil)
+	r.mux.Unlock()
+
+	r.svc.recordings.add(rec)
+
+	for _, forwarder := range forwarders {
+		rec.attach(forwarder)
+	}
+
+	manifest := rec.snapshot()
+	r.audit(actor, "recording-start", memberID, rec.id)
+	r.broadcast(nil, "recording-started", map[string]any{"recording": manifest})
+
+	return manifest, nil
+}
+
+// StopRecording stops a recording of the room. Its files are finalized in
+// the background; the returned status is finalizing until they are stored.
+func (r *Room) StopRecording(actor, id string) (RecordingManifest, error) {
+	r.mux.Lock()
+	rec, ok := r.recordings[id]
+	delete(r.recordings, id)
+	r.mux.Unlock()
+
+	if !ok {
+		return RecordingManifest{}, ErrRecordingNotFound
+	}
+
+	rec.stop()
+
+	manifest := rec.snapshot()
+	r.audit(actor, "recording-stop", rec.memberID, rec.id)
+	r.broadcast(nil, "recording-stopped", map[string]any{"recording": manifest})
+
+	return manifest, nil
+}
+
+// Recordings returns the room's recordings in progress.
+func (r *Room) Recordings() []RecordingManifest {
+	r.mux.RLock()
+	recs := r.recordingList()
+	r.mux.RUnlock()
+
+	manifests := make([]RecordingManifest, 0, len(recs))
+	for _, rec := range recs {
+		manifests = append(manifests, rec.snapshot())
+	}
+
+	return manifests
+}
+
+// recordingList returns the room's recordings. Callers hold r.mux.
+func (r *Room) recordingList() []*recording {
+	recs := make([]*recording, 0, len(r.recordings))
+	for _, rec := range r.recordings {
+		recs = append(recs, rec)
+	}
+
+	return recs
+}
+
+// stopMemberRecordings stops recording a member who left the room.
+func (r *Room) stopMemberRecordings(memberID string) {
+	r.mux.RLock()
+	var ids []string
+	for id, rec := range r.recordings {
+		if rec.memberID == memberID {
+			ids = append(ids, id)
+		}
+	}
+	r.mux.RUnlock()
+
+	for _, id := range ids {
+		if _, err := r.StopRecording(systemActor, id); err != nil && !errors.Is(err, ErrRecordingNotFound) {
+			slog.Error("Failed to stop recording", slog.String("recording", id), slog.String("error", err.Error()))
+		}
+	}
+}
+
+// Recordings returns the status of tenant's recordings, in progress and
+// recently finished.
+func (s *SFU) Recordings(tenant string) []RecordingManifest {
+	return s.svc.recordings.list(tenant)
+}
+
+// Recording returns the status of one of tenant's recordings. It stays
+// available after the room has closed.
+func (s *SFU) Recording(tenant, id string) (RecordingManifest, error) {
+	return s.svc.recordings.get(tenant, id)
+}
+
+// recordingRegistry keeps every recording of an SFU for status queries,
+// forgetting the oldest finished ones beyond recordingHistory.
+type recordingRegistry struct {
+	mux   sync.RWMutex
+	byID  map[string]*recording
+	order []string
+}
+
+func newRecordingRegistry() *recordingRegistry {
+	return &recordingRegistry{byID: make(map[string]*recording)}
+}
+
+func (reg *recordingRegistry) add(rec *recording) {
+	reg.mux.Lock()
+	defer reg.mux.Unlock()
+
+	reg.byID[rec.id] = rec
+	reg.order = append(reg.order, rec.id)
+
+	for i := 0; len(reg.order) > recordingHistory && i < len(reg.order); {
+		if !reg.byID[reg.order[i]].finished() {
+			i++
+			continue
+		}
+
+		delete(reg.byID, reg.order[i])
+		reg.order = append(reg.order[:i], reg.order[i+1:]...)
+	}
+}
+
+func (reg *recordingRegistry) list(tenant string) []RecordingManifest {
+	reg.mux.RLock()
+	defer reg.mux.RUnlock()
+
+	manifests := make([]RecordingManifest, 0)
+	for _, id := range reg.order {
+		if rec := reg.byID[id]; rec.tenant == tenant {
+			manifests = append(manifests, rec.snapshot())
+		}
+	}
+
+	return manifests
+}
+
+func (reg *recordingRegistry) get(tenant, id string) (RecordingManifest, error) {
+	reg.mux.RLock()
+	rec, ok := reg.byID[id]
+	reg.mux.RUnlock()
+
+	if !ok || rec.tenant != tenant {
+		return RecordingManifest{}, ErrRecordingNotFound
+	}
+
+	return rec.snapshot(), nil
+}
+
+// recording is a recording in progress. Each recorded forwarder feeds a
+// trackRecorder sink, and every file goes to the SFU's recording storage
+// under prefix.
+type recording struct {
+	id       string
+	tenant   string
+	memberID string
+	prefix   string
+	format   RecordingFormat
+	store    storage.Store
+
+	mux      sync.Mutex
+	manifest RecordingManifest
+	attached map[string]*TrackForwarder
+	members  map[string]*webmMember
+	stopped  bool
+
+	// wg counts track recorders that have not closed yet.
+	wg sync.WaitGroup
+}
+
+// webmMember is a member's WebM file and which of its tracks are taken.
+type webmMember struct {
+	file  *webmFile
+	name  string
+	start time.Time
+	video bool
+	audio bool
+}
+
+func newRecording(r *Room, memberID string) *recording {
+	id := uuid.NewString()
+	prefix := url.PathEscape(r.storageKey()) + "/" + id
+
+	format := r.svc.recordingFormat
+	if format != RecordWebM {
+		format = RecordTracks
+	}
+
+	return &recording{
+		id:       id,
+		tenant:   r.tenant,
+		memberID: memberID,
+		prefix:   prefix,
+		format:   format,
+		store:    r.svc.recordingStore,
+		manifest: RecordingManifest{
+			ID:        id,
+			Tenant:    r.tenant,
+			Room:      r.id,
+			MemberID:  memberID,
+			Status:    RecordingPending,
+			Format:    format,
+			Path:      prefix,
+			StartedAt: time.Now(),
+			Tracks:    []TrackRecording{},
+		},
+		attached: make(map[string]*TrackForwarder),
+		members:  make(map[string]*webmMember),
+	}
+}
+
+func (rec *recording) sinkID() string {
+	return "recording:" + rec.id
+}
+
+// attach starts recording forwarder unless the recording has stopped or
+// records another member.
+func (rec *recording) attach(forwarder *TrackForwarder) {
+	rec.mux.Lock()
+	defer rec.mux.Unlock()
+
+	if rec.stopped || (rec.memberID != "" && forwarder.peer.ID() != rec.memberID) {
+		return
+	}
+	if _, ok := rec.attached[forwarder.ID()]; ok {
+		return
+	}
+
+	codec := forwarder.remote.Codec()
+	memberID := forwarder.peer.ID()
+	entry := TrackRecording{
+		TrackID:   forwarder.ID(),
+		MemberID:  memberID,
+		Kind:      forwarder.Kind().String(),
+		Source:    forwarder.Source(),
+		MimeType:  codec.MimeType,
+		ClockRate: codec.ClockRate,
+		File:      trackFileName(len(rec.manifest.Tracks), memberID, forwarder.ID(), codec.MimeType),
+	}
+
+	var member *webmMember
+	if rec.format == RecordWebM {
+		member = rec.webmSlot(memberID, forwarder, codec.MimeType)
+		if member != nil {
+			entry.File = member.name
+		}
+	}
+
+	rec.manifest.Tracks = append(rec.manifest.Tracks, entry)
+	sink := &trackRecorder{
+		rec:       rec,
+		index:     len(rec.manifest.Tracks) - 1,
+		mimeType:  codec.MimeType,
+		clockRate: codec.ClockRate,
+		channels:  codec.Channels,
+		video:     forwarder.Kind() == webrtc.RTPCodecTypeVideo,
+		member:    member,
+		keyframe:  forwarder.RequestKeyframe,
+	}
+
+	rec.wg.Add(1)
+	if err := forwarder.AddSink(rec.sinkID(), sink); err != nil {
+		rec.wg.Done()
+		rec.manifest.Tracks[sink.index].Error = err.Error()
+		return
+	}
+
+	rec.attached[forwarder.ID()] = forwarder
+}
+
+// detach stops recording forwarder, e.g. when its member moves to a
+// breakout room.
+func (rec *recording) detach(forwarder *TrackForwarder) {
+	rec.mux.Lock()
+	_, ok := rec.attached[forwarder.ID()]
+	delete(rec.attached, forwarder.ID())
+	rec.mux.Unlock()
+
+	if ok {
+		forwarder.RemoveSink(rec.sinkID())
+	}
+}
+
+// stop detaches every forwarder and finalizes the recording in the
+// background: it waits for the track recorders to flush, closes the WebM
+// files and writes the final manifest.
+func (rec *recording) stop() {
+	rec.mux.Lock()
+	if rec.stopped {
+		rec.mux.Unlock()
+		return
+	}
+	rec.stopped = true
+	rec.manifest.Status = RecordingFinalizing
+	attached := make([]*TrackForwarder, 0, len(rec.attached))
+	for _, forwarder := range rec.attached {
+		attached = append(attached, forwarder)
+	}
+	clear(rec.attached)
+	rec.mux.Unlock()
+
+	for _, forwarder := range attached {
+		forwarder.RemoveSink(rec.sinkID())
+	}
+
+	goroutines.Go("recording-finalize", rec.finalize)
+}
+
+func (rec *recording) finalize() {
+	rec.wg.Wait()
+
+	rec.mux.Lock()
+	defer rec.mux.Unlock()
+
+	var errs []error
+	for _, member := range rec.members {
+		if err := member.file.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", member.name, err))
+		}
+	}
+
+	now := time.Now()
+	rec.manifest.EndedAt = &now
+	rec.manifest.Status = RecordingDone
+	if err := errors.Join(errs...); err != nil {
+		rec.manifest.Status = RecordingFailed
+		rec.manifest.Error = err.Error()
+	}
+
+	if err := rec.writeManifest(); err != nil {
+		rec.manifest.Status = RecordingFailed
+		rec.manifest.Error = err.Error()
+	}
+
+	if rec.manifest.Status == RecordingFailed {
+		slog.Error("Recording failed", slog.String("recording", rec.id), slog.String("error", rec.manifest.Error))
+	}
+}
+
+func (rec *recording) finished() bool {
+	rec.mux.Lock()
+	defer rec.mux.Unlock()
+
+	return rec.manifest.Status == RecordingDone || rec.manifest.Status == RecordingFailed
+}
+
+func (rec *recording) snapshot() RecordingManifest {
+	rec.mux.Lock()
+	defer rec.mux.Unlock()
+
+	manifest := rec.manifest
+	manifest.Tracks = append([]TrackRecording{}, rec.manifest.Tracks...)
+
+	return manifest
+}
+
+// webmSlot returns the member's WebM file when the track is their camera or
+// microphone and that slot is still free. Callers hold rec.mux.
+func (rec *recording) webmSlot(memberID string, forwarder *TrackForwarder, mimeType string) *webmMember {
+	video := strings.EqualFold(mimeType, webrtc.MimeTypeVP8) || strings.EqualFold(mimeType, webrtc.MimeTypeVP9)
+	audio := strings.EqualFold(mimeType, webrtc.MimeTypeOpus)
+
+	source := forwarder.Source()
+	if !(video && source == SourceCamera) && !(audio && source == SourceMicrophone) {
+		return nil
+	}
+
+	member, ok := rec.members[memberID]
+	if !ok {
+		name := url.PathEscape(memberID) + ".webm"
+		f, err := rec.create(name)
+		if err != nil {
+			slog.Error("Failed to create recording", slog.String("file", name), slog.String("error", err.Error()))
+			return nil
+		}
+
+		member = &webmMember{file: newWebMFile(f), name: name}
+		rec.members[memberID] = member
+	}
+
+	if (video && member.video) || (audio && member.audio) {
+		return nil
+	}
+
+	// The file takes the codec of the first video track; another codec
+	// is recorded to its own file.
+	if video {
+		fourcc := "VP80"
+		if strings.EqualFold(mimeType, webrtc.MimeTypeVP9) {
+			fourcc = "VP90"
+		}
+		if !member.file.claimVideo(fourcc) {
+			return nil
+		}
+	}
+	member.video = member.video || video
+	member.audio = member.audio || audio
+
+	return member
+}
+
+// create opens a file of the recording in storage.
+func (rec *recording) create(name string) (io.WriteCloser, error) {
+	return rec.store.Create(rec.prefix + "/" + name)
+}
+
+// writeManifest stores the manifest. Callers hold rec.mux.
+func (rec *recording) writeManifest() error {
+	data, err := json.MarshalIndent(rec.manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	w, err := rec.create(manifestFile)
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.Write(data); err != nil {
+		_ = w.Close()
+		return err
+	}
+
+	return w.Close()
+}
+
+func (rec *recording) update(index int, apply func(*TrackRecording)) {
+	rec.mux.Lock()
+	defer rec.mux.Unlock()
+
+	apply(&rec.manifest.Tracks[index])
+}
+
+// trackFileName is unique within a recording even when a track is recorded
+// twice, e.g. after its member returns from a breakout room.
+func trackFileName(index int, memberID, trackID, mimeType string) string {
+	ext := "ivf"
+	if strings.EqualFold(mimeType, webrtc.MimeTypeOpus) {
+		ext = "ogg"
+	}
+
+	return fmt.Sprintf("%03d-%s-%s.%s", index, url.PathEscape(memberID), url.PathEscape(trackID), ext)
+}
+
+// trackRecorder is the sink recording one forwarder. Packets are put back
+// in sequence order, video waits for a keyframe, and the output is opened
+// on the first recorded packet so the manifest gets its real start time.
+type trackRecorder struct {
+	rec       *recording
+	index     int
+	mimeType  string
+	clockRate uint32
+	channels  uint16
+	video     bool
+	member    *webmMember
+	keyframe  func()
+
+	reorder reorderBuffer
+	started bool
+	failed  bool
+	firstTS uint32
+	packets uint64
+
+	// Either rtpOut takes packets directly, or builder assembles frames
+	// for frames.
+	rtpOut  media.Writer
+	builder *samplebuilder.SampleBuilder
+	frames  frameWriter
+	keyTS   uint32
+	hasKey  bool
+}
+
+func (t *trackRecorder) Write(b []byte) (int, error) {
+	pkt := &rtp.Packet{}
+	if err := pkt.Unmarshal(append([]byte(nil), b...)); err != nil {
+		return 0, err
+	}
+
+	ordered, skipped := t.reorder.push(pkt)
+	if skipped && t.video {
+		t.keyframe()
+	}
+
+	for _, p := range ordered {
+		t.writePacket(p)
+	}
+
+	return len(b), nil
+}
+
+func (t *trackRecorder) writePacket(pkt *rtp.Packet) {
+	if t.failed {
+		return
+	}
+
+	if !t.started {
+		if t.video && detectsKeyframes(t.mimeType) && !isKeyframe(t.mimeType, pkt.Payload) {
+			return
+		}
+
+		if err := t.start(pkt); err != nil {
+			t.fail(err)
+			return
+		}
+	}
+
+	t.packets++
+
+	if t.rtpOut != nil {
+		if err := t.rtpOut.WriteRTP(pkt); err != nil {
+			t.fail(err)
+		}
+		return
+	}
+
+	if t.video && isKeyframe(t.mimeType, pkt.Payload) {
+		t.keyTS, t.hasKey = pkt.Timestamp, true
+	}
+
+	t.builder.Push(pkt)
+	for sample, ts := t.builder.PopWithTimestamp(); sample != nil; sample, ts = t.builder.PopWithTimestamp() {
+		pts := time.Duration(ts-t.firstTS) * time.Second / time.Duration(t.clockRate)
+		keyframe := t.hasKey && ts == t.keyTS
+
+		if err := t.frames.writeFrame(sample.Data, pts, keyframe); err != nil {
+			t.fail(err)
+			return
+		}
+	}
+}
+
+// start opens the output for the track's first recorded packet.
+func (t *trackRecorder) start(pkt *rtp.Packet) error {
+	now := time.Now()
+	t.started = true
+	t.firstTS = pkt.Timestamp
+
+	var name string
+	var offset time.Duration
+	t.rec.update(t.index, func(entry *TrackRecording) {
+		if t.rec.manifest.Status == RecordingPending {
+			t.rec.manifest.Status = RecordingActive
+		}
+
+		entry.StartedAt = &now
+		entry.OffsetMs = now.Sub(t.rec.manifest.StartedAt).Milliseconds()
+		entry.FirstRTPTimestamp = pkt.Timestamp
+		name = entry.File
+
+		if t.member != nil {
+			if t.member.start.IsZero() {
+				t.member.start = now
+			}
+			offset = now.Sub(t.member.start)
+		}
+	})
+
+	depacketizer := depacketizerFor(t.mimeType)
+
+	if t.member != nil {
+		track := uint64(webmAudioTrack)
+		if t.video {
+			track = webmVideoTrack
+		}
+
+		t.builder = samplebuilder.New(sampleMaxLate, depacketizer, t.clockRate)
+		t.frames = t.member.file.track(track, offset)
+
+		return nil
+	}
+
+	out, err := t.rec.create(name)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case strings.EqualFold(t.mimeType, webrtc.MimeTypeOpus):
+		t.rtpOut, err = oggwriter.NewWith(out, t.clockRate, max(t.channels, 1))
+	case strings.EqualFold(t.mimeType, webrtc.MimeTypeAV1):
+		t.rtpOut, err = ivfwriter.NewWith(out, ivfwriter.WithCodec(webrtc.MimeTypeAV1))
+	case strings.EqualFold(t.mimeType, webrtc.MimeTypeVP8), strings.EqualFold(t.mimeType, webrtc.MimeTypeVP9):
+		fourcc := "VP80"
+		if strings.EqualFold(t.mimeType, webrtc.MimeTypeVP9) {
+			fourcc = "VP90"
+		}
+
+		width, height := uint16(640), uint16(480)
+		var vp8 codecs.VP8Packet
+		if frame, err := vp8.Unmarshal(pkt.Payload); err == nil && fourcc == "VP80" {
+			if w, h, ok := vp8Dimensions(frame); ok {
+				width, height = w, h
+			}
+		}
+
+		t.builder = samplebuilder.New(sampleMaxLate, depacketizer, t.clockRate)
+		t.frames, err = newIVFFile(out, fourcc, width, height)
+	case strings.EqualFold(t.mimeType, webrtc.MimeTypeH264):
+		// Frames are Annex B access units. The IVF header takes the picture
+		// size from the SPS sent ahead of the first keyframe, if any.
+		width, height := uint16(640), uint16(480)
+		if w, h, err := h264Dimensions(h264SPS(pkt.Payload)); err == nil {
+			width, height = w, h
+		}
+
+		t.builder = samplebuilder.New(sampleMaxLate, depacketizer, t.clockRate)
+		t.frames, err = newIVFFile(out, "H264", width, height)
+	default:
+		err = errors.New("unsupported codec " + t.mimeType)
+	}
+
+	if err != nil {
+		_ = out.Close()
+	}
+
+	return err
+}
+
+func (t *trackRecorder) fail(err error) {
+	t.failed = true
+	t.rec.update(t.index, func(entry *TrackRecording) {
+		entry.Error = err.Error()
+	})
+	slog.Error("Track recording failed", slog.String("recording", t.rec.id), slog.String("error", err.Error()))
+}
+
+// Close flushes the packets still held for reordering and finalizes the
+// output. The forwarder calls it once the sink is removed.
+func (t *trackRecorder) Close() error {
+	defer t.rec.wg.Done()
+
+	for _, pkt := range t.reorder.flush() {
+		t.writePacket(pkt)
+	}
+
+	var err error
+	switch {
+	case t.rtpOut != nil:
+		err = t.rtpOut.Close()
+	case t.frames != nil:
+		err = t.frames.Close()
+	}
+
+	now := time.Now()
+	t.rec.update(t.index, func(entry *TrackRecording) {
+		entry.EndedAt = &now
+		entry.Packets = t.packets
+	})
+
+	return err
+}
+
+func depacketizerFor(mimeType string) rtp.Depacketizer {
+	switch {
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP8):
+		return &codecs.VP8Packet{}
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP9):
+		return &codecs.VP9Packet{}
+	case strings.EqualFold(mimeType, webrtc.MimeTypeH264):
+		return &codecs.H264Packet{}
+	case strings.EqualFold(mimeType, webrtc.MimeTypeOpus):
+		return &codecs.OpusPacket{}
+	}
+
+	return nil
+}
+
+// reorderBuffer puts RTP packets back in sequence order. It holds packets
+// after a gap until either the missing one arrives or reorderWindow packets
+// are waiting, then skips the gap. Packets older than the ones already
+// released are dropped.
+type reorderBuffer struct {
+	init    bool
+	next    uint16
+	pending map[uint16]*rtp.Packet
+}
+
+// push adds p and returns the packets now in order, and whether a gap was
+// skipped to get them.
+func (b *reorderBuffer) push(p *rtp.Packet) ([]*rtp.Packet, bool) {
+	if !b.init {
+		b.init = true
+		b.next = p.SequenceNumber
+		b.pending = make(map[uint16]*rtp.Packet)
+	}
+
+	if int16(p.SequenceNumber-b.next) < 0 {
+		return nil, false
+	}
+	b.pending[p.SequenceNumber] = p
+
+	out := b.drain()
+	skipped := false
+	for len(b.pending) >= reorderWindow {
+		b.next = b.oldest()
+		skipped = true
+		out = append(out, b.drain()...)
+	}
+
+	return out, skipped
+}
+
+// flush releases every held packet in order.
+func (b *reorderBuffer) flush() []*rtp.Packet {
+	var out []*rtp.Packet
+	for len(b.pending) > 0 {
+		b.next = b.oldest()
+		out = append(out, b.drain()...)
+	}
+
+	return out
+}
+
+func (b *reorderBuffer) drain() []*rtp.Packet {
+	var out []*rtp.Packet
+	for {
+		p, ok := b.pending[b.next]
+		if !ok {
+			return out
+		}
+
+		delete(b.pending, b.next)
+		out = append(out, p)
+		b.next++
+	}
+}
+
+func (b *reorderBuffer) oldest() uint16 {
+	oldest, first := uint16(0), true
+	for seq := range b.pending {
+		if first || int16(seq-oldest) < 0 {
+			oldest, first = seq, false
+		}
+	}
+
+	return oldest
+}
@@ -0,0 +1,97 @@
+package sfu
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gonference/internal/storage"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+func TestRecordH264Track(t *testing.T) {
+	dir := t.TempDir()
+	rec := &recording{
+		id:     "rec",
+		prefix: "room/rec",
+		store:  storage.NewDir(dir),
+		manifest: RecordingManifest{
+			StartedAt: time.Now(),
+			Tracks:    []TrackRecording{{File: "0-alice-video.ivf"}},
+		},
+	}
+
+	sink := &trackRecorder{
+		rec:       rec,
+		mimeType:  webrtc.MimeTypeH264,
+		clockRate: 90000,
+		video:     true,
+		keyframe:  func() {},
+	}
+	rec.wg.Add(1)
+
+	// A STAP-A with the SPS and PPS, then an IDR picture followed by
+	// non-IDR ones, a NAL unit per packet.
+	sps, pps := testSPS(100, 120, 68, 4), []byte{0x68, 0xce}
+	stapA := []byte{0x78, 0, byte(len(sps))}
+	stapA = append(stapA, sps...)
+	stapA = append(stapA, 0, byte(len(pps)))
+	stapA = append(stapA, pps...)
+
+	payloads := [][]byte{stapA}
+	for _, nalType := range []byte{5, 1, 1, 1} {
+		payloads = append(payloads, []byte{0x60 | nalType, 0xaa, 0xbb})
+	}
+	for i, payload := range payloads {
+		pkt := rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				Marker:         i > 0,
+				SequenceNumber: uint16(100 + i),
+				Timestamp:      uint32(3000 * max(i-1, 0)),
+			},
+			Payload: payload,
+		}
+		data, err := pkt.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := sink.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if entry := rec.manifest.Tracks[0]; entry.Error != "" || entry.StartedAt == nil {
+		t.Fatalf("track not recorded: %+v", entry)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "room", "rec", "0-alice-video.ivf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) < 32+12 || string(data[:4]) != "DKIF" || string(data[8:12]) != "H264" {
+		t.Fatalf("not an H.264 IVF file: % x", data[:min(len(data), 32)])
+	}
+
+	if width, height := binary.LittleEndian.Uint16(data[12:]), binary.LittleEndian.Uint16(data[14:]); width != 1920 || height != 1080 {
+		t.Fatalf("IVF header says %dx%d, want 1920x1080 from the SPS", width, height)
+	}
+
+	// The first frame is the parameter sets and the IDR picture as an
+	// Annex B access unit.
+	frame := data[32+12:]
+	if want := append([]byte{0, 0, 0, 1}, sps...); !bytes.HasPrefix(frame, want) {
+		t.Fatalf("first frame % x, want the SPS first", frame[:min(len(frame), 8)])
+	}
+	if want := []byte{0, 0, 0, 1, 0x65, 0xaa, 0xbb}; !bytes.Contains(frame, want) {
+		t.Fatalf("first frame % x lacks the IDR picture % x", frame, want)
+	}
+}
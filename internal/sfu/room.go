@@ -3,25 +3,91 @@ package sfu
 import (
 	"log/slog"
 	"sync"
-
-	"github.com/pion/webrtc/v3"
+	"time"
 )
 
+// RoomOptions configures room behaviour at creation time.
+type RoomOptions struct {
+	// Lobby parks joiners until a moderator or the API admits them. Only
+	// the host, and members the API admitted before they joined, skip it.
+	Lobby bool `json:"lobby"`
+	// Host is the member ID of the room's creator, who becomes its
+	// moderator. Without a host, the first member to join an empty room
+	// does, unless the room has a lobby: then only the API moderates until
+	// the host joins. Member IDs are not authenticated, so the host's
+	// should not be guessable.
+	Host string `json:"host,omitempty"`
+	// LastN caps how many camera tracks each member receives. Screen share
+	// and audio are never held back. Zero means unlimited.
+	LastN int `json:"lastN"`
+	// ScreenShare restricts who may publish screen share tracks.
+	ScreenShare ScreenSharePolicy `json:"screenShare"`
+	// SinglePresenter allows only one member to share their screen at a time.
+	SinglePresenter bool `json:"singlePresenter"`
+	// ManualSubscription makes every member pick the tracks they receive,
+	// as if each had joined with JoinRequest.ManualSubscription.
+	ManualSubscription bool `json:"manualSubscription"`
+	// FileSharing restricts who may offer files to the room.
+	FileSharing FileSharingPolicy `json:"fileSharing"`
+	// Record starts recording the room as soon as it is created.
+	Record bool `json:"record"`
+}
+
+// idleRoomTimeout is how long a main room may stay empty before it is
+// closed and removed from the SFU. Tests shorten it.
+var idleRoomTimeout = 5 * time.Minute
+
 type Room struct {
-	id  string
-	api *webrtc.API
+	id      string
+	tenant  string
+	svc     *services
+	options RoomOptions
 
 	mux        sync.RWMutex
 	peers      map[string]*Peer
 	forwarders map[string]*TrackForwarder
+	lobby      map[string]*lobbyEntry
+	invited    map[string]struct{}
+	banned     map[string]struct{}
+	locked     bool
+	auditLog   []AuditEntry
+	hands      []HandRaise
+	polls      map[string]*poll
+	state      *sharedState
+	transfers  map[string]*fileTransfer
+	recordings map[string]*recording
+	publishers map[string]*virtualPublisher
+	egresses   map[string]*egress
+	hls        *hlsStream
+
+	parent        *Room
+	breakouts     map[string]*Room
+	breakoutTimer *time.Timer
+	breakoutsEnd  time.Time
+
+	idleTimer *time.Timer
+	onClose   func()
+	closeOnce sync.Once
 }
 
-func NewRoom(api *webrtc.API, id string) *Room {
+func NewRoom(svc *services, tenant, id string, opts RoomOptions) *Room {
 	return &Room{
 		id:         id,
-		api:        api,
+		tenant:     tenant,
+		svc:        svc,
+		options:    opts,
 		peers:      make(map[string]*Peer),
 		forwarders: make(map[string]*TrackForwarder),
+		lobby:      make(map[string]*lobbyEntry),
+		invited:    make(map[string]struct{}),
+		banned:     make(map[string]struct{}),
+		polls:      make(map[string]*poll),
+		state:      newSharedState(),
+		transfers:  make(map[string]*fileTransfer),
+		recordings: make(map[string]*recording),
+		publishers: make(map[string]*virtualPublisher),
+		egresses:   make(map[string]*egress),
+		breakouts:  make(map[string]*Room),
 	}
 }
 
@@ -29,6 +95,21 @@ func (r *Room) ID() string {
 	return r.id
 }
 
+func (r *Room) Tenant() string {
+	return r.tenant
+}
+
+func (r *Room) Options() RoomOptions {
+	return r.options
+}
+
+func (r *Room) PeerCount() int {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	return len(r.peers)
+}
+
 func (r *Room) GetPeer(id string) (*Peer, bool) {
 	r.mux.RLock()
 	defer r.mux.RUnlock()
@@ -37,41 +118,91 @@ func (r *Room) GetPeer(id string) (*Peer, bool) {
 	return peer, ok
 }
 
-func (r *Room) AddPeer(signal Signaling, offer webrtc.SessionDescription, id string) (*Peer, error) {
-	peer, err := NewPeer(r.api, signal, r, offer, id)
-	if err != nil {
+// AddPeer connects the member and adds them to the room. The checks of
+// canJoin are repeated when the peer is inserted, as the room may have
+// changed while the connection was set up.
+func (r *Room) AddPeer(signal Signaling, req JoinRequest) (*Peer, error) {
+	id := req.MemberID
+	if err := r.canJoin(id); err != nil {
 		return nil, err
 	}
 
-	r.mux.Lock()
-	r.peers[id] = peer
-	forwarders := make([]*TrackForwarder, 0, len(r.forwarders))
-	for _, f := range r.forwarders {
-		forwarders = append(forwarders, f)
+	if err := r.svc.participants.acquire(r.tenant); err != nil {
+		return nil, err
 	}
-	r.mux.Unlock()
 
-	for _, forwarder := range forwarders {
-		local, err := forwarder.AddPeer(id)
-		if err != nil {
-			peer.logger.Error("Failed to add peer to forwarder", slog.String("error", err.Error()))
-			continue
-		}
+	req.ManualSubscription = req.ManualSubscription || r.options.ManualSubscription
 
-		peer.addOutboundTrack(local)
-		if _, err := peer.conn.AddTrack(local); err != nil {
-			peer.logger.Error("Failed to add track to peer connection", slog.String("error", err.Error()))
+	tap := newCaptureTap()
+	peer, err := NewPeer(r.svc.peerAPI(tap), tap, signal, r, req)
+	if err != nil {
+		r.svc.participants.release(r.tenant, 1)
+		return nil, err
+	}
+
+	r.mux.Lock()
+	if err := r.joinable(id); err != nil {
+		r.mux.Unlock()
+		r.svc.participants.release(r.tenant, 1)
+		if err := peer.Close(); err != nil {
+			peer.logger.Error("Failed to close peer", slog.String("error", err.Error()))
 		}
+		return nil, err
 	}
+	if r.moderates(id) {
+		peer.setRole(RoleModerator)
+	}
+	r.peers[id] = peer
+	forwarders := r.forwarderList(nil)
+	r.mux.Unlock()
+
+	r.subscribe(peer, forwarders)
 
 	if err := peer.Renegotiate(); err != nil {
 		peer.logger.Error("Failed to renegotiate", slog.String("error", err.Error()))
+		r.discardPeer(peer)
 		return nil, err
 	}
 
+	r.announceJoin(peer)
+	if peer.IsModerator() {
+		r.sendLobby(peer)
+	}
+
 	return peer, nil
 }
 
+// discardPeer undoes AddPeer for a peer that failed to join before it was
+// announced, unless it was removed meanwhile.
+func (r *Room) discardPeer(peer *Peer) {
+	r.mux.Lock()
+	if r.peers[peer.ID()] != peer {
+		r.mux.Unlock()
+		return
+	}
+	delete(r.peers, peer.ID())
+	for _, forwarder := range r.forwarders {
+		forwarder.RemovePeer(peer.ID())
+	}
+	r.mux.Unlock()
+
+	r.svc.participants.release(r.tenant, 1)
+	if err := peer.Close(); err != nil {
+		peer.logger.Error("Failed to close peer", slog.String("error", err.Error()))
+	}
+	r.closeIfIdle()
+}
+
+// moderates tells whether a member joining now becomes moderator; see
+// RoomOptions.Host.
+func (r *Room) moderates(id string) bool {
+	if r.options.Host != "" {
+		return id == r.options.Host
+	}
+
+	return !r.options.Lobby && len(r.peers) == 0
+}
+
 func (r *Room) RemovePeer(id string) {
 	r.mux.Lock()
 	peer, ok := r.peers[id]
@@ -80,58 +211,342 @@ func (r *Room) RemovePeer(id string) {
 		return
 	}
 	delete(r.peers, id)
+	r.svc.participants.release(r.tenant, 1)
+
+	var owned []string
+	var closing []*TrackForwarder
+	for trackID, forwarder := range r.forwarders {
+		if forwarder.peer == peer {
+			delete(r.forwarders, trackID)
+			owned = append(owned, trackID)
+			closing = append(closing, forwarder)
+			continue
+		}
+
+		forwarder.RemovePeer(id)
+	}
+
+	peers := r.peerList(nil)
 	r.mux.Unlock()
 
 	if err := peer.Close(); err != nil {
 		peer.logger.Error("Failed to close peer", slog.String("error", err.Error()))
 	}
+
+	for _, forwarder := range closing {
+		forwarder.Close()
+	}
+
+	r.announceLeave(id)
+	r.stopMemberRecordings(id)
+	r.stopMemberEgresses(id)
+	r.closeIfIdle()
+
+	if len(owned) == 0 {
+		return
+	}
+
+	for _, p := range peers {
+		if err := p.RemoveTracksAndRenegotiate(owned...); err != nil {
+			p.logger.Error("Failed to renegotiate", slog.String("error", err.Error()))
+		}
+	}
+
+	r.backfill()
 }
 
-func (r *Room) addIncomingTrack(from *Peer, remote *webrtc.TrackRemote) {
+// addIncomingTrack starts forwarding a track published by from to the room.
+// It returns nil when the track was rejected.
+func (r *Room) addIncomingTrack(from *Peer, remote trackReader) *TrackForwarder {
 	r.mux.Lock()
 
 	forwarder := NewTrackForwarder(from, remote)
-	r.forwarders[remote.ID()] = forwarder
+	if d, ok := from.declaration(remote.ID()); ok {
+		forwarder.setSource(d.Source, d.Metadata)
+	}
 
-	peers := make(map[string]*Peer, len(r.peers))
-	for peerID, peer := range r.peers {
-		if peerID != from.ID() {
-			peers[peerID] = peer
-		}
+	if err := r.admitTrack(forwarder); err != nil {
+		r.mux.Unlock()
+		r.rejectTrack(forwarder, err)
+		forwarder.Close()
+		return nil
 	}
+
+	forwarder.SetMuted(from.isMuted(remote.Kind()))
+	r.forwarders[remote.ID()] = forwarder
+
+	peers := r.peerList(from)
+	recs := r.recordingList()
+	egresses := r.egressList()
+	hls := r.hls
 	r.mux.Unlock()
 
 	forwarder.Start()
+	for _, rec := range recs {
+		rec.attach(forwarder)
+	}
+	for _, e := range egresses {
+		e.attach(forwarder)
+	}
+	if hls != nil {
+		hls.attach(forwarder)
+	}
+
+	r.announceUpdate(from)
+	r.publish(forwarder, peers)
+
+	return forwarder
+}
 
-	for peerID, peer := range peers {
-		local, err := forwarder.AddPeer(peerID)
+// subscribe adds senders for forwarders to peer, highest priority first and
+// within the room's last-N limit, and returns how many were added. The caller
+// renegotiates.
+func (r *Room) subscribe(peer *Peer, forwarders []*TrackForwarder) int {
+	byPriority(forwarders)
+
+	added := 0
+	for _, forwarder := range forwarders {
+		if !r.canSubscribe(peer, forwarder) {
+			continue
+		}
+
+		local, err := forwarder.AddPeer(peer.ID())
 		if err != nil {
-			from.logger.Error("Failed to add peer to forwarder",
-				slog.String("peerId", peerID),
+			peer.logger.Error("Failed to add peer to forwarder", slog.String("error", err.Error()))
+			continue
+		}
+
+		peer.addOutboundTrack(local)
+		if err := peer.addSender(local); err != nil {
+			peer.logger.Error("Failed to add track to peer connection", slog.String("error", err.Error()))
+			continue
+		}
+		added++
+	}
+
+	return added
+}
+
+// publish sends forwarder to every peer in peers, renegotiating each.
+func (r *Room) publish(forwarder *TrackForwarder, peers []*Peer) {
+	for _, peer := range peers {
+		if !r.canSubscribe(peer, forwarder) {
+			continue
+		}
+
+		local, err := forwarder.AddPeer(peer.ID())
+		if err != nil {
+			forwarder.peer.logger.Error("Failed to add peer to forwarder",
+				slog.String("peerId", peer.ID()),
 				slog.String("error", err.Error()))
 			continue
 		}
 
 		if err := peer.AddTrackAndRenegotiate(local); err != nil {
-			from.logger.Error("Failed to renegotiate",
-				slog.String("peerId", peerID),
+			forwarder.peer.logger.Error("Failed to renegotiate",
+				slog.String("peerId", peer.ID()),
 				slog.String("error", err.Error()))
 			continue
 		}
 	}
 }
 
+// peerList returns the room's peers except exclude. Callers hold r.mux.
+func (r *Room) peerList(exclude *Peer) []*Peer {
+	peers := make([]*Peer, 0, len(r.peers))
+	for _, peer := range r.peers {
+		if peer != exclude {
+			peers = append(peers, peer)
+		}
+	}
+
+	return peers
+}
+
+// forwarderList returns the room's forwarders except those published by
+// exclude. Callers hold r.mux.
+func (r *Room) forwarderList(exclude *Peer) []*TrackForwarder {
+	forwarders := make([]*TrackForwarder, 0, len(r.forwarders))
+	for _, forwarder := range r.forwarders {
+		if exclude == nil || forwarder.peer != exclude {
+			forwarders = append(forwarders, forwarder)
+		}
+	}
+
+	return forwarders
+}
+
+// broadcast sends a signaling message to every peer in the room except
+// exclude, which may be nil.
+func (r *Room) broadcast(exclude *Peer, msgType string, fields map[string]any) {
+	r.mux.RLock()
+	peers := r.peerList(exclude)
+	r.mux.RUnlock()
+
+	for _, peer := range peers {
+		if err := peer.send(msgType, fields); err != nil {
+			peer.logger.Error("Failed to send "+msgType, slog.String("error", err.Error()))
+		}
+	}
+}
+
+func (r *Room) canJoin(id string) error {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	return r.joinable(id)
+}
+
+// joinable is canJoin for callers holding r.mux. The tenant's participant
+// quota is checked when a slot is acquired.
+func (r *Room) joinable(id string) error {
+	if _, banned := r.banned[id]; banned {
+		return ErrBanned
+	}
+
+	// Moderation targets members by ID, so an ID is only ever in use once,
+	// counting virtual publishers and the breakouts.
+	if _, ok := r.publishers[id]; ok {
+		return ErrMemberExists
+	}
+	if _, ok := r.peers[id]; ok {
+		return ErrMemberExists
+	}
+	for _, breakout := range r.breakouts {
+		if _, ok := breakout.GetPeer(id); ok {
+			return ErrMemberExists
+		}
+	}
+
+	if r.locked {
+		return ErrRoomLocked
+	}
+
+	return nil
+}
+
+// Close disconnects every member, stops every forwarder and breakout, and
+// waits for their goroutines before the room unregisters itself from the
+// SFU. It is safe to call more than once.
 func (r *Room) Close() {
+	r.closeOnce.Do(func() {
+		r.mux.Lock()
+		if r.breakoutTimer != nil {
+			r.breakoutTimer.Stop()
+		}
+		if r.idleTimer != nil {
+			r.idleTimer.Stop()
+		}
+
+		breakouts := r.breakouts
+		peers := r.peerList(nil)
+		forwarders := r.forwarderList(nil)
+		lobby := r.lobby
+		transfers := r.transfers
+		recs := r.recordingList()
+		publishers := r.publishers
+		egresses := r.egressList()
+		hls := r.hls
+
+		r.breakouts = make(map[string]*Room)
+		r.peers = make(map[string]*Peer)
+		r.forwarders = make(map[string]*TrackForwarder)
+		r.lobby = make(map[string]*lobbyEntry)
+		r.transfers = make(map[string]*fileTransfer)
+		r.recordings = make(map[string]*recording)
+		r.publishers = make(map[string]*virtualPublisher)
+		r.egresses = make(map[string]*egress)
+		r.hls = nil
+		r.mux.Unlock()
+
+		r.svc.participants.release(r.tenant, len(peers)+len(publishers))
+
+		for _, t := range transfers {
+			t.cancel()
+		}
+
+		for _, breakout := range breakouts {
+			breakout.Close()
+		}
+
+		for _, entry := range lobby {
+			if err := writeSignal(entry.signal, r.id, entry.req.MemberID, "rejected", map[string]any{"reason": "room closed"}); err != nil {
+				slog.Error("Failed to notify lobby member", slog.String("member", entry.req.MemberID), slog.String("error", err.Error()))
+			}
+		}
+
+		for _, peer := range peers {
+			if err := peer.Close(); err != nil {
+				peer.logger.Error("Failed to close peer", slog.String("error", err.Error()))
+			}
+		}
+
+		for _, forwarder := range forwarders {
+			forwarder.Close()
+		}
+
+		for _, vp := range publishers {
+			vp.close()
+		}
+
+		for _, rec := range recs {
+			rec.stop()
+		}
+
+		for _, e := range egresses {
+			e.stop()
+		}
+
+		if hls != nil {
+			hls.stop()
+			r.svc.hls.retire(hls)
+		}
+
+		if r.onClose != nil {
+			r.onClose()
+		}
+	})
+}
+
+// idle reports whether nobody is in the room, its lobby or its breakouts.
+// Callers hold r.mux.
+func (r *Room) idle() bool {
+	return len(r.peers) == 0 && len(r.lobby) == 0 && len(r.breakouts) == 0
+}
+
+// closeIfIdle arms the idle timer when a main room has nobody left in it.
+func (r *Room) closeIfIdle() {
+	if r.parent != nil {
+		return
+	}
+
 	r.mux.Lock()
 	defer r.mux.Unlock()
 
-	for _, peer := range r.peers {
-		if err := peer.Close(); err != nil {
-			peer.logger.Error("Failed to close peer", slog.String("error", err.Error()))
-		}
+	if !r.idle() {
+		return
 	}
 
-	for _, forwarder := range r.forwarders {
-		forwarder.Close()
+	if r.idleTimer != nil {
+		r.idleTimer.Stop()
 	}
+	r.idleTimer = time.AfterFunc(idleRoomTimeout, func() {
+		r.mux.RLock()
+		idle := r.idle()
+		r.mux.RUnlock()
+
+		if idle {
+			r.Close()
+		}
+	})
+}
+
+// storageKey identifies the room in chat history and recordings; breakouts
+// are kept under their main room.
+func (r *Room) storageKey() string {
+	if r.parent != nil {
+		return roomKey(r.tenant, r.parent.id) + "/" + r.id
+	}
+
+	return roomKey(r.tenant, r.id)
 }
@@ -0,0 +1,121 @@
+package sfu
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+type TrackSource string
+
+const (
+	SourceCamera     TrackSource = "camera"
+	SourceMicrophone TrackSource = "microphone"
+	SourceScreen     TrackSource = "screen"
+)
+
+// Member is a roster entry describing a participant and what they publish.
+type Member struct {
+	ID       string      `json:"id"`
+	Name     string      `json:"name,omitempty"`
+	Role     Role        `json:"role"`
+	JoinedAt time.Time   `json:"joinedAt"`
+	Tracks   []TrackInfo `json:"tracks"`
+	// Virtual is set for virtual publishers, which play files and never
+	// subscribe.
+	Virtual bool `json:"virtual,omitempty"`
+}
+
+// TrackInfo describes a track published by a member.
+type TrackInfo struct {
+	ID       string            `json:"id"`
+	Kind     string            `json:"kind"`
+	Source   TrackSource       `json:"source"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Muted    bool              `json:"muted"`
+}
+
+// Roster lists the members currently in the room.
+func (r *Room) Roster() []Member {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	members := make([]Member, 0, len(r.peers)+len(r.publishers))
+	for _, peer := range r.peers {
+		members = append(members, r.member(peer))
+	}
+	for _, vp := range r.publishers {
+		members = append(members, r.member(vp.peer))
+	}
+
+	return members
+}
+
+// member builds the roster entry for peer. Callers hold r.mux.
+func (r *Room) member(peer *Peer) Member {
+	m := Member{
+		ID:       peer.ID(),
+		Name:     peer.Name(),
+		Role:     peer.Role(),
+		JoinedAt: peer.joinedAt,
+		Tracks:   make([]TrackInfo, 0),
+		Virtual:  peer.isVirtual(),
+	}
+
+	for _, forwarder := range r.forwarders {
+		if forwarder.peer != peer {
+			continue
+		}
+
+		m.Tracks = append(m.Tracks, TrackInfo{
+			ID:       forwarder.ID(),
+			Kind:     forwarder.Kind().String(),
+			Source:   forwarder.Source(),
+			Metadata: forwarder.Metadata(),
+			Muted:    forwarder.muted.Load(),
+		})
+	}
+
+	return m
+}
+
+// announceJoin sends the roster to a member who just entered the room and
+// tells everyone else about them.
+func (r *Room) announceJoin(peer *Peer) {
+	if err := peer.send("roster", map[string]any{"members": r.Roster()}); err != nil {
+		peer.logger.Error("Failed to send roster", slog.String("error", err.Error()))
+	}
+
+	r.mux.RLock()
+	member := r.member(peer)
+	r.mux.RUnlock()
+
+	r.broadcast(peer, "member-joined", map[string]any{"member": member})
+
+	r.sendRoomState(peer)
+	r.replayChat(peer)
+}
+
+func (r *Room) announceLeave(id string) {
+	r.dropHand(id)
+	r.dropTransfers(id)
+	r.broadcast(nil, "member-left", map[string]any{"member": Member{ID: id}})
+}
+
+// announceUpdate tells everyone that peer's roster entry changed.
+func (r *Room) announceUpdate(peer *Peer) {
+	r.mux.RLock()
+	member := r.member(peer)
+	r.mux.RUnlock()
+
+	r.broadcast(nil, "member-updated", map[string]any{"member": member})
+}
+
+func defaultSource(kind webrtc.RTPCodecType) TrackSource {
+	if kind == webrtc.RTPCodecTypeAudio {
+		return SourceMicrophone
+	}
+
+	return SourceCamera
+}
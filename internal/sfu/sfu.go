@@ -1,21 +1,107 @@
 package sfu
 
 import (
+	"context"
+	"errors"
+	"log/slog"
 	"sync"
+	"time"
+
+	"gonference/internal/chat"
+	"gonference/internal/config"
+	"gonference/internal/storage"
 
 	"github.com/pion/interceptor"
 	"github.com/pion/webrtc/v3"
 )
 
+var (
+	ErrRoomQuotaExceeded = errors.New("tenant room quota exceeded")
+	ErrParticipantQuota  = errors.New("tenant participant quota exceeded")
+	ErrRoomLocked        = errors.New("room is locked")
+	ErrBanned            = errors.New("member is banned from the room")
+	ErrPeerNotFound      = errors.New("member not found")
+	ErrMemberExists      = errors.New("member is already in the room")
+	ErrNotInLobby        = errors.New("member is not waiting in the lobby")
+)
+
+const shutdownTimeout = 5 * time.Second
+
+// Quota limits what a single tenant may use. Zero values mean unlimited.
+type Quota struct {
+	MaxRooms        int
+	MaxParticipants int
+}
+
+// services are shared by every room of an SFU.
+type services struct {
+	mediaEngine  *webrtc.MediaEngine
+	interceptors *interceptor.Registry
+
+	chat       chat.Store
+	chatReplay int
+
+	fileMaxSize int64
+	fileDir     string
+
+	recordingStore  storage.Store
+	recordingFormat RecordingFormat
+	recordings      *recordingRegistry
+
+	captures *captureRegistry
+
+	// mediaDir holds the files virtual publishers may play.
+	mediaDir string
+
+	// rtpAddress is the local IP plain RTP ingest receives on, and
+	// egressHosts the hosts plain RTP egress may send to.
+	rtpAddress  string
+	egressHosts []string
+
+	snapshots *rateLimiter
+
+	hls *hlsRegistry
+
+	participants *participantQuota
+}
+
+// peerAPI returns the API a peer's connection is created with. Every peer
+// gets its own interceptor chain so that its packets can be captured.
+func (svc *services) peerAPI(tap *captureTap) *webrtc.API {
+	interceptors := &interceptor.Registry{}
+	interceptors.Add(captureFactory{tap: tap})
+	interceptors.Add(sharedInterceptors{svc.interceptors})
+
+	return webrtc.NewAPI(
+		webrtc.WithMediaEngine(svc.mediaEngine),
+		webrtc.WithInterceptorRegistry(interceptors),
+	)
+}
+
+// sharedInterceptors builds the interceptors every peer connection uses.
+type sharedInterceptors struct {
+	registry *interceptor.Registry
+}
+
+func (f sharedInterceptors) NewInterceptor(id string) (interceptor.Interceptor, error) {
+	return f.registry.Build(id)
+}
+
 type SFU struct {
-	api *webrtc.API
+	svc *services
 
-	mux   sync.RWMutex
-	rooms map[string]*Room
+	mux    sync.RWMutex
+	rooms  map[string]*Room
+	quotas map[string]Quota
 }
 
-func New() (*SFU, error) {
+func New(cfg config.SFU) (*SFU, error) {
 	mediaEngine := &webrtc.MediaEngine{}
+	for _, codec := range audioCodecs {
+		if err := mediaEngine.RegisterCodec(codec, webrtc.RTPCodecTypeAudio); err != nil {
+			return nil, err
+		}
+	}
 	for _, codec := range videoCodecs {
 		if err := mediaEngine.RegisterCodec(codec, webrtc.RTPCodecTypeVideo); err != nil {
 			return nil, err
@@ -27,42 +113,218 @@ func New() (*SFU, error) {
 		return nil, err
 	}
 
-	api := webrtc.NewAPI(
-		webrtc.WithMediaEngine(mediaEngine),
-		webrtc.WithInterceptorRegistry(interceptorRegistry),
-	)
+	chatStore, err := newChatStore(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	recordingStore, err := storage.New(cfg.Recordings)
+	if err != nil {
+		return nil, err
+	}
 
 	return &SFU{
-		api:   api,
-		rooms: make(map[string]*Room),
+		svc: &services{
+			mediaEngine:  mediaEngine,
+			interceptors: interceptorRegistry,
+
+			chat:       chatStore,
+			chatReplay: cfg.ChatReplay,
+
+			fileMaxSize: int64(cfg.FileMaxSize),
+			fileDir:     cfg.FileDir,
+
+			recordingStore:  recordingStore,
+			recordingFormat: RecordingFormat(cfg.RecordingFormat),
+			recordings:      newRecordingRegistry(),
+
+			captures: newCaptureRegistry(),
+
+			mediaDir: cfg.MediaDir,
+
+			rtpAddress:  cfg.RTPAddress,
+			egressHosts: cfg.RTPEgressHosts,
+
+			snapshots: newRateLimiter(snapshotRate, snapshotBurst),
+
+			hls: newHLSRegistry(),
+
+			participants: newParticipantQuota(),
+		},
+		rooms:  make(map[string]*Room),
+		quotas: make(map[string]Quota),
 	}, nil
 }
 
-func (s *SFU) GetOrCreateRoom(id string) *Room {
+// SetQuota configures the limits applied to rooms created for tenant.
+func (s *SFU) SetQuota(tenant string, quota Quota) {
 	s.mux.Lock()
 	defer s.mux.Unlock()
 
-	room, ok := s.rooms[id]
-	if !ok {
-		room = NewRoom(s.api, id)
-		s.rooms[id] = room
-	}
+	s.quotas[tenant] = quota
+	s.svc.participants.setLimit(tenant, quota.MaxParticipants)
+}
+
+func (s *SFU) GetRoom(tenant, id string) (*Room, bool) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
 
-	return room
+	room, ok := s.rooms[roomKey(tenant, id)]
+	return room, ok
 }
 
-func (s *SFU) RemoveRoom(id string) {
+// GetOrCreateRoom returns the room, creating it with default options when it
+// does not exist yet.
+func (s *SFU) GetOrCreateRoom(tenant, id string) (*Room, error) {
+	return s.CreateRoom(tenant, id, RoomOptions{})
+}
+
+// CreateRoom creates a room with opts. An existing room is returned as is.
+func (s *SFU) CreateRoom(tenant, id string, opts RoomOptions) (*Room, error) {
 	s.mux.Lock()
 	defer s.mux.Unlock()
 
-	delete(s.rooms, id)
+	key := roomKey(tenant, id)
+
+	room, ok := s.rooms[key]
+	if ok {
+		return room, nil
+	}
+
+	quota := s.quotas[tenant]
+	if quota.MaxRooms > 0 && s.countRooms(tenant) >= quota.MaxRooms {
+		return nil, ErrRoomQuotaExceeded
+	}
+
+	room = NewRoom(s.svc, tenant, id, opts)
+	room.onClose = func() {
+		s.mux.Lock()
+		defer s.mux.Unlock()
+
+		if s.rooms[key] == room {
+			delete(s.rooms, key)
+		}
+	}
+	s.rooms[key] = room
+
+	// A room nobody joins is closed like one everybody left.
+	room.closeIfIdle()
+
+	if opts.Record {
+		if _, err := room.StartRecording(systemActor, ""); err != nil {
+			slog.Error("Failed to start recording", slog.String("room", id), slog.String("error", err.Error()))
+		}
+	}
+
+	return room, nil
 }
 
-func (s *SFU) Close() {
-	s.mux.Lock()
-	defer s.mux.Unlock()
+// Rooms returns the rooms owned by tenant.
+func (s *SFU) Rooms(tenant string) []*Room {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
 
+	rooms := make([]*Room, 0)
 	for _, room := range s.rooms {
+		if room.tenant == tenant {
+			rooms = append(rooms, room)
+		}
+	}
+
+	return rooms
+}
+
+// RemoveRoom closes the room, disconnecting its members.
+func (s *SFU) RemoveRoom(tenant, id string) {
+	if room, ok := s.GetRoom(tenant, id); ok {
 		room.Close()
 	}
 }
+
+// Close closes every room and waits up to shutdownTimeout for their
+// goroutines, logging any that are still running afterwards.
+func (s *SFU) Close() {
+	s.mux.RLock()
+	rooms := make([]*Room, 0, len(s.rooms))
+	for _, room := range s.rooms {
+		rooms = append(rooms, room)
+	}
+	s.mux.RUnlock()
+
+	for _, room := range rooms {
+		room.Close()
+	}
+	s.svc.captures.closeAll()
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := goroutines.Wait(ctx); err != nil {
+		for name, n := range goroutines.Live() {
+			slog.Warn("Goroutines still running after shutdown", slog.String("name", name), slog.Int("count", n))
+		}
+	}
+}
+
+func (s *SFU) countRooms(tenant string) int {
+	n := 0
+	for _, room := range s.rooms {
+		if room.tenant == tenant {
+			n++
+		}
+	}
+
+	return n
+}
+
+// roomKey is unambiguous as tenant IDs cannot contain a slash.
+func roomKey(tenant, id string) string {
+	return tenant + "/" + id
+}
+
+// participantQuota counts the members of every tenant across all of its
+// rooms and breakouts, so that Quota.MaxParticipants holds however they
+// are spread. A member holds a slot from AddPeer until they are removed or
+// their room closes; moving between breakouts keeps it.
+type participantQuota struct {
+	mux    sync.Mutex
+	limits map[string]int
+	counts map[string]int
+}
+
+func newParticipantQuota() *participantQuota {
+	return &participantQuota{
+		limits: make(map[string]int),
+		counts: make(map[string]int),
+	}
+}
+
+func (q *participantQuota) setLimit(tenant string, limit int) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	q.limits[tenant] = limit
+}
+
+// acquire takes a slot for a new member of tenant.
+func (q *participantQuota) acquire(tenant string) error {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	if limit := q.limits[tenant]; limit > 0 && q.counts[tenant] >= limit {
+		return ErrParticipantQuota
+	}
+	q.counts[tenant]++
+
+	return nil
+}
+
+func (q *participantQuota) release(tenant string, n int) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	q.counts[tenant] -= n
+	if q.counts[tenant] <= 0 {
+		delete(q.counts, tenant)
+	}
+}
@@ -0,0 +1,380 @@
+package sfu
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"gonference/internal/config"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+// testSignaling records the types of the messages the SFU sends a member.
+type testSignaling struct {
+	mux   sync.Mutex
+	types []string
+}
+
+func (s *testSignaling) WriteMessage(_ int, payload []byte) error {
+	var m struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(payload, &m); err != nil {
+		return err
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.types = append(s.types, m.Type)
+	return nil
+}
+
+func (s *testSignaling) received(msgType string) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	for _, t := range s.types {
+		if t == msgType {
+			return true
+		}
+	}
+	return false
+}
+
+func newTestSFU(t *testing.T) *SFU {
+	t.Helper()
+
+	s, err := New(config.SFU{Recordings: config.Storage{Dir: t.TempDir()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+// testOffer returns an offer from a client that only receives audio.
+func testOffer(t *testing.T) webrtc.SessionDescription {
+	t.Helper()
+
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = pc.Close() })
+
+	_, err = pc.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio, webrtc.RTPTransceiverInit{
+		Direction: webrtc.RTPTransceiverDirectionRecvonly,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return offer
+}
+
+func joinRequest(t *testing.T, id string) JoinRequest {
+	return JoinRequest{MemberID: id, Offer: testOffer(t)}
+}
+
+func TestParticipantQuotaSpansRooms(t *testing.T) {
+	s := newTestSFU(t)
+	s.SetQuota("acme", Quota{MaxParticipants: 2})
+
+	a, err := s.CreateRoom("acme", "a", RoomOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := s.CreateRoom("acme", "b", RoomOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := a.AddPeer(&testSignaling{}, joinRequest(t, "m1")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.AddPeer(&testSignaling{}, joinRequest(t, "m2")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.AddPeer(&testSignaling{}, joinRequest(t, "m3")); !errors.Is(err, ErrParticipantQuota) {
+		t.Fatalf("third member across rooms: got %v, want %v", err, ErrParticipantQuota)
+	}
+
+	a.RemovePeer("m1")
+	if _, err := b.AddPeer(&testSignaling{}, joinRequest(t, "m3")); err != nil {
+		t.Fatalf("after a member left: %v", err)
+	}
+
+	// Another tenant has its own count.
+	other, err := s.CreateRoom("other", "a", RoomOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.AddPeer(&testSignaling{}, joinRequest(t, "m1")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParticipantQuotaConcurrentJoins(t *testing.T) {
+	s := newTestSFU(t)
+	s.SetQuota("acme", Quota{MaxParticipants: 3})
+
+	room, err := s.CreateRoom("acme", "a", RoomOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reqs := make([]JoinRequest, 10)
+	for i := range reqs {
+		reqs[i] = joinRequest(t, string(rune('a'+i)))
+	}
+
+	var wg sync.WaitGroup
+	for _, req := range reqs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = room.AddPeer(&testSignaling{}, req)
+		}()
+	}
+	wg.Wait()
+
+	if n := room.PeerCount(); n != 3 {
+		t.Fatalf("got %d members, want 3", n)
+	}
+}
+
+func TestDuplicateMemberRejected(t *testing.T) {
+	s := newTestSFU(t)
+
+	room, err := s.CreateRoom("", "a", RoomOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := room.AddPeer(&testSignaling{}, joinRequest(t, "m1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := room.AddPeer(&testSignaling{}, joinRequest(t, "m1")); !errors.Is(err, ErrMemberExists) {
+		t.Fatalf("got %v, want %v", err, ErrMemberExists)
+	}
+	if peer, _ := room.GetPeer("m1"); peer != first {
+		t.Fatal("the first connection was replaced")
+	}
+
+	// Members in a breakout hold their ID too.
+	if err := room.CreateBreakouts(systemActor, []string{"b"}, map[string]string{"m1": "b"}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := room.AddPeer(&testSignaling{}, joinRequest(t, "m1")); !errors.Is(err, ErrMemberExists) {
+		t.Fatalf("member in a breakout: got %v, want %v", err, ErrMemberExists)
+	}
+}
+
+// offerFailingSignaling cannot deliver offers, so renegotiation fails.
+type offerFailingSignaling struct {
+	testSignaling
+}
+
+func (s *offerFailingSignaling) WriteMessage(msgType int, payload []byte) error {
+	if err := s.testSignaling.WriteMessage(msgType, payload); err != nil {
+		return err
+	}
+	if s.received("offer") {
+		return errors.New("connection lost")
+	}
+	return nil
+}
+
+func TestFailedJoinReleasesMember(t *testing.T) {
+	s := newTestSFU(t)
+	s.SetQuota("acme", Quota{MaxParticipants: 1})
+
+	room, err := s.CreateRoom("acme", "a", RoomOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := room.AddPeer(&offerFailingSignaling{}, joinRequest(t, "m1")); err == nil {
+		t.Fatal("join succeeded without delivering the offer")
+	}
+	if n := room.PeerCount(); n != 0 {
+		t.Fatalf("%d members after a failed join, want 0", n)
+	}
+
+	// Neither the ID nor the quota slot is held.
+	if _, err := room.AddPeer(&testSignaling{}, joinRequest(t, "m1")); err != nil {
+		t.Fatalf("rejoin after a failed join: %v", err)
+	}
+}
+
+// testClient is a member's browser: it answers the SFU's offers and, when
+// publishing, sends an Opus track.
+type testClient struct {
+	t    *testing.T
+	room *Room
+	id   string
+	pc   *webrtc.PeerConnection
+
+	messages chan []byte
+	done     chan struct{}
+}
+
+func newTestClient(t *testing.T, room *Room, id string, publish bool) *testClient {
+	t.Helper()
+
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &testClient{
+		t:        t,
+		room:     room,
+		id:       id,
+		pc:       pc,
+		messages: make(chan []byte, 64),
+		done:     make(chan struct{}),
+	}
+	t.Cleanup(c.close)
+
+	if publish {
+		track, err := webrtc.NewTrackLocalStaticSample(
+			webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2},
+			id+"-audio", id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := pc.AddTrack(track); err != nil {
+			t.Fatal(err)
+		}
+		go c.sendAudio(track)
+	} else {
+		_, err = pc.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio, webrtc.RTPTransceiverInit{
+			Direction: webrtc.RTPTransceiverDirectionRecvonly,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pc.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-webrtc.GatheringCompletePromise(pc)
+
+	go c.run()
+
+	req := JoinRequest{MemberID: id, Offer: *pc.LocalDescription()}
+	if _, err := room.Join(c, req); err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+// WriteMessage is called with the room's locks held, so messages are
+// handled on their own goroutine, in order.
+func (c *testClient) WriteMessage(_ int, payload []byte) error {
+	select {
+	case c.messages <- payload:
+	case <-c.done:
+	}
+	return nil
+}
+
+func (c *testClient) run() {
+	for {
+		select {
+		case payload := <-c.messages:
+			c.handle(payload)
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *testClient) handle(payload []byte) {
+	var m struct {
+		Type string `json:"type"`
+		SDP  string `json:"sdp"`
+	}
+	if err := json.Unmarshal(payload, &m); err != nil {
+		c.t.Error(err)
+		return
+	}
+
+	switch m.Type {
+	case "answer":
+		_ = c.pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: m.SDP})
+	case "offer":
+		if err := c.pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: m.SDP}); err != nil {
+			return
+		}
+		answer, err := c.pc.CreateAnswer(nil)
+		if err != nil {
+			return
+		}
+		if err := c.pc.SetLocalDescription(answer); err != nil {
+			return
+		}
+		<-webrtc.GatheringCompletePromise(c.pc)
+
+		if peer, ok := c.room.FindPeer(c.id); ok {
+			_ = peer.ValidateAnswer(*c.pc.LocalDescription())
+		}
+	}
+}
+
+func (c *testClient) sendAudio(track *webrtc.TrackLocalStaticSample) {
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+
+	// An Opus frame of silence.
+	frame := []byte{0xf8, 0xff, 0xfe}
+	for {
+		select {
+		case <-ticker.C:
+			_ = track.WriteSample(media.Sample{Data: frame, Duration: 20 * time.Millisecond})
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *testClient) close() {
+	select {
+	case <-c.done:
+	default:
+		close(c.done)
+		_ = c.pc.Close()
+	}
+}
+
+// waitFor polls cond until it holds or the test times out.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
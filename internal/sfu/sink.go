@@ -0,0 +1,70 @@
+package sfu
+
+import (
+	"github.com/pion/webrtc/v3"
+)
+
+// MediaTrack describes a track forwarded in a room. Codec is the one the SFU
+// registered for it: packets handed to a TrackSink keep the payload type the
+// publisher negotiated, which may differ.
+type MediaTrack struct {
+	TrackID  string
+	MemberID string
+	Kind     webrtc.RTPCodecType
+	Source   TrackSource
+	Codec    webrtc.RTPCodecParameters
+}
+
+// Tracks lists the tracks forwarded in the room, or only memberID's when it
+// is set, highest priority first. Tracks whose codec the SFU does not
+// register are left out.
+func (r *Room) Tracks(memberID string) []MediaTrack {
+	r.mux.RLock()
+	forwarders := r.forwarderList(nil)
+	r.mux.RUnlock()
+
+	byPriority(forwarders)
+
+	tracks := make([]MediaTrack, 0, len(forwarders))
+	for _, forwarder := range forwarders {
+		if memberID != "" && forwarder.peer.ID() != memberID {
+			continue
+		}
+
+		codec, ok := registeredCodec(forwarder.remote.Codec().MimeType)
+		if !ok {
+			continue
+		}
+
+		tracks = append(tracks, MediaTrack{
+			TrackID:  forwarder.ID(),
+			MemberID: forwarder.peer.ID(),
+			Kind:     forwarder.Kind(),
+			Source:   forwarder.Source(),
+			Codec:    codec,
+		})
+	}
+
+	return tracks
+}
+
+// AddTrackSink feeds one of the room's tracks to sink, under an id unique
+// among the track's sinks. The sink follows the track into breakout rooms
+// and is closed when the track ends or the returned function removes it.
+func (r *Room) AddTrackSink(trackID, id string, sink TrackSink) (func(), error) {
+	r.mux.RLock()
+	forwarder, ok := r.forwarders[trackID]
+	r.mux.RUnlock()
+
+	if !ok {
+		return nil, ErrTrackNotFound
+	}
+
+	if err := forwarder.AddSink(id, sink); err != nil {
+		return nil, err
+	}
+
+	return func() {
+		forwarder.RemoveSink(id)
+	}, nil
+}
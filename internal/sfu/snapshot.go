@@ -0,0 +1,252 @@
+package sfu
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+	"golang.org/x/image/draw"
+	"golang.org/x/image/vp8"
+)
+
+// SnapshotFormat is the image format of a video snapshot.
+type SnapshotFormat string
+
+const (
+	SnapshotJPEG SnapshotFormat = "jpeg"
+	SnapshotPNG  SnapshotFormat = "png"
+)
+
+const (
+	// snapshotRate and snapshotBurst limit how many keyframes the SFU
+	// decodes per second across all rooms; cached snapshots are free.
+	snapshotRate  = 10
+	snapshotBurst = 20
+
+	// staleKeyframe is the age after which asking for a snapshot also asks
+	// the publisher for a fresh keyframe, so thumbnails stay live.
+	staleKeyframe = 5 * time.Second
+
+	maxSnapshotWidth = 1920
+	maxKeyframeSize  = 4 << 20
+	snapshotQuality  = 75
+)
+
+var (
+	ErrNoSnapshot        = errors.New("no video keyframe available")
+	ErrInvalidSnapshot   = errors.New("invalid snapshot request")
+	ErrSnapshotRateLimit = errors.New("snapshot rate limit exceeded")
+	// ErrSnapshotCodec is returned for video other than VP8, such as the
+	// H.264 of rooms packaged as HLS, which cannot be decoded in pure Go.
+	ErrSnapshotCodec = errors.New("snapshots need VP8 video")
+)
+
+// Snapshot is an encoded still of a member's video, taken from the latest
+// keyframe of the track. ETag changes with the keyframe, format and size.
+type Snapshot struct {
+	TrackID     string
+	ContentType string
+	Data        []byte
+	CapturedAt  time.Time
+	ETag        string
+}
+
+// Snapshot encodes the latest keyframe of a member's video, preferring the
+// camera over a screen share. A width of zero keeps the original size, and
+// any other width scales the image down to it, keeping the aspect ratio.
+func (r *Room) Snapshot(memberID string, format SnapshotFormat, width int) (Snapshot, error) {
+	if format == "" {
+		format = SnapshotJPEG
+	}
+	if (format != SnapshotJPEG && format != SnapshotPNG) || width < 0 || width > maxSnapshotWidth {
+		return Snapshot{}, ErrInvalidSnapshot
+	}
+
+	r.mux.RLock()
+	_, isPeer := r.peers[memberID]
+	_, isPublisher := r.publishers[memberID]
+
+	var video *TrackForwarder
+	for _, forwarder := range r.forwarders {
+		if forwarder.peer.ID() != memberID || forwarder.Kind() != webrtc.RTPCodecTypeVideo {
+			continue
+		}
+		if video == nil || (video.Source() != SourceCamera && forwarder.Source() == SourceCamera) {
+			video = forwarder
+		}
+	}
+	r.mux.RUnlock()
+
+	if !isPeer && !isPublisher {
+		return Snapshot{}, ErrPeerNotFound
+	}
+	if video == nil {
+		return Snapshot{}, ErrNoSnapshot
+	}
+	if mimeType := video.remote.Codec().MimeType; !strings.EqualFold(mimeType, webrtc.MimeTypeVP8) {
+		return Snapshot{}, fmt.Errorf("%w: the track is %s", ErrSnapshotCodec, mimeType)
+	}
+
+	return video.takeSnapshot(r.svc.snapshots, format, width)
+}
+
+// keyframe is a complete VP8 keyframe reassembled from its RTP packets.
+type keyframe struct {
+	id   uint64
+	data []byte
+	at   time.Time
+}
+
+// keyframeBuffer keeps the latest VP8 keyframe of a forwarder. The read loop
+// feeds it the packets marked as keyframe; the frame is published once its
+// marker packet arrives with no packet missing in between.
+type keyframeBuffer struct {
+	// Touched only by the read loop.
+	ts      uint32
+	nextSeq uint16
+	frame   []byte
+	active  bool
+	count   uint64
+
+	latest atomic.Pointer[keyframe]
+
+	// mux guards cache, the encoded snapshots of the latest keyframe.
+	mux     sync.Mutex
+	cacheID uint64
+	cache   map[string]Snapshot
+}
+
+func (k *keyframeBuffer) push(p *packet) {
+	var header rtp.Header
+	n, err := header.Unmarshal(p.payload())
+	if err != nil || n >= p.n {
+		return
+	}
+
+	var vp8Packet codecs.VP8Packet
+	payload, err := vp8Packet.Unmarshal(p.buf[n:p.n])
+	if err != nil {
+		k.active = false
+		return
+	}
+
+	switch {
+	case vp8Packet.S == 1 && vp8Packet.PID == 0:
+		k.ts, k.active = header.Timestamp, true
+		k.frame = k.frame[:0]
+	case !k.active || header.Timestamp != k.ts || header.SequenceNumber != k.nextSeq:
+		k.active = false
+		return
+	}
+
+	k.frame = append(k.frame, payload...)
+	k.nextSeq = header.SequenceNumber + 1
+	if len(k.frame) > maxKeyframeSize {
+		k.active = false
+		return
+	}
+
+	if header.Marker {
+		k.count++
+		k.latest.Store(&keyframe{
+			id:   k.count,
+			data: append([]byte(nil), k.frame...),
+			at:   time.Now(),
+		})
+		k.active = false
+	}
+}
+
+// bufferKeyframe keeps p when it belongs to a VP8 keyframe. Called from the
+// read loop after markKeyframe.
+func (tf *TrackForwarder) bufferKeyframe(p *packet, mimeType string) {
+	if p.keyframe && strings.EqualFold(mimeType, webrtc.MimeTypeVP8) {
+		tf.keyframes.push(p)
+	}
+}
+
+func (tf *TrackForwarder) takeSnapshot(limiter *rateLimiter, format SnapshotFormat, width int) (Snapshot, error) {
+	frame := tf.keyframes.latest.Load()
+	if frame == nil || time.Since(frame.at) > staleKeyframe {
+		tf.RequestKeyframe()
+	}
+	if frame == nil {
+		return Snapshot{}, ErrNoSnapshot
+	}
+
+	key := fmt.Sprintf("%s-%d", format, width)
+
+	k := &tf.keyframes
+	k.mux.Lock()
+	defer k.mux.Unlock()
+
+	if k.cacheID != frame.id {
+		k.cacheID = frame.id
+		k.cache = make(map[string]Snapshot)
+	}
+	if snap, ok := k.cache[key]; ok {
+		return snap, nil
+	}
+
+	if !limiter.Allow() {
+		return Snapshot{}, ErrSnapshotRateLimit
+	}
+
+	data, contentType, err := encodeKeyframe(frame.data, format, width)
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	snap := Snapshot{
+		TrackID:     tf.ID(),
+		ContentType: contentType,
+		Data:        data,
+		CapturedAt:  frame.at,
+		ETag:        fmt.Sprintf(`"%s-%d-%s"`, tf.ID(), frame.id, key),
+	}
+	k.cache[key] = snap
+
+	return snap, nil
+}
+
+// encodeKeyframe decodes a VP8 keyframe and encodes it as format, scaled
+// down to width when it is set.
+func encodeKeyframe(frame []byte, format SnapshotFormat, width int) ([]byte, string, error) {
+	decoder := vp8.NewDecoder()
+	decoder.Init(bytes.NewReader(frame), len(frame))
+	if _, err := decoder.DecodeFrameHeader(); err != nil {
+		return nil, "", err
+	}
+
+	var img image.Image
+	img, err := decoder.DecodeFrame()
+	if err != nil {
+		return nil, "", err
+	}
+
+	if bounds := img.Bounds(); width > 0 && width < bounds.Dx() {
+		height := max(1, bounds.Dy()*width/bounds.Dx())
+		scaled := image.NewRGBA(image.Rect(0, 0, width, height))
+		draw.ApproxBiLinear.Scale(scaled, scaled.Bounds(), img, bounds, draw.Src, nil)
+		img = scaled
+	}
+
+	var buf bytes.Buffer
+	if format == SnapshotPNG {
+		err = png.Encode(&buf, img)
+		return buf.Bytes(), "image/png", err
+	}
+
+	err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: snapshotQuality})
+	return buf.Bytes(), "image/jpeg", err
+}
@@ -0,0 +1,222 @@
+package sfu
+
+import (
+	"errors"
+	"log/slog"
+	"sort"
+
+	"github.com/pion/webrtc/v3"
+)
+
+var (
+	ErrScreenShareDenied = errors.New("screen sharing is not permitted")
+	ErrPresenterBusy     = errors.New("another member is already presenting")
+)
+
+// TrackDeclaration is sent by a publisher to describe a track it publishes,
+// keyed by the MediaStreamTrack ID carried in the SDP msid.
+type TrackDeclaration struct {
+	TrackID  string            `json:"trackId"`
+	Source   TrackSource       `json:"source"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// ScreenSharePolicy controls who may publish screen share tracks.
+type ScreenSharePolicy string
+
+const (
+	ScreenShareAll        ScreenSharePolicy = ""
+	ScreenShareModerators ScreenSharePolicy = "moderators"
+	ScreenShareNone       ScreenSharePolicy = "none"
+)
+
+// DeclareTracks records track sources sent after joining, typically ahead of
+// a renegotiation. Already published tracks are retyped, and a track that
+// turns into a screen share it may not be is withdrawn.
+func (r *Room) DeclareTracks(peer *Peer, decls []TrackDeclaration) {
+	peer.declareTracks(decls)
+
+	r.mux.Lock()
+	rejected := make(map[*TrackForwarder]error)
+	for _, d := range decls {
+		forwarder, ok := r.forwarders[d.TrackID]
+		if !ok || forwarder.peer != peer {
+			continue
+		}
+
+		forwarder.setSource(d.Source, d.Metadata)
+		if err := r.admitTrack(forwarder); err != nil {
+			rejected[forwarder] = err
+		}
+	}
+	r.mux.Unlock()
+
+	for forwarder, err := range rejected {
+		r.rejectTrack(forwarder, err)
+		r.removeForwarder(forwarder)
+	}
+
+	r.announceUpdate(peer)
+}
+
+// admitTrack applies the room's screen share policy to a new or retyped
+// forwarder. Callers hold r.mux.
+func (r *Room) admitTrack(forwarder *TrackForwarder) error {
+	if forwarder.Source() != SourceScreen {
+		return nil
+	}
+
+	switch r.options.ScreenShare {
+	case ScreenShareNone:
+		return ErrScreenShareDenied
+	case ScreenShareModerators:
+		if !forwarder.peer.IsModerator() {
+			return ErrScreenShareDenied
+		}
+	}
+
+	if r.options.SinglePresenter {
+		for _, other := range r.forwarders {
+			if other != forwarder && other.peer != forwarder.peer && other.Source() == SourceScreen {
+				return ErrPresenterBusy
+			}
+		}
+	}
+
+	return nil
+}
+
+// rejectTrack tells the publisher why a track is not forwarded. Callers do
+// not hold r.mux.
+func (r *Room) rejectTrack(forwarder *TrackForwarder, reason error) {
+	forwarder.peer.logger.Warn("Track rejected",
+		slog.String("track", forwarder.ID()),
+		slog.String("reason", reason.Error()))
+
+	err := forwarder.peer.send("track-rejected", map[string]any{
+		"trackId": forwarder.ID(),
+		"reason":  reason.Error(),
+	})
+	if err != nil {
+		forwarder.peer.logger.Error("Failed to notify track rejection", slog.String("error", err.Error()))
+	}
+}
+
+// removeForwarder withdraws a single published track from the room.
+func (r *Room) removeForwarder(forwarder *TrackForwarder) {
+	r.mux.Lock()
+	if r.forwarders[forwarder.ID()] == forwarder {
+		delete(r.forwarders, forwarder.ID())
+	}
+	peers := r.peerList(forwarder.peer)
+	r.mux.Unlock()
+
+	for _, peer := range peers {
+		forwarder.RemovePeer(peer.ID())
+		if err := peer.RemoveTracksAndRenegotiate(forwarder.ID()); err != nil {
+			peer.logger.Error("Failed to renegotiate", slog.String("error", err.Error()))
+		}
+	}
+
+	forwarder.Close()
+
+	r.backfill()
+}
+
+// canSubscribe reports whether peer should be subscribed to forwarder
+// automatically: members in manual subscription mode never are, and everyone
+// else is held to the room's last-N limit. Screen share and audio never count
+// against it.
+func (r *Room) canSubscribe(peer *Peer, forwarder *TrackForwarder) bool {
+	if peer.ManualSubscription() {
+		return false
+	}
+
+	if r.options.LastN <= 0 || !forwarder.countsTowardsLastN() {
+		return true
+	}
+
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	n := 0
+	for _, f := range r.forwarders {
+		if f.countsTowardsLastN() && f.hasPeer(peer.ID()) {
+			n++
+		}
+	}
+
+	return n < r.options.LastN
+}
+
+// backfill subscribes peers to camera tracks they were held back from by
+// last-N once a slot frees up.
+func (r *Room) backfill() {
+	if r.options.LastN <= 0 {
+		return
+	}
+
+	r.mux.RLock()
+	peers := r.peerList(nil)
+	r.mux.RUnlock()
+
+	for _, peer := range peers {
+		r.mux.RLock()
+		var missing []*TrackForwarder
+		for _, f := range r.forwarders {
+			if f.peer != peer && f.countsTowardsLastN() && !f.hasPeer(peer.ID()) {
+				missing = append(missing, f)
+			}
+		}
+		r.mux.RUnlock()
+
+		if len(missing) == 0 || r.subscribe(peer, missing) == 0 {
+			continue
+		}
+
+		if err := peer.Renegotiate(); err != nil {
+			peer.logger.Error("Failed to renegotiate", slog.String("error", err.Error()))
+		}
+	}
+}
+
+// byPriority sorts forwarders so higher priority tracks are handed out first,
+// oldest first within the same priority.
+func byPriority(forwarders []*TrackForwarder) {
+	sort.SliceStable(forwarders, func(i, j int) bool {
+		pi, pj := forwarders[i].Priority(), forwarders[j].Priority()
+		if pi != pj {
+			return pi > pj
+		}
+
+		return forwarders[i].createdAt.Before(forwarders[j].createdAt)
+	})
+}
+
+func (p *Peer) declareTracks(decls []TrackDeclaration) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	for _, d := range decls {
+		p.declared[d.TrackID] = d
+	}
+}
+
+func (p *Peer) declaration(trackID string) (TrackDeclaration, bool) {
+	p.mux.RLock()
+	defer p.mux.RUnlock()
+
+	d, ok := p.declared[trackID]
+	return d, ok
+}
+
+func sourcePriority(source TrackSource, kind webrtc.RTPCodecType) int {
+	switch {
+	case source == SourceScreen:
+		return 3
+	case kind == webrtc.RTPCodecTypeAudio:
+		return 2
+	default:
+		return 1
+	}
+}
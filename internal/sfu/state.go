@@ -0,0 +1,211 @@
+package sfu
+
+import (
+	"encoding/json"
+	"errors"
+	"maps"
+	"sync"
+)
+
+// stateMsgType is the message that carries shared state operations, both
+// over signaling and on the reliable data channel.
+const stateMsgType = "state-update"
+
+const (
+	maxStateDocs      = 32
+	maxStateKeys      = 1024
+	maxStateNameBytes = 128
+	maxStateValue     = 8 * 1024
+)
+
+var (
+	ErrInvalidStateOp = errors.New("invalid shared state operation")
+	ErrStateFull      = errors.New("shared state limit reached")
+)
+
+// StateEntry is one key of a shared document. Entries form a last-writer-wins
+// map: the entry with the higher Clock wins and ties go to the higher Author,
+// so every member converges on the same value whatever order updates arrive
+// in. Deleted entries are kept as tombstones so a stale write cannot revive
+// them.
+type StateEntry struct {
+	Value   json.RawMessage `json:"value,omitempty"`
+	Clock   uint64          `json:"clock"`
+	Author  string          `json:"author"`
+	Deleted bool            `json:"deleted,omitempty"`
+}
+
+// StateOp sets or deletes a key in a shared document. Clock is the writer's
+// Lamport clock: one more than the highest clock it has seen. As every clock
+// comes through the SFU, one above the room's clock is rejected; otherwise a
+// writer could win a key for good. Zero lets the SFU pick the next clock,
+// which always wins. Author is set by the SFU.
+type StateOp struct {
+	Doc    string          `json:"doc"`
+	Key    string          `json:"key"`
+	Value  json.RawMessage `json:"value,omitempty"`
+	Delete bool            `json:"delete,omitempty"`
+	Clock  uint64          `json:"clock,omitempty"`
+	Author string          `json:"author,omitempty"`
+}
+
+// StateSnapshot is the full shared state of a room. Docs maps a document
+// name, e.g. "whiteboard" or "notes", to its entries.
+type StateSnapshot struct {
+	Clock uint64                           `json:"clock"`
+	Docs  map[string]map[string]StateEntry `json:"docs"`
+}
+
+// sharedState holds a room's shared documents. It has its own lock, taken
+// after r.mux when both are needed.
+type sharedState struct {
+	mux   sync.RWMutex
+	clock uint64
+	docs  map[string]map[string]StateEntry
+}
+
+func newSharedState() *sharedState {
+	return &sharedState{docs: make(map[string]map[string]StateEntry)}
+}
+
+// apply merges ops written by author and returns the ones that changed the
+// state, with their clock and author filled in.
+func (s *sharedState) apply(author string, ops []StateOp) ([]StateOp, error) {
+	for _, op := range ops {
+		if err := op.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	// The ops are checked against the clock and the limits as they will be
+	// when each is applied, so that a batch is rejected before any of it is.
+	clock := s.clock
+	added := make(map[string]map[string]bool) // keys added per doc
+	docs := len(s.docs)
+	for _, op := range ops {
+		switch {
+		case op.Clock == 0:
+			clock++
+		case op.Clock > clock+1:
+			return nil, ErrInvalidStateOp
+		default:
+			clock = max(clock, op.Clock)
+		}
+
+		doc, ok := s.docs[op.Doc]
+		newKeys, seen := added[op.Doc]
+		if !seen {
+			if !ok {
+				if docs >= maxStateDocs {
+					return nil, ErrStateFull
+				}
+				docs++
+			}
+			newKeys = make(map[string]bool)
+			added[op.Doc] = newKeys
+		}
+
+		if _, ok := doc[op.Key]; !ok && !newKeys[op.Key] {
+			if len(doc)+len(newKeys) >= maxStateKeys {
+				return nil, ErrStateFull
+			}
+			newKeys[op.Key] = true
+		}
+	}
+
+	applied := make([]StateOp, 0, len(ops))
+	for _, op := range ops {
+		op.Author = author
+		if op.Clock == 0 {
+			op.Clock = s.clock + 1
+		}
+		s.clock = max(s.clock, op.Clock)
+
+		doc, ok := s.docs[op.Doc]
+		if !ok {
+			doc = make(map[string]StateEntry)
+			s.docs[op.Doc] = doc
+		}
+
+		current, ok := doc[op.Key]
+		if ok && !wins(op.Clock, op.Author, current) {
+			continue
+		}
+
+		entry := StateEntry{Clock: op.Clock, Author: op.Author, Deleted: op.Delete}
+		if !op.Delete {
+			entry.Value = op.Value
+		}
+		doc[op.Key] = entry
+		applied = append(applied, op)
+	}
+
+	return applied, nil
+}
+
+func (s *sharedState) snapshot() StateSnapshot {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	docs := make(map[string]map[string]StateEntry, len(s.docs))
+	for name, doc := range s.docs {
+		docs[name] = maps.Clone(doc)
+	}
+
+	return StateSnapshot{Clock: s.clock, Docs: docs}
+}
+
+func wins(clock uint64, author string, current StateEntry) bool {
+	if clock != current.Clock {
+		return clock > current.Clock
+	}
+
+	return author > current.Author
+}
+
+func (op StateOp) validate() error {
+	switch {
+	case op.Doc == "" || len(op.Doc) > maxStateNameBytes,
+		op.Key == "" || len(op.Key) > maxStateNameBytes,
+		len(op.Value) > maxStateValue,
+		!op.Delete && !json.Valid(op.Value):
+		return ErrInvalidStateOp
+	}
+
+	return nil
+}
+
+// UpdateState applies shared state operations on behalf of author and
+// broadcasts the ones that took effect to every member, the author
+// included, so they learn the winning clocks.
+func (r *Room) UpdateState(author string, ops []StateOp) ([]StateOp, error) {
+	applied, err := r.state.apply(author, ops)
+	if len(applied) > 0 {
+		r.broadcast(nil, stateMsgType, map[string]any{"ops": applied})
+	}
+
+	return applied, err
+}
+
+// State returns a snapshot of the room's shared documents.
+func (r *Room) State() StateSnapshot {
+	return r.state.snapshot()
+}
+
+// handleStateMessage applies operations sent on the reliable data channel.
+// Updates are broadcast over signaling like the join snapshot, so members see
+// them in order with it.
+func (r *Room) handleStateMessage(from *Peer, msg DataMessage) error {
+	var payload struct {
+		Ops []StateOp `json:"ops"`
+	}
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+		return errDataMalformed
+	}
+
+	_, err := r.UpdateState(from.ID(), payload.Ops)
+	return err
+}
@@ -0,0 +1,111 @@
+package sfu
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestSharedStateLastWriterWins(t *testing.T) {
+	s := newSharedState()
+	value := json.RawMessage(`1`)
+
+	if _, err := s.apply("b", []StateOp{{Doc: "d", Key: "k", Value: value, Clock: 1}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Same clock: the higher author wins, whatever the order.
+	applied, err := s.apply("a", []StateOp{{Doc: "d", Key: "k", Value: json.RawMessage(`2`), Clock: 1}})
+	if err != nil || len(applied) != 0 {
+		t.Fatalf("lower author at the same clock: applied %v, %v", applied, err)
+	}
+
+	// A deletion leaves a tombstone that a stale write cannot revive.
+	if _, err := s.apply("a", []StateOp{{Doc: "d", Key: "k", Delete: true}}); err != nil {
+		t.Fatal(err)
+	}
+	applied, err = s.apply("c", []StateOp{{Doc: "d", Key: "k", Value: value, Clock: 1}})
+	if err != nil || len(applied) != 0 {
+		t.Fatalf("stale write: applied %v, %v", applied, err)
+	}
+
+	entry := s.snapshot().Docs["d"]["k"]
+	if !entry.Deleted || entry.Clock != 2 || entry.Author != "a" {
+		t.Fatalf("got %+v, want a tombstone at clock 2 by a", entry)
+	}
+}
+
+func TestSharedStateRejectsClockOverflow(t *testing.T) {
+	s := newSharedState()
+	value := json.RawMessage(`"x"`)
+
+	_, err := s.apply("mallory", []StateOp{{Doc: "d", Key: "k", Value: value, Clock: math.MaxUint64}})
+	if !errors.Is(err, ErrInvalidStateOp) {
+		t.Fatalf("got %v, want %v", err, ErrInvalidStateOp)
+	}
+
+	// A batch is checked op by op against the clock as it advances, and
+	// rejected whole.
+	_, err = s.apply("mallory", []StateOp{
+		{Doc: "d", Key: "a", Value: value, Clock: 1},
+		{Doc: "d", Key: "b", Value: value, Clock: 3},
+	})
+	if !errors.Is(err, ErrInvalidStateOp) {
+		t.Fatalf("batch: got %v, want %v", err, ErrInvalidStateOp)
+	}
+	if snapshot := s.snapshot(); snapshot.Clock != 0 || len(snapshot.Docs) != 0 {
+		t.Fatalf("a rejected batch changed the state: %+v", snapshot)
+	}
+
+	// The SFU's clock still wins.
+	if _, err := s.apply("mallory", []StateOp{{Doc: "d", Key: "k", Value: value, Clock: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	applied, err := s.apply("alice", []StateOp{{Doc: "d", Key: "k", Value: json.RawMessage(`"y"`)}})
+	if err != nil || len(applied) != 1 || applied[0].Clock != 2 {
+		t.Fatalf("got %v, %v; want alice's write at clock 2", applied, err)
+	}
+}
+
+func TestSharedStateRejectsFullBatchWhole(t *testing.T) {
+	s := newSharedState()
+	value := json.RawMessage(`1`)
+
+	ops := make([]StateOp, 0, maxStateKeys-1)
+	for i := range maxStateKeys - 1 {
+		ops = append(ops, StateOp{Doc: "d", Key: fmt.Sprint(i), Value: value})
+	}
+	if _, err := s.apply("a", ops); err != nil {
+		t.Fatal(err)
+	}
+	clock := s.snapshot().Clock
+
+	// One key fits, the second does not; neither is written.
+	_, err := s.apply("a", []StateOp{
+		{Doc: "d", Key: "x", Value: value},
+		{Doc: "d", Key: "y", Value: value},
+	})
+	if !errors.Is(err, ErrStateFull) {
+		t.Fatalf("keys: got %v, want %v", err, ErrStateFull)
+	}
+
+	ops = ops[:0]
+	for i := range maxStateDocs {
+		ops = append(ops, StateOp{Doc: fmt.Sprint("doc", i), Key: "k", Value: value})
+	}
+	if _, err := s.apply("a", ops); !errors.Is(err, ErrStateFull) {
+		t.Fatalf("docs: got %v, want %v", err, ErrStateFull)
+	}
+
+	snapshot := s.snapshot()
+	if snapshot.Clock != clock || len(snapshot.Docs) != 1 || len(snapshot.Docs["d"]) != maxStateKeys-1 {
+		t.Fatalf("a rejected batch changed the state: clock %d, %d docs", snapshot.Clock, len(snapshot.Docs))
+	}
+
+	// An overwrite does not take a slot, so the last one is still free.
+	if _, err := s.apply("a", []StateOp{{Doc: "d", Key: "0", Value: value}, {Doc: "d", Key: "x", Value: value}}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,59 @@
+package sfu
+
+// ForwarderStats reports fan-out health for one published track.
+type ForwarderStats struct {
+	TrackID     string            `json:"trackId"`
+	MemberID    string            `json:"memberId"`
+	Kind        string            `json:"kind"`
+	Source      TrackSource       `json:"source"`
+	Received    uint64            `json:"received"`
+	Subscribers []SubscriberStats `json:"subscribers"`
+}
+
+// SubscriberStats reports the send queue of one forwarder to subscriber leg.
+type SubscriberStats struct {
+	MemberID      string `json:"memberId"`
+	QueueDepth    int    `json:"queueDepth"`
+	QueueCapacity int    `json:"queueCapacity"`
+	Sent          uint64 `json:"sent"`
+	Dropped       uint64 `json:"dropped"`
+	Paused        bool   `json:"paused"`
+}
+
+func (tf *TrackForwarder) Stats() ForwarderStats {
+	stats := ForwarderStats{
+		TrackID:     tf.ID(),
+		MemberID:    tf.peer.ID(),
+		Kind:        tf.Kind().String(),
+		Source:      tf.Source(),
+		Received:    tf.received.Load(),
+		Subscribers: make([]SubscriberStats, 0),
+	}
+
+	for _, sub := range *tf.subs.Load() {
+		stats.Subscribers = append(stats.Subscribers, SubscriberStats{
+			MemberID:      sub.id,
+			QueueDepth:    sub.queue.len(),
+			QueueCapacity: sub.queue.capacity(),
+			Sent:          sub.sent.Load(),
+			Dropped:       sub.dropped.Load(),
+			Paused:        sub.paused.Load() != 0,
+		})
+	}
+
+	return stats
+}
+
+// Stats reports forwarding metrics for every track published in the room.
+func (r *Room) Stats() []ForwarderStats {
+	r.mux.RLock()
+	forwarders := r.forwarderList(nil)
+	r.mux.RUnlock()
+
+	stats := make([]ForwarderStats, 0, len(forwarders))
+	for _, forwarder := range forwarders {
+		stats = append(stats, forwarder.Stats())
+	}
+
+	return stats
+}
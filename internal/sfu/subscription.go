@@ -0,0 +1,171 @@
+package sfu
+
+import (
+	"errors"
+	"log/slog"
+)
+
+var ErrTrackNotFound = errors.New("track not found")
+
+// Quality is the layer a subscriber asks for. Forwarders carry a single
+// layer today, so it is recorded for layer selection rather than enforced.
+type Quality string
+
+const (
+	QualityHigh   Quality = "high"
+	QualityMedium Quality = "medium"
+	QualityLow    Quality = "low"
+)
+
+// Subscription names a member's track a subscriber wants to receive. An
+// empty TrackID means every track the member publishes.
+type Subscription struct {
+	MemberID string  `json:"memberId"`
+	TrackID  string  `json:"trackId,omitempty"`
+	Quality  Quality `json:"quality,omitempty"`
+	Paused   bool    `json:"paused,omitempty"`
+}
+
+// Subscribe adds the requested tracks to a member in manual subscription
+// mode and renegotiates once.
+func (r *Room) Subscribe(peer *Peer, subs []Subscription) error {
+	forwarders, err := r.resolveSubscriptions(peer, subs)
+	if err != nil {
+		return err
+	}
+
+	added := 0
+	for _, forwarder := range forwarders {
+		if forwarder.hasPeer(peer.ID()) {
+			continue
+		}
+
+		local, err := forwarder.AddPeer(peer.ID())
+		if err != nil {
+			peer.logger.Error("Failed to add peer to forwarder", slog.String("error", err.Error()))
+			continue
+		}
+
+		peer.addOutboundTrack(local)
+		if err := peer.addSender(local); err != nil {
+			peer.logger.Error("Failed to add track to peer connection", slog.String("error", err.Error()))
+			continue
+		}
+		added++
+	}
+
+	for _, sub := range subs {
+		peer.setQuality(sub)
+	}
+
+	if added > 0 {
+		if err := peer.Renegotiate(); err != nil {
+			return err
+		}
+	}
+
+	return r.sendSubscriptions(peer)
+}
+
+// Unsubscribe stops sending the requested tracks to a member and
+// renegotiates once.
+func (r *Room) Unsubscribe(peer *Peer, subs []Subscription) error {
+	forwarders, err := r.resolveSubscriptions(peer, subs)
+	if err != nil {
+		return err
+	}
+
+	trackIDs := make([]string, 0, len(forwarders))
+	for _, forwarder := range forwarders {
+		forwarder.RemovePeer(peer.ID())
+		trackIDs = append(trackIDs, forwarder.ID())
+	}
+
+	if err := peer.RemoveTracksAndRenegotiate(trackIDs...); err != nil {
+		return err
+	}
+
+	return r.sendSubscriptions(peer)
+}
+
+// Subscriptions lists the tracks peer currently receives.
+func (r *Room) Subscriptions(peer *Peer) []Subscription {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	subs := make([]Subscription, 0)
+	for _, forwarder := range r.forwarders {
+		if !forwarder.hasPeer(peer.ID()) {
+			continue
+		}
+
+		subs = append(subs, Subscription{
+			MemberID: forwarder.peer.ID(),
+			TrackID:  forwarder.ID(),
+			Quality:  peer.quality(forwarder.ID()),
+			Paused:   forwarder.Paused(peer.ID()),
+		})
+	}
+
+	return subs
+}
+
+func (r *Room) resolveSubscriptions(peer *Peer, subs []Subscription) ([]*TrackForwarder, error) {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	var forwarders []*TrackForwarder
+	for _, sub := range subs {
+		if sub.TrackID != "" {
+			forwarder, ok := r.forwarders[sub.TrackID]
+			if !ok || forwarder.peer.ID() != sub.MemberID || forwarder.peer == peer {
+				return nil, ErrTrackNotFound
+			}
+
+			forwarders = append(forwarders, forwarder)
+			continue
+		}
+
+		for _, forwarder := range r.forwarders {
+			if forwarder.peer.ID() == sub.MemberID && forwarder.peer != peer {
+				forwarders = append(forwarders, forwarder)
+			}
+		}
+	}
+
+	return forwarders, nil
+}
+
+func (r *Room) sendSubscriptions(peer *Peer) error {
+	return peer.send("subscriptions", map[string]any{
+		"subscriptions": r.Subscriptions(peer),
+	})
+}
+
+// ManualSubscription reports whether the peer picks its own tracks instead
+// of receiving everything published in the room.
+func (p *Peer) ManualSubscription() bool {
+	return p.manualSubscription
+}
+
+func (p *Peer) setQuality(sub Subscription) {
+	if sub.TrackID == "" || sub.Quality == "" {
+		return
+	}
+
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	p.qualities[sub.TrackID] = sub.Quality
+}
+
+func (p *Peer) quality(trackID string) Quality {
+	p.mux.RLock()
+	defer p.mux.RUnlock()
+
+	if q, ok := p.qualities[trackID]; ok {
+		return q
+	}
+
+	return QualityHigh
+}
@@ -1,27 +1,147 @@
 package sfu
 
 import (
+	"context"
+	"errors"
+	"log/slog"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
 	"github.com/pion/webrtc/v3"
 )
 
+var ErrForwarderClosed = errors.New("track forwarder is closed")
+
+// PauseReason is why a forwarder to subscriber leg is paused.
+type PauseReason uint32
+
+const (
+	// PauseBySubscriber is requested by the client, e.g. for an off-screen tile.
+	PauseBySubscriber PauseReason = 1 << iota
+	// PauseByBandwidth is applied when the subscriber's estimate is too low.
+	PauseByBandwidth
+)
+
+// trackReader is where a forwarder reads RTP from: a track received over a
+// peer connection, or a virtual publisher's track.
+type trackReader interface {
+	ID() string
+	StreamID() string
+	Kind() webrtc.RTPCodecType
+	Codec() webrtc.RTPCodecParameters
+	SSRC() webrtc.SSRC
+	Read(b []byte) (int, interceptor.Attributes, error)
+	SetReadDeadline(t time.Time) error
+}
+
 type TrackForwarder struct {
-	peer   *Peer
-	remote *webrtc.TrackRemote
+	peer      *Peer
+	remote    trackReader
+	createdAt time.Time
+
+	mux      sync.RWMutex
+	source   TrackSource
+	metadata map[string]string
+	locals   map[string]*subscriber
+	sinks    map[string]*subscriber
+
+	// subs is a copy-on-write snapshot of locals and sinks for the read
+	// loop, so adding or removing subscribers never stalls forwarding.
+	subs atomic.Pointer[[]*subscriber]
+
+	// keyframeTS is the timestamp of the last keyframe seen by the read
+	// loop; every packet sharing it belongs to that keyframe.
+	keyframeTS uint32
+	hasKey     bool
+	keyframes  keyframeBuffer
+
+	received atomic.Uint64
+	muted    atomic.Bool
+	lastPLI  atomic.Int64
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+func NewTrackForwarder(peer *Peer, remote trackReader) *TrackForwarder {
+	tf := &TrackForwarder{
+		peer:      peer,
+		remote:    remote,
+		createdAt: time.Now(),
+		source:    defaultSource(remote.Kind()),
+		locals:    make(map[string]*subscriber),
+		sinks:     make(map[string]*subscriber),
+	}
+	tf.ctx, tf.cancel = context.WithCancel(context.Background())
+	tf.subs.Store(&[]*subscriber{})
+
+	return tf
+}
+
+func (tf *TrackForwarder) ID() string {
+	return tf.remote.ID()
+}
+
+func (tf *TrackForwarder) Kind() webrtc.RTPCodecType {
+	return tf.remote.Kind()
+}
+
+func (tf *TrackForwarder) Source() TrackSource {
+	tf.mux.RLock()
+	defer tf.mux.RUnlock()
+
+	return tf.source
+}
+
+func (tf *TrackForwarder) Metadata() map[string]string {
+	tf.mux.RLock()
+	defer tf.mux.RUnlock()
+
+	return tf.metadata
+}
+
+// Priority orders forwarders when subscribing and shedding load: screen
+// share first, then audio, then camera video.
+func (tf *TrackForwarder) Priority() int {
+	return sourcePriority(tf.Source(), tf.Kind())
+}
+
+func (tf *TrackForwarder) setSource(source TrackSource, metadata map[string]string) {
+	tf.mux.Lock()
+	defer tf.mux.Unlock()
+
+	if source != "" {
+		tf.source = source
+	}
+	tf.metadata = metadata
+}
 
-	mux    sync.RWMutex
-	locals map[string]*webrtc.TrackLocalStaticRTP
+func (tf *TrackForwarder) hasPeer(id string) bool {
+	tf.mux.RLock()
+	defer tf.mux.RUnlock()
 
-	closed chan struct{}
+	_, ok := tf.locals[id]
+	return ok
 }
 
-func NewTrackForwarder(peer *Peer, remote *webrtc.TrackRemote) *TrackForwarder {
-	return &TrackForwarder{
-		peer:   peer,
-		remote: remote,
-		locals: make(map[string]*webrtc.TrackLocalStaticRTP),
-		closed: make(chan struct{}),
+func (tf *TrackForwarder) countsTowardsLastN() bool {
+	return tf.Kind() == webrtc.RTPCodecTypeVideo && tf.Source() != SourceScreen
+}
+
+// SetMuted stops or resumes forwarding the track to every subscriber without
+// touching the negotiated senders.
+func (tf *TrackForwarder) SetMuted(muted bool) {
+	if !tf.muted.Swap(muted) || muted {
+		return
+	}
+
+	if tf.remote.Kind() == webrtc.RTPCodecTypeVideo {
+		go tf.peer.SendPLI(uint32(tf.remote.SSRC()))
 	}
 }
 
@@ -35,47 +155,260 @@ func (tf *TrackForwarder) AddPeer(id string) (*webrtc.TrackLocalStaticRTP, error
 		return nil, err
 	}
 
+	sub := newSubscriber(id, local, tf.queueSize())
+
 	tf.mux.Lock()
-	tf.locals[id] = local
+	if tf.ctx.Err() != nil {
+		tf.mux.Unlock()
+		return nil, ErrForwarderClosed
+	}
+	if old, ok := tf.locals[id]; ok {
+		old.stop()
+	}
+	tf.locals[id] = sub
+	tf.snapshot()
 	tf.mux.Unlock()
 
+	tf.wg.Add(1)
+	goroutines.Go("subscriber", func() {
+		defer tf.wg.Done()
+		sub.run(tf.ctx)
+	})
+
 	go tf.peer.SendPLI(uint32(tf.remote.SSRC()))
 
 	return local, nil
 }
 
+// TrackSink consumes a forwarder's packets outside any peer connection,
+// e.g. to record them.
+type TrackSink interface {
+	rtpWriter
+	Close() error
+}
+
+// AddSink feeds every forwarded packet to sink from its own goroutine until
+// RemoveSink or Close, and then closes it. Sinks do not count as
+// subscribers and are never paused.
+func (tf *TrackForwarder) AddSink(id string, sink TrackSink) error {
+	sub := newSubscriber(id, sink, tf.queueSize())
+
+	tf.mux.Lock()
+	if tf.ctx.Err() != nil {
+		tf.mux.Unlock()
+		return ErrForwarderClosed
+	}
+	if old, ok := tf.sinks[id]; ok {
+		old.stop()
+	}
+	tf.sinks[id] = sub
+	tf.snapshot()
+	tf.mux.Unlock()
+
+	tf.wg.Add(1)
+	goroutines.Go("sink", func() {
+		defer tf.wg.Done()
+		sub.run(tf.ctx)
+
+		if err := sink.Close(); err != nil {
+			tf.peer.logger.Error("Failed to close track sink", slog.String("sink", id), slog.String("error", err.Error()))
+		}
+	})
+
+	if tf.Kind() == webrtc.RTPCodecTypeVideo {
+		tf.RequestKeyframe()
+	}
+
+	return nil
+}
+
+func (tf *TrackForwarder) RemoveSink(id string) {
+	tf.mux.Lock()
+	if sub, ok := tf.sinks[id]; ok {
+		sub.stop()
+		delete(tf.sinks, id)
+		tf.snapshot()
+	}
+	tf.mux.Unlock()
+}
+
+func (tf *TrackForwarder) queueSize() int {
+	if tf.Kind() == webrtc.RTPCodecTypeAudio {
+		return audioQueueSize
+	}
+
+	return videoQueueSize
+}
+
 func (tf *TrackForwarder) RemovePeer(id string) {
 	tf.mux.Lock()
-	delete(tf.locals, id)
+	if sub, ok := tf.locals[id]; ok {
+		sub.stop()
+		delete(tf.locals, id)
+		tf.snapshot()
+	}
 	tf.mux.Unlock()
 }
 
+// snapshot publishes the current subscribers to the read loop. Callers hold
+// tf.mux.
+func (tf *TrackForwarder) snapshot() {
+	subs := make([]*subscriber, 0, len(tf.locals)+len(tf.sinks))
+	for _, sub := range tf.locals {
+		subs = append(subs, sub)
+	}
+	for _, sub := range tf.sinks {
+		subs = append(subs, sub)
+	}
+
+	tf.subs.Store(&subs)
+}
+
 func (tf *TrackForwarder) Start() {
-	go func() {
-		buf := make([]byte, 1500)
+	tf.wg.Add(1)
+	goroutines.Go("forwarder", func() {
+		defer tf.wg.Done()
+
+		mimeType := tf.remote.Codec().MimeType
+		video := tf.Kind() == webrtc.RTPCodecTypeVideo
 
-		for {
-			select {
-			case <-tf.closed:
+		for tf.ctx.Err() == nil {
+			p := getPacket()
+			n, _, err := tf.remote.Read(p.buf[:])
+			if err != nil {
+				p.release()
 				return
-			default:
-				n, _, err := tf.remote.Read(buf)
-				if err != nil {
-					return
-				}
-
-				tf.mux.RLock()
-				for _, local := range tf.locals {
-					if _, err = local.Write(buf[:n]); err != nil {
-						continue
-					}
-				}
-				tf.mux.RUnlock()
 			}
+			p.n = n
+			tf.received.Add(1)
+
+			if tf.muted.Load() {
+				p.release()
+				continue
+			}
+
+			if video {
+				tf.markKeyframe(p, mimeType)
+				tf.bufferKeyframe(p, mimeType)
+			}
+
+			tf.fanOut(p, video)
+			p.release()
 		}
-	}()
+	})
+}
+
+// RequestKeyframe asks the publisher for a keyframe on behalf of a
+// subscriber, at most once per pliInterval.
+func (tf *TrackForwarder) RequestKeyframe() {
+	now := time.Now().UnixNano()
+	last := tf.lastPLI.Load()
+	if now-last < int64(pliInterval) || !tf.lastPLI.CompareAndSwap(last, now) {
+		return
+	}
+
+	go tf.peer.SendPLI(uint32(tf.remote.SSRC()))
 }
 
+// SetPaused stops or resumes sending to one subscriber while keeping the
+// negotiated transceiver. A leg stays paused while any reason holds, and a
+// resumed video leg gets a keyframe so it can start decoding right away.
+// It reports whether the leg's effective state changed.
+func (tf *TrackForwarder) SetPaused(id string, reason PauseReason, paused bool) bool {
+	tf.mux.RLock()
+	sub, ok := tf.locals[id]
+	tf.mux.RUnlock()
+	if !ok {
+		return false
+	}
+
+	for {
+		old := sub.paused.Load()
+		next := old &^ uint32(reason)
+		if paused {
+			next = old | uint32(reason)
+		}
+
+		if !sub.paused.CompareAndSwap(old, next) {
+			continue
+		}
+
+		if old != 0 && next == 0 && tf.Kind() == webrtc.RTPCodecTypeVideo {
+			go tf.peer.SendPLI(uint32(tf.remote.SSRC()))
+		}
+
+		return (old == 0) != (next == 0)
+	}
+}
+
+// Paused reports whether sending to the subscriber is paused for any reason.
+func (tf *TrackForwarder) Paused(id string) bool {
+	tf.mux.RLock()
+	defer tf.mux.RUnlock()
+
+	sub, ok := tf.locals[id]
+	return ok && sub.paused.Load() != 0
+}
+
+// markKeyframe flags p when it belongs to a keyframe so queues prefer to
+// keep it. Only the first packet of a frame identifies the frame type; the
+// rest are matched by RTP timestamp.
+func (tf *TrackForwarder) markKeyframe(p *packet, mimeType string) {
+	var header rtp.Header
+	n, err := header.Unmarshal(p.payload())
+	if err != nil || n >= p.n {
+		return
+	}
+
+	if isKeyframe(mimeType, p.buf[n:p.n]) {
+		tf.keyframeTS = header.Timestamp
+		tf.hasKey = true
+	}
+
+	p.keyframe = tf.hasKey && header.Timestamp == tf.keyframeTS
+}
+
+// fanOut queues p for every active subscriber without blocking on any of
+// them. A subscriber that had to drop video asks for a keyframe to recover.
+func (tf *TrackForwarder) fanOut(p *packet, video bool) {
+	for _, sub := range *tf.subs.Load() {
+		if sub.paused.Load() != 0 {
+			continue
+		}
+
+		p.retain()
+		if sub.queue.push(p) {
+			sub.dropped.Add(1)
+			if video {
+				tf.RequestKeyframe()
+			}
+		}
+	}
+}
+
+// Close stops forwarding and waits for the read loop and every subscriber
+// writer to return. The pending read is interrupted with a deadline rather
+// than waiting for the next packet. Close is safe to call more than once.
 func (tf *TrackForwarder) Close() {
-	close(tf.closed)
+	tf.closeOnce.Do(func() {
+		tf.cancel()
+
+		if err := tf.remote.SetReadDeadline(time.Now()); err != nil {
+			tf.peer.logger.Warn("Failed to interrupt track read", slog.String("error", err.Error()))
+		}
+
+		tf.mux.Lock()
+		for _, sub := range tf.locals {
+			sub.stop()
+		}
+		for _, sub := range tf.sinks {
+			sub.stop()
+		}
+		clear(tf.locals)
+		clear(tf.sinks)
+		tf.snapshot()
+		tf.mux.Unlock()
+
+		tf.wg.Wait()
+	})
 }
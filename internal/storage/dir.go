@@ -0,0 +1,25 @@
+package storage
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Dir stores objects as files under a local directory.
+type Dir struct {
+	root string
+}
+
+func NewDir(root string) *Dir {
+	return &Dir{root: root}
+}
+
+func (d *Dir) Create(key string) (io.WriteCloser, error) {
+	path := filepath.Join(d.root, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return nil, err
+	}
+
+	return os.Create(path)
+}
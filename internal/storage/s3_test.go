@@ -0,0 +1,195 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"gonference/internal/config"
+)
+
+const (
+	testAccessKey = "minio"
+	testSecretKey = "minio-secret"
+	testRegion    = "eu-central-1"
+)
+
+// fakeS3 stands in for MinIO: it verifies each request's SigV4 signature
+// and payload hash and keeps the objects it is sent.
+type fakeS3 struct {
+	t *testing.T
+
+	mux     sync.Mutex
+	objects map[string][]byte
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if r.Method != http.MethodPut {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sum := sha256.Sum256(body)
+	if got := r.Header.Get("X-Amz-Content-Sha256"); got != hex.EncodeToString(sum[:]) {
+		f.t.Errorf("payload hash %q does not match the body", got)
+		http.Error(w, "XAmzContentSHA256Mismatch", http.StatusBadRequest)
+		return
+	}
+
+	if err := f.verify(r); err != nil {
+		f.t.Error(err)
+		http.Error(w, "SignatureDoesNotMatch", http.StatusForbidden)
+		return
+	}
+
+	f.mux.Lock()
+	f.objects[r.URL.Path] = body
+	f.mux.Unlock()
+}
+
+// verify recomputes the signature from the request as received.
+func (f *fakeS3) verify(r *http.Request) error {
+	auth := r.Header.Get("Authorization")
+	fields := map[string]string{}
+	for _, part := range strings.Split(strings.TrimPrefix(auth, "AWS4-HMAC-SHA256 "), ", ") {
+		name, value, _ := strings.Cut(part, "=")
+		fields[name] = value
+	}
+
+	amzDate := r.Header.Get("X-Amz-Date")
+	if len(amzDate) != len("20060102T150405Z") {
+		return fmt.Errorf("bad X-Amz-Date %q", amzDate)
+	}
+	scope := amzDate[:8] + "/" + testRegion + "/s3/aws4_request"
+	if fields["Credential"] != testAccessKey+"/"+scope {
+		return fmt.Errorf("bad credential %q", fields["Credential"])
+	}
+
+	signed := strings.Split(fields["SignedHeaders"], ";")
+	if !sort.StringsAreSorted(signed) {
+		return fmt.Errorf("signed headers not sorted: %v", signed)
+	}
+	for _, required := range []string{"host", "x-amz-content-sha256", "x-amz-date"} {
+		if !contains(signed, required) {
+			return fmt.Errorf("%s is not signed", required)
+		}
+	}
+
+	var headers strings.Builder
+	for _, name := range signed {
+		value := r.Header.Get(name)
+		if name == "host" {
+			value = r.Host
+		}
+		headers.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+
+	canonical := strings.Join([]string{
+		r.Method,
+		r.URL.EscapedPath(),
+		"",
+		headers.String(),
+		fields["SignedHeaders"],
+		r.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+	canonicalSum := sha256.Sum256([]byte(canonical))
+
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalSum[:])
+
+	key := []byte("AWS4" + testSecretKey)
+	for _, part := range []string{amzDate[:8], testRegion, "s3", "aws4_request", stringToSign} {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+
+	if want := hex.EncodeToString(key); fields["Signature"] != want {
+		return fmt.Errorf("signature %s, want %s", fields["Signature"], want)
+	}
+
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func TestS3Put(t *testing.T) {
+	fake := &fakeS3{t: t, objects: make(map[string][]byte)}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	store, err := NewS3(config.S3{
+		Endpoint:  srv.URL,
+		Region:    testRegion,
+		Bucket:    "recordings",
+		AccessKey: testAccessKey,
+		SecretKey: testSecretKey,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Keys carry escaped room keys, which must be signed as sent.
+	key := "acme%2Froom/rec 1/alice.webm"
+	w, err := store.Create(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, "webm data"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	fake.mux.Lock()
+	defer fake.mux.Unlock()
+
+	got, ok := fake.objects["/recordings/"+key]
+	if !ok {
+		t.Fatalf("object not stored; have %v", fake.objects)
+	}
+	if string(got) != "webm data" {
+		t.Fatalf("stored %q", got)
+	}
+}
+
+func TestS3RejectedPut(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "AccessDenied", http.StatusForbidden)
+	}))
+	defer srv.Close()
+
+	store, err := NewS3(config.S3{Endpoint: srv.URL, Bucket: "recordings"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := store.Create("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Fatalf("got %v, want the 403 reported", err)
+	}
+}
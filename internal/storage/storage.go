@@ -0,0 +1,29 @@
+// Package storage abstracts where the SFU writes long-lived output such as
+// recordings.
+package storage
+
+import (
+	"fmt"
+	"io"
+
+	"gonference/internal/config"
+)
+
+// Store writes objects addressed by slash-separated keys.
+type Store interface {
+	// Create returns a writer for key. The object is complete once the
+	// writer is closed; writers that can seek support it.
+	Create(key string) (io.WriteCloser, error)
+}
+
+// New returns the store selected by cfg.
+func New(cfg config.Storage) (Store, error) {
+	switch cfg.Kind {
+	case "", "local":
+		return NewDir(cfg.Dir), nil
+	case "s3":
+		return NewS3(cfg.S3)
+	default:
+		return nil, fmt.Errorf("unknown storage %q", cfg.Kind)
+	}
+}